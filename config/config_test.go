@@ -0,0 +1,89 @@
+package config
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+func TestRedactDatabaseURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"empty", "", ""},
+		{"url with password", "postgres://recap:s3cret@db:5432/recap", "postgres://recap:[REDACTED]@db:5432/recap"},
+		{"url without password", "postgres://recap@db/recap?sslmode=disable", "postgres://recap@db/recap?sslmode=disable"},
+		{"url with encoded password", "postgresql://recap:p%40ss%2Fword@db/recap", "postgresql://recap:[REDACTED]@db/recap"},
+		{"url query passwords", "postgres://recap@db/recap?password=s3cret&sslpassword=k3y", "postgres://recap@db/recap?password=[REDACTED]&sslpassword=[REDACTED]"},
+		{"keyword form", "host=db user=recap password=s3cret dbname=recap", "host=db user=recap password=[REDACTED] dbname=recap"},
+		{"keyword form quoted", "host=db password='a s3cret' dbname=recap", "host=db password=[REDACTED] dbname=recap"},
+		{"keyword form spaced and cased", "host=db PASSWORD = s3cret sslpassword=k3y", "host=db PASSWORD = [REDACTED] sslpassword=[REDACTED]"},
+		{"unparsable url", "postgres://recap:s3cret@db:port/recap", Redacted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RedactDatabaseURL(tt.url)
+			if got != tt.want {
+				t.Fatalf("RedactDatabaseURL(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+			for _, secret := range []string{"s3cret", "k3y", "p%40ss"} {
+				if strings.Contains(got, secret) {
+					t.Fatalf("RedactDatabaseURL(%q) = %q, which still contains %q", tt.url, got, secret)
+				}
+			}
+		})
+	}
+}
+func TestEffectiveRedactsSecrets(t *testing.T) {
+	cfg := &Config{
+		ServerPort:        "8080",
+		DatabaseURL:       "postgres://recap:db-secret@db/recap",
+		FIRM:              FIRMConfig{JWTSigningKey: "jwt-secret", Issuer: "firm"},
+		GitHub:            GitHubConfig{LabsRepoPath: "/srv/labs", WebhookSecret: "hook-secret"},
+		IngestionInterval: 5 * time.Minute,
+		Notifications:     NotificationsConfig{SMTPAddr: "mail:25", SMTPUsername: "recap", SMTPPassword: "smtp-secret"},
+	}
+	effective := cfg.Effective()
+	dump := fmt.Sprint(effective)
+	for _, secret := range []string{"db-secret", "jwt-secret", "hook-secret", "smtp-secret"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("Effective() shows %q: %s", secret, dump)
+		}
+	}
+	tests := []struct {
+		path []string
+		want interface{}
+	}{
+		{[]string{"SERVER_PORT"}, "8080"},
+		{[]string{"DATABASE_URL"}, "postgres://recap:[REDACTED]@db/recap"},
+		{[]string{"INGESTION_INTERVAL"}, "5m0s"},
+		{[]string{"FIRM", "JWT_SIGNING_KEY"}, Redacted},
+		{[]string{"FIRM", "ISSUER"}, "firm"},
+		{[]string{"GITHUB", "WEBHOOK_SECRET"}, Redacted},
+		{[]string{"GITHUB", "LABS_REPO_PATH"}, "/srv/labs"},
+		{[]string{"NOTIFICATIONS", "SMTP_PASSWORD"}, Redacted},
+		{[]string{"NOTIFICATIONS", "SMTP_USERNAME"}, "recap"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.path, "."), func(t *testing.T) {
+			var value interface{} = effective
+			for _, key := range tt.path {
+				value = value.(map[string]interface{})[key]
+			}
+			if value != tt.want {
+				t.Fatalf("Effective()[%s] = %v, want %v", strings.Join(tt.path, "."), value, tt.want)
+			}
+		})
+	}
+}
+func TestEffectiveShowsUnsetSecretsAsEmpty(t *testing.T) {
+	// An unset secret stays "" so operators can tell it apart from a configured one
+	effective := (&Config{}).Effective()
+	if got := effective["GITHUB"].(map[string]interface{})["WEBHOOK_SECRET"]; got != "" {
+		t.Fatalf("unset WEBHOOK_SECRET shown as %v, want \"\"", got)
+	}
+	if got := effective["DATABASE_URL"]; got != "" {
+		t.Fatalf("unset DATABASE_URL shown as %v, want \"\"", got)
+	}
+}
@@ -4,14 +4,24 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	// "database/sql" // REMOVED: This import is not directly used in this file's functions.
 	// "recap-server/models" // REMOVED: This import is not directly used by types/functions within this file.
 	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/text/language"
+	"recap-server/metrics"
 )
 // InitDB initializes the PostgreSQL database connection pool
 func InitDB(connString string) (*pgxpool.Pool, error) {
-	pool, err := pgxpool.New(context.Background(), connString)
+	poolConfig, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse database URL: %w", err)
+	}
+	poolConfig.ConnConfig.Tracer = metrics.QueryTracer{} // Query durations for /metrics
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create connection pool: %w", err)
 	}
@@ -48,15 +58,14 @@ func CreateSchema(pool *pgxpool.Pool) error {
 		domain_id INT NOT NULL,
 		question_text TEXT NOT NULL,
 		explanation TEXT NOT NULL,
-		question_type VARCHAR(50) NOT NULL CHECK (question_type IN ('single', 'multi', 'truefalse', 'fillblank')),
+		question_type VARCHAR(50) NOT NULL CHECK (question_type IN ('single', 'multi', 'truefalse', 'fillblank', 'ordering', 'matching')),
 		image_url TEXT,
 		code_block TEXT,
 		input_method VARCHAR(50) CHECK (input_method IN ('text', 'terminal')), -- NULL implies 'text' for existing, but 'text' is better
 		validity_score FLOAT DEFAULT NULL,
 		flagged BOOLEAN DEFAULT FALSE,
 		exam_bank_version VARCHAR(50) NOT NULL,
-		FOREIGN KEY (domain_id) REFERENCES domains(id) ON DELETE CASCADE,
-		UNIQUE (question_text, exam_bank_version) -- Ensure unique questions per version
+		FOREIGN KEY (domain_id) REFERENCES domains(id) ON DELETE CASCADE -- Unique per course and version, see idx_questions_course_text_version
 	);
 	CREATE TABLE IF NOT EXISTS choices (
 		id SERIAL PRIMARY KEY,
@@ -151,6 +160,161 @@ func CreateSchema(pool *pgxpool.Pool) error {
 		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
 		updated_by VARCHAR(255)
 	);
+	CREATE TABLE IF NOT EXISTS course_shared_domains (
+		id SERIAL PRIMARY KEY,
+		course_id INT NOT NULL,        -- Course whose exams draw from the shared bank
+		domain_name VARCHAR(255) NOT NULL,
+		source_course_id INT NOT NULL, -- Course that owns the shared questions
+		FOREIGN KEY (course_id) REFERENCES courses(id) ON DELETE CASCADE,
+		FOREIGN KEY (source_course_id) REFERENCES courses(id) ON DELETE CASCADE,
+		UNIQUE (course_id, domain_name), -- A domain draws from at most one shared bank
+		CHECK (course_id <> source_course_id)
+	);
+	CREATE TABLE IF NOT EXISTS pending_notifications (
+		id SERIAL PRIMARY KEY,
+		channel VARCHAR(50) NOT NULL CHECK (channel IN ('email', 'webhook')),
+		event VARCHAR(255) NOT NULL, -- e.g., "exam_completed"
+		recipient TEXT NOT NULL,     -- Email address or webhook URL
+		subject TEXT,
+		payload TEXT NOT NULL,       -- JSON event body
+		status VARCHAR(50) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP WITH TIME ZONE
+	);
+	CREATE INDEX IF NOT EXISTS idx_pending_notifications_due ON pending_notifications (status, next_attempt_at);
+	CREATE TABLE IF NOT EXISTS exam_title_overrides (
+		id SERIAL PRIMARY KEY,
+		course_id INT NOT NULL,
+		bank_name VARCHAR(255) NOT NULL DEFAULT '', -- Exam bank of the exam (see exam.BankName); '' for the primary bank
+		exam_number INT NOT NULL, -- Position of the exam in the generation plan (1 = "Practice Exam 1")
+		title VARCHAR(255) NOT NULL,
+		updated_by VARCHAR(255),
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (course_id) REFERENCES courses(id) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS question_notes (
+		id SERIAL PRIMARY KEY,
+		question_id INT, -- NULL while no ingested question has the note's course, text and bank
+		author VARCHAR(255) NOT NULL, -- Email of the instructor who wrote the note
+		note TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_question_notes_question ON question_notes (question_id, created_at);
+	-- Students' reports of broken questions, separate from the admin-set flagged column
+	CREATE TABLE IF NOT EXISTS question_flags (
+		id SERIAL PRIMARY KEY,
+		question_id INT NOT NULL,
+		attempt_id INT NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		reason TEXT,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE,
+		FOREIGN KEY (attempt_id) REFERENCES exam_attempts(id) ON DELETE CASCADE,
+		UNIQUE (attempt_id, question_id) -- Flagging again within an attempt updates the reason
+	);
+	-- Columns added after the initial schema; ADD COLUMN IF NOT EXISTS keeps existing databases in sync
+	ALTER TABLE questions ADD COLUMN IF NOT EXISTS exact_select INT; -- For multi: exact number of choices to select
+	ALTER TABLE questions ADD COLUMN IF NOT EXISTS context_hints BOOLEAN DEFAULT FALSE; -- Practice hints may quote the code_block
+	ALTER TABLE questions ADD COLUMN IF NOT EXISTS draft BOOLEAN NOT NULL DEFAULT FALSE; -- Work-in-progress: may lack a correct answer, never placed on exams
+	ALTER TABLE questions ADD COLUMN IF NOT EXISTS allow_feedback_in_simulation BOOLEAN NOT NULL DEFAULT FALSE; -- e.g. warm-up questions
+	ALTER TABLE questions ADD COLUMN IF NOT EXISTS hint TEXT; -- Authored practice hint, preferred over generated ones
+	ALTER TABLE questions ADD COLUMN IF NOT EXISTS ignore_flag_order BOOLEAN NOT NULL DEFAULT FALSE; -- Terminal answers match regardless of flag order
+	ALTER TABLE questions ADD COLUMN IF NOT EXISTS code_language VARCHAR(50); -- Syntax highlighting hint for the code_block
+	-- Ordering and matching questions: the CHECK is recreated so databases created before the types accept them
+	ALTER TABLE questions DROP CONSTRAINT IF EXISTS questions_question_type_check;
+	ALTER TABLE questions ADD CONSTRAINT questions_question_type_check CHECK (question_type IN ('single', 'multi', 'truefalse', 'fillblank', 'ordering', 'matching'));
+	ALTER TABLE choices ADD COLUMN IF NOT EXISTS position INT; -- For ordering: the item's expected position, 1 = first
+	-- For matching: each choice is a left-hand prompt and its match option the right-hand response paired with it.
+	-- Options are inserted in random order so their IDs do not reveal the pairing.
+	CREATE TABLE IF NOT EXISTS match_options (
+		id SERIAL PRIMARY KEY,
+		question_id INT NOT NULL,
+		choice_id INT NOT NULL UNIQUE,
+		option_text TEXT NOT NULL,
+		FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE,
+		FOREIGN KEY (choice_id) REFERENCES choices(id) ON DELETE CASCADE
+	);
+	ALTER TABLE fill_blank_answers ADD COLUMN IF NOT EXISTS is_regex BOOLEAN NOT NULL DEFAULT FALSE; -- acceptable_answer is an RE2 pattern, declared with the "re:" prefix
+	ALTER TABLE user_answers ADD COLUMN IF NOT EXISTS match_answer JSONB; -- For matching: {"<choice_id>": <match_option_id>}
+	-- Session modes an exam may be started in; defaults come from the exam bank metadata
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS allow_practice BOOLEAN NOT NULL DEFAULT TRUE;
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS allow_simulation BOOLEAN NOT NULL DEFAULT TRUE;
+	-- Repeated identical system events are coalesced into one row (see LogAdminEvent)
+	ALTER TABLE admin_events ADD COLUMN IF NOT EXISTS occurrences INT NOT NULL DEFAULT 1;
+	ALTER TABLE admin_events ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP WITH TIME ZONE;
+	CREATE INDEX IF NOT EXISTS idx_admin_events_actor_target ON admin_events (actor, target, timestamp);
+	-- Full-text search over question texts of every course (see AdminSearchQuestions)
+	CREATE INDEX IF NOT EXISTS idx_questions_text_search ON questions USING GIN (to_tsvector('english', question_text));
+	-- Question texts are unique per course and exam_bank_version rather than globally, so courses may share a
+	-- text and a version string; course_id is copied from the question's domain for the index
+	ALTER TABLE questions ADD COLUMN IF NOT EXISTS course_id INT REFERENCES courses(id) ON DELETE CASCADE;
+	UPDATE questions q SET course_id = d.course_id FROM domains d WHERE q.domain_id = d.id AND q.course_id IS NULL;
+	ALTER TABLE questions ALTER COLUMN course_id SET NOT NULL;
+	ALTER TABLE questions DROP CONSTRAINT IF EXISTS questions_question_text_exam_bank_version_key;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_questions_course_text_version ON questions (course_id, question_text, exam_bank_version);
+	-- Generation plan position, and whether the title comes from exam_title_overrides
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS exam_number INT;
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS title_override BOOLEAN NOT NULL DEFAULT FALSE;
+	-- Title overrides are kept per exam bank, so exam N of one bank does not rename exam N of the others
+	ALTER TABLE exam_title_overrides ADD COLUMN IF NOT EXISTS bank_name VARCHAR(255) NOT NULL DEFAULT '';
+	ALTER TABLE exam_title_overrides DROP CONSTRAINT IF EXISTS exam_title_overrides_course_id_exam_number_key;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_exam_title_overrides_bank_number ON exam_title_overrides (course_id, bank_name, exam_number);
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS target_exam_count INT; -- Exam bank target_exam_count, NULL when the planner chose
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS penalty_per_wrong FLOAT NOT NULL DEFAULT 0; -- Negative marking: questions deducted per wrong answer
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS instructions TEXT; -- Pre-exam briefing (markdown), from metadata or set by an admin
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS retired_at TIMESTAMP WITH TIME ZONE; -- Kept by re-ingestion for in-progress attempts; closed to new ones
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS fuzzy_accept_distance INT NOT NULL DEFAULT 0; -- Edit distance accepted in fillblank answers; 0 = exact
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS sample BOOLEAN NOT NULL DEFAULT FALSE; -- Demo exam from exam.GenerateSampleExam; never served to students
+	-- Exam bank metadata of the last ingestion, kept even when exam generation fails (used by the exam plan preview)
+	ALTER TABLE courses ADD COLUMN IF NOT EXISTS exam_bank_version VARCHAR(50);
+	ALTER TABLE courses ADD COLUMN IF NOT EXISTS exam_bank_metadata JSONB;
+	ALTER TABLE courses ADD COLUMN IF NOT EXISTS content_hash TEXT;
+	-- Cronbach's alpha over completed simulation attempts, recomputed as simulations are submitted
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS reliability DOUBLE PRECISION;
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS reliability_attempts INT NOT NULL DEFAULT 0;
+	ALTER TABLE exams ADD COLUMN IF NOT EXISTS reliability_updated_at TIMESTAMP WITH TIME ZONE;
+	-- Student emails are stored lowercase; merge rows that differ only by case before enforcing it
+	INSERT INTO students (email) SELECT DISTINCT LOWER(email) FROM students WHERE email <> LOWER(email) ON CONFLICT (email) DO NOTHING;
+	UPDATE exam_attempts SET email = LOWER(email) WHERE email <> LOWER(email);
+	DELETE FROM students WHERE email <> LOWER(email);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_students_email_lower ON students (LOWER(email));
+	-- Per-attempt question ordering: 'shuffled' serves the generated exam order, 'domain' a stable domain-grouped order
+	ALTER TABLE exam_attempts ADD COLUMN IF NOT EXISTS question_order VARCHAR(50) NOT NULL DEFAULT 'shuffled' CHECK (question_order IN ('shuffled', 'domain'));
+	-- Per-attempt choice order, fixed at start from the shuffle_choices setting; earlier attempts keep id order
+	ALTER TABLE exam_attempts ADD COLUMN IF NOT EXISTS shuffle_choices BOOLEAN NOT NULL DEFAULT FALSE;
+	-- Optional roster metadata for students pre-registered via POST /admin/students/import
+	ALTER TABLE students ADD COLUMN IF NOT EXISTS full_name VARCHAR(255);
+	ALTER TABLE students ADD COLUMN IF NOT EXISTS cohort VARCHAR(255);
+	-- Opaque, unguessable session token used in exam session URLs instead of the attempt ID (gen_random_uuid needs PostgreSQL 13+)
+	ALTER TABLE exam_attempts ADD COLUMN IF NOT EXISTS session_token UUID NOT NULL DEFAULT gen_random_uuid();
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_exam_attempts_session_token ON exam_attempts (session_token);
+	-- Hint endpoint requests made by a practice attempt, checked against practice_hints_per_session
+	ALTER TABLE exam_attempts ADD COLUMN IF NOT EXISTS hints_used INT NOT NULL DEFAULT 0;
+	-- Per-domain score percentages recorded at submission
+	ALTER TABLE exam_attempts ADD COLUMN IF NOT EXISTS domain_breakdown JSONB;
+	ALTER TABLE exam_attempts ADD COLUMN IF NOT EXISTS abandoned_at TIMESTAMP WITH TIME ZONE; -- Set by the stale attempt job; the attempt can no longer be continued
+	-- Full credit from exam.ScoreAttempt, stored when the attempt is finalized or rescored (see exam.StoreAnswerCorrectness)
+	-- so statistics grade like the scorer; NULL until then, and filled in for older attempts by exam.BackfillAnswerCorrectness
+	ALTER TABLE user_answers ADD COLUMN IF NOT EXISTS is_correct BOOLEAN;
+	-- Notes are also keyed on their question's course, text and exam bank (see exam.BankName), so re-ingestion
+	-- moves them to the re-inserted question instead of deleting them with the old one
+	ALTER TABLE question_notes ADD COLUMN IF NOT EXISTS course_id INT REFERENCES courses(id) ON DELETE CASCADE;
+	ALTER TABLE question_notes ADD COLUMN IF NOT EXISTS question_text TEXT;
+	ALTER TABLE question_notes ADD COLUMN IF NOT EXISTS bank_name VARCHAR(255) NOT NULL DEFAULT '';
+	UPDATE question_notes n SET course_id = d.course_id, question_text = q.question_text, bank_name = split_part(q.exam_bank_version, '+', 2)
+	FROM questions q JOIN domains d ON q.domain_id = d.id WHERE n.question_id = q.id AND n.course_id IS NULL;
+	ALTER TABLE question_notes ALTER COLUMN question_id DROP NOT NULL;
+	DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'question_notes_question_id_fkey' AND confdeltype = 'c') THEN
+			ALTER TABLE question_notes DROP CONSTRAINT question_notes_question_id_fkey;
+			ALTER TABLE question_notes ADD CONSTRAINT question_notes_question_id_fkey FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE SET NULL;
+		END IF;
+	END $$;
+	CREATE INDEX IF NOT EXISTS idx_question_notes_key ON question_notes (course_id, bank_name, question_text);
 	`
 	_, err := pool.Exec(context.Background(), schemaSQL)
 	if err != nil {
@@ -158,9 +322,44 @@ func CreateSchema(pool *pgxpool.Pool) error {
 	}
 	// Insert default settings if not already present
 	defaultSettings := map[string]string{
-		"rate_limit_api_per_hour":    "100",
-		"rate_limit_admin_per_hour":  "50",
+		"rate_limit_api_per_hour":    "100", // Requests per user per sliding hour on /api/v1; 0 disables
+		"rate_limit_admin_per_hour":  "50",  // Requests per user per sliding hour on /admin; 0 disables
+		"admin_page_size":            "25",  // Default rows per page of the admin list pages; ?page_size overrides it up to 200
+		"impersonation_token_ttl":    "15m", // Lifetime of admin impersonation tokens, capped at 1h
 		"question_validity_threshold":"0.25", // Bottom 25% for low-scoring
+		"validity_update_batch_size": "500",  // Questions per validity score UPDATE statement, each its own short transaction; 0 updates all at once
+		"notification_webhook_url":   "",     // Empty disables webhook notifications
+		"notification_email":         "",     // Empty disables email notifications
+		"practice_context_hints":     "false", // Enables code_block hints for questions with context_hints
+		"duplicate_choice_severity":  "error", // "error" fails ingestion on repeated choice text within a question; "warning" only logs it
+		"unweighted_domain_policy":   "explicit", // "explicit" requires every question domain in the domains metadata; "holding" adds unlisted ones with weight 0
+		"duplicate_question_scope":   "file", // Where question_text must be unique: "file" (one exam bank), "course" (all of a course's banks) or "global" (also other courses)
+		"validate_image_urls":        "false", // HEAD-checks image_url reachability and content type at ingestion
+		"validate_image_urls_strict": "false", // Fails ingestion on image_url check failures instead of only logging them
+		"image_url_check_timeout":    "5s",    // Per-request timeout of the image_url checks
+		"normalize_code_blocks":      "false", // Dedents code_block and drops its surrounding blank lines at ingestion
+		"detect_code_language":       "false", // Guesses code_language at ingestion when a code_block has none
+		"practice_choice_feedback":   "all",   // "all" choices, or only "selected" plus correct choices, in practice feedback
+		"practice_hints_per_session": "10",   // Hint endpoint requests allowed per practice attempt; 0 disables the endpoint
+		"practice_recommend_margin":  "15",    // Points above passing_score that recommend a harder exam next
+		"answer_locale":              "und",   // BCP 47 locale for fill-in-the-blank case folding, e.g. "tr" for Turkish; "und" uses Unicode defaults
+		"simulation_answer_grace":    "30s",   // Time past exam_time during which simulation answers are still accepted
+		"min_answered_fraction":      "0",     // Fraction of questions that must be answered before submit without confirm=true; 0 disables
+		"max_exam_time_minutes":      "1440",  // Upper bound for exam_time accepted at ingestion (24h)
+		"max_questions_limit":        "500",   // Upper bound for min_questions/max_questions accepted at ingestion
+		"require_csv_header":         "false", // Requires exam_bank.csv to declare a header row after the metadata rows
+		"exclude_flagged_questions":  "true",  // Leaves flagged questions out of newly generated exams
+		"exam_selection_strategy":    "uniform", // "uniform", or "validity_weighted" to favour questions with higher validity scores
+		"abandon_practice_after_days": "30",   // In-progress practice attempts older than this are marked abandoned; 0 disables
+		"delete_abandoned_answers":   "false", // Also deletes the answers of attempts marked abandoned
+		"exam_plan_tie_break":        "exam_count", // "exam_count", or "domain_balance" to prefer plans closest to the domain weights over more exams
+		"simulation_results_release": "immediate", // "immediate", "without_explanations" or "score_only": what students see of a submitted simulation
+		"scoring_mode":               "strict",  // "strict" all-or-nothing, or "partial" credit for multi-select, ordering and matching questions
+		"shuffle_choices":            "true",   // Serves each attempt its own choice order (True/False excepted); fixed when the attempt starts
+		"quality_band_excellent_min": "0.4",  // Validity score quality bands (lower bounds); below poor is "review"
+		"quality_band_good_min":      "0.2",
+		"quality_band_fair_min":      "0.1",
+		"quality_band_poor_min":      "0.0",
 	}
 	for key, value := range defaultSettings {
 		_, err := pool.Exec(context.Background(), `
@@ -184,12 +383,36 @@ func LogError(pool *pgxpool.Pool, source, courseCode, filePath string, lineNumbe
 		log.Printf("ERROR: Failed to log error to database: %v. Original error: %s", err, errMsg)
 	}
 }
+// SystemActor is the admin_events actor for events logged by the server's scheduled jobs.
+const SystemActor = "system"
 // LogAdminEvent adds an entry to the admin_events table
+// Events from SystemActor (the scheduled jobs) are coalesced: when the latest system event for
+// the same target has the same action and notes, its occurrences count and last_seen_at are
+// updated instead of inserting a new row. User-initiated events are always logged individually.
 func LogAdminEvent(pool *pgxpool.Pool, actor, action, target, notes string) {
-	_, err := pool.Exec(context.Background(), `
+	query := `
 		INSERT INTO admin_events (action, actor, target, notes)
 		VALUES ($1, $2, $3, $4)
-	`, action, actor, target, notes)
+	`
+	if actor == SystemActor {
+		query = `
+			WITH latest AS (
+				SELECT id, action, notes FROM admin_events
+				WHERE actor = $2 AND target = $3
+				ORDER BY timestamp DESC, id DESC
+				LIMIT 1
+			), coalesced AS (
+				UPDATE admin_events ae SET occurrences = ae.occurrences + 1, last_seen_at = CURRENT_TIMESTAMP
+				FROM latest
+				WHERE ae.id = latest.id AND latest.action = $1 AND latest.notes IS NOT DISTINCT FROM $4
+				RETURNING ae.id
+			)
+			INSERT INTO admin_events (action, actor, target, notes)
+			SELECT $1, $2, $3, $4
+			WHERE NOT EXISTS (SELECT 1 FROM coalesced)
+		`
+	}
+	_, err := pool.Exec(context.Background(), query, action, actor, target, notes)
 	if err != nil {
 		log.Printf("ERROR: Failed to log admin event to database: %v. Event: %s by %s on %s", err, action, actor, target)
 	}
@@ -203,6 +426,157 @@ func GetSetting(pool *pgxpool.Pool, key string) (string, error) {
     }
     return value, nil
 }
+// settingsCacheTTL bounds how long GetSettingCached serves a value, which also limits staleness
+// after changes made directly in the database rather than through InvalidateSettingsCache.
+const settingsCacheTTL = 30 * time.Second
+// cachedSetting is a settings value cached by GetSettingCached.
+type cachedSetting struct {
+	value     string
+	expiresAt time.Time
+}
+// settingsCache is shared by request handlers and background jobs; guarded by settingsCacheMu.
+// settingsCacheGen is bumped on invalidation so a read racing with an update can't re-cache the old value.
+var (
+	settingsCacheMu  sync.RWMutex
+	settingsCache    = make(map[string]cachedSetting)
+	settingsCacheGen uint64
+)
+// AnswerLocale returns the BCP 47 locale whose case rules fill-in-the-blank answers are lowercased with
+// (setting answer_locale), or "und" for the Unicode defaults when unset or invalid.
+func AnswerLocale(pool *pgxpool.Pool) string {
+	locale, err := GetSettingCached(pool, "answer_locale")
+	if err != nil || strings.TrimSpace(locale) == "" {
+		return "und"
+	}
+	if _, err := language.Parse(locale); err != nil {
+		log.Printf("Invalid answer_locale setting '%s', using Unicode default case folding: %v", locale, err)
+		return "und"
+	}
+	return locale
+}
+// GetSettingCached returns a setting value like GetSetting, caching it for settingsCacheTTL.
+// Safe for concurrent use.
+func GetSettingCached(pool *pgxpool.Pool, key string) (string, error) {
+	settingsCacheMu.RLock()
+	entry, ok := settingsCache[key]
+	gen := settingsCacheGen
+	settingsCacheMu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.value, nil
+	}
+	value, err := GetSetting(pool, key)
+	if err != nil {
+		return "", err
+	}
+	settingsCacheMu.Lock()
+	if gen == settingsCacheGen { // Skip caching if invalidated while reading
+		settingsCache[key] = cachedSetting{value: value, expiresAt: time.Now().Add(settingsCacheTTL)}
+	}
+	settingsCacheMu.Unlock()
+	return value, nil
+}
+// InvalidateSettingsCache drops the cached values of the given keys, or of all keys when none are given.
+// Call it after updating the settings table.
+func InvalidateSettingsCache(keys ...string) {
+	settingsCacheMu.Lock()
+	defer settingsCacheMu.Unlock()
+	settingsCacheGen++
+	if len(keys) == 0 {
+		settingsCache = make(map[string]cachedSetting)
+		return
+	}
+	for _, key := range keys {
+		delete(settingsCache, key)
+	}
+}
+// settingValue fetches a cached setting for the typed accessors, returning ok=false (after logging)
+// when the setting is missing so the caller falls back to its default.
+func settingValue(pool *pgxpool.Pool, key string) (string, bool) {
+	value, err := GetSettingCached(pool, key)
+	if err != nil {
+		log.Printf("Warning: Could not get setting %s, using default: %v", key, err)
+		return "", false
+	}
+	return strings.TrimSpace(value), true
+}
+// GetSettingInt returns a setting parsed as an int, or def if it is missing or malformed.
+func GetSettingInt(pool *pgxpool.Pool, key string, def int) int {
+	valueStr, ok := settingValue(pool, key)
+	if !ok {
+		return def
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		log.Printf("Warning: Invalid integer setting %s '%s', defaulting to %d: %v", key, valueStr, def, err)
+		return def
+	}
+	return value
+}
+// GetSettingFloat returns a setting parsed as a float64, or def if it is missing or malformed.
+func GetSettingFloat(pool *pgxpool.Pool, key string, def float64) float64 {
+	valueStr, ok := settingValue(pool, key)
+	if !ok {
+		return def
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		log.Printf("Warning: Invalid float setting %s '%s', defaulting to %g: %v", key, valueStr, def, err)
+		return def
+	}
+	return value
+}
+// GetSettingBool returns a setting parsed as a bool (true/false, 1/0, ...), or def if it is missing or malformed.
+func GetSettingBool(pool *pgxpool.Pool, key string, def bool) bool {
+	valueStr, ok := settingValue(pool, key)
+	if !ok {
+		return def
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		log.Printf("Warning: Invalid boolean setting %s '%s', defaulting to %t: %v", key, valueStr, def, err)
+		return def
+	}
+	return value
+}
+// GetSettingDuration returns a setting parsed as a duration (e.g. "30s", "5m"), or def if it is missing or malformed.
+func GetSettingDuration(pool *pgxpool.Pool, key string, def time.Duration) time.Duration {
+	valueStr, ok := settingValue(pool, key)
+	if !ok {
+		return def
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		log.Printf("Warning: Invalid duration setting %s '%s', defaulting to %s: %v", key, valueStr, def, err)
+		return def
+	}
+	return value
+}
+// ActiveSessionsQuery counts active exam sessions: attempts not yet completed whose exam time limit has not
+// elapsed and that are not marked abandoned. Unsubmitted attempts stop counting once their time is up.
+const ActiveSessionsQuery = `
+	SELECT COUNT(ea.id)
+	FROM exam_attempts ea
+	JOIN exams e ON ea.exam_id = e.id
+	WHERE ea.completed_at IS NULL AND ea.abandoned_at IS NULL AND ea.started_at + e.exam_time * INTERVAL '1 minute' > NOW()
+`
+// CountActiveSessions returns the number of active exam sessions (see ActiveSessionsQuery).
+func CountActiveSessions(pool *pgxpool.Pool) (int, error) {
+	var count int
+	if err := pool.QueryRow(context.Background(), ActiveSessionsQuery).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count active sessions: %w", err)
+	}
+	return count, nil
+}
+// RefreshActiveSessionsGauge sets metrics.ActiveExamSessions from CountActiveSessions. The count is taken
+// from the database so every instance reports the same value; failures are logged and leave the gauge as is.
+func RefreshActiveSessionsGauge(pool *pgxpool.Pool) {
+	count, err := CountActiveSessions(pool)
+	if err != nil {
+		log.Printf("Error refreshing active sessions gauge: %v", err)
+		return
+	}
+	metrics.ActiveExamSessions.Set(float64(count))
+}
 // GetAllCourseCodes fetches all course codes from the courses table.
 func GetAllCourseCodes(pool *pgxpool.Pool) ([]string, error) {
 	rows, err := pool.Query(context.Background(), "SELECT course_code FROM courses")
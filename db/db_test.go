@@ -0,0 +1,178 @@
+
+package db
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+// cacheSetting stores a fresh settings cache entry, so GetSettingCached serves it without a database.
+func cacheSetting(t *testing.T, key, value string) {
+	t.Helper()
+	settingsCacheMu.Lock()
+	settingsCache[key] = cachedSetting{value: value, expiresAt: time.Now().Add(settingsCacheTTL)}
+	settingsCacheMu.Unlock()
+	t.Cleanup(func() { InvalidateSettingsCache(key) })
+}
+// isCached reports whether key has a settings cache entry.
+func isCached(key string) bool {
+	settingsCacheMu.RLock()
+	defer settingsCacheMu.RUnlock()
+	_, ok := settingsCache[key]
+	return ok
+}
+func TestGetSettingCachedServesCachedValue(t *testing.T) {
+	cacheSetting(t, "test_cached_key", "42")
+	value, err := GetSettingCached(nil, "test_cached_key") // A nil pool would panic on a cache miss
+	if err != nil || value != "42" {
+		t.Fatalf("GetSettingCached = %q, %v, want \"42\", nil", value, err)
+	}
+}
+func TestInvalidateSettingsCache(t *testing.T) {
+	tests := []struct {
+		name        string
+		invalidate  []string
+		wantDropped map[string]bool
+	}{
+		{"one key", []string{"test_key_a"}, map[string]bool{"test_key_a": true, "test_key_b": false}},
+		{"several keys", []string{"test_key_a", "test_key_b"}, map[string]bool{"test_key_a": true, "test_key_b": true}},
+		{"unrelated key", []string{"test_key_c"}, map[string]bool{"test_key_a": false, "test_key_b": false}},
+		{"all keys", nil, map[string]bool{"test_key_a": true, "test_key_b": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheSetting(t, "test_key_a", "a")
+			cacheSetting(t, "test_key_b", "b")
+			settingsCacheMu.RLock()
+			genBefore := settingsCacheGen
+			settingsCacheMu.RUnlock()
+			InvalidateSettingsCache(tt.invalidate...)
+			for key, dropped := range tt.wantDropped {
+				if isCached(key) == dropped {
+					t.Errorf("after InvalidateSettingsCache(%v), %s cached = %t, want %t", tt.invalidate, key, dropped, !dropped)
+				}
+			}
+			settingsCacheMu.RLock()
+			genAfter := settingsCacheGen
+			settingsCacheMu.RUnlock()
+			if genAfter == genBefore {
+				t.Errorf("InvalidateSettingsCache did not advance the cache generation")
+			}
+		})
+	}
+}
+func TestGetSettingCachedConcurrentUse(t *testing.T) {
+	// Handlers and background jobs read while admins update; run with -race to check the locking
+	cacheSetting(t, "test_concurrent_key", "v")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if value, err := GetSettingCached(nil, "test_concurrent_key"); err != nil || value != "v" {
+					t.Errorf("GetSettingCached = %q, %v, want \"v\", nil", value, err)
+					return
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				InvalidateSettingsCache(fmt.Sprintf("test_other_key_%d", i))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+func TestGetSettingInt(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		def   int
+		want  int
+	}{
+		{"valid", "25", 10, 25},
+		{"surrounding space", " 25 ", 10, 25},
+		{"negative", "-3", 10, -3},
+		{"malformed", "twenty", 10, 10},
+		{"float", "2.5", 10, 10},
+		{"empty", "", 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheSetting(t, "test_int_setting", tt.value)
+			if got := GetSettingInt(nil, "test_int_setting", tt.def); got != tt.want {
+				t.Fatalf("GetSettingInt(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+func TestGetSettingFloat(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		def   float64
+		want  float64
+	}{
+		{"valid", "0.3", 0.25, 0.3},
+		{"integer", "1", 0.25, 1},
+		{"malformed", "quarter", 0.25, 0.25},
+		{"trailing percent", "25%", 0.25, 0.25},
+		{"empty", "", 0.25, 0.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheSetting(t, "test_float_setting", tt.value)
+			if got := GetSettingFloat(nil, "test_float_setting", tt.def); got != tt.want {
+				t.Fatalf("GetSettingFloat(%q) = %g, want %g", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+func TestGetSettingBool(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		def   bool
+		want  bool
+	}{
+		{"true", "true", false, true},
+		{"false", "false", true, false},
+		{"numeric", "1", false, true},
+		{"upper case", "TRUE", false, true},
+		{"malformed", "yes", true, true},
+		{"malformed default false", "on", false, false},
+		{"empty", "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheSetting(t, "test_bool_setting", tt.value)
+			if got := GetSettingBool(nil, "test_bool_setting", tt.def); got != tt.want {
+				t.Fatalf("GetSettingBool(%q) = %t, want %t", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+func TestGetSettingDuration(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		def   time.Duration
+		want  time.Duration
+	}{
+		{"seconds", "45s", 30 * time.Second, 45 * time.Second},
+		{"minutes", "5m", 30 * time.Second, 5 * time.Minute},
+		{"missing unit", "30", time.Minute, time.Minute},
+		{"malformed", "soon", time.Minute, time.Minute},
+		{"empty", "", time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheSetting(t, "test_duration_setting", tt.value)
+			if got := GetSettingDuration(nil, "test_duration_setting", tt.def); got != tt.want {
+				t.Fatalf("GetSettingDuration(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
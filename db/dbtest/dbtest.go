@@ -0,0 +1,132 @@
+
+package dbtest
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+)
+// URLVariable names the environment variable holding the connection string of a scratch PostgreSQL
+// database for tests against a real database. Its tables are emptied by every test using it.
+const URLVariable = "RECAP_TEST_DATABASE_URL"
+// lockKey is the advisory lock that serializes tests of different packages sharing the database.
+const lockKey = 7125
+// Pool returns a pool on the database named by URLVariable, with the RECAP schema created, every table
+// emptied, the default settings restored and the settings cache cleared. The test is skipped when the variable is unset.
+func Pool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	return PoolWithTracer(t, nil)
+}
+// PoolWithTracer is Pool with tracer tracing the pool's queries, e.g. to count round trips.
+func PoolWithTracer(t *testing.T, tracer pgx.QueryTracer) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv(URLVariable)
+	if url == "" {
+		t.Skipf("%s is not set; skipping test against a real database", URLVariable)
+	}
+	poolConfig, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", URLVariable, err)
+	}
+	poolConfig.ConnConfig.Tracer = tracer
+	ctx := context.Background()
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	// Packages are tested concurrently; the lock is held on its own connection until the test ends
+	lockConn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	if _, err := lockConn.Exec(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		t.Fatalf("locking the test database: %v", err)
+	}
+	t.Cleanup(func() { lockConn.Close(context.Background()) }) // Closing releases the lock
+	if err := db.CreateSchema(pool); err != nil {
+		t.Fatalf("creating the schema: %v", err)
+	}
+	var tables []string
+	rows, err := pool.Query(ctx, `SELECT quote_ident(tablename) FROM pg_tables WHERE schemaname = current_schema()`)
+	if err == nil {
+		tables, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	}
+	if err != nil {
+		t.Fatalf("listing tables: %v", err)
+	}
+	if _, err := pool.Exec(ctx, `TRUNCATE `+strings.Join(tables, ", ")+` RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatalf("emptying tables: %v", err)
+	}
+	if err := db.CreateSchema(pool); err != nil { // Inserts the default settings again
+		t.Fatalf("restoring default settings: %v", err)
+	}
+	db.InvalidateSettingsCache()
+	t.Cleanup(func() { db.InvalidateSettingsCache() })
+	return pool
+}
+// SetSetting stores a setting value and drops its cached value.
+func SetSetting(t *testing.T, pool *pgxpool.Pool, key, value string) {
+	t.Helper()
+	_, err := pool.Exec(context.Background(), `
+		INSERT INTO settings (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value
+	`, key, value)
+	if err != nil {
+		t.Fatalf("setting %s: %v", key, err)
+	}
+	db.InvalidateSettingsCache(key)
+}
+// ExamBankCSV renders an exam_bank.csv of schemaVersion with exams of 2 to 4 questions from the domains of
+// questionsByDomain, weighted equally. Each question text becomes a single-answer question whose correct
+// choice is "Alpha".
+func ExamBankCSV(schemaVersion string, questionsByDomain map[string][]string) string {
+	domains := make([]string, 0, len(questionsByDomain))
+	for domain := range questionsByDomain {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	weights := make([]string, len(domains))
+	for i, domain := range domains {
+		weights[i] = fmt.Sprintf("%s:%g", domain, 1/float64(len(domains)))
+	}
+	var b strings.Builder
+	for _, row := range [][2]string{
+		{"schema_version", schemaVersion},
+		{"min_questions", "2"},
+		{"max_questions", "4"},
+		{"exam_time", "30"},
+		{"passing_score", "70"},
+		{"domains", strings.Join(weights, "|")},
+	} {
+		fmt.Fprintf(&b, "%s,%s\n", row[0], row[1])
+	}
+	for _, domain := range domains {
+		for _, text := range questionsByDomain[domain] {
+			fmt.Fprintf(&b, "single,%s,%q,Because.,,,,Alpha,TRUE,,Beta,FALSE,,Gamma,FALSE,,\n", domain, text)
+		}
+	}
+	return b.String()
+}
+// WriteCourse writes courses/<courseCode>/course.yaml and exam_bank.csv under labsRepoPath, replacing an
+// earlier version of the course.
+func WriteCourse(t *testing.T, labsRepoPath, courseCode, examBankCSV string) {
+	t.Helper()
+	coursePath := filepath.Join(labsRepoPath, "courses", courseCode)
+	if err := os.MkdirAll(coursePath, 0o755); err != nil {
+		t.Fatalf("creating %s: %v", coursePath, err)
+	}
+	courseYAML := fmt.Sprintf("course_code: %s\nmarketing_name: %s Test Course\nduration_days: 3\nresponsibility: tests\n", courseCode, courseCode)
+	files := map[string]string{"course.yaml": courseYAML, "exam_bank.csv": examBankCSV}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(coursePath, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+}
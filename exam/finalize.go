@@ -0,0 +1,233 @@
+
+package exam
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/metrics"
+	"recap-server/models"
+	"recap-server/notifications"
+	"recap-server/utils"
+)
+// ErrAttemptCompleted is returned by FinalizeAttempt when the attempt was already completed, e.g. by a
+// concurrent submission or the expired-attempt reaper, or was marked abandoned.
+var ErrAttemptCompleted = errors.New("attempt already completed")
+// Simulation results release policies, chosen by the simulation_results_release setting. They govern what
+// students see of a completed simulation attempt; practice attempts always get the full report.
+const (
+	ReleaseImmediate           = "immediate"            // Full detailed report with explanations
+	ReleaseWithoutExplanations = "without_explanations" // Detailed report with explanations removed
+	ReleaseScoreOnly           = "score_only"           // Score, pass and domain breakdown only; no detailed report
+)
+// AttemptResult is the outcome of finalizing an attempt.
+type AttemptResult struct {
+	Mode            string // "practice" or "simulation"
+	ScorePercent    int
+	Pass            bool
+	DomainBreakdown map[string]int
+	DetailedReport  []models.DetailedQuestionReport
+}
+// LoadReleasePolicy reads the simulation_results_release setting, falling back to ReleaseImmediate for
+// missing or unknown values.
+func LoadReleasePolicy(ctx context.Context, pool *pgxpool.Pool) string {
+	policy, err := db.GetSettingCached(pool, "simulation_results_release")
+	if err != nil || policy == "" {
+		return ReleaseImmediate
+	}
+	if policy != ReleaseImmediate && policy != ReleaseWithoutExplanations && policy != ReleaseScoreOnly {
+		utils.LoggerFromContext(ctx).Warn("Unknown simulation_results_release, using the default", "value", policy, "default", ReleaseImmediate)
+		return ReleaseImmediate
+	}
+	return policy
+}
+// WithholdExplanations clears the explanations of a detailed report in place.
+func WithholdExplanations(report []models.DetailedQuestionReport) {
+	for i := range report {
+		report[i].Explanation = ""
+	}
+}
+// FinalizeAttempt scores an attempt on whatever answers it has and marks it completed, storing the score
+// and domain breakdown. It then enqueues the completion notification and, for simulation attempts,
+// recomputes the exam's reliability; failures of those follow-ups are logged and do not fail the call.
+// orderBy orders the detailed report (see ScoreAttempt). Scoring and the completion update run under ctx; the
+// follow-ups run when it is cancelled too, so a request ending after the attempt is completed does not skip them.
+func FinalizeAttempt(ctx context.Context, pool *pgxpool.Pool, attemptID int, orderBy string) (*AttemptResult, error) {
+	var examID, totalQuestions int
+	var email, mode string
+	var passingScore, penaltyPerWrong float64
+	err := pool.QueryRow(ctx, `
+		SELECT ea.exam_id, ea.email, ea.mode, e.passing_score, e.penalty_per_wrong, (SELECT COUNT(id) FROM exam_questions WHERE exam_id = e.id)
+		FROM exam_attempts ea
+		JOIN exams e ON ea.exam_id = e.id
+		WHERE ea.id = $1
+	`, attemptID).Scan(&examID, &email, &mode, &passingScore, &penaltyPerWrong, &totalQuestions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load attempt %d: %w", attemptID, err)
+	}
+	scoringStart := time.Now()
+	score, err := ScoreAttempt(ctx, pool, attemptID, examID, orderBy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to score attempt %d: %w", attemptID, err)
+	}
+	metrics.ScoringDuration.Observe(time.Since(scoringStart).Seconds())
+	result := &AttemptResult{
+		Mode:            mode,
+		ScorePercent:    ScorePercent(score, totalQuestions, penaltyPerWrong),
+		DomainBreakdown: score.DomainBreakdown,
+		DetailedReport:  score.DetailedReport,
+	}
+	result.Pass = Passed(result.ScorePercent, passingScore)
+	domainBreakdownJSON, err := json.Marshal(result.DomainBreakdown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal domain breakdown for attempt %d: %w", attemptID, err)
+	}
+	// The breakdown is stored for history and recommendations. Only an open attempt is updated, so a
+	// submission racing the reaper finalizes it once.
+	completedAt := time.Now()
+	err = pool.QueryRow(ctx, `
+		UPDATE exam_attempts SET completed_at = $1, score_percent = $2, domain_breakdown = $3
+		WHERE id = $4 AND completed_at IS NULL AND abandoned_at IS NULL
+		RETURNING id
+	`, completedAt, result.ScorePercent, domainBreakdownJSON, attemptID).Scan(&attemptID)
+	if err == pgx.ErrNoRows {
+		return nil, ErrAttemptCompleted
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update attempt %d completion: %w", attemptID, err)
+	}
+	metrics.ExamsSubmitted.WithLabelValues(mode).Inc()
+	db.RefreshActiveSessionsGauge(pool)
+	ctx = context.WithoutCancel(ctx)
+	// Statistics read the stored correctness; rows left NULL are filled in by BackfillAnswerCorrectness
+	if err := StoreAnswerCorrectness(ctx, pool, attemptID, score); err != nil {
+		utils.LoggerFromContext(ctx).Error("Error storing answer correctness", "attempt_id", attemptID, "error", err)
+	}
+	err = notifications.EnqueueEvent(pool, notifications.EventExamCompleted, fmt.Sprintf("%s completed exam %d", email, examID), map[string]interface{}{
+		"attempt_id":    attemptID,
+		"exam_id":       examID,
+		"email":         email,
+		"score_percent": result.ScorePercent,
+		"pass":          result.Pass,
+		"completed_at":  completedAt,
+	})
+	if err != nil {
+		utils.LoggerFromContext(ctx).Error("Error enqueueing completion notification", "attempt_id", attemptID, "error", err)
+	}
+	// Reliability is computed over simulation attempts only
+	if mode == "simulation" {
+		if _, err := ComputeReliability(pool, examID); err != nil {
+			utils.LoggerFromContext(ctx).Error("Error computing reliability", "exam_id", examID, "error", err)
+		}
+	}
+	return result, nil
+}
+// FinalizeExpiredAttempts finalizes every open simulation attempt whose time limit plus the
+// simulation_answer_grace setting has passed, scoring the answers recorded so far, and logs each as a
+// system admin event. It returns the number of attempts finalized.
+func FinalizeExpiredAttempts(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	grace := db.GetSettingDuration(pool, "simulation_answer_grace", 30*time.Second)
+	rows, err := pool.Query(ctx, `
+		SELECT ea.id
+		FROM exam_attempts ea
+		JOIN exams e ON ea.exam_id = e.id
+		WHERE ea.mode = 'simulation' AND ea.completed_at IS NULL AND ea.abandoned_at IS NULL
+			AND ea.started_at + e.exam_time * INTERVAL '1 minute' + $1 * INTERVAL '1 second' < NOW()
+		ORDER BY ea.id
+	`, grace.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to query expired attempts: %w", err)
+	}
+	var attemptIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan expired attempt: %w", err)
+		}
+		attemptIDs = append(attemptIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read expired attempts: %w", err)
+	}
+	finalized := 0
+	for _, attemptID := range attemptIDs {
+		result, err := FinalizeAttempt(ctx, pool, attemptID, "eq.question_order")
+		if err == ErrAttemptCompleted {
+			continue // Submitted in the meantime
+		}
+		if err != nil {
+			utils.LoggerFromContext(ctx).Error("Error auto-submitting expired attempt", "attempt_id", attemptID, "error", err)
+			continue
+		}
+		finalized++
+		db.LogAdminEvent(pool, db.SystemActor, "auto_submit_attempt", strconv.Itoa(attemptID), fmt.Sprintf("Time limit expired; scored %d%% on the recorded answers", result.ScorePercent))
+	}
+	// Sessions also stop counting as active when their time runs out, without being finalized
+	db.RefreshActiveSessionsGauge(pool)
+	return finalized, nil
+}
+// AbandonStaleAttempts marks in-progress practice attempts started more than the abandon_practice_after_days
+// setting ago as abandoned, so they stop counting as open sessions and can no longer be continued. When the
+// delete_abandoned_answers setting is true, their recorded answers are deleted as well. A system admin event
+// records each run that abandons attempts. It returns the number of attempts marked abandoned.
+func AbandonStaleAttempts(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	days := db.GetSettingInt(pool, "abandon_practice_after_days", 30)
+	if days <= 0 {
+		return 0, nil // Disabled
+	}
+	deleteAnswers := db.GetSettingBool(pool, "delete_abandoned_answers", false)
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin stale attempt transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // Rollback on error
+	rows, err := tx.Query(ctx, `
+		UPDATE exam_attempts SET abandoned_at = NOW()
+		WHERE mode = 'practice' AND completed_at IS NULL AND abandoned_at IS NULL
+			AND started_at < NOW() - $1 * INTERVAL '1 day'
+		RETURNING id
+	`, days)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark stale attempts abandoned: %w", err)
+	}
+	var attemptIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan abandoned attempt: %w", err)
+		}
+		attemptIDs = append(attemptIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read abandoned attempts: %w", err)
+	}
+	if len(attemptIDs) == 0 {
+		return 0, nil
+	}
+	var deleted int64
+	if deleteAnswers {
+		tag, err := tx.Exec(ctx, `DELETE FROM user_answers WHERE attempt_id = ANY($1)`, attemptIDs)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete answers of abandoned attempts: %w", err)
+		}
+		deleted = tag.RowsAffected()
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit stale attempt transaction: %w", err)
+	}
+	notes := fmt.Sprintf("Marked %d practice attempts older than %d days abandoned", len(attemptIDs), days)
+	if deleteAnswers {
+		notes += fmt.Sprintf("; deleted %d answers", deleted)
+	}
+	db.LogAdminEvent(pool, db.SystemActor, "abandon_stale_attempts", "exam_attempts", notes)
+	return len(attemptIDs), nil
+}
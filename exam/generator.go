@@ -5,10 +5,9 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math"
 	"math/rand"
-	"strconv"
+	"sort"
 	"strings"
 	_ "time" // USED: For time.Now() in UpdateQuestionValidityScores
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -16,43 +15,138 @@ import (
 	"recap-server/models"
 	"recap-server/utils"
 )
+// GenerationQuestion is a question as seen by exam generation: the stored question plus the
+// domain and owning course it is planned and selected by. These fields stay out of models.Question
+// so API responses don't carry them.
+type GenerationQuestion struct {
+	models.Question
+	DomainName       string
+	SourceCourseCode string // Owning course for questions drawn from a shared bank; empty for the course's own
+}
+// bankVersionSeparator separates the schema_version from the bank name in the exam_bank_version of a
+// course's additional exam banks, e.g. "1.0.0+networking" for exam_bank_networking.csv.
+const bankVersionSeparator = "+"
+// BankVersion returns the exam_bank_version questions and exams of the named exam bank are stored under.
+// The primary bank (name "") keeps its schema_version unchanged.
+func BankVersion(schemaVersion, bankName string) string {
+	if bankName == "" {
+		return schemaVersion
+	}
+	return schemaVersion + bankVersionSeparator + bankName
+}
+// BankName returns the exam bank name of an exam_bank_version, or "" for the course's primary bank.
+func BankName(examBankVersion string) string {
+	if i := strings.LastIndex(examBankVersion, bankVersionSeparator); i >= 0 {
+		return examBankVersion[i+len(bankVersionSeparator):]
+	}
+	return ""
+}
+// SchemaVersion returns the schema_version part of an exam_bank_version, without the bank name.
+func SchemaVersion(examBankVersion string) string {
+	if i := strings.LastIndex(examBankVersion, bankVersionSeparator); i >= 0 {
+		return examBankVersion[:i]
+	}
+	return examBankVersion
+}
 // GenerateExamsForCourse orchestrates the exam generation process for a specific course.
-func GenerateExamsForCourse(pool *pgxpool.Pool, courseID int, courseMarketingName, examBankVersion string, metadata models.ExamBankMetadata) error {
-	log.Printf("Starting exam generation for course ID: %d, Version: %s", courseID, examBankVersion)
-	// Fetch all questions for this course and exam_bank_version
-	questions, err := GetQuestionsByCourseAndVersion(pool, courseID, examBankVersion)
+// The existing exams for the version are replaced atomically; on any error they are left untouched.
+// Exams of an additional exam bank carry the bank name in their title, and title overrides apply to the
+// primary bank's exams only.
+// selectionStrategy is SelectionUniform or SelectionValidityWeighted (see LoadSelectionStrategy).
+func GenerateExamsForCourse(ctx context.Context, pool *pgxpool.Pool, courseID int, courseMarketingName, examBankVersion string, metadata models.ExamBankMetadata, selectionStrategy string) error {
+	logger := utils.LoggerFromContext(ctx).With("course_id", courseID, "exam_bank_version", examBankVersion)
+	logger.Info("Starting exam generation", "selection", selectionStrategy)
+	// Fetch all questions for this course and exam_bank_version; flagged ones are left out unless disabled
+	excludeFlagged := db.GetSettingBool(pool, "exclude_flagged_questions", true)
+	questions, err := GetQuestionsByCourseAndVersion(ctx, pool, courseID, examBankVersion, excludeFlagged)
 	if err != nil {
 		return fmt.Errorf("failed to get questions for exam generation: %w", err)
 	}
 	if len(questions) == 0 {
 		return fmt.Errorf("no questions available for course ID %d and version %s to generate exams", courseID, examBankVersion)
 	}
+	sharedCount := 0
+	for _, q := range questions {
+		if q.SourceCourseCode != "" {
+			sharedCount++
+		}
+	}
+	if sharedCount > 0 {
+		logger.Info("Including shared bank questions", "questions", sharedCount)
+	}
 	// Determine the optimal exam plan
-	plan, err := GenerateExamPlan(questions, metadata.MinQuestions, metadata.MaxQuestions, metadata.Domains)
+	plan, err := GenerateExamPlan(questions, metadata.MinQuestions, metadata.MaxQuestions, metadata.Domains, metadata.TargetExamCount, LoadPlanTieBreak(ctx, pool))
 	if err != nil {
+		if metadata.TargetExamCount > 0 {
+			db.LogError(pool, "exam_generation", courseMarketingName, "", 0, "target_exam_count", "target_exam_count could not be met",
+				fmt.Sprintf("No exam of %d to %d questions can be formed from the available questions, so %d exams cannot be generated: %v", metadata.MinQuestions, metadata.MaxQuestions, metadata.TargetExamCount, err))
+		}
+		if excludeFlagged {
+			for _, shortage := range DomainShortages(questions, metadata.MinQuestions, metadata.Domains) {
+				db.LogError(pool, "exam_generation", courseMarketingName, "", 0, "domain", "Domain short of unflagged questions",
+					fmt.Sprintf("Domain '%s' has %d unflagged question(s) but needs %d at min_questions %d; it is short by %d. Unflag or add questions, or set exclude_flagged_questions to \"false\".",
+						shortage.Domain, shortage.Available, shortage.Required, metadata.MinQuestions, shortage.Required-shortage.Available))
+			}
+		}
 		return fmt.Errorf("failed to generate exam plan: %w", err)
 	}
-	log.Printf("Generated Exam Plan: NumExams=%d, QuestionsPerExam=%d, PerDomainPerExam=%v",
-		plan.NumExams, plan.QuestionsPerExam, plan.PerDomainPerExam)
+	logger.Info("Generated exam plan", "num_exams", plan.NumExams, "questions_per_exam", plan.QuestionsPerExam, "per_domain_per_exam", plan.PerDomainPerExam)
+	if plan.ReuseAcrossExams {
+		// Each exam selects independently from the whole pool, so only within-exam uniqueness is enforced
+		logger.Warn("target_exam_count exceeds the question pool; questions will repeat across exams", "target_exam_count", plan.NumExams)
+	}
+	var targetExamCount *int
+	if metadata.TargetExamCount > 0 {
+		targetExamCount = &metadata.TargetExamCount
+	}
+	domainWeightsJSON, err := json.Marshal(metadata.Domains)
+	if err != nil {
+		return fmt.Errorf("failed to marshal domain weights for course %d: %w", courseID, err)
+	}
+	// Clear and regenerate inside one transaction so a failure midway leaves the previous exams intact
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin exam generation transaction for course %d: %w", courseID, err)
+	}
+	defer tx.Rollback(ctx) // Rollback on error
 	// Clear existing exams and exam_questions for this course and exam_bank_version
 	// This prevents old exam data from interfering and ensures fresh generation.
-	_, err = pool.Exec(context.Background(), `
-		DELETE FROM exam_questions WHERE exam_id IN (SELECT id FROM exams WHERE course_id = $1 AND exam_bank_version = $2);
-		DELETE FROM exams WHERE course_id = $1 AND exam_bank_version = $2;
-	`, courseID, examBankVersion)
+	for _, stmt := range cleanupStatements {
+		if _, err := tx.Exec(ctx, stmt, courseID, examBankVersion); err != nil {
+			return fmt.Errorf("failed to clear existing exams and exam_questions for course %d, version %s: %w", courseID, examBankVersion, err)
+		}
+	}
+	// Instructor titles survive regeneration; they are keyed by the exam's bank and position in its plan
+	titleOverrides := make(map[int]string)
+	bankName := BankName(examBankVersion)
+	overrideRows, err := tx.Query(ctx, `SELECT exam_number, title FROM exam_title_overrides WHERE course_id = $1 AND bank_name = $2`, courseID, bankName)
 	if err != nil {
-		return fmt.Errorf("failed to clear existing exams and exam_questions for course %d, version %s: %w", courseID, examBankVersion, err)
+		return fmt.Errorf("failed to load exam title overrides for course %d: %w", courseID, err)
+	}
+	for overrideRows.Next() {
+		var examNumber int
+		var title string
+		if err := overrideRows.Scan(&examNumber, &title); err != nil {
+			overrideRows.Close()
+			return fmt.Errorf("failed to scan exam title override for course %d: %w", courseID, err)
+		}
+		titleOverrides[examNumber] = title
 	}
+	overrideRows.Close()
 	// Generate individual exams
 	for i := 0; i < plan.NumExams; i++ {
 		examTitle := fmt.Sprintf("%s Practice Exam %d", courseMarketingName, i+1)
+		if bankName != "" {
+			examTitle = fmt.Sprintf("%s %s Practice Exam %d", courseMarketingName, bankName, i+1)
+		}
+		overrideTitle, titleOverride := titleOverrides[i+1]
 		// Create a deterministic seed for this exam based on version, course, and exam index
 		seedStr := fmt.Sprintf("%s:%s:%d", examBankVersion, courseMarketingName, i)
 		hasher := sha256.New()
 		hasher.Write([]byte(seedStr))
 		seed := int64(utils.BytesToInt(hasher.Sum(nil)))
-		log.Printf("Generating exam '%s' with seed %d", examTitle, seed)
-		selectedQuestions, err := selectQuestionsForExam(questions, plan.PerDomainPerExam, seed)
+		logger.Info("Generating exam", "title", examTitle, "seed", seed)
+		selectedQuestions, err := selectQuestionsForExam(questions, plan.PerDomainPerExam, seed, selectionStrategy)
 		if err != nil {
 			db.LogError(pool, "exam_generation", courseMarketingName, "", 0, "", "Failed to select questions for exam", fmt.Sprintf("Exam: %s, Error: %v", examTitle, err))
 			return fmt.Errorf("failed to select questions for exam %s: %w", examTitle, err)
@@ -62,18 +156,18 @@ func GenerateExamsForCourse(pool *pgxpool.Pool, courseID int, courseMarketingNam
 			return fmt.Errorf("generated exam question count mismatch for %s", examTitle)
 		}
 		// Insert the exam into the database
-		domainWeightsJSON, err := json.Marshal(metadata.Domains)
-		if err != nil {
-			return fmt.Errorf("failed to marshal domain weights for exam %s: %w", examTitle, err)
-		}
 		var examID int
-		err = pool.QueryRow(context.Background(), `
-			INSERT INTO exams (course_id, title, exam_bank_version, min_questions, max_questions, exam_time, passing_score, domain_weights)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id
-		`, courseID, examTitle, examBankVersion, metadata.MinQuestions, metadata.MaxQuestions, metadata.ExamTime, metadata.PassingScore, domainWeightsJSON).Scan(&examID)
+		storedTitle := examTitle
+		if titleOverride {
+			storedTitle = overrideTitle
+		}
+		err = tx.QueryRow(ctx, `
+			INSERT INTO exams (course_id, title, exam_bank_version, min_questions, max_questions, exam_time, passing_score, domain_weights, allow_practice, allow_simulation, exam_number, title_override, target_exam_count, penalty_per_wrong, instructions, fuzzy_accept_distance)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NULLIF($15, ''), $16) RETURNING id
+		`, courseID, storedTitle, examBankVersion, metadata.MinQuestions, metadata.MaxQuestions, metadata.ExamTime, metadata.PassingScore, domainWeightsJSON, metadata.AllowPractice, metadata.AllowSimulation, i+1, titleOverride, targetExamCount, metadata.PenaltyPerWrong, metadata.Instructions, metadata.FuzzyAcceptDistance).Scan(&examID)
 		if err != nil {
-			db.LogError(pool, "exam_generation", courseMarketingName, "", 0, "", "Failed to insert exam", fmt.Sprintf("Exam: %s, Error: %v", examID, err))
-			return fmt.Errorf("failed to insert exam %s: %w", examID, err)
+			db.LogError(pool, "exam_generation", courseMarketingName, "", 0, "", "Failed to insert exam", fmt.Sprintf("Exam: %s, Error: %v", examTitle, err))
+			return fmt.Errorf("failed to insert exam %s: %w", examTitle, err)
 		}
 		// Insert exam_questions
 		// Randomize order within the exam after selection
@@ -82,7 +176,7 @@ func GenerateExamsForCourse(pool *pgxpool.Pool, courseID int, courseMarketingNam
 			selectedQuestions[i], selectedQuestions[j] = selectedQuestions[j], selectedQuestions[i]
 		})
 		for qOrder, q := range selectedQuestions {
-			_, err := pool.Exec(context.Background(), `
+			_, err := tx.Exec(ctx, `
 				INSERT INTO exam_questions (exam_id, question_id, question_order, exam_bank_version)
 				VALUES ($1, $2, $3, $4)
 			`, examID, q.ID, qOrder+1, examBankVersion) // question_order starts from 1
@@ -91,30 +185,129 @@ func GenerateExamsForCourse(pool *pgxpool.Pool, courseID int, courseMarketingNam
 				return fmt.Errorf("failed to insert exam question %d for exam %d: %w", q.ID, examID, err)
 			}
 		}
-		log.Printf("Successfully generated exam '%s' with %d questions.", examTitle, len(selectedQuestions))
+		logger.Info("Successfully generated exam", "title", examTitle, "questions", len(selectedQuestions))
+	}
+	if err := tx.Commit(ctx); err != nil {
+		db.LogError(pool, "exam_generation", courseMarketingName, "", 0, "", "Failed to commit exam generation", fmt.Sprintf("Database error: %v", err))
+		return fmt.Errorf("failed to commit exam generation for course %d, version %s: %w", courseID, examBankVersion, err)
 	}
-	log.Printf("Finished exam generation for course ID: %d, Version: %s", courseID, examBankVersion)
+	logger.Info("Finished exam generation")
 	return nil
 }
+// cleanupStatements clear a course's exams of an exam_bank_version before generation, exam_questions first.
+// The deletes run as separate statements; a parameterized Exec runs a single statement.
+var cleanupStatements = []string{
+	`DELETE FROM exam_questions WHERE exam_id IN (SELECT id FROM exams WHERE course_id = $1 AND exam_bank_version = $2)`,
+	`DELETE FROM exams WHERE course_id = $1 AND exam_bank_version = $2`,
+}
+// requiredForDomain is the number of questions a domain contributes to an exam of qPerExam questions;
+// a weighted domain always contributes at least one.
+func requiredForDomain(qPerExam int, weight float64) int {
+	required := int(math.Round(float64(qPerExam) * weight))
+	if required == 0 && weight > 0 {
+		required = 1
+	}
+	return required
+}
+// DomainShortages lists, in domain name order, the domains that cannot fill an exam of minQ questions.
+func DomainShortages(questions []GenerationQuestion, minQ int, domainWeights map[string]float64) []models.DomainShortage {
+	domainCounts := make(map[string]int)
+	for _, q := range questions {
+		domainCounts[q.DomainName]++
+	}
+	var shortages []models.DomainShortage
+	for domain, weight := range domainWeights {
+		if required := requiredForDomain(minQ, weight); domainCounts[domain] < required {
+			shortages = append(shortages, models.DomainShortage{Domain: domain, Available: domainCounts[domain], Required: required})
+		}
+	}
+	sort.Slice(shortages, func(i, j int) bool { return shortages[i].Domain < shortages[j].Domain })
+	return shortages
+}
+// LimitingDomains returns, in name order, the domains whose question count bounds plan.NumExams:
+// those that can fill the fewest exams at their per-exam requirement.
+func LimitingDomains(questions []GenerationQuestion, plan models.ExamPlan) []string {
+	domainCounts := make(map[string]int)
+	for _, q := range questions {
+		domainCounts[q.DomainName]++
+	}
+	fewest := -1
+	var limiting []string
+	for domain, perExam := range plan.PerDomainPerExam {
+		if perExam == 0 {
+			continue
+		}
+		exams := domainCounts[domain] / perExam
+		switch {
+		case fewest == -1 || exams < fewest:
+			fewest = exams
+			limiting = []string{domain}
+		case exams == fewest:
+			limiting = append(limiting, domain)
+		}
+	}
+	sort.Strings(limiting)
+	return limiting
+}
+// Tie-breaks between exam plans that leave the same number of questions over, chosen by the
+// exam_plan_tie_break setting.
+const (
+	PlanTieBreakExamCount     = "exam_count"     // More exams first, then the plan closest to the domain weights
+	PlanTieBreakDomainBalance = "domain_balance" // The plan closest to the domain weights first, then more exams
+)
+// deviationEpsilon absorbs floating point noise when comparing domain deviations.
+const deviationEpsilon = 1e-9
+// LoadPlanTieBreak reads the exam_plan_tie_break setting, falling back to PlanTieBreakExamCount for
+// missing or unknown values.
+func LoadPlanTieBreak(ctx context.Context, pool *pgxpool.Pool) string {
+	tieBreak, err := db.GetSettingCached(pool, "exam_plan_tie_break")
+	if err != nil || tieBreak == "" {
+		return PlanTieBreakExamCount
+	}
+	if tieBreak != PlanTieBreakExamCount && tieBreak != PlanTieBreakDomainBalance {
+		utils.LoggerFromContext(ctx).Warn("Unknown exam_plan_tie_break, using the default", "value", tieBreak, "default", PlanTieBreakExamCount)
+		return PlanTieBreakExamCount
+	}
+	return tieBreak
+}
+// domainDeviation is the sum over domains of the squared difference between a domain's share of the
+// exam and its declared weight; lower values are more faithful to the weights.
+func domainDeviation(perDomain map[string]int, questionsPerExam int, domainWeights map[string]float64) float64 {
+	deviation := 0.0
+	for domain, weight := range domainWeights {
+		diff := float64(perDomain[domain])/float64(questionsPerExam) - weight
+		deviation += diff * diff
+	}
+	return deviation
+}
 // GenerateExamPlan determines the optimal number of questions per exam and number of exams.
-func GenerateExamPlan(questions []models.Question, minQ, maxQ int, domainWeights map[string]float64) (models.ExamPlan, error) {
+// Domain counts are taken from questions, so questions excluded before planning (drafts, flagged) are not counted.
+// Without a target, it minimizes leftover questions; among plans with the same leftover, tieBreak
+// (PlanTieBreakExamCount or PlanTieBreakDomainBalance) orders maximizing the number of exams and
+// minimizing the deviation from the domain weights (see domainDeviation). A positive
+// targetExamCount fixes the number of exams instead: the longest exam that fits the pool without reusing
+// questions across exams is chosen, or, when none fits, the shortest valid exam, with ReuseAcrossExams set;
+// equally long exams are decided by the lower domain deviation.
+func GenerateExamPlan(questions []GenerationQuestion, minQ, maxQ int, domainWeights map[string]float64, targetExamCount int, tieBreak string) (models.ExamPlan, error) {
+	// Questions of zero-weight (holding) domains are never selected, so they do not count toward the exams
 	domainCounts := make(map[string]int)
+	totalQuestions := 0
 	for _, q := range questions {
-		domainCounts[q.QuestionDomainName]++ // Assumes Question struct has a field QuestionDomainName
+		domainCounts[q.DomainName]++
+		if domainWeights[q.DomainName] > 0 {
+			totalQuestions++
+		}
 	}
-	totalQuestions := len(questions)
 	var bestPlan models.ExamPlan
 	bestRemainder := totalQuestions // Initialize with worst case
 	bestNumExams := 0
+	bestDeviation := 0.0
 	for qPerExam := minQ; qPerExam <= maxQ; qPerExam++ {
 		currentPerDomainPerExam := make(map[string]int)
 		isValidPlan := true
 		actualQuestionsInPlan := 0
 		for domain, weight := range domainWeights {
-			required := int(math.Round(float64(qPerExam) * weight))
-			if required == 0 && weight > 0 { // Ensure at least 1 question if weight > 0 and qPerExam > 0
-				required = 1
-			}
+			required := requiredForDomain(qPerExam, weight) // At least 1 question if weight > 0
 			if domainCounts[domain] < required {
 				// This 'qPerExam' value is not possible due to insufficient questions in this domain.
 				// This scenario should reduce the range of qPerExam or indicate failure.
@@ -137,9 +330,41 @@ func GenerateExamPlan(questions []models.Question, minQ, maxQ int, domainWeights
 		}
 		numExamsForThisQ := totalQuestions / questionsUsedForThisQ
 		remainderForThisQ := totalQuestions % questionsUsedForThisQ
-		// Criteria: lowest remainder, then highest numExams
-		if remainderForThisQ < bestRemainder || (remainderForThisQ == bestRemainder && numExamsForThisQ > bestNumExams) {
+		deviation := domainDeviation(currentPerDomainPerExam, questionsUsedForThisQ, domainWeights)
+		if targetExamCount > 0 {
+			fits := numExamsForThisQ >= targetExamCount
+			bestFits := !bestPlan.ReuseAcrossExams
+			better := bestPlan.QuestionsPerExam == 0 || (fits && !bestFits) ||
+				(fits == bestFits && fits && questionsUsedForThisQ > bestPlan.QuestionsPerExam) ||
+				(fits == bestFits && !fits && questionsUsedForThisQ < bestPlan.QuestionsPerExam) ||
+				(fits == bestFits && questionsUsedForThisQ == bestPlan.QuestionsPerExam && deviation < bestDeviation-deviationEpsilon)
+			if better {
+				bestDeviation = deviation
+				bestPlan = models.ExamPlan{
+					NumExams:         targetExamCount,
+					QuestionsPerExam: questionsUsedForThisQ,
+					PerDomainPerExam: currentPerDomainPerExam,
+					ReuseAcrossExams: !fits,
+				}
+			}
+			continue
+		}
+		// Criteria: lowest remainder, then highest numExams and lowest deviation in tieBreak order
+		better := remainderForThisQ < bestRemainder
+		if !better && remainderForThisQ == bestRemainder {
+			moreExams := numExamsForThisQ > bestNumExams
+			sameExams := numExamsForThisQ == bestNumExams
+			moreBalanced := deviation < bestDeviation-deviationEpsilon
+			sameBalance := !moreBalanced && deviation <= bestDeviation+deviationEpsilon
+			if tieBreak == PlanTieBreakDomainBalance {
+				better = moreBalanced || (sameBalance && moreExams)
+			} else {
+				better = moreExams || (sameExams && moreBalanced)
+			}
+		}
+		if better {
 			bestRemainder = remainderForThisQ
+			bestDeviation = deviation
 			bestQuestionsPerExam := questionsUsedForThisQ
 			bestNumExams = numExamsForThisQ
 			bestPlan = models.ExamPlan{
@@ -155,32 +380,43 @@ func GenerateExamPlan(questions []models.Question, minQ, maxQ int, domainWeights
 	return bestPlan, nil
 }
 // selectQuestionsForExam selects a set of questions for a single exam, ensuring no reuse within the exam.
-func selectQuestionsForExam(allQuestions []models.Question, perDomainRequired map[string]int, seed int64) ([]models.Question, error) {
-	selected := make([]models.Question, 0, len(allQuestions))
+// Domains are visited in name order so the same seed always yields the same selection.
+func selectQuestionsForExam(allQuestions []GenerationQuestion, perDomainRequired map[string]int, seed int64, selectionStrategy string) ([]GenerationQuestion, error) {
+	selected := make([]GenerationQuestion, 0, len(allQuestions))
 	usedQuestionIDs := make(map[int]bool)
 	// Group questions by domain
-	questionsByDomain := make(map[string][]models.Question)
+	questionsByDomain := make(map[string][]GenerationQuestion)
 	for _, q := range allQuestions {
-		questionsByDomain[q.QuestionDomainName] = append(questionsByDomain[q.QuestionDomainName], q)
+		questionsByDomain[q.DomainName] = append(questionsByDomain[q.DomainName], q)
 	}
 	r := rand.New(rand.NewSource(seed)) // Use the deterministic seed
-	for domain, count := range perDomainRequired {
+	domains := make([]string, 0, len(perDomainRequired))
+	for domain := range perDomainRequired {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		count := perDomainRequired[domain]
 		available := questionsByDomain[domain]
-		currentDomainSelections := make([]models.Question, 0, count)
+		currentDomainSelections := make([]GenerationQuestion, 0, count)
 		// Filter out already used questions and shuffle available questions for this domain
-		shuffledAvailable := make([]models.Question, 0, len(available))
+		shuffledAvailable := make([]GenerationQuestion, 0, len(available))
 		for _, q := range available {
 			if !usedQuestionIDs[q.ID] {
 				shuffledAvailable = append(shuffledAvailable, q)
 			}
 		}
-		// Shuffle the filtered list using the exam-specific random source
-		r.Shuffle(len(shuffledAvailable), func(i, j int) {
-			shuffledAvailable[i], shuffledAvailable[j] = shuffledAvailable[j], shuffledAvailable[i]
-		})
 		if len(shuffledAvailable) < count {
 			return nil, fmt.Errorf("not enough unique questions in domain '%s' (available: %d, required: %d)", domain, len(shuffledAvailable), count)
 		}
+		if selectionStrategy == SelectionValidityWeighted {
+			shuffledAvailable = weightedSample(shuffledAvailable, count, r)
+		} else {
+			// Shuffle the filtered list using the exam-specific random source
+			r.Shuffle(len(shuffledAvailable), func(i, j int) {
+				shuffledAvailable[i], shuffledAvailable[j] = shuffledAvailable[j], shuffledAvailable[i]
+			})
+		}
 		// Select the required number of questions
 		for i := 0; i < count; i++ {
 			q := shuffledAvailable[i]
@@ -193,51 +429,107 @@ func selectQuestionsForExam(allQuestions []models.Question, perDomainRequired ma
 }
 // GetQuestionsByCourseAndVersion fetches questions for a given course ID and exam bank version.
 // This is crucial for the exam generation process to operate on the correct set of questions.
-func GetQuestionsByCourseAndVersion(pool *pgxpool.Pool, courseID int, examBankVersion string) ([]models.Question, error) {
+// Domains mapped to a shared bank in course_shared_domains also receive the source course's
+// questions in the same-named domain, with SourceCourseCode set. Only the source's current versions
+// are drawn, those of its exams that are neither retired nor samples (as in LatestBankVersions).
+// With excludeFlagged, questions an admin has flagged are left out.
+func GetQuestionsByCourseAndVersion(ctx context.Context, pool *pgxpool.Pool, courseID int, examBankVersion string, excludeFlagged bool) ([]GenerationQuestion, error) {
 	query := `
 		SELECT
-			q.id, q.question_text, q.explanation, q.question_type, q.image_url, q.code_block, q.input_method, q.exam_bank_version,
-			d.name AS domain_name -- Join to get domain name
+			q.id, q.question_text, q.explanation, q.question_type, q.image_url, q.code_block, q.input_method, q.exam_bank_version, q.validity_score,
+			d.name AS domain_name, -- Join to get domain name
+			CASE WHEN d.course_id = $1 THEN '' ELSE c.course_code END AS source_course_code
 		FROM questions q
 		JOIN domains d ON q.domain_id = d.id
-		WHERE d.course_id = $1 AND q.exam_bank_version = $2
+		JOIN courses c ON d.course_id = c.id
+		WHERE ((d.course_id = $1 AND q.exam_bank_version = $2)
+		OR EXISTS (
+			SELECT 1 FROM course_shared_domains csd
+			WHERE csd.course_id = $1 AND csd.source_course_id = d.course_id AND csd.domain_name = d.name
+		) AND EXISTS ( -- Only the source's current versions, those of its live exams, not superseded ones
+			SELECT 1 FROM exams se
+			WHERE se.course_id = d.course_id AND se.exam_bank_version = q.exam_bank_version AND se.retired_at IS NULL AND NOT se.sample
+		))
+		AND NOT q.draft -- Drafts may lack a correct answer
+		AND (NOT $3 OR COALESCE(q.flagged, FALSE) = FALSE)
+		ORDER BY q.id -- Stable input order keeps seeded selection reproducible
 	`
-	rows, err := pool.Query(context.Background(), query, courseID, examBankVersion)
+	rows, err := pool.Query(ctx, query, courseID, examBankVersion, excludeFlagged)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query questions for course %d, version %s: %w", courseID, examBankVersion, err)
 	}
 	defer rows.Close()
-	var questions []models.Question
+	var questions []GenerationQuestion
 	for rows.Next() {
-		var q models.Question
-		var domainName string
-		// Scan directly into question struct and domain name
+		var q GenerationQuestion
 		if err := rows.Scan(
-			&q.ID, &q.QuestionText, &q.Explanation, &q.QuestionType, &q.ImageURL, &q.CodeBlock, &q.InputMethod, &q.ExamBankVersion,
-			&domainName,
+			&q.ID, &q.QuestionText, &q.Explanation, &q.QuestionType, &q.ImageURL, &q.CodeBlock, &q.InputMethod, &q.ExamBankVersion, &q.ValidityScore,
+			&q.DomainName, &q.SourceCourseCode,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan question row: %w", err)
 		}
-		q.QuestionDomainName = domainName // Set the domain name for internal use
 		questions = append(questions, q)
 	}
 	return questions, nil
 }
+// validityCohorts splits attempts, ordered by score_percent, into the IDs of the low-scoring threshold
+// fraction (question_validity_threshold) and of all the others, the high-scoring cohort.
+func validityCohorts(attempts []models.ExamAttempt, threshold float64) (low, high []int) {
+    bottomIndex := int(float64(len(attempts)) * threshold) // Bottom N% of scores
+    bottomIndex = max(0, min(bottomIndex, len(attempts))) // A misconfigured threshold leaves one cohort empty
+    low = make([]int, 0, bottomIndex)
+    high = make([]int, 0, len(attempts)-bottomIndex)
+    for i, attempt := range attempts {
+        if i < bottomIndex {
+            low = append(low, attempt.ID)
+        } else {
+            high = append(high, attempt.ID)
+        }
+    }
+    return low, high
+}
+// validityBatches splits the question IDs minID to maxID into inclusive ranges of batchSize IDs, the last
+// one possibly shorter. A batchSize of 0 or less gives a single range; maxID below minID gives none.
+func validityBatches(minID, maxID, batchSize int) [][2]int {
+    if maxID < minID {
+        return nil
+    }
+    if batchSize <= 0 {
+        return [][2]int{{minID, maxID}}
+    }
+    batches := make([][2]int, 0, (maxID-minID)/batchSize+1)
+    for start := minID; start <= maxID; start += batchSize {
+        batches = append(batches, [2]int{start, min(start+batchSize-1, maxID)})
+    }
+    return batches
+}
 // UpdateQuestionValidityScores calculates and updates the validity_score for questions.
 // This is a daily background job.
-func UpdateQuestionValidityScores(pool *pgxpool.Pool) error {
-    log.Println("Starting validity score calculation...")
-    // Get the threshold for low-scoring students from settings
-    thresholdStr, err := db.GetSetting(pool, "question_validity_threshold")
-    if err != nil {
-        log.Printf("Warning: Could not get validity threshold setting, defaulting to 0.25: %v", err)
-        thresholdStr = "0.25"
+func UpdateQuestionValidityScores(ctx context.Context, pool *pgxpool.Pool) error {
+    return updateQuestionValidityScores(ctx, pool, nil)
+}
+// UpdateQuestionValidityScoresForCourse recalculates validity scores for one course's questions,
+// using only attempts on that course's exams. It runs after the course is ingested; questions
+// shared with other courses get their full-cohort score back from the daily global job.
+func UpdateQuestionValidityScoresForCourse(ctx context.Context, pool *pgxpool.Pool, courseID int) error {
+    return updateQuestionValidityScores(ctx, pool, &courseID)
+}
+// updateQuestionValidityScores scores every question, or when courseID is set, only that course's
+// questions against the attempts on its exams.
+func updateQuestionValidityScores(ctx context.Context, pool *pgxpool.Pool, courseID *int) error {
+    logger := utils.LoggerFromContext(ctx)
+    if courseID != nil {
+        logger = logger.With("course_id", *courseID)
     }
-    threshold, err := strconv.ParseFloat(thresholdStr, 64)
-    if err != nil {
-        log.Printf("Warning: Invalid validity threshold setting '%s', defaulting to 0.25: %v", thresholdStr, err)
-        threshold = 0.25
+    logger.Info("Starting validity score calculation")
+    // Attempts scored before answer correctness was stored would otherwise count as all incorrect
+    if filled, err := BackfillAnswerCorrectness(ctx, pool); err != nil {
+        logger.Error("Error backfilling answer correctness", "error", err)
+    } else if filled > 0 {
+        logger.Info("Stored answer correctness for earlier attempts", "attempts", filled)
     }
+    // Get the threshold for low-scoring students from settings
+    threshold := db.GetSettingFloat(pool, "question_validity_threshold", 0.25)
     // Step 1: Identify high-scoring (top 75%) and low-scoring (bottom 25%) attempts
     // This is a simplified approach. A more robust system would define cohorts
     // based on full exam scores or other criteria.
@@ -247,9 +539,10 @@ func UpdateQuestionValidityScores(pool *pgxpool.Pool) error {
         SELECT id, score_percent, email
         FROM exam_attempts
         WHERE completed_at IS NOT NULL AND score_percent IS NOT NULL
+        AND ($1::int IS NULL OR exam_id IN (SELECT id FROM exams WHERE course_id = $1))
         ORDER BY score_percent;
     `
-    rows, err := pool.Query(context.Background(), attemptsQuery)
+    rows, err := pool.Query(ctx, attemptsQuery, courseID)
     if err != nil {
         return fmt.Errorf("failed to query exam attempts for validity score: %w", err)
     }
@@ -263,54 +556,31 @@ func UpdateQuestionValidityScores(pool *pgxpool.Pool) error {
         allAttempts = append(allAttempts, attempt)
     }
     if len(allAttempts) < 10 { // Need a minimum number of attempts to calculate meaningful stats
-        log.Println("Not enough exam attempts to calculate validity scores. Skipping.")
+        logger.Info("Not enough exam attempts to calculate validity scores; skipping", "attempts", len(allAttempts))
         return nil
     }
-    // Sort by score percent to determine quartiles
     // allAttempts is already ordered by score_percent from the query
-    // Calculate quartile indices
-    numAttempts := len(allAttempts)
-    // top75PercentIndex := int(float64(numAttempts) * 0.25) // Top 25% of scores (indices from end)
-    bottom25PercentIndex := int(float64(numAttempts) * threshold) // Bottom N% of scores
-    // Collect IDs of high and low scoring attempts
-    lowScoringAttemptIDs := make([]int, 0, bottom25PercentIndex)
-    highScoringAttemptIDs := make([]int, 0, numAttempts-bottom25PercentIndex) // Using all above bottom 25% as 'high'
-    
-    for i, attempt := range allAttempts {
-        if i < bottom25PercentIndex {
-            lowScoringAttemptIDs = append(lowScoringAttemptIDs, attempt.ID)
-        } else {
-            highScoringAttemptIDs = append(highScoringAttemptIDs, attempt.ID)
-        }
-    }
+    lowScoringAttemptIDs, highScoringAttemptIDs := validityCohorts(allAttempts, threshold)
     if len(lowScoringAttemptIDs) == 0 || len(highScoringAttemptIDs) == 0 {
-        log.Println("Insufficient high/low scoring attempts to calculate validity scores. Skipping.")
+        logger.Info("Insufficient high/low scoring attempts to calculate validity scores; skipping")
         return nil
     }
-    // Calculate correctness for each question for high/low scoring groups
-    // This is a complex query to get correctness per question for high/low scorers
-    // Correctness is 1 if all correct choices are selected and no incorrect choices are selected (MCQ)
-    // or if text_answer matches acceptable_answers (Fill-in-the-Blank).
-    // For simplicity and performance, this query will calculate
+    // Calculate correctness for each question for high/low scoring groups, as stored by StoreAnswerCorrectness
+    // when the attempts were scored. This query will calculate
     // (correct_count_high - correct_count_low) / total_attempts_high_low
-    log.Printf("Calculating validity for %d attempts...", len(allAttempts))
+    logger.Info("Calculating validity", "attempts", len(allAttempts))
     updateQuery := `
         WITH QuestionCorrectness AS (
             SELECT
                 eq.question_id,
                 ua.attempt_id,
-                CASE
-                    WHEN q.question_type IN ('single', 'multi', 'truefalse') THEN
-                        -- Check if user selected all correct choices and no incorrect choices
-                        (SELECT COUNT(c.id) FROM choices c WHERE c.question_id = q.id AND c.is_correct = TRUE) = CARDINALITY(ua.choice_ids) AND
-                        (SELECT COUNT(c.id) FROM choices c WHERE c.question_id = q.id AND c.is_correct = FALSE AND c.id = ANY(ua.choice_ids)) = 0
-                    WHEN q.question_type = 'fillblank' THEN
-                        EXISTS (SELECT 1 FROM fill_blank_answers fba WHERE fba.question_id = q.id AND LOWER(fba.acceptable_answer) = LOWER(ua.text_answer))
-                    ELSE FALSE
-                END AS is_correct
+                COALESCE(ua.is_correct, FALSE) AS is_correct
             FROM user_answers ua
             JOIN exam_questions eq ON ua.exam_question_id = eq.id
             JOIN questions q ON eq.question_id = q.id
+            JOIN domains d ON q.domain_id = d.id
+            WHERE ($3::int IS NULL OR d.course_id = $3)
+            AND eq.question_id BETWEEN $4 AND $5
         ),
         QuestionPerformance AS (
             SELECT
@@ -334,15 +604,26 @@ func UpdateQuestionValidityScores(pool *pgxpool.Pool) error {
     // Convert []int to pgx-compatible array
     lowScoringIDs := "{" + strings.Trim(strings.Join(strings.Fields(fmt.Sprint(lowScoringAttemptIDs)), ","), "[]") + "}"
     highScoringIDs := "{" + strings.Trim(strings.Join(strings.Fields(fmt.Sprint(highScoringAttemptIDs)), ","), "[]") + "}"
-    _, err = pool.Exec(context.Background(), updateQuery, highScoringIDs, lowScoringIDs)
+    // The update runs over question ID ranges of validity_update_batch_size, each statement its own
+    // transaction, so a large bank is never locked as a whole while ingestion and sessions need it
+    var minQuestionID, maxQuestionID int
+    err = pool.QueryRow(ctx, `
+        SELECT COALESCE(MIN(q.id), 0), COALESCE(MAX(q.id), -1)
+        FROM questions q
+        JOIN domains d ON q.domain_id = d.id
+        WHERE ($1::int IS NULL OR d.course_id = $1)
+    `, courseID).Scan(&minQuestionID, &maxQuestionID)
     if err != nil {
-        return fmt.Errorf("failed to update question validity scores: %w", err)
+        return fmt.Errorf("failed to query question ID range for validity scores: %w", err)
+    }
+    batchSize := db.GetSettingInt(pool, "validity_update_batch_size", 500)
+    for _, batch := range validityBatches(minQuestionID, maxQuestionID, batchSize) {
+        _, err = pool.Exec(ctx, updateQuery, highScoringIDs, lowScoringIDs, courseID, batch[0], batch[1])
+        if err != nil {
+            return fmt.Errorf("failed to update question validity scores for question IDs %d-%d: %w", batch[0], batch[1], err)
+        }
     }
-    log.Println("Validity score calculation completed.")
+    logger.Info("Validity score calculation completed")
     return nil
 }
-// Dummy struct for domain names in Question. This should ideally be handled by fetching the domain name during retrieval from DB.
-type QuestionWithDomain struct {
-    models.Question
-    QuestionDomainName string `json:"question_domain_name"` // For internal use in exam generation
-}
+
@@ -0,0 +1,496 @@
+
+package exam
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db/dbtest"
+	"recap-server/models"
+)
+func TestCleanupStatements(t *testing.T) {
+	wantTables := []string{"exam_questions", "exams"}
+	if len(cleanupStatements) != len(wantTables) {
+		t.Fatalf("len(cleanupStatements) = %d, want %d", len(cleanupStatements), len(wantTables))
+	}
+	for i, stmt := range cleanupStatements {
+		t.Run(wantTables[i], func(t *testing.T) {
+			if strings.Contains(stmt, ";") || strings.Count(stmt, "DELETE FROM") != 1 {
+				t.Errorf("statement %d is not a single DELETE: %s", i, stmt)
+			}
+			if !strings.HasPrefix(stmt, "DELETE FROM "+wantTables[i]+" ") {
+				t.Errorf("statement %d = %q, want it to clear %s", i, stmt, wantTables[i])
+			}
+			if !strings.Contains(stmt, "exam_bank_version = $2") {
+				t.Errorf("statement %d is not scoped to the exam_bank_version: %s", i, stmt)
+			}
+		})
+	}
+}
+// generationQuestions returns count questions of domain, with IDs from firstID on.
+func generationQuestions(domain string, firstID, count int) []GenerationQuestion {
+	questions := make([]GenerationQuestion, count)
+	for i := range questions {
+		questions[i].ID = firstID + i
+		questions[i].DomainName = domain
+	}
+	return questions
+}
+func TestSelectQuestionsForExam(t *testing.T) {
+	questions := append(generationQuestions("networking", 1, 4), generationQuestions("storage", 101, 2)...)
+	tests := []struct {
+		name      string
+		perDomain map[string]int
+		wantErr   string
+	}{
+		{"every domain covered", map[string]int{"networking": 3, "storage": 2}, ""},
+		{"whole pool", map[string]int{"networking": 4, "storage": 2}, ""},
+		{"domain short of questions", map[string]int{"networking": 3, "storage": 3}, "not enough unique questions in domain 'storage'"},
+		{"domain without questions", map[string]int{"networking": 1, "security": 1}, "not enough unique questions in domain 'security'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := selectQuestionsForExam(questions, tt.perDomain, 7, SelectionUniform)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("selectQuestionsForExam error = %v, want one containing %q", err, tt.wantErr)
+				}
+				if selected != nil {
+					t.Fatalf("selectQuestionsForExam returned %d questions with its error, want none", len(selected))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectQuestionsForExam error = %v", err)
+			}
+			counts := make(map[string]int)
+			seen := make(map[int]bool)
+			for _, q := range selected {
+				if seen[q.ID] {
+					t.Fatalf("question %d selected twice", q.ID)
+				}
+				seen[q.ID] = true
+				counts[q.DomainName]++
+			}
+			for domain, want := range tt.perDomain {
+				if counts[domain] != want {
+					t.Errorf("%s questions = %d, want %d", domain, counts[domain], want)
+				}
+			}
+		})
+	}
+}
+func TestSelectQuestionsForExamIsDeterministic(t *testing.T) {
+	questions := append(generationQuestions("networking", 1, 10), generationQuestions("storage", 101, 10)...)
+	perDomain := map[string]int{"networking": 4, "storage": 3}
+	for _, strategy := range []string{SelectionUniform, SelectionValidityWeighted} {
+		first, err := selectQuestionsForExam(questions, perDomain, 42, strategy)
+		if err != nil {
+			t.Fatalf("%s: selectQuestionsForExam error = %v", strategy, err)
+		}
+		again, _ := selectQuestionsForExam(questions, perDomain, 42, strategy)
+		for i := range first {
+			if first[i].ID != again[i].ID {
+				t.Fatalf("%s: selection %d differs between runs with the same seed: %d vs %d", strategy, i, first[i].ID, again[i].ID)
+			}
+		}
+	}
+}
+// scoredAttempts returns attempts with IDs 1 to n, ordered by score as updateQuestionValidityScores reads them.
+func scoredAttempts(n int) []models.ExamAttempt {
+	attempts := make([]models.ExamAttempt, n)
+	for i := range attempts {
+		score := 10 * i
+		attempts[i] = models.ExamAttempt{ID: i + 1, ScorePercent: &score}
+	}
+	return attempts
+}
+func TestValidityCohorts(t *testing.T) {
+	tests := []struct {
+		name      string
+		attempts  int
+		threshold float64
+		wantLow   []int
+		wantHigh  int
+	}{
+		{"default quarter", 12, 0.25, []int{1, 2, 3}, 9},
+		{"rounds the low cohort down", 10, 0.25, []int{1, 2}, 8},
+		{"half", 10, 0.5, []int{1, 2, 3, 4, 5}, 5},
+		{"zero threshold", 10, 0, []int{}, 10},
+		{"threshold over one", 10, 1.5, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 0},
+		{"negative threshold", 10, -0.5, []int{}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			low, high := validityCohorts(scoredAttempts(tt.attempts), tt.threshold)
+			if len(low) != len(tt.wantLow) {
+				t.Fatalf("low cohort = %v, want %v", low, tt.wantLow)
+			}
+			for i := range low {
+				if low[i] != tt.wantLow[i] {
+					t.Fatalf("low cohort = %v, want %v", low, tt.wantLow)
+				}
+			}
+			if len(high) != tt.wantHigh {
+				t.Fatalf("high cohort has %d attempts, want %d", len(high), tt.wantHigh)
+			}
+		})
+	}
+}
+func TestDomainDeviation(t *testing.T) {
+	weights := map[string]float64{"networking": 0.6, "storage": 0.4}
+	tests := []struct {
+		name      string
+		perDomain map[string]int
+		want      float64
+	}{
+		{"exact split", map[string]int{"networking": 3, "storage": 2}, 0},
+		{"even split", map[string]int{"networking": 1, "storage": 1}, 0.02},
+		{"one domain only", map[string]int{"networking": 5}, 0.32},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total := 0
+			for _, n := range tt.perDomain {
+				total += n
+			}
+			if got := domainDeviation(tt.perDomain, total, weights); got < tt.want-deviationEpsilon || got > tt.want+deviationEpsilon {
+				t.Fatalf("domainDeviation(%v) = %g, want %g", tt.perDomain, got, tt.want)
+			}
+		})
+	}
+}
+func TestGenerateExamPlanTieBreak(t *testing.T) {
+	// Every exam length from minQ to maxQ below divides the pool evenly, so all plans leave no questions
+	// over and only the tie-break decides between more exams and a split closer to the weights
+	tests := []struct {
+		name        string
+		weights     map[string]float64
+		counts      map[string]int
+		minQ, maxQ  int
+		tieBreak    string
+		wantPerExam int
+		wantExams   int
+	}{
+		{"exam count prefers more exams", map[string]float64{"networking": 0.6, "storage": 0.4}, map[string]int{"networking": 12, "storage": 8}, 2, 5, PlanTieBreakExamCount, 2, 10},
+		{"domain balance prefers the faithful split", map[string]float64{"networking": 0.6, "storage": 0.4}, map[string]int{"networking": 12, "storage": 8}, 2, 5, PlanTieBreakDomainBalance, 5, 4},
+		{"exam count, skewed weights", map[string]float64{"networking": 0.7, "storage": 0.3}, map[string]int{"networking": 14, "storage": 6}, 2, 4, PlanTieBreakExamCount, 2, 10},
+		{"domain balance, skewed weights", map[string]float64{"networking": 0.7, "storage": 0.3}, map[string]int{"networking": 14, "storage": 6}, 2, 4, PlanTieBreakDomainBalance, 4, 5},
+		{"unknown tie-break orders like exam count", map[string]float64{"networking": 0.6, "storage": 0.4}, map[string]int{"networking": 12, "storage": 8}, 2, 5, "", 2, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			questions := append(generationQuestions("networking", 1, tt.counts["networking"]), generationQuestions("storage", 101, tt.counts["storage"])...)
+			plan, err := GenerateExamPlan(questions, tt.minQ, tt.maxQ, tt.weights, 0, tt.tieBreak)
+			if err != nil {
+				t.Fatalf("GenerateExamPlan error = %v", err)
+			}
+			if plan.QuestionsPerExam != tt.wantPerExam || plan.NumExams != tt.wantExams {
+				t.Fatalf("GenerateExamPlan = %d exams of %d, want %d exams of %d", plan.NumExams, plan.QuestionsPerExam, tt.wantExams, tt.wantPerExam)
+			}
+		})
+	}
+}
+func TestGenerateExamPlanTargetExamCount(t *testing.T) {
+	weights := map[string]float64{"networking": 0.6, "storage": 0.4}
+	questions := append(generationQuestions("networking", 1, 12), generationQuestions("storage", 101, 8)...)
+	tests := []struct {
+		name        string
+		target      int
+		wantPerExam int
+		wantReuse   bool
+	}{
+		{"longest exam that fits", 2, 10, false},
+		{"tighter target", 4, 5, false},
+		{"target beyond the pool", 30, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := GenerateExamPlan(questions, 2, 10, weights, tt.target, PlanTieBreakExamCount)
+			if err != nil {
+				t.Fatalf("GenerateExamPlan error = %v", err)
+			}
+			if plan.NumExams != tt.target || plan.QuestionsPerExam != tt.wantPerExam || plan.ReuseAcrossExams != tt.wantReuse {
+				t.Fatalf("GenerateExamPlan = %d exams of %d (reuse %t), want %d exams of %d (reuse %t)",
+					plan.NumExams, plan.QuestionsPerExam, plan.ReuseAcrossExams, tt.target, tt.wantPerExam, tt.wantReuse)
+			}
+		})
+	}
+}
+func TestBankNameKeysQuestionsAcrossVersions(t *testing.T) {
+	// Validity scores carried across re-ingestion are keyed by bank name, which must not change with the
+	// schema_version and must match the SQL split_part(exam_bank_version, '+', 2)
+	tests := []struct {
+		examBankVersion string
+		schemaVersion   string
+		wantBank        string
+	}{
+		{"1.0.0", "1.0.0", ""},
+		{"1.1.0", "1.1.0", ""},
+		{"1.0.0+networking", "1.0.0", "networking"},
+		{"2.3.1+networking", "2.3.1", "networking"},
+		{"1.0.0+storage", "1.0.0", "storage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.examBankVersion, func(t *testing.T) {
+			if got := BankName(tt.examBankVersion); got != tt.wantBank {
+				t.Errorf("BankName(%q) = %q, want %q", tt.examBankVersion, got, tt.wantBank)
+			}
+			if got := BankVersion(tt.schemaVersion, tt.wantBank); got != tt.examBankVersion {
+				t.Errorf("BankVersion(%q, %q) = %q, want %q", tt.schemaVersion, tt.wantBank, got, tt.examBankVersion)
+			}
+		})
+	}
+}
+func TestValidityBatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		minID     int
+		maxID     int
+		batchSize int
+		want      [][2]int
+	}{
+		{"no questions", 0, -1, 500, nil},
+		{"one batch", 1, 300, 500, [][2]int{{1, 300}}},
+		{"exact batches", 1, 1000, 500, [][2]int{{1, 500}, {501, 1000}}},
+		{"short last batch", 101, 1100, 400, [][2]int{{101, 500}, {501, 900}, {901, 1100}}},
+		{"single question", 42, 42, 500, [][2]int{{42, 42}}},
+		{"batching disabled", 1, 1000, 0, [][2]int{{1, 1000}}},
+		{"negative batch size", 1, 1000, -5, [][2]int{{1, 1000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validityBatches(tt.minID, tt.maxID, tt.batchSize); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("validityBatches(%d, %d, %d) = %v, want %v", tt.minID, tt.maxID, tt.batchSize, got, tt.want)
+			}
+		})
+	}
+}
+func TestValidityBatchesCoverLargeBank(t *testing.T) {
+	// A synthetic bank of a million question IDs must be covered exactly once, in ranges of at most batchSize
+	const minID, maxID, batchSize = 7, 1_000_006, 500
+	batches := validityBatches(minID, maxID, batchSize)
+	if want := (maxID - minID + batchSize) / batchSize; len(batches) != want {
+		t.Fatalf("len(validityBatches) = %d, want %d", len(batches), want)
+	}
+	next := minID
+	for _, batch := range batches {
+		if batch[0] != next || batch[1] < batch[0] || batch[1]-batch[0]+1 > batchSize {
+			t.Fatalf("batch %v does not continue from %d in at most %d IDs", batch, next, batchSize)
+		}
+		next = batch[1] + 1
+	}
+	if next != maxID+1 {
+		t.Fatalf("batches end at %d, want %d", next-1, maxID)
+	}
+}
+func BenchmarkValidityBatches(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		validityBatches(1, 1_000_000, 500)
+	}
+}
+// testMetadata is the exam bank metadata of the courses stored by seedCourse: exams of 2 to 4 questions
+// from the single Networking domain.
+func testMetadata() models.ExamBankMetadata {
+	return models.ExamBankMetadata{
+		SchemaVersion:   "1.0.0",
+		MinQuestions:    2,
+		MaxQuestions:    4,
+		ExamTime:        30,
+		PassingScore:    70,
+		Domains:         map[string]float64{"Networking": 1},
+		AllowPractice:   true,
+		AllowSimulation: true,
+	}
+}
+// seedCourse stores a course with a Networking domain holding count single-answer questions of exam bank
+// version 1.0.0, each correct on its first choice, and returns the course ID.
+func seedCourse(t *testing.T, pool *pgxpool.Pool, courseCode string, count int) int {
+	t.Helper()
+	ctx := context.Background()
+	var courseID, domainID int
+	err := pool.QueryRow(ctx, `INSERT INTO courses (name, course_code, marketing_name, exam_bank_version) VALUES ($1, $2, $3, '1.0.0') RETURNING id`, courseCode, courseCode, courseCode).Scan(&courseID)
+	if err == nil {
+		err = pool.QueryRow(ctx, `INSERT INTO domains (course_id, name) VALUES ($1, 'Networking') RETURNING id`, courseID).Scan(&domainID)
+	}
+	if err != nil {
+		t.Fatalf("storing course %s: %v", courseCode, err)
+	}
+	for i := 1; i <= count; i++ {
+		var questionID int
+		err := pool.QueryRow(ctx, `
+			INSERT INTO questions (course_id, domain_id, question_text, explanation, question_type, exam_bank_version)
+			VALUES ($1, $2, $3, 'Because.', 'single', '1.0.0') RETURNING id
+		`, courseID, domainID, fmt.Sprintf("%s question %d", courseCode, i)).Scan(&questionID)
+		if err == nil {
+			_, err = pool.Exec(ctx, `INSERT INTO choices (question_id, choice_text, is_correct) VALUES ($1, 'Alpha', TRUE), ($1, 'Beta', FALSE)`, questionID)
+		}
+		if err != nil {
+			t.Fatalf("storing question %d of %s: %v", i, courseCode, err)
+		}
+	}
+	return courseID
+}
+// generateTestExams generates the exams of a course stored by seedCourse and returns the ID of the first.
+func generateTestExams(t *testing.T, pool *pgxpool.Pool, courseID int) int {
+	t.Helper()
+	ctx := context.Background()
+	if err := GenerateExamsForCourse(ctx, pool, courseID, fmt.Sprintf("Course %d", courseID), "1.0.0", testMetadata(), SelectionUniform); err != nil {
+		t.Fatalf("GenerateExamsForCourse: %v", err)
+	}
+	var examID int
+	if err := pool.QueryRow(ctx, `SELECT MIN(id) FROM exams WHERE course_id = $1`, courseID).Scan(&examID); err != nil {
+		t.Fatalf("reading generated exams: %v", err)
+	}
+	return examID
+}
+// seedAttempts stores a completed practice attempt of the exam for each score, answering every question
+// with the correct choice when correct(i) holds for the i-th attempt and a wrong one otherwise, with the
+// correctness stored as the scorer would. It returns the attempt IDs.
+func seedAttempts(t *testing.T, pool *pgxpool.Pool, examID int, scores []int, correct func(i int) bool) []int {
+	t.Helper()
+	ctx := context.Background()
+	attemptIDs := make([]int, len(scores))
+	for i, score := range scores {
+		email := fmt.Sprintf("student%d-%d@example.com", examID, i)
+		_, err := pool.Exec(ctx, `INSERT INTO students (email) VALUES ($1) ON CONFLICT DO NOTHING`, email)
+		if err == nil {
+			err = pool.QueryRow(ctx, `
+				INSERT INTO exam_attempts (exam_id, email, mode, completed_at, score_percent)
+				VALUES ($1, $2, 'practice', NOW(), $3) RETURNING id
+			`, examID, email, score).Scan(&attemptIDs[i])
+		}
+		if err == nil {
+			_, err = pool.Exec(ctx, `
+				INSERT INTO user_answers (attempt_id, exam_question_id, choice_ids, is_correct)
+				SELECT $1, eq.id, ARRAY[(SELECT c.id FROM choices c WHERE c.question_id = eq.question_id AND c.is_correct = $2 ORDER BY c.id LIMIT 1)], $2
+				FROM exam_questions eq WHERE eq.exam_id = $3
+			`, attemptIDs[i], correct(i), examID)
+		}
+		if err != nil {
+			t.Fatalf("storing attempt %d of exam %d: %v", i, examID, err)
+		}
+	}
+	return attemptIDs
+}
+// examQuestionRows lists the course's exams with their questions in order, as "exam:question:order".
+func examQuestionRows(t *testing.T, pool *pgxpool.Pool, courseID int) []string {
+	t.Helper()
+	rows, err := pool.Query(context.Background(), `
+		SELECT e.id || ':' || eq.question_id || ':' || eq.question_order
+		FROM exams e JOIN exam_questions eq ON eq.exam_id = e.id
+		WHERE e.course_id = $1
+		ORDER BY e.id, eq.question_order
+	`, courseID)
+	if err != nil {
+		t.Fatalf("reading exams of course %d: %v", courseID, err)
+	}
+	exams, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatalf("reading exams of course %d: %v", courseID, err)
+	}
+	return exams
+}
+// TestGenerateExamsForCourseRollsBackFailedInsert checks that when a later exam cannot be inserted, the
+// exams already written by the regeneration are rolled back and the course keeps its earlier exams.
+func TestGenerateExamsForCourseRollsBackFailedInsert(t *testing.T) {
+	pool := dbtest.Pool(t)
+	ctx := context.Background()
+	courseID := seedCourse(t, pool, "GEN101", 8)
+	generateTestExams(t, pool, courseID)
+	before := examQuestionRows(t, pool, courseID)
+	var examCount int
+	if err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM exams WHERE course_id = $1`, courseID).Scan(&examCount); err != nil || examCount < 2 {
+		t.Fatalf("generated %d exams (%v), want at least 2 so a later insert can fail", examCount, err)
+	}
+	// Exam 2 of the regeneration is rejected after exam 1 and its questions were inserted
+	_, err := pool.Exec(ctx, `
+		CREATE OR REPLACE FUNCTION reject_second_exam() RETURNS trigger AS $$
+		BEGIN
+			IF NEW.exam_number = 2 THEN
+				RAISE EXCEPTION 'exam 2 rejected by the test trigger';
+			END IF;
+			RETURN NEW;
+		END $$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS reject_second_exam ON exams;
+		CREATE TRIGGER reject_second_exam BEFORE INSERT ON exams FOR EACH ROW EXECUTE FUNCTION reject_second_exam();
+	`)
+	if err != nil {
+		t.Fatalf("creating the failing trigger: %v", err)
+	}
+	t.Cleanup(func() {
+		pool.Exec(context.Background(), `DROP TRIGGER IF EXISTS reject_second_exam ON exams; DROP FUNCTION IF EXISTS reject_second_exam()`)
+	})
+	err = GenerateExamsForCourse(ctx, pool, courseID, "GEN101", "1.0.0", testMetadata(), SelectionUniform)
+	if err == nil || !strings.Contains(err.Error(), "failed to insert exam") {
+		t.Fatalf("GenerateExamsForCourse with exam 2 rejected = %v, want a failed exam insert", err)
+	}
+	if after := examQuestionRows(t, pool, courseID); !reflect.DeepEqual(after, before) {
+		t.Fatalf("exams after the failed regeneration = %v, want the earlier exams %v", after, before)
+	}
+}
+// questionValidityScores returns the validity scores of the course's questions by question ID.
+func questionValidityScores(t *testing.T, pool *pgxpool.Pool, courseID int) map[int]*float64 {
+	t.Helper()
+	rows, err := pool.Query(context.Background(), `SELECT id, validity_score FROM questions WHERE course_id = $1`, courseID)
+	if err != nil {
+		t.Fatalf("reading validity scores of course %d: %v", courseID, err)
+	}
+	defer rows.Close()
+	scores := make(map[int]*float64)
+	for rows.Next() {
+		var id int
+		var score *float64
+		if err := rows.Scan(&id, &score); err != nil {
+			t.Fatalf("reading validity scores of course %d: %v", courseID, err)
+		}
+		scores[id] = score
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("reading validity scores of course %d: %v", courseID, err)
+	}
+	return scores
+}
+// TestUpdateQuestionValidityScoresForCourseIgnoresOtherCourses checks that a course's recalculation
+// neither rescores another course's questions nor lets that course's attempts into its cohorts.
+func TestUpdateQuestionValidityScoresForCourseIgnoresOtherCourses(t *testing.T) {
+	pool := dbtest.Pool(t)
+	ctx := context.Background()
+	scores := []int{0, 10, 20, 30, 40, 50, 60, 70, 80, 90}
+	courseID := seedCourse(t, pool, "VAL101", 4)
+	seedAttempts(t, pool, generateTestExams(t, pool, courseID), scores, func(i int) bool { return i >= 5 })
+	// Every answer of the other course is correct, so rescoring it would set its scores to 0
+	otherCourseID := seedCourse(t, pool, "VAL202", 4)
+	seedAttempts(t, pool, generateTestExams(t, pool, otherCourseID), scores, func(int) bool { return true })
+	if _, err := pool.Exec(ctx, `UPDATE questions SET validity_score = 0.5 WHERE course_id = $1`, otherCourseID); err != nil {
+		t.Fatalf("presetting validity scores: %v", err)
+	}
+	if err := UpdateQuestionValidityScoresForCourse(ctx, pool, courseID); err != nil {
+		t.Fatalf("UpdateQuestionValidityScoresForCourse: %v", err)
+	}
+	// The bottom 25% (the first two attempts) answered wrong; 5 of the other 8 answered right
+	want := 5.0 / 8.0
+	answered := 0
+	for id, score := range questionValidityScores(t, pool, courseID) {
+		if score == nil {
+			continue // Not on the attempted exam
+		}
+		answered++
+		if diff := *score - want; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("validity score of question %d = %v, want %v from its own course's attempts", id, *score, want)
+		}
+	}
+	if answered == 0 {
+		t.Error("no question of the recalculated course was scored")
+	}
+	for id, score := range questionValidityScores(t, pool, otherCourseID) {
+		if score == nil {
+			t.Errorf("validity score of the other course's question %d = NULL, want it left at 0.5", id)
+		} else if *score != 0.5 {
+			t.Errorf("validity score of the other course's question %d = %v, want it left at 0.5", id, *score)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+
+package exam
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+)
+// Quality band labels for question validity scores.
+const (
+	QualityExcellent = "excellent"
+	QualityGood      = "good"
+	QualityFair      = "fair"
+	QualityPoor      = "poor"
+	QualityReview    = "review"
+	QualityUnrated   = "unrated" // No validity score calculated yet
+)
+// QualityBands holds the lower validity score bound of each band, read from the settings table.
+// Scores below Poor (default 0) fall into the "review" band.
+type QualityBands struct {
+	Excellent float64
+	Good      float64
+	Fair      float64
+	Poor      float64
+}
+// qualityBandSettings maps each setting key to its default lower bound.
+var qualityBandSettings = map[string]float64{
+	"quality_band_excellent_min": 0.4,
+	"quality_band_good_min":      0.2,
+	"quality_band_fair_min":      0.1,
+	"quality_band_poor_min":      0.0,
+}
+// LoadQualityBands reads the band thresholds from settings, falling back to the defaults
+// for missing or invalid values.
+func LoadQualityBands(pool *pgxpool.Pool) QualityBands {
+	values := make(map[string]float64, len(qualityBandSettings))
+	for key, def := range qualityBandSettings {
+		values[key] = db.GetSettingFloat(pool, key, def)
+	}
+	return QualityBands{
+		Excellent: values["quality_band_excellent_min"],
+		Good:      values["quality_band_good_min"],
+		Fair:      values["quality_band_fair_min"],
+		Poor:      values["quality_band_poor_min"],
+	}
+}
+// Band returns the quality band label for a validity score.
+func (b QualityBands) Band(validityScore *float64) string {
+	if validityScore == nil {
+		return QualityUnrated
+	}
+	score := *validityScore
+	switch {
+	case score >= b.Excellent:
+		return QualityExcellent
+	case score >= b.Good:
+		return QualityGood
+	case score >= b.Fair:
+		return QualityFair
+	case score >= b.Poor:
+		return QualityPoor
+	default:
+		return QualityReview
+	}
+}
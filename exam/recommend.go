@@ -0,0 +1,85 @@
+
+package exam
+import (
+	"sort"
+)
+// Recommendation strategies returned by RecommendNextExam.
+const (
+	StrategyAdvance  = "advance"  // Passed comfortably: a harder exam
+	StrategyPractice = "practice" // Passed narrowly: another exam of similar difficulty
+	StrategyReview   = "review"   // Did not pass: the exam weighted most toward the weak domains
+)
+// ExamCandidate is an exam of the same course and version that could be recommended next.
+type ExamCandidate struct {
+	ExamID        int
+	DomainWeights map[string]float64
+	AverageScore  *float64 // Mean completed score across all students; nil if never completed
+	Completed     bool     // The student has already completed this exam
+}
+// Recommendation is the outcome of the recommendation policy.
+type Recommendation struct {
+	ExamID      int
+	Strategy    string
+	WeakDomains []string
+}
+// RecommendNextExam picks the next exam after a completed practice attempt. A score at least
+// comfortableMargin points above the passing score recommends the hardest exam (lowest average
+// score); a pass below that margin recommends another exam; a fail recommends the exam that puts
+// the most weight on the weak domains (those scored below the passing score). Exams the student has
+// not completed are preferred, and ties go to the lowest exam ID. Returns false when there are no candidates.
+func RecommendNextExam(scorePercent int, passingScore, comfortableMargin float64, domainBreakdown map[string]int, candidates []ExamCandidate) (Recommendation, bool) {
+	if len(candidates) == 0 {
+		return Recommendation{}, false
+	}
+	var weakDomains []string
+	for domain, pct := range domainBreakdown {
+		if float64(pct) < passingScore {
+			weakDomains = append(weakDomains, domain)
+		}
+	}
+	sort.Strings(weakDomains)
+	rec := Recommendation{WeakDomains: weakDomains}
+	score := float64(scorePercent)
+	switch {
+	case score >= passingScore+comfortableMargin:
+		rec.Strategy = StrategyAdvance
+	case score >= passingScore:
+		rec.Strategy = StrategyPractice
+	default:
+		rec.Strategy = StrategyReview
+	}
+	// difficulty ranks exams by average score; exams nobody has completed rank as average
+	difficulty := func(c ExamCandidate) float64 {
+		if c.AverageScore == nil {
+			return 50
+		}
+		return *c.AverageScore
+	}
+	weakWeight := func(c ExamCandidate) float64 {
+		total := 0.0
+		for _, domain := range weakDomains {
+			total += c.DomainWeights[domain]
+		}
+		return total
+	}
+	sorted := append([]ExamCandidate(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Completed != b.Completed {
+			return !a.Completed
+		}
+		switch rec.Strategy {
+		case StrategyAdvance:
+			if difficulty(a) != difficulty(b) {
+				return difficulty(a) < difficulty(b)
+			}
+		case StrategyReview:
+			if weakWeight(a) != weakWeight(b) {
+				return weakWeight(a) > weakWeight(b)
+			}
+		}
+		return a.ExamID < b.ExamID
+	})
+	rec.ExamID = sorted[0].ExamID
+	return rec, true
+}
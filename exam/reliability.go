@@ -0,0 +1,112 @@
+
+package exam
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+// minReliabilityAttempts is the number of completed simulation attempts needed before alpha is computed.
+const minReliabilityAttempts = 10
+// CronbachAlpha computes Cronbach's alpha from an item-response matrix with one row per attempt and
+// one column per item (1 correct, 0 incorrect or unanswered). Population variances are used for both
+// the items and the total scores. Returns false when there are fewer than two items or attempts, or
+// when total scores do not vary.
+func CronbachAlpha(responses [][]float64) (float64, bool) {
+	n := len(responses)
+	if n < 2 {
+		return 0, false
+	}
+	k := len(responses[0])
+	if k < 2 {
+		return 0, false
+	}
+	variance := func(values []float64) float64 {
+		mean := 0.0
+		for _, v := range values {
+			mean += v
+		}
+		mean /= float64(len(values))
+		sum := 0.0
+		for _, v := range values {
+			sum += (v - mean) * (v - mean)
+		}
+		return sum / float64(len(values))
+	}
+	totals := make([]float64, n)
+	itemVarianceSum := 0.0
+	column := make([]float64, n)
+	for j := 0; j < k; j++ {
+		for i, row := range responses {
+			column[i] = row[j]
+			totals[i] += row[j]
+		}
+		itemVarianceSum += variance(column)
+	}
+	totalVariance := variance(totals)
+	if totalVariance == 0 {
+		return 0, false
+	}
+	return float64(k) / float64(k-1) * (1 - itemVarianceSum/totalVariance), true
+}
+// ComputeReliability computes Cronbach's alpha for an exam over all of its completed simulation
+// attempts and stores it on the exams row with the number of attempts used. The stored value is
+// cleared and nil returned when there are too few attempts or alpha is undefined.
+func ComputeReliability(pool *pgxpool.Pool, examID int) (*float64, error) {
+	// One row per (attempt, exam question), graded as stored by StoreAnswerCorrectness; unanswered
+	// questions count as incorrect
+	rows, err := pool.Query(context.Background(), `
+		SELECT ea.id, eq.id, COALESCE(ua.is_correct, FALSE) AS is_correct
+		FROM exam_attempts ea
+		JOIN exam_questions eq ON eq.exam_id = ea.exam_id
+		LEFT JOIN user_answers ua ON ua.attempt_id = ea.id AND ua.exam_question_id = eq.id
+		WHERE ea.exam_id = $1 AND ea.mode = 'simulation' AND ea.completed_at IS NOT NULL
+		ORDER BY ea.id, eq.id
+	`, examID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query item responses for exam %d: %w", examID, err)
+	}
+	defer rows.Close()
+	var responses [][]float64
+	itemIndex := make(map[int]int) // exam question ID -> matrix column
+	lastAttemptID := 0
+	for rows.Next() {
+		var attemptID, examQuestionID int
+		var isCorrect bool
+		if err := rows.Scan(&attemptID, &examQuestionID, &isCorrect); err != nil {
+			return nil, fmt.Errorf("failed to scan item response for exam %d: %w", examID, err)
+		}
+		if attemptID != lastAttemptID {
+			responses = append(responses, nil)
+			lastAttemptID = attemptID
+		}
+		col, ok := itemIndex[examQuestionID]
+		if !ok {
+			col = len(itemIndex)
+			itemIndex[examQuestionID] = col
+		}
+		row := responses[len(responses)-1]
+		for len(row) <= col {
+			row = append(row, 0)
+		}
+		if isCorrect {
+			row[col] = 1
+		}
+		responses[len(responses)-1] = row
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read item responses for exam %d: %w", examID, err)
+	}
+	var reliability *float64
+	if len(responses) >= minReliabilityAttempts {
+		if alpha, ok := CronbachAlpha(responses); ok {
+			reliability = &alpha
+		}
+	}
+	_, err = pool.Exec(context.Background(), `
+		UPDATE exams SET reliability = $1, reliability_attempts = $2, reliability_updated_at = CURRENT_TIMESTAMP WHERE id = $3
+	`, reliability, len(responses), examID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store reliability for exam %d: %w", examID, err)
+	}
+	return reliability, nil
+}
@@ -0,0 +1,122 @@
+
+package exam
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/models"
+	"recap-server/utils"
+)
+// ErrSampleSize is returned by GenerateSampleExam when the requested size is not positive or exceeds the
+// questions available in the weighted domains.
+var ErrSampleSize = errors.New("invalid sample exam size")
+// sampleDomainCounts splits size questions across the weighted domains in proportion to their weights
+// (Sainte-Laguë), never giving a domain more questions than it has; the share of a domain that runs out
+// goes to the others. Ties go to the domain first in name order.
+func sampleDomainCounts(questions []GenerationQuestion, size int, domainWeights map[string]float64) (map[string]int, error) {
+	available := make(map[string]int)
+	total := 0
+	for _, q := range questions {
+		if domainWeights[q.DomainName] > 0 {
+			available[q.DomainName]++
+			total++
+		}
+	}
+	if size <= 0 || size > total {
+		return nil, fmt.Errorf("%w: %d requested, %d questions available in the weighted domains", ErrSampleSize, size, total)
+	}
+	domains := make([]string, 0, len(available))
+	for domain := range available {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	counts := make(map[string]int, len(domains))
+	for n := 0; n < size; n++ {
+		best := ""
+		bestQuotient := 0.0
+		for _, domain := range domains {
+			if counts[domain] >= available[domain] {
+				continue
+			}
+			quotient := domainWeights[domain] / float64(2*counts[domain]+1)
+			if best == "" || quotient > bestQuotient {
+				best, bestQuotient = domain, quotient
+			}
+		}
+		counts[best]++
+	}
+	return counts, nil
+}
+// GenerateSampleExam generates a single demo exam of size questions from the course's questions of an
+// exam_bank_version, for banks too small for the real plan. min_questions and max_questions are ignored,
+// domains are drawn in proportion to their weights (see sampleDomainCounts) and questions already on
+// other exams may be reused. The exam is marked sample and accepts neither session mode, so it is never
+// listed or served to students; it replaces the version's previous sample exam and is removed like the
+// other exams when the course is regenerated. It returns the exam ID and the questions per domain.
+func GenerateSampleExam(ctx context.Context, pool *pgxpool.Pool, courseID int, courseMarketingName, examBankVersion string, metadata models.ExamBankMetadata, size int, selectionStrategy string) (int, map[string]int, error) {
+	excludeFlagged := db.GetSettingBool(pool, "exclude_flagged_questions", true)
+	questions, err := GetQuestionsByCourseAndVersion(ctx, pool, courseID, examBankVersion, excludeFlagged)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get questions for sample exam: %w", err)
+	}
+	perDomain, err := sampleDomainCounts(questions, size, metadata.Domains)
+	if err != nil {
+		return 0, nil, err
+	}
+	seedStr := fmt.Sprintf("%s:%s:sample:%d", examBankVersion, courseMarketingName, size)
+	hasher := sha256.New()
+	hasher.Write([]byte(seedStr))
+	seed := int64(utils.BytesToInt(hasher.Sum(nil)))
+	selectedQuestions, err := selectQuestionsForExam(questions, perDomain, seed, selectionStrategy)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to select questions for sample exam: %w", err)
+	}
+	domainWeightsJSON, err := json.Marshal(metadata.Domains)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to marshal domain weights for course %d: %w", courseID, err)
+	}
+	examTitle := fmt.Sprintf("%s Sample Exam", courseMarketingName)
+	if bankName := BankName(examBankVersion); bankName != "" {
+		examTitle = fmt.Sprintf("%s %s Sample Exam", courseMarketingName, bankName)
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin sample exam transaction for course %d: %w", courseID, err)
+	}
+	defer tx.Rollback(ctx) // Rollback on error
+	if _, err := tx.Exec(ctx, `DELETE FROM exams WHERE course_id = $1 AND exam_bank_version = $2 AND sample`, courseID, examBankVersion); err != nil {
+		return 0, nil, fmt.Errorf("failed to clear previous sample exam for course %d, version %s: %w", courseID, examBankVersion, err)
+	}
+	var examID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO exams (course_id, title, exam_bank_version, min_questions, max_questions, exam_time, passing_score, domain_weights, allow_practice, allow_simulation, penalty_per_wrong, instructions, fuzzy_accept_distance, sample)
+		VALUES ($1, $2, $3, $4, $4, $5, $6, $7, FALSE, FALSE, $8, NULLIF($9, ''), $10, TRUE) RETURNING id
+	`, courseID, examTitle, examBankVersion, size, metadata.ExamTime, metadata.PassingScore, domainWeightsJSON, metadata.PenaltyPerWrong, metadata.Instructions, metadata.FuzzyAcceptDistance).Scan(&examID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to insert sample exam for course %d: %w", courseID, err)
+	}
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(selectedQuestions), func(i, j int) {
+		selectedQuestions[i], selectedQuestions[j] = selectedQuestions[j], selectedQuestions[i]
+	})
+	for qOrder, q := range selectedQuestions {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO exam_questions (exam_id, question_id, question_order, exam_bank_version)
+			VALUES ($1, $2, $3, $4)
+		`, examID, q.ID, qOrder+1, examBankVersion)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to insert sample exam question %d for exam %d: %w", q.ID, examID, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, nil, fmt.Errorf("failed to commit sample exam for course %d, version %s: %w", courseID, examBankVersion, err)
+	}
+	utils.LoggerFromContext(ctx).Info("Generated sample exam", "title", examTitle, "questions", len(selectedQuestions), "course_id", courseID)
+	return examID, perDomain, nil
+}
@@ -0,0 +1,490 @@
+
+package exam
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/models"
+	"recap-server/utils"
+)
+// Values of the scoring_mode setting: multi-select questions score all or nothing, or earn partial credit.
+const (
+	ScoringStrict  = "strict"
+	ScoringPartial = "partial"
+)
+// LoadScoringMode reads the scoring_mode setting, falling back to strict scoring for missing or unknown values.
+func LoadScoringMode(ctx context.Context, pool *pgxpool.Pool) string {
+	mode, err := db.GetSettingCached(pool, "scoring_mode")
+	if err != nil || mode == "" {
+		return ScoringStrict
+	}
+	if mode != ScoringStrict && mode != ScoringPartial {
+		utils.LoggerFromContext(ctx).Warn("Unknown scoring_mode, using the default", "value", mode, "default", ScoringStrict)
+		return ScoringStrict
+	}
+	return mode
+}
+// IsChoiceAnswerCorrect grades an answer to a single, multi, or truefalse question.
+// single/truefalse require exactly one selected choice that is correct. multi requires every
+// correct choice and nothing else, or, when exactSelect is set ("choose exactly N"), exactly
+// N selected choices that are all correct; selecting more than N is always incorrect.
+func IsChoiceAnswerCorrect(questionType string, exactSelect *int, correctChoiceIDs map[int]bool, selected []int) bool {
+	unique := make(map[int]bool, len(selected))
+	for _, id := range selected {
+		if !correctChoiceIDs[id] {
+			return false // Selected an incorrect choice
+		}
+		unique[id] = true
+	}
+	switch questionType {
+	case "single", "truefalse":
+		return len(unique) == 1 && len(correctChoiceIDs) == 1
+	case "multi":
+		if exactSelect != nil {
+			return len(unique) == *exactSelect
+		}
+		return len(unique) == len(correctChoiceIDs)
+	default:
+		return false
+	}
+}
+// ChoiceAnswerCredit scores a choice answer from 0 to 1. A correct answer earns 1; under partial scoring a
+// multi answer otherwise earns (correct selected - incorrect selected) / total correct, floored at 0.
+func ChoiceAnswerCredit(questionType string, exactSelect *int, correctChoiceIDs map[int]bool, selected []int, scoringMode string) float64 {
+	if IsChoiceAnswerCorrect(questionType, exactSelect, correctChoiceIDs, selected) {
+		return 1
+	}
+	if scoringMode != ScoringPartial || questionType != "multi" || len(correctChoiceIDs) == 0 {
+		return 0
+	}
+	unique := make(map[int]bool, len(selected))
+	net := 0
+	for _, id := range selected {
+		if unique[id] {
+			continue
+		}
+		unique[id] = true
+		if correctChoiceIDs[id] {
+			net++
+		} else {
+			net--
+		}
+	}
+	return math.Min(math.Max(float64(net)/float64(len(correctChoiceIDs)), 0), 1)
+}
+// OrderingAnswerCredit scores an ordering answer from 0 to 1 against expected, the item choice IDs in their
+// correct order. The exact order earns 1. Under partial scoring any other arrangement of all the items earns
+// 1 minus its normalized Kendall tau distance: the share of item pairs placed in the wrong relative order.
+// An answer that is not an arrangement of exactly the expected items earns 0.
+func OrderingAnswerCredit(expected, submitted []int, scoringMode string) float64 {
+	if len(submitted) != len(expected) || len(expected) == 0 {
+		return 0
+	}
+	rank := make(map[int]int, len(expected))
+	for i, id := range expected {
+		rank[id] = i
+	}
+	ranks := make([]int, len(submitted))
+	seen := make(map[int]bool, len(submitted))
+	exact := true
+	for i, id := range submitted {
+		r, ok := rank[id]
+		if !ok || seen[id] {
+			return 0
+		}
+		seen[id] = true
+		ranks[i] = r
+		exact = exact && r == i
+	}
+	if exact {
+		return 1
+	}
+	if scoringMode != ScoringPartial || len(ranks) < 2 {
+		return 0
+	}
+	discordant := 0
+	for i := range ranks {
+		for j := i + 1; j < len(ranks); j++ {
+			if ranks[i] > ranks[j] {
+				discordant++
+			}
+		}
+	}
+	pairs := len(ranks) * (len(ranks) - 1) / 2
+	return 1 - float64(discordant)/float64(pairs)
+}
+// MatchingAnswerCredit scores a matching answer from 0 to 1 against pairs, each prompt's choice ID mapped to
+// the ID of the response it pairs with. Pairing every prompt correctly earns 1. Under partial scoring any
+// other answer earns the share of prompts paired correctly; prompts left unpaired count as wrong.
+func MatchingAnswerCredit(pairs, submitted map[int]int, scoringMode string) float64 {
+	if len(pairs) == 0 {
+		return 0
+	}
+	correct := 0
+	for choiceID, matchID := range pairs {
+		if submitted[choiceID] == matchID {
+			correct++
+		}
+	}
+	if correct == len(pairs) {
+		return 1
+	}
+	if scoringMode != ScoringPartial {
+		return 0
+	}
+	return float64(correct) / float64(len(pairs))
+}
+// AnsweredCondition is the SQL condition over user_answers ua under which a recorded answer counts as
+// answered rather than skipped. It mirrors IsAnswered, so SQL counts agree with the scorer.
+const AnsweredCondition = `(CARDINALITY(ua.choice_ids) > 0 OR ua.text_answer IS NOT NULL OR COALESCE(ua.match_answer, '{}'::jsonb) <> '{}'::jsonb)`
+// IsAnswered reports whether a recorded answer counts as answered: it selects or orders choices, gives a
+// text answer, or pairs at least one matching prompt. Questions without such an answer are skipped.
+func IsAnswered(choiceIDs []int32, textAnswer *string, matchAnswer models.MatchingAnswer) bool {
+	return len(choiceIDs) > 0 || textAnswer != nil || len(matchAnswer) > 0
+}
+// AttemptScore is the graded result of an attempt's answers.
+type AttemptScore struct {
+	CorrectCount    int
+	Points          float64                         // Credit earned; equals CorrectCount under strict scoring
+	IncorrectCount  int                             // Answered questions that earned no credit; skipped ones are not counted
+	DetailedReport  []models.DetailedQuestionReport // In the requested question order
+	ExamQuestionIDs []int                           // exam_questions.id of each DetailedReport entry
+	DomainBreakdown map[string]int                  // Percentage of credit earned per domain, including domains with none
+}
+// ScoreAttempt grades every question of the attempt's exam against the recorded answers, listing the
+// report in orderBy, an ORDER BY expression over exam_questions eq, questions q and domains d. It is
+// shared by submission, the review, the PDF report and rescoring so all present the same results. Under partial
+// scoring, multi, ordering and matching questions earn fractional credit and every report entry carries its score.
+func ScoreAttempt(ctx context.Context, pool *pgxpool.Pool, attemptID, examID int, orderBy string) (AttemptScore, error) {
+	locale := db.AnswerLocale(pool)
+	scoringMode := LoadScoringMode(ctx, pool)
+	correctCount := 0
+	incorrectCount := 0
+	points := 0.0
+	detailedReport := []models.DetailedQuestionReport{}
+	var examQuestionIDs []int
+	domainPoints := make(map[string]float64)
+	domainTotalCounts := make(map[string]int)
+	choicesByQuestion, answersByQuestion, err := loadAnswerKeys(ctx, pool, examID, locale)
+	if err != nil {
+		return AttemptScore{}, err
+	}
+	var fuzzyAcceptDistance int
+	if err := pool.QueryRow(ctx, `SELECT fuzzy_accept_distance FROM exams WHERE id = $1`, examID).Scan(&fuzzyAcceptDistance); err != nil {
+		return AttemptScore{}, fmt.Errorf("failed to fetch fuzzy_accept_distance of exam %d: %w", examID, err)
+	}
+	// Fetch all exam questions for this exam
+	examQuestionsRows, err := pool.Query(ctx, fmt.Sprintf(`
+		SELECT
+			eq.id AS exam_question_id,
+			q.id AS question_id,
+			q.question_text,
+			q.question_type,
+			q.explanation,
+			q.input_method,
+			q.exact_select,
+			q.ignore_flag_order,
+			d.name AS domain_name,
+			ua.choice_ids,
+			ua.text_answer,
+			ua.match_answer
+		FROM exam_questions eq
+		JOIN questions q ON eq.question_id = q.id
+		JOIN domains d ON q.domain_id = d.id
+		LEFT JOIN user_answers ua ON ua.exam_question_id = eq.id AND ua.attempt_id = $1
+		WHERE eq.exam_id = $2
+		ORDER BY %s
+	`, orderBy), attemptID, examID)
+	if err != nil {
+		return AttemptScore{}, err
+	}
+	defer examQuestionsRows.Close()
+	for examQuestionsRows.Next() {
+		var eq models.ExamQuestion
+		var q models.Question
+		var domainName string
+		var answer recordedAnswer
+		if err := examQuestionsRows.Scan(
+			&eq.ID, &q.ID, &q.QuestionText, &q.QuestionType, &q.Explanation, &q.InputMethod, &q.ExactSelect, &q.IgnoreFlagOrder, &domainName,
+			&answer.ChoiceIDs, &answer.TextAnswer, &answer.MatchAnswer,
+		); err != nil {
+			utils.LoggerFromContext(ctx).Error("Error scanning exam question for scoring", "attempt_id", attemptID, "error", err)
+			continue
+		}
+		domainTotalCounts[domainName]++
+		reportEntry := models.DetailedQuestionReport{
+			Question:    q.QuestionText,
+			Explanation: q.Explanation,
+		}
+		graded := gradeAnswer(q, choicesByQuestion[q.ID], answersByQuestion[q.ID], answer, scoringMode, locale, fuzzyAcceptDistance)
+		isCorrect, credit := graded.Correct, graded.Credit
+		points += credit
+		domainPoints[domainName] += credit
+		if scoringMode == ScoringPartial {
+			reportEntry.Score = &credit
+		}
+		// A question with no answer recorded is skipped rather than incorrect, so negative marking spares it
+		switch {
+		case isCorrect:
+			correctCount++
+			reportEntry.Result = "correct"
+		case !IsAnswered(answer.ChoiceIDs, answer.TextAnswer, answer.MatchAnswer):
+			reportEntry.Result = "skipped"
+		default:
+			reportEntry.Result = "incorrect"
+			if credit == 0 {
+				incorrectCount++
+			}
+		}
+		reportEntry.YourAnswer = graded.YourAnswer
+		reportEntry.CorrectAnswer = graded.CorrectAnswer
+		detailedReport = append(detailedReport, reportEntry)
+		examQuestionIDs = append(examQuestionIDs, eq.ID)
+	}
+	if err := examQuestionsRows.Err(); err != nil {
+		return AttemptScore{}, err
+	}
+	// Calculate domain breakdown percentage
+	// Every domain in the exam is included, so one with no correct answers scores 0
+	domainBreakdown := make(map[string]int)
+	for domain, total := range domainTotalCounts {
+		domainBreakdown[domain] = int(math.Round(domainPoints[domain] / float64(total) * 100))
+	}
+	return AttemptScore{CorrectCount: correctCount, Points: points, IncorrectCount: incorrectCount, DetailedReport: detailedReport, ExamQuestionIDs: examQuestionIDs, DomainBreakdown: domainBreakdown}, nil
+}
+// recordedAnswer is a student's stored answer to a question, as read from user_answers.
+type recordedAnswer struct {
+	ChoiceIDs   []int32 // From DB array type
+	TextAnswer  *string
+	MatchAnswer models.MatchingAnswer // Scanned from JSONB
+}
+// gradedAnswer is the grading of one answer: its credit from 0 to 1, whether that is full credit, and the
+// texts of the answer and the answer key as listed in the detailed report.
+type gradedAnswer struct {
+	Credit        float64
+	Correct       bool
+	YourAnswer    []string
+	CorrectAnswer []string
+}
+// gradeAnswer grades an answer to q against its answer key, the choices and normalized acceptable answers
+// loadAnswerKeys fetched for it, without querying the database.
+func gradeAnswer(q models.Question, choices []answerKeyChoice, acceptableAnswers []string, answer recordedAnswer, scoringMode, locale string, fuzzyAcceptDistance int) gradedAnswer {
+	isCorrect := false
+	credit := 0.0
+	correctAnswerTexts := []string{}
+	yourAnswerTexts := []string{}
+	if q.QuestionType == "single" || q.QuestionType == "multi" || q.QuestionType == "truefalse" {
+		correctChoicesMap := make(map[int]bool)
+		for _, choice := range choices {
+			if choice.IsCorrect {
+				correctChoicesMap[choice.ID] = true
+				correctAnswerTexts = append(correctAnswerTexts, choice.Text)
+			}
+		}
+		// Convert answer.ChoiceIDs from int32 to int for comparison with int-based map
+		userSelectedChoicesInt := make([]int, len(answer.ChoiceIDs))
+		for i, v := range answer.ChoiceIDs {
+			userSelectedChoicesInt[i] = int(v)
+		}
+		for _, choice := range choices {
+			if utils.ContainsInt(userSelectedChoicesInt, choice.ID) {
+				yourAnswerTexts = append(yourAnswerTexts, choice.Text)
+			}
+		}
+		// Check correctness
+		isCorrect = IsChoiceAnswerCorrect(q.QuestionType, q.ExactSelect, correctChoicesMap, userSelectedChoicesInt)
+		credit = ChoiceAnswerCredit(q.QuestionType, q.ExactSelect, correctChoicesMap, userSelectedChoicesInt, scoringMode)
+	} else if q.QuestionType == "ordering" {
+		// Items are listed in their expected order; the answer in the order it was submitted
+		items := append([]answerKeyChoice(nil), choices...)
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Position < items[j].Position })
+		var expected []int
+		itemTexts := make(map[int]string)
+		for _, item := range items {
+			expected = append(expected, item.ID)
+			itemTexts[item.ID] = item.Text
+			correctAnswerTexts = append(correctAnswerTexts, item.Text)
+		}
+		submitted := make([]int, len(answer.ChoiceIDs))
+		for i, v := range answer.ChoiceIDs {
+			submitted[i] = int(v)
+			yourAnswerTexts = append(yourAnswerTexts, itemTexts[int(v)])
+		}
+		credit = OrderingAnswerCredit(expected, submitted, scoringMode)
+		isCorrect = credit == 1
+	} else if q.QuestionType == "matching" {
+		// Pairs are listed as "prompt -> response", the answer's for each prompt the student paired
+		pairs := make(map[int]int)
+		matchTexts := make(map[int]string)
+		var promptIDs []int
+		promptTexts := make(map[int]string)
+		for _, choice := range choices {
+			if choice.MatchID == nil {
+				continue
+			}
+			pairs[choice.ID] = *choice.MatchID
+			matchTexts[*choice.MatchID] = *choice.MatchText
+			promptIDs = append(promptIDs, choice.ID)
+			promptTexts[choice.ID] = choice.Text
+			correctAnswerTexts = append(correctAnswerTexts, choice.Text+" -> "+*choice.MatchText)
+		}
+		for _, choiceID := range promptIDs {
+			if matchID, ok := answer.MatchAnswer[choiceID]; ok {
+				yourAnswerTexts = append(yourAnswerTexts, promptTexts[choiceID]+" -> "+matchTexts[matchID])
+			}
+		}
+		credit = MatchingAnswerCredit(pairs, answer.MatchAnswer, scoringMode)
+		isCorrect = credit == 1
+	} else if q.QuestionType == "fillblank" {
+		if answer.TextAnswer != nil {
+			yourAnswerTexts = []string{*answer.TextAnswer}
+			isCorrect = utils.AnswerMatches(acceptableAnswers, utils.NormalizeAnswer(*answer.TextAnswer, locale), q.IgnoreFlagOrder, fuzzyAcceptDistance)
+		} else {
+			isCorrect = false
+		}
+		if isCorrect {
+			credit = 1
+		}
+		correctAnswerTexts = acceptableAnswers // Show all acceptable answers
+	}
+	return gradedAnswer{Credit: credit, Correct: isCorrect, YourAnswer: yourAnswerTexts, CorrectAnswer: correctAnswerTexts}
+}
+// execer is the part of *pgxpool.Pool and pgx.Tx used to store answer correctness.
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+// StoreAnswerCorrectness records on the attempt's user_answers whether each earned full credit in score, so
+// exam and question statistics use the scorer's grading (regex, fuzzy, locale and flag order included)
+// instead of re-grading in SQL. Run it through the transaction that stores the attempt's score, if any.
+func StoreAnswerCorrectness(ctx context.Context, q execer, attemptID int, score AttemptScore) error {
+	correct := make([]bool, len(score.DetailedReport))
+	for i, entry := range score.DetailedReport {
+		correct[i] = entry.Result == "correct"
+	}
+	_, err := q.Exec(ctx, `
+		UPDATE user_answers ua SET is_correct = s.is_correct
+		FROM unnest($2::int[], $3::bool[]) AS s(exam_question_id, is_correct)
+		WHERE ua.attempt_id = $1 AND ua.exam_question_id = s.exam_question_id
+	`, attemptID, score.ExamQuestionIDs, correct)
+	if err != nil {
+		return fmt.Errorf("failed to store answer correctness of attempt %d: %w", attemptID, err)
+	}
+	return nil
+}
+// BackfillAnswerCorrectness scores every completed attempt with answers lacking is_correct, such as those
+// finalized before it was stored, and stores their correctness. It returns the number of attempts filled in.
+func BackfillAnswerCorrectness(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT DISTINCT ea.id, ea.exam_id
+		FROM exam_attempts ea
+		JOIN user_answers ua ON ua.attempt_id = ea.id
+		WHERE ea.completed_at IS NOT NULL AND ua.is_correct IS NULL
+		ORDER BY ea.id
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query attempts without answer correctness: %w", err)
+	}
+	type pendingAttempt struct{ ID, ExamID int }
+	var attempts []pendingAttempt
+	for rows.Next() {
+		var a pendingAttempt
+		if err := rows.Scan(&a.ID, &a.ExamID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan attempt without answer correctness: %w", err)
+		}
+		attempts = append(attempts, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read attempts without answer correctness: %w", err)
+	}
+	for i, a := range attempts {
+		score, err := ScoreAttempt(ctx, pool, a.ID, a.ExamID, "eq.question_order")
+		if err != nil {
+			return i, fmt.Errorf("failed to score attempt %d: %w", a.ID, err)
+		}
+		if err := StoreAnswerCorrectness(ctx, pool, a.ID, score); err != nil {
+			return i, err
+		}
+	}
+	return len(attempts), nil
+}
+// answerKeyChoice is a choice of a question being scored, with its matching response for matching questions.
+type answerKeyChoice struct {
+	ID        int
+	Text      string
+	IsCorrect bool
+	Position  int
+	MatchID   *int
+	MatchText *string
+}
+// loadAnswerKeys fetches the choices (in ID order) and normalized acceptable answers of every question of
+// the exam in two queries, keyed by question ID, so scoring does not query per question.
+func loadAnswerKeys(ctx context.Context, pool *pgxpool.Pool, examID int, locale string) (map[int][]answerKeyChoice, map[int][]string, error) {
+	choiceRows, err := pool.Query(ctx, `
+		SELECT c.question_id, c.id, c.choice_text, c.is_correct, COALESCE(c.position, 0), mo.id, mo.option_text
+		FROM choices c
+		LEFT JOIN match_options mo ON mo.choice_id = c.id
+		WHERE c.question_id IN (SELECT question_id FROM exam_questions WHERE exam_id = $1)
+		ORDER BY c.question_id, c.id
+	`, examID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch choices of exam %d for scoring: %w", examID, err)
+	}
+	choicesByQuestion := make(map[int][]answerKeyChoice)
+	for choiceRows.Next() {
+		var questionID int
+		var choice answerKeyChoice
+		if err := choiceRows.Scan(&questionID, &choice.ID, &choice.Text, &choice.IsCorrect, &choice.Position, &choice.MatchID, &choice.MatchText); err != nil {
+			choiceRows.Close()
+			return nil, nil, fmt.Errorf("failed to scan choice of exam %d for scoring: %w", examID, err)
+		}
+		choicesByQuestion[questionID] = append(choicesByQuestion[questionID], choice)
+	}
+	choiceRows.Close()
+	if err := choiceRows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read choices of exam %d for scoring: %w", examID, err)
+	}
+	answerRows, err := pool.Query(ctx, `
+		SELECT question_id, acceptable_answer, is_regex
+		FROM fill_blank_answers
+		WHERE question_id IN (SELECT question_id FROM exam_questions WHERE exam_id = $1)
+		ORDER BY question_id, id
+	`, examID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch acceptable answers of exam %d for scoring: %w", examID, err)
+	}
+	defer answerRows.Close()
+	answersByQuestion := make(map[int][]string)
+	for answerRows.Next() {
+		var questionID int
+		var answer string
+		var isRegex bool
+		if err := answerRows.Scan(&questionID, &answer, &isRegex); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan acceptable answer of exam %d for scoring: %w", examID, err)
+		}
+		answersByQuestion[questionID] = append(answersByQuestion[questionID], utils.AcceptableAnswerForm(answer, isRegex, locale))
+	}
+	if err := answerRows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read acceptable answers of exam %d for scoring: %w", examID, err)
+	}
+	return choicesByQuestion, answersByQuestion, nil
+}
+// ScorePercent converts an attempt's credit into the stored percentage, deducting penaltyPerWrong
+// questions for each incorrect answer (negative marking) and clamping the result at zero.
+func ScorePercent(score AttemptScore, totalQuestions int, penaltyPerWrong float64) int {
+	if totalQuestions == 0 {
+		return 0
+	}
+	points := math.Max(score.Points-penaltyPerWrong*float64(score.IncorrectCount), 0)
+	return int(math.Round(points / float64(totalQuestions) * 100))
+}
+// Passed reports whether a stored score percentage reaches passingScore. Passing scores may be
+// fractional (e.g. 70.5), so the comparison is made in float64 rather than truncating the threshold.
+func Passed(scorePercent int, passingScore float64) bool {
+	return float64(scorePercent) >= passingScore
+}
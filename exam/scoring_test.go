@@ -0,0 +1,230 @@
+
+package exam
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db/dbtest"
+	"recap-server/models"
+	"recap-server/utils"
+)
+// multiKey is the answer key of a multi question with choices 1 to 4, of which 1 and 2 are correct.
+var multiKey = []answerKeyChoice{{ID: 1, Text: "TCP", IsCorrect: true}, {ID: 2, Text: "UDP", IsCorrect: true}, {ID: 3, Text: "HTTP"}, {ID: 4, Text: "DNS"}}
+// orderingKey is the answer key of an ordering question whose items 11, 12 and 13 go in that order.
+var orderingKey = []answerKeyChoice{{ID: 12, Text: "Second", Position: 2}, {ID: 11, Text: "First", Position: 1}, {ID: 13, Text: "Third", Position: 3}}
+// matchingKey pairs a matching question's prompts 21 and 22 with responses 31 and 32.
+func matchingKey() []answerKeyChoice {
+	m31, m32 := 31, 32
+	t31, t32 := "Transport", "Network"
+	return []answerKeyChoice{{ID: 21, Text: "TCP", MatchID: &m31, MatchText: &t31}, {ID: 22, Text: "IP", MatchID: &m32, MatchText: &t32}}
+}
+func TestGradeAnswer(t *testing.T) {
+	text := func(s string) *string { return &s }
+	tests := []struct {
+		name        string
+		question    models.Question
+		choices     []answerKeyChoice
+		acceptable  []string
+		answer      recordedAnswer
+		scoringMode string
+		wantCredit  float64
+		wantCorrect bool
+	}{
+		{"single correct", models.Question{QuestionType: "single"}, []answerKeyChoice{{ID: 1, Text: "Yes", IsCorrect: true}, {ID: 2, Text: "No"}}, nil, recordedAnswer{ChoiceIDs: []int32{1}}, ScoringStrict, 1, true},
+		{"single wrong", models.Question{QuestionType: "single"}, []answerKeyChoice{{ID: 1, Text: "Yes", IsCorrect: true}, {ID: 2, Text: "No"}}, nil, recordedAnswer{ChoiceIDs: []int32{2}}, ScoringStrict, 0, false},
+		{"multi every correct choice", models.Question{QuestionType: "multi"}, multiKey, nil, recordedAnswer{ChoiceIDs: []int32{2, 1}}, ScoringStrict, 1, true},
+		{"multi half, strict", models.Question{QuestionType: "multi"}, multiKey, nil, recordedAnswer{ChoiceIDs: []int32{1}}, ScoringStrict, 0, false},
+		{"multi half, partial", models.Question{QuestionType: "multi"}, multiKey, nil, recordedAnswer{ChoiceIDs: []int32{1}}, ScoringPartial, 0.5, false},
+		{"multi wrong choice cancels a right one", models.Question{QuestionType: "multi"}, multiKey, nil, recordedAnswer{ChoiceIDs: []int32{1, 3}}, ScoringPartial, 0, false},
+		{"ordering exact", models.Question{QuestionType: "ordering"}, orderingKey, nil, recordedAnswer{ChoiceIDs: []int32{11, 12, 13}}, ScoringStrict, 1, true},
+		{"ordering one swap, partial", models.Question{QuestionType: "ordering"}, orderingKey, nil, recordedAnswer{ChoiceIDs: []int32{12, 11, 13}}, ScoringPartial, 2.0 / 3, false},
+		{"ordering one swap, strict", models.Question{QuestionType: "ordering"}, orderingKey, nil, recordedAnswer{ChoiceIDs: []int32{12, 11, 13}}, ScoringStrict, 0, false},
+		{"matching all pairs", models.Question{QuestionType: "matching"}, matchingKey(), nil, recordedAnswer{MatchAnswer: models.MatchingAnswer{21: 31, 22: 32}}, ScoringStrict, 1, true},
+		{"matching one pair, partial", models.Question{QuestionType: "matching"}, matchingKey(), nil, recordedAnswer{MatchAnswer: models.MatchingAnswer{21: 31, 22: 31}}, ScoringPartial, 0.5, false},
+		{"fillblank matches", models.Question{QuestionType: "fillblank"}, nil, []string{"ls -la"}, recordedAnswer{TextAnswer: text("  LS -la ")}, ScoringStrict, 1, true},
+		{"fillblank flag order", models.Question{QuestionType: "fillblank", IgnoreFlagOrder: true}, nil, []string{"ls -l -a"}, recordedAnswer{TextAnswer: text("ls -al")}, ScoringStrict, 1, true},
+		{"fillblank regex", models.Question{QuestionType: "fillblank"}, nil, []string{utils.RegexAnswerPrefix + `ls\s+-(la|al)`}, recordedAnswer{TextAnswer: text("ls -al")}, ScoringStrict, 1, true},
+		{"fillblank wrong", models.Question{QuestionType: "fillblank"}, nil, []string{"ls -la"}, recordedAnswer{TextAnswer: text("dir")}, ScoringPartial, 0, false},
+		{"fillblank unanswered", models.Question{QuestionType: "fillblank"}, nil, []string{"ls -la"}, recordedAnswer{}, ScoringStrict, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := gradeAnswer(tt.question, tt.choices, tt.acceptable, tt.answer, tt.scoringMode, "und", 0)
+			if got.Correct != tt.wantCorrect || got.Credit < tt.wantCredit-1e-9 || got.Credit > tt.wantCredit+1e-9 {
+				t.Fatalf("gradeAnswer = credit %g, correct %t, want %g, %t", got.Credit, got.Correct, tt.wantCredit, tt.wantCorrect)
+			}
+		})
+	}
+}
+func TestGradeAnswerReportTexts(t *testing.T) {
+	tests := []struct {
+		name        string
+		question    models.Question
+		choices     []answerKeyChoice
+		answer      recordedAnswer
+		wantYours   []string
+		wantCorrect []string
+	}{
+		{"multi", models.Question{QuestionType: "multi"}, multiKey, recordedAnswer{ChoiceIDs: []int32{3, 1}}, []string{"TCP", "HTTP"}, []string{"TCP", "UDP"}},
+		{"ordering keeps the submitted order", models.Question{QuestionType: "ordering"}, orderingKey, recordedAnswer{ChoiceIDs: []int32{13, 11, 12}}, []string{"Third", "First", "Second"}, []string{"First", "Second", "Third"}},
+		{"matching lists paired prompts", models.Question{QuestionType: "matching"}, matchingKey(), recordedAnswer{MatchAnswer: models.MatchingAnswer{22: 31}}, []string{"IP -> Transport"}, []string{"TCP -> Transport", "IP -> Network"}},
+		{"unanswered", models.Question{QuestionType: "single"}, multiKey[:1], recordedAnswer{}, []string{}, []string{"TCP"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := gradeAnswer(tt.question, tt.choices, nil, tt.answer, ScoringStrict, "und", 0)
+			if fmt.Sprint(got.YourAnswer) != fmt.Sprint(tt.wantYours) || fmt.Sprint(got.CorrectAnswer) != fmt.Sprint(tt.wantCorrect) {
+				t.Fatalf("gradeAnswer report = %q / %q, want %q / %q", got.YourAnswer, got.CorrectAnswer, tt.wantYours, tt.wantCorrect)
+			}
+		})
+	}
+}
+func TestScorePercent(t *testing.T) {
+	tests := []struct {
+		name    string
+		score   AttemptScore
+		total   int
+		penalty float64
+		want    int
+	}{
+		{"no questions", AttemptScore{}, 0, 0, 0},
+		{"all correct", AttemptScore{Points: 10, CorrectCount: 10}, 10, 0.25, 100},
+		{"no penalty", AttemptScore{Points: 7, CorrectCount: 7, IncorrectCount: 3}, 10, 0, 70},
+		{"quarter penalty", AttemptScore{Points: 7, CorrectCount: 7, IncorrectCount: 2}, 10, 0.25, 65},
+		{"skipped questions are spared", AttemptScore{Points: 7, CorrectCount: 7}, 10, 0.25, 70},
+		{"partial credit", AttemptScore{Points: 7.5, CorrectCount: 7, IncorrectCount: 1}, 10, 0.5, 70},
+		{"clamped at zero", AttemptScore{Points: 1, CorrectCount: 1, IncorrectCount: 9}, 10, 1, 0},
+		{"rounded", AttemptScore{Points: 2, CorrectCount: 2}, 3, 0, 67},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ScorePercent(tt.score, tt.total, tt.penalty); got != tt.want {
+				t.Fatalf("ScorePercent(%+v, %d, %g) = %d, want %d", tt.score, tt.total, tt.penalty, got, tt.want)
+			}
+		})
+	}
+}
+func TestPassed(t *testing.T) {
+	tests := []struct {
+		score        int
+		passingScore float64
+		want         bool
+	}{
+		{70, 70, true},
+		{69, 70, false},
+		{70, 70.5, false}, // A fractional passing score is not truncated to 70
+		{71, 70.5, true},
+		{0, 0, true},
+		{100, 100, true},
+	}
+	for _, tt := range tests {
+		if got := Passed(tt.score, tt.passingScore); got != tt.want {
+			t.Errorf("Passed(%d, %g) = %t, want %t", tt.score, tt.passingScore, got, tt.want)
+		}
+	}
+}
+// BenchmarkGradeAnswer100Questions grades a 100-question exam from the answer keys loadAnswerKeys loads in
+// two queries: the grading itself makes no round trips, however many questions the exam has.
+func BenchmarkGradeAnswer100Questions(b *testing.B) {
+	const questions = 100
+	choicesByQuestion := make(map[int][]answerKeyChoice, questions)
+	answersByQuestion := make(map[int][]string, questions)
+	examQuestions := make([]models.Question, questions)
+	answers := make([]recordedAnswer, questions)
+	for i := range examQuestions {
+		examQuestions[i].ID = i + 1
+		switch i % 4 {
+		case 0:
+			examQuestions[i].QuestionType = "single"
+			choicesByQuestion[i+1] = multiKey[1:]
+			answers[i] = recordedAnswer{ChoiceIDs: []int32{2}}
+		case 1:
+			examQuestions[i].QuestionType = "multi"
+			choicesByQuestion[i+1] = multiKey
+			answers[i] = recordedAnswer{ChoiceIDs: []int32{1, 3}}
+		case 2:
+			examQuestions[i].QuestionType = "ordering"
+			choicesByQuestion[i+1] = orderingKey
+			answers[i] = recordedAnswer{ChoiceIDs: []int32{12, 11, 13}}
+		default:
+			answer := "ls -al"
+			examQuestions[i].QuestionType = "fillblank"
+			answersByQuestion[i+1] = []string{"ls -la", "ls -l -a"}
+			answers[i] = recordedAnswer{TextAnswer: &answer}
+		}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i, q := range examQuestions {
+			gradeAnswer(q, choicesByQuestion[q.ID], answersByQuestion[q.ID], answers[i], ScoringPartial, "und", 1)
+		}
+	}
+}
+// queryCounter is a pgx.QueryTracer counting the queries sent through a pool.
+type queryCounter struct {
+	queries atomic.Int64
+}
+// TraceQueryStart counts the query.
+func (c *queryCounter) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	c.queries.Add(1)
+	return ctx
+}
+// TraceQueryEnd does nothing; queries are counted when they start.
+func (c *queryCounter) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+// seedExam stores an exam of the first count questions of a course stored by seedCourse, in ID order, and
+// returns its ID.
+func seedExam(t *testing.T, pool *pgxpool.Pool, courseID, count int) int {
+	t.Helper()
+	ctx := context.Background()
+	var examID int
+	err := pool.QueryRow(ctx, `
+		INSERT INTO exams (course_id, title, exam_bank_version, min_questions, max_questions, exam_time, passing_score, domain_weights)
+		VALUES ($1, $2, '1.0.0', 1, $3, 30, 70, '{"Networking": 1}') RETURNING id
+	`, courseID, fmt.Sprintf("%d-question exam", count), count).Scan(&examID)
+	if err == nil {
+		_, err = pool.Exec(ctx, `
+			INSERT INTO exam_questions (exam_id, question_id, question_order, exam_bank_version)
+			SELECT $1, id, ROW_NUMBER() OVER (ORDER BY id), '1.0.0' FROM questions WHERE course_id = $2 ORDER BY id LIMIT $3
+		`, examID, courseID, count)
+	}
+	if err != nil {
+		t.Fatalf("storing a %d-question exam: %v", count, err)
+	}
+	return examID
+}
+// TestScoreAttemptQueriesIndependentOfExamLength checks that scoring loads the answer keys and answers of
+// all questions at once: a 100-question attempt takes as many round trips as a 1-question one.
+func TestScoreAttemptQueriesIndependentOfExamLength(t *testing.T) {
+	counter := &queryCounter{}
+	pool := dbtest.PoolWithTracer(t, counter)
+	ctx := context.Background()
+	courseID := seedCourse(t, pool, "SCORE101", 100)
+	queriesToScore := func(questions int) int64 {
+		examID := seedExam(t, pool, courseID, questions)
+		attemptID := seedAttempts(t, pool, examID, []int{100}, func(int) bool { return true })[0]
+		if _, err := ScoreAttempt(ctx, pool, attemptID, examID, "eq.question_order"); err != nil { // Caches the settings read
+			t.Fatalf("ScoreAttempt: %v", err)
+		}
+		before := counter.queries.Load()
+		score, err := ScoreAttempt(ctx, pool, attemptID, examID, "eq.question_order")
+		queries := counter.queries.Load() - before
+		if err != nil {
+			t.Fatalf("ScoreAttempt: %v", err)
+		}
+		if score.CorrectCount != questions {
+			t.Fatalf("ScoreAttempt of %d correct answers: CorrectCount = %d", questions, score.CorrectCount)
+		}
+		return queries
+	}
+	one := queriesToScore(1)
+	hundred := queriesToScore(100)
+	if hundred != one {
+		t.Errorf("ScoreAttempt made %d queries for 100 questions and %d for 1, want the same number", hundred, one)
+	}
+	if one > 4 { // Exam settings, questions with answers, choices and acceptable answers
+		t.Errorf("ScoreAttempt made %d queries, want at most 4", one)
+	}
+}
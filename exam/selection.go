@@ -0,0 +1,60 @@
+
+package exam
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/utils"
+)
+// Question selection strategies, chosen by the exam_selection_strategy setting.
+const (
+	SelectionUniform          = "uniform"           // Every available question is equally likely
+	SelectionValidityWeighted = "validity_weighted" // Questions with higher validity scores are more likely
+)
+// minSelectionWeight keeps questions with the lowest validity scores selectable.
+const minSelectionWeight = 0.05
+// LoadSelectionStrategy reads the exam_selection_strategy setting, falling back to uniform
+// selection for missing or unknown values.
+func LoadSelectionStrategy(ctx context.Context, pool *pgxpool.Pool) string {
+	strategy, err := db.GetSettingCached(pool, "exam_selection_strategy")
+	if err != nil || strategy == "" {
+		return SelectionUniform
+	}
+	if strategy != SelectionUniform && strategy != SelectionValidityWeighted {
+		utils.LoggerFromContext(ctx).Warn("Unknown exam_selection_strategy, using the default", "value", strategy, "default", SelectionUniform)
+		return SelectionUniform
+	}
+	return strategy
+}
+// selectionWeight maps a validity score (-1 to 1) to a sampling weight; unscored questions get the
+// neutral weight 1, the same as a score of 0.
+func selectionWeight(validityScore *float64) float64 {
+	if validityScore == nil {
+		return 1
+	}
+	return math.Max(1+*validityScore, minSelectionWeight)
+}
+// weightedSample picks count questions without replacement, each draw favouring higher selection
+// weights (Efraimidis-Spirakis: the count largest keys u^(1/w)). Draws come from r only, so the
+// result is reproducible for a given seed and input order.
+func weightedSample(available []GenerationQuestion, count int, r *rand.Rand) []GenerationQuestion {
+	type keyed struct {
+		question GenerationQuestion
+		key      float64
+	}
+	keyedQuestions := make([]keyed, len(available))
+	for i, q := range available {
+		keyedQuestions[i] = keyed{question: q, key: math.Pow(r.Float64(), 1/selectionWeight(q.ValidityScore))}
+	}
+	sort.SliceStable(keyedQuestions, func(i, j int) bool {
+		return keyedQuestions[i].key > keyedQuestions[j].key
+	})
+	sampled := make([]GenerationQuestion, count)
+	for i := range sampled {
+		sampled[i] = keyedQuestions[i].question
+	}
+	return sampled
+}
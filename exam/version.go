@@ -0,0 +1,72 @@
+
+package exam
+import (
+	"context"
+	"fmt"
+	"sort"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/utils"
+)
+// LatestVersion returns the newest of a set of exam_bank_versions by semver precedence of their
+// schema_version (see utils.CompareSemver), so 1.10.0 is newer than 1.9.0. Ties, such as the same
+// schema_version in two banks, go to the earlier entry. It returns "" for no versions.
+func LatestVersion(versions []string) string {
+	latest := ""
+	for _, version := range versions {
+		if latest == "" || utils.CompareSemver(SchemaVersion(version), SchemaVersion(latest)) > 0 {
+			latest = version
+		}
+	}
+	return latest
+}
+// LatestBankVersions returns, per course ID, the latest exam_bank_version of each of the course's exam
+// banks (primary and named, see BankName) among its exams that are neither retired nor samples. A
+// courseID of 0 covers every course.
+func LatestBankVersions(ctx context.Context, pool *pgxpool.Pool, courseID int) (map[int][]string, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT course_id, exam_bank_version FROM exams
+		WHERE ($1 = 0 OR course_id = $1) AND retired_at IS NULL AND NOT sample
+		GROUP BY course_id, exam_bank_version
+		ORDER BY course_id, MAX(created_at) DESC
+	`, courseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch exam bank versions: %w", err)
+	}
+	defer rows.Close()
+	byCourse := make(map[int][]string)
+	for rows.Next() {
+		var id int
+		var version string
+		if err := rows.Scan(&id, &version); err != nil {
+			return nil, fmt.Errorf("failed to scan exam bank version: %w", err)
+		}
+		byCourse[id] = append(byCourse[id], version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read exam bank versions: %w", err)
+	}
+	latest := make(map[int][]string, len(byCourse))
+	for id, versions := range byCourse {
+		latest[id] = latestPerBank(versions)
+	}
+	return latest, nil
+}
+// latestPerBank groups a course's exam_bank_versions by exam bank (see BankName) and returns the latest
+// version of each bank (see LatestVersion), in bank name order.
+func latestPerBank(versions []string) []string {
+	byBank := make(map[string][]string)
+	var banks []string
+	for _, version := range versions {
+		bank := BankName(version)
+		if _, ok := byBank[bank]; !ok {
+			banks = append(banks, bank)
+		}
+		byBank[bank] = append(byBank[bank], version)
+	}
+	sort.Strings(banks)
+	latest := make([]string, 0, len(banks))
+	for _, bank := range banks {
+		latest = append(latest, LatestVersion(byBank[bank]))
+	}
+	return latest
+}
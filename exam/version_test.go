@@ -0,0 +1,49 @@
+
+package exam
+import (
+	"fmt"
+	"testing"
+)
+func TestLatestPerBank(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		want     []string
+	}{
+		{"no versions", nil, []string{}},
+		{"single version", []string{"1.0.0"}, []string{"1.0.0"}},
+		{"primary bank across versions", []string{"1.0.0", "1.2.0", "1.1.0"}, []string{"1.2.0"}},
+		{"named banks kept apart", []string{"2.0.0", "1.0.0+storage", "1.0.0", "1.3.0+storage"}, []string{"2.0.0", "1.3.0+storage"}},
+		{"named bank newer than primary", []string{"1.0.0", "3.0.0+networking"}, []string{"1.0.0", "3.0.0+networking"}},
+		{"several named banks", []string{"1.0.0+storage", "1.1.0+networking", "1.0.0+networking"}, []string{"1.1.0+networking", "1.0.0+storage"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := latestPerBank(tt.versions); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("latestPerBank(%q) = %q, want %q", tt.versions, got, tt.want)
+			}
+		})
+	}
+}
+func TestLatestVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		want     string
+	}{
+		{"none", nil, ""},
+		{"double-digit minor beats string order", []string{"1.9.0", "1.10.0", "1.2.0"}, "1.10.0"},
+		{"insertion order ignored", []string{"1.10.0", "1.9.0"}, "1.10.0"},
+		{"release beats its pre-release", []string{"2.0.0-rc.1", "2.0.0", "1.9.9"}, "2.0.0"},
+		{"named bank compares its schema_version", []string{"1.9.0+storage", "1.10.0+storage"}, "1.10.0+storage"},
+		{"tie goes to the earlier entry", []string{"1.0.0+networking", "1.0.0"}, "1.0.0+networking"},
+		{"unparsable versions lose", []string{"latest", "1.0.0"}, "1.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LatestVersion(tt.versions); got != tt.want {
+				t.Fatalf("LatestVersion(%q) = %q, want %q", tt.versions, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,94 +1,179 @@
 
 package handlers
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http" // ADDED: Import net/http for HTTP status constants
+	"net/mail"
 	"strconv"
 	"strings"
 	"time"
 	"math" // ADDED: Import math package for math.Ceil
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/config"
 	"recap-server/db"
+	"recap-server/exam"
 	"recap-server/ingestion"
+	"recap-server/middleware"
 	"recap-server/models"
-	// "recap-server/utils" // REMOVED: Not directly used in this file
+	"recap-server/notifications"
+	"recap-server/utils"
 )
+// adminDataUnavailable is shown in place of admin data whose query failed, so a database error is never
+// mistaken for real zeros or empty lists.
+const adminDataUnavailable = "Data unavailable"
+// logAdminQueryError logs a failed admin data query with the route and admin who requested it.
+func logAdminQueryError(c *gin.Context, what string, err error) {
+	logRequestError(c, "Admin %s %s: failed to load %s: %v", c.Request.Method, c.FullPath(), what, err)
+}
+// renderAdminError logs a failed admin data query and renders the page in its "data unavailable" state.
+func renderAdminError(c *gin.Context, templateName, title, what string, err error) {
+	logAdminQueryError(c, what, err)
+	c.HTML(http.StatusInternalServerError, templateName, gin.H{
+		"Title":           title,
+		"error":           fmt.Sprintf("%s: failed to retrieve %s. Check the server logs.", adminDataUnavailable, what),
+		"DataUnavailable": true,
+		"UserEmail":       c.GetString("user_email"),
+	})
+}
 // AdminDashboard renders the admin dashboard with metrics and recent activity.
+// Each section whose query fails is rendered as unavailable instead of zero or empty.
 // GET /admin/dashboard
 func AdminDashboard(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		unavailable := make(map[string]bool) // Dashboard sections whose data could not be loaded
 		// Fetch metrics
-		var totalVerifiedUsers int
-		_ = pool.QueryRow(context.Background(), `SELECT COUNT(DISTINCT email) FROM exam_attempts WHERE completed_at IS NOT NULL`).Scan(&totalVerifiedUsers)
-		var totalExamsTaken int
-		_ = pool.QueryRow(context.Background(), `SELECT COUNT(id) FROM exam_attempts`).Scan(&totalExamsTaken)
-		var validationFailures int
-		_ = pool.QueryRow(context.Background(), `SELECT COUNT(id) FROM error_logs WHERE source = 'ingestion'`).Scan(&validationFailures)
+		metrics := []struct {
+			Key   string
+			Query string
+			Value int
+		}{
+			{Key: "TotalVerifiedUsers", Query: `SELECT COUNT(DISTINCT email) FROM exam_attempts WHERE completed_at IS NOT NULL`},
+			{Key: "TotalExamsTaken", Query: `SELECT COUNT(id) FROM exam_attempts`},
+			{Key: "ValidationFailures", Query: `SELECT COUNT(id) FROM error_logs WHERE source = 'ingestion'`},
+			{Key: "ActiveSessions", Query: db.ActiveSessionsQuery},
+		}
+		for i := range metrics {
+			if err := pool.QueryRow(ctx, metrics[i].Query).Scan(&metrics[i].Value); err != nil {
+				logAdminQueryError(c, metrics[i].Key, err)
+				unavailable[metrics[i].Key] = true
+			}
+		}
 		// Recent activity: admin events
-		adminEventsQuery := `SELECT id, timestamp, action, actor, target, notes FROM admin_events ORDER BY timestamp DESC LIMIT 5`
-		adminEventsRows, err := pool.Query(context.Background(), adminEventsQuery)
+		adminEventsQuery := `
+			SELECT id, timestamp, action, actor, target, notes, occurrences, last_seen_at
+			FROM admin_events
+			ORDER BY COALESCE(last_seen_at, timestamp) DESC
+			LIMIT 5
+		`
 		var recentAdminEvents []models.AdminEvent
+		adminEventsRows, err := pool.Query(ctx, adminEventsQuery)
 		if err == nil {
 			for adminEventsRows.Next() {
 				var ae models.AdminEvent
-				_ = adminEventsRows.Scan(&ae.ID, &ae.Timestamp, &ae.Action, &ae.Actor, &ae.Target, &ae.Notes)
+				if err = adminEventsRows.Scan(&ae.ID, &ae.Timestamp, &ae.Action, &ae.Actor, &ae.Target, &ae.Notes, &ae.Occurrences, &ae.LastSeenAt); err != nil {
+					break
+				}
 				recentAdminEvents = append(recentAdminEvents, ae)
 			}
 			adminEventsRows.Close()
-		} else {
-			log.Printf("Error fetching recent admin events: %v", err)
+			if err == nil {
+				err = adminEventsRows.Err()
+			}
+		}
+		if err != nil {
+			logAdminQueryError(c, "recent admin events", err)
+			unavailable["RecentAdminEvents"] = true
+			recentAdminEvents = nil
 		}
 		// Recent activity: latest ingested courses
 		recentCoursesQuery := `SELECT id, course_code, marketing_name FROM courses ORDER BY id DESC LIMIT 5`
-		recentCoursesRows, err := pool.Query(context.Background(), recentCoursesQuery)
 		var recentCourses []models.Course
+		recentCoursesRows, err := pool.Query(ctx, recentCoursesQuery)
 		if err == nil {
 			for recentCoursesRows.Next() {
 				var course models.Course
-				_ = recentCoursesRows.Scan(&course.ID, &course.CourseCode, &course.MarketingName)
+				if err = recentCoursesRows.Scan(&course.ID, &course.CourseCode, &course.MarketingName); err != nil {
+					break
+				}
 				recentCourses = append(recentCourses, course)
 			}
 			recentCoursesRows.Close()
-		} else {
-			log.Printf("Error fetching recent courses: %v", err)
-		}
-		c.HTML(http.StatusOK, "admin_dashboard", gin.H{
-			"Title":              "FIRM Admin Dashboard",
-			"TotalVerifiedUsers": totalVerifiedUsers,
-			"TotalExamsTaken":    totalExamsTaken,
-			"ValidationFailures": validationFailures,
-			"RecentAdminEvents":  recentAdminEvents,
-			"RecentCourses":      recentCourses,
-			"UserEmail":          c.GetString("user_email"),
-		})
+			if err == nil {
+				err = recentCoursesRows.Err()
+			}
+		}
+		if err != nil {
+			logAdminQueryError(c, "recent courses", err)
+			unavailable["RecentCourses"] = true
+			recentCourses = nil
+		}
+		data := gin.H{
+			"Title":             "FIRM Admin Dashboard",
+			"RecentAdminEvents": recentAdminEvents,
+			"RecentCourses":     recentCourses,
+			"Unavailable":       unavailable,
+			"UserEmail":         c.GetString("user_email"),
+		}
+		for _, m := range metrics {
+			data[m.Key] = m.Value
+		}
+		if len(unavailable) > 0 {
+			data["error"] = "Some dashboard data is unavailable because a database query failed. Check the server logs."
+		}
+		c.HTML(http.StatusOK, "admin_dashboard", data)
+	}
+}
+// maxAdminPageSize bounds the page_size query parameter of the admin list pages.
+const maxAdminPageSize = 200
+// adminPagination reads the page and page_size query parameters of an admin list page. page_size defaults
+// to the admin_page_size setting (25 when unset) and is clamped to 1..maxAdminPageSize.
+func adminPagination(c *gin.Context, pool *pgxpool.Pool) (page, pageSize, offset int) {
+	page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize = db.GetSettingInt(pool, "admin_page_size", 25)
+	if raw := c.Query("page_size"); raw != "" {
+		if requested, err := strconv.Atoi(raw); err == nil {
+			pageSize = requested
+		}
+	}
+	if pageSize < 1 {
+		pageSize = 1
 	}
+	if pageSize > maxAdminPageSize {
+		pageSize = maxAdminPageSize
+	}
+	return page, pageSize, (page - 1) * pageSize
 }
-// AdminListCourses lists courses for admin.
+// courseListOrder validates the order_by and order_dir parameters of AdminListCourses against SQL
+// injection, falling back to course_code ascending.
+func courseListOrder(orderBy, orderDir string) (string, string) {
+	validOrderBy := map[string]bool{"course_code": true, "marketing_name": true, "exams_taken": true}
+	if !validOrderBy[orderBy] {
+		orderBy = "course_code"
+	}
+	if orderDir != "asc" && orderDir != "desc" {
+		orderDir = "asc"
+	}
+	return orderBy, orderDir
+}
+// AdminListCourses lists courses for admin, paginated with page and page_size.
 // GET /admin/courses
 func AdminListCourses(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Pagination parameters
-		pageStr := c.DefaultQuery("page", "1")
-		page, _ := strconv.Atoi(pageStr)
-		if page < 1 {
-			page = 1
-		}
-		pageSize := 25
-		offset := (page - 1) * pageSize
+		ctx := c.Request.Context()
+		page, pageSize, offset := adminPagination(c, pool)
 		searchQuery := c.Query("search")
-		orderBy := c.DefaultQuery("order_by", "course_code")
-		orderDir := c.DefaultQuery("order_dir", "asc")
-		// Validate order_by and order_dir to prevent SQL injection
-		validOrderBy := map[string]bool{"course_code": true, "marketing_name": true, "exams_taken": true}
-		if !validOrderBy[orderBy] {
-			orderBy = "course_code"
-		}
-		if orderDir != "asc" && orderDir != "desc" {
-			orderDir = "asc"
-		}
+		orderBy, orderDir := courseListOrder(c.DefaultQuery("order_by", "course_code"), c.DefaultQuery("order_dir", "asc"))
 		query := fmt.Sprintf(`
 			SELECT
 				c.id, c.course_code, c.marketing_name, c.duration_days, c.responsibility,
@@ -98,13 +183,12 @@ func AdminListCourses(pool *pgxpool.Pool) gin.HandlerFunc {
 			LEFT JOIN exam_attempts ea ON e.id = ea.exam_id
 			WHERE c.course_code ILIKE $1 OR c.marketing_name ILIKE $1
 			GROUP BY c.id
-			ORDER BY %s %s
+			ORDER BY %s %s, c.id -- id breaks ties so pages neither repeat nor skip courses
 			LIMIT $2 OFFSET $3
 		`, orderBy, orderDir)
-		rows, err := pool.Query(context.Background(), query, "%"+searchQuery+"%", pageSize, offset)
+		rows, err := pool.Query(ctx, query, "%"+searchQuery+"%", pageSize, offset)
 		if err != nil {
-			log.Printf("Error querying courses for admin: %v", err)
-			c.HTML(http.StatusInternalServerError, "admin_courses", gin.H{"error": "Failed to retrieve courses"})
+			renderAdminError(c, "admin_courses", "Manage Courses", "courses", err)
 			return
 		}
 		defer rows.Close()
@@ -121,8 +205,7 @@ func AdminListCourses(pool *pgxpool.Pool) gin.HandlerFunc {
 			if err := rows.Scan(
 				&course.ID, &course.CourseCode, &course.MarketingName, &course.DurationDays, &course.Responsibility, &course.ExamsTaken,
 			); err != nil {
-				log.Printf("Error scanning course row for admin: %v", err)
-				c.HTML(http.StatusInternalServerError, "admin_courses", gin.H{"error": "Failed to process course data"})
+				renderAdminError(c, "admin_courses", "Manage Courses", "course data", err)
 				return
 			}
 			courses = append(courses, course)
@@ -130,13 +213,17 @@ func AdminListCourses(pool *pgxpool.Pool) gin.HandlerFunc {
 		// Count total records for pagination
 		var totalCourses int
 		countQuery := `SELECT COUNT(DISTINCT c.id) FROM courses c WHERE c.course_code ILIKE $1 OR c.marketing_name ILIKE $1`
-		pool.QueryRow(context.Background(), countQuery, "%"+searchQuery+"%").Scan(&totalCourses)
+		if err := pool.QueryRow(ctx, countQuery, "%"+searchQuery+"%").Scan(&totalCourses); err != nil {
+			renderAdminError(c, "admin_courses", "Manage Courses", "course count", err)
+			return
+		}
 		totalPages := int(math.Ceil(float64(totalCourses) / float64(pageSize))) // FIXED: math.Ceil is now available
 		c.HTML(http.StatusOK, "admin_courses", gin.H{
 			"Title":       "Manage Courses",
 			"Courses":     courses,
 			"CurrentPage": page,
 			"TotalPages":  totalPages,
+			"PageSize":    pageSize,
 			"SearchQuery": searchQuery,
 			"OrderBy":     orderBy,
 			"OrderDir":    orderDir,
@@ -148,6 +235,7 @@ func AdminListCourses(pool *pgxpool.Pool) gin.HandlerFunc {
 // POST /admin/courses
 func AdminCreateCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		var req models.AdminCourseCreateRequest
 		if err := c.ShouldBind(&req); err != nil { // Use ShouldBind for form data
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -155,17 +243,17 @@ func AdminCreateCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 		}
 		// Basic validation: Check if course_code already exists
 		var existingID int
-		err := pool.QueryRow(context.Background(), `SELECT id FROM courses WHERE course_code = $1`, req.CourseCode).Scan(&existingID)
+		err := pool.QueryRow(ctx, `SELECT id FROM courses WHERE course_code = $1`, req.CourseCode).Scan(&existingID)
 		if err == nil {
 			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Course with code %s already exists", req.CourseCode)})
 			return
 		}
-		_, err = pool.Exec(context.Background(), `
+		_, err = pool.Exec(ctx, `
 			INSERT INTO courses (name, course_code, duration_days, marketing_name, responsibility)
 			VALUES ($1, $2, $3, $4, $5)
 		`, req.Name, req.CourseCode, req.DurationDays, req.MarketingName, req.Responsibility)
 		if err != nil {
-			log.Printf("Error creating course: %v", err)
+			logRequestError(c, "Error creating course: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create course"})
 			return
 		}
@@ -177,13 +265,14 @@ func AdminCreateCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 // PUT /admin/courses/:course_code
 func AdminUpdateCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		courseCode := c.Param("course_code")
 		var req models.AdminCourseCreateRequest // Reuse struct for update fields
 		if err := c.ShouldBindJSON(&req); err != nil { // Assuming JSON for PUT
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		res, err := pool.Exec(context.Background(), `
+		res, err := pool.Exec(ctx, `
 			UPDATE courses SET
 				name = $1,
 				duration_days = $2,
@@ -192,7 +281,7 @@ func AdminUpdateCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 			WHERE course_code = $5
 		`, req.Name, req.DurationDays, req.MarketingName, req.Responsibility, courseCode)
 		if err != nil {
-			log.Printf("Error updating course %s: %v", courseCode, err)
+			logRequestError(c, "Error updating course %s: %v", courseCode, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update course"})
 			return
 		}
@@ -208,10 +297,11 @@ func AdminUpdateCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 // DELETE /admin/courses/:course_code
 func AdminDeleteCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		courseCode := c.Param("course_code")
-		res, err := pool.Exec(context.Background(), `DELETE FROM courses WHERE course_code = $1`, courseCode)
+		res, err := pool.Exec(ctx, `DELETE FROM courses WHERE course_code = $1`, courseCode)
 		if err != nil {
-			log.Printf("Error deleting course %s: %v", courseCode, err)
+			logRequestError(c, "Error deleting course %s: %v", courseCode, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course"})
 			return
 		}
@@ -223,23 +313,827 @@ func AdminDeleteCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"message": "Course deleted successfully", "course_code": courseCode})
 	}
 }
-// AdminErrorLogs displays validation error logs.
+// AdminExamPlanPreview runs GenerateExamPlan as a dry run over the course's stored questions and the
+// exam bank metadata of its last ingestion, without writing to any table. The response reports the
+// eligible questions per domain and the domains limiting the plan, including why no plan could be formed.
+// GET /admin/courses/:course_code/exam_plan
+func AdminExamPlanPreview(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		courseCode := c.Param("course_code")
+		var courseID int
+		var examBankVersion *string
+		var metadataJSON []byte
+		err := pool.QueryRow(ctx, `
+			SELECT id, exam_bank_version, exam_bank_metadata FROM courses WHERE course_code = $1
+		`, courseCode).Scan(&courseID, &examBankVersion, &metadataJSON)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s not found", courseCode)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching course %s for exam plan preview: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve course"})
+			return
+		}
+		if examBankVersion == nil || metadataJSON == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s has no ingested exam bank", courseCode)})
+			return
+		}
+		var metadata models.ExamBankMetadata
+		if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+			logRequestError(c, "Error unmarshaling exam bank metadata for %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read exam bank metadata"})
+			return
+		}
+		excludeFlagged := db.GetSettingBool(pool, "exclude_flagged_questions", true)
+		questions, err := exam.GetQuestionsByCourseAndVersion(ctx, pool, courseID, *examBankVersion, excludeFlagged)
+		if err != nil {
+			logRequestError(c, "Error fetching questions for exam plan preview of %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve questions"})
+			return
+		}
+		preview := models.ExamPlanPreview{
+			CourseCode:        courseCode,
+			ExamBankVersion:   *examBankVersion,
+			MinQuestions:      metadata.MinQuestions,
+			MaxQuestions:      metadata.MaxQuestions,
+			DomainWeights:     metadata.Domains,
+			AvailableByDomain: make(map[string]int),
+			PerDomainPerExam:  map[string]int{},
+			TargetExamCount:   metadata.TargetExamCount,
+			LimitingDomains:   []string{},
+		}
+		for domain := range metadata.Domains {
+			preview.AvailableByDomain[domain] = 0
+		}
+		for _, q := range questions {
+			preview.AvailableByDomain[q.DomainName]++
+		}
+		plan, err := exam.GenerateExamPlan(questions, metadata.MinQuestions, metadata.MaxQuestions, metadata.Domains, metadata.TargetExamCount, exam.LoadPlanTieBreak(ctx, pool))
+		if err != nil {
+			preview.Error = err.Error()
+			preview.Shortages = exam.DomainShortages(questions, metadata.MinQuestions, metadata.Domains)
+			for _, shortage := range preview.Shortages {
+				preview.LimitingDomains = append(preview.LimitingDomains, shortage.Domain)
+			}
+			c.JSON(http.StatusOK, preview)
+			return
+		}
+		preview.NumExams = plan.NumExams
+		preview.QuestionsPerExam = plan.QuestionsPerExam
+		preview.PerDomainPerExam = plan.PerDomainPerExam
+		preview.ReuseAcrossExams = plan.ReuseAcrossExams
+		preview.LimitingDomains = exam.LimitingDomains(questions, plan)
+		c.JSON(http.StatusOK, preview)
+	}
+}
+// AdminGenerateSampleExam generates a single demo exam of the requested size from the course's questions of
+// its current exam_bank_version, ignoring min_questions, max_questions and question reuse, for banks too
+// small for a real exam plan (see exam.GenerateSampleExam). The exam is marked sample and never served
+// to students; generating again replaces it.
+// POST /admin/courses/:course_code/sample_exam
+func AdminGenerateSampleExam(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		courseCode := c.Param("course_code")
+		var req models.SampleExamRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var courseID int
+		var marketingName string
+		var examBankVersion *string
+		var metadataJSON []byte
+		err := pool.QueryRow(ctx, `
+			SELECT id, COALESCE(marketing_name, name), exam_bank_version, exam_bank_metadata FROM courses WHERE course_code = $1
+		`, courseCode).Scan(&courseID, &marketingName, &examBankVersion, &metadataJSON)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s not found", courseCode)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching course %s for sample exam: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve course"})
+			return
+		}
+		if examBankVersion == nil || metadataJSON == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s has no ingested exam bank", courseCode)})
+			return
+		}
+		var metadata models.ExamBankMetadata
+		if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+			logRequestError(c, "Error unmarshaling exam bank metadata for %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read exam bank metadata"})
+			return
+		}
+		examID, perDomain, err := exam.GenerateSampleExam(ctx, pool, courseID, marketingName, *examBankVersion, metadata, req.Size, exam.LoadSelectionStrategy(ctx, pool))
+		if errors.Is(err, exam.ErrSampleSize) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error generating sample exam for %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate sample exam"})
+			return
+		}
+		sample := models.SampleExam{ExamID: examID, ExamBankVersion: *examBankVersion, Sample: true, Questions: req.Size, PerDomain: perDomain}
+		if err := pool.QueryRow(ctx, `SELECT title FROM exams WHERE id = $1`, examID).Scan(&sample.Title); err != nil {
+			logRequestError(c, "Error fetching sample exam %d: %v", examID, err)
+		}
+		db.LogAdminEvent(pool, c.GetString("user_email"), "generate_sample_exam", courseCode, fmt.Sprintf("Sample exam %d with %d questions", examID, req.Size))
+		c.JSON(http.StatusCreated, sample)
+	}
+}
+// AdminExportExamBank streams the course's own questions of its current exam_bank_version, with choices and
+// acceptable answers, and the exam bank metadata of its last ingestion as a JSON document (see
+// models.ExamBankExportCourse). The exam_bank object can be saved as exam_bank.json and re-ingested.
+// Questions drawn from shared banks belong to their owning course and are not included.
+// GET /admin/courses/:course_code/export
+func AdminExportExamBank(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		courseCode := c.Param("course_code")
+		var courseID int
+		var course models.ExamBankExportCourse
+		var examBankVersion, marketingName *string
+		var metadataJSON []byte
+		err := pool.QueryRow(ctx, `
+			SELECT id, course_code, name, marketing_name, exam_bank_version, exam_bank_metadata FROM courses WHERE course_code = $1
+		`, courseCode).Scan(&courseID, &course.CourseCode, &course.Name, &marketingName, &examBankVersion, &metadataJSON)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s not found", courseCode)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching course %s for export: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve course"})
+			return
+		}
+		if examBankVersion == nil || metadataJSON == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s has no ingested exam bank", courseCode)})
+			return
+		}
+		course.ExamBankVersion = *examBankVersion
+		if marketingName != nil {
+			course.MarketingName = *marketingName
+		}
+		var metadata models.ExamBankMetadata
+		if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+			logRequestError(c, "Error unmarshaling exam bank metadata for %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read exam bank metadata"})
+			return
+		}
+		exportMetadata := models.ExamBankJSONMetadata{
+			SchemaVersion:   *examBankVersion,
+			MinQuestions:    metadata.MinQuestions,
+			MaxQuestions:    metadata.MaxQuestions,
+			ExamTime:        metadata.ExamTime,
+			PassingScore:    metadata.PassingScore,
+			Domains:         metadata.Domains,
+			AllowPractice:   &metadata.AllowPractice,
+			AllowSimulation: &metadata.AllowSimulation,
+			TargetExamCount: metadata.TargetExamCount,
+			PenaltyPerWrong: metadata.PenaltyPerWrong,
+			FuzzyAcceptDistance: metadata.FuzzyAcceptDistance,
+			Instructions:    metadata.Instructions,
+		}
+		rows, err := pool.Query(ctx, ingestion.ExamBankQuestionsQuery, courseID, *examBankVersion)
+		if err != nil {
+			logRequestError(c, "Error querying questions for export of %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve questions"})
+			return
+		}
+		defer rows.Close()
+		// Stream the document one question at a time. Once the status is sent a failure can only
+		// truncate the body, which leaves invalid JSON rather than a silently incomplete export.
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="exam-bank-%s-%s.json"`, courseCode, *examBankVersion))
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		c.Writer.WriteString(`{"course":`)
+		encoder.Encode(course)
+		c.Writer.WriteString(`,"exam_bank":{"metadata":`)
+		encoder.Encode(exportMetadata)
+		c.Writer.WriteString(`,"questions":[`)
+		count := 0
+		for rows.Next() {
+			q, err := ingestion.ScanExamBankQuestion(rows)
+			if err != nil {
+				logRequestError(c, "Error scanning question for export of %s: %v", courseCode, err)
+				return
+			}
+			if count > 0 {
+				c.Writer.WriteString(",")
+			}
+			if err := encoder.Encode(q); err != nil {
+				logRequestError(c, "Error writing export of %s: %v", courseCode, err)
+				return
+			}
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			logRequestError(c, "Error reading questions for export of %s: %v", courseCode, err)
+			return
+		}
+		c.Writer.WriteString("]}}\n")
+		db.LogAdminEvent(pool, c.GetString("user_email"), "export_exam_bank", courseCode, fmt.Sprintf("Exported %d questions of version %s", count, *examBankVersion))
+	}
+}
+// AdminExportExamBankCSV returns the course's exam bank regenerated as exam_bank.csv (see
+// ingestion.ExportExamBankCSV), ready to be committed and re-ingested.
+// GET /admin/courses/:course_code/export.csv
+func AdminExportExamBankCSV(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		courseCode := c.Param("course_code")
+		data, err := ingestion.ExportExamBankCSV(pool, courseCode)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s not found", courseCode)})
+			return
+		}
+		if err == ingestion.ErrNoExamBank {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s has no ingested exam bank", courseCode)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error exporting exam bank CSV of %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export exam bank"})
+			return
+		}
+		db.LogAdminEvent(pool, c.GetString("user_email"), "export_exam_bank_csv", courseCode, fmt.Sprintf("Exported exam_bank.csv (%d bytes)", len(data)))
+		c.Header("Content-Disposition", `attachment; filename="exam_bank.csv"`)
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", data)
+	}
+}
+// AdminDomainDifficulty aggregates, per domain, how students do across all exams of a course: the average of
+// the domain percentages stored with completed attempts, and the average p-value (share of recorded answers
+// that are correct, under strict grading) of the domain's questions that were answered. Abandoned attempts
+// are left out; ?mode=practice or ?mode=simulation restricts the attempts. Hardest domains are listed first.
+// GET /admin/courses/:course_code/domain_difficulty
+func AdminDomainDifficulty(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		courseCode := c.Param("course_code")
+		mode := c.Query("mode")
+		if mode != "" && mode != "practice" && mode != "simulation" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be 'practice' or 'simulation'"})
+			return
+		}
+		var courseID int
+		err := pool.QueryRow(ctx, `SELECT id FROM courses WHERE course_code = $1`, courseCode).Scan(&courseID)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course %s not found", courseCode)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching course %s for domain difficulty: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve course"})
+			return
+		}
+		// Questions are grouped by domain name, so shared bank questions count toward the course's domain
+		rows, err := pool.Query(ctx, `
+			WITH attempts AS (
+				SELECT ea.id, ea.domain_breakdown
+				FROM exam_attempts ea
+				JOIN exams e ON ea.exam_id = e.id
+				WHERE e.course_id = $1 AND ea.completed_at IS NOT NULL AND ea.abandoned_at IS NULL
+					AND ($2::text = '' OR ea.mode = $2)
+			),
+			domain_scores AS (
+				SELECT b.key AS domain, AVG(b.value::float8) AS average_score, COUNT(*) AS attempts
+				FROM attempts a, jsonb_each_text(a.domain_breakdown) b
+				GROUP BY b.key
+			),
+			question_p_values AS (
+				SELECT d.name AS domain, q.id, AVG(CASE WHEN ua.is_correct THEN 1.0 ELSE 0.0 END)::float8 AS p_value
+				FROM attempts a
+				JOIN user_answers ua ON ua.attempt_id = a.id
+				JOIN exam_questions eq ON ua.exam_question_id = eq.id
+				JOIN questions q ON eq.question_id = q.id
+				JOIN domains d ON q.domain_id = d.id
+				GROUP BY d.name, q.id
+			),
+			domain_p_values AS (
+				SELECT domain, AVG(p_value) AS average_p_value, COUNT(*) AS questions FROM question_p_values GROUP BY domain
+			)
+			SELECT COALESCE(s.domain, p.domain), s.average_score, COALESCE(s.attempts, 0), p.average_p_value, COALESCE(p.questions, 0)
+			FROM domain_scores s
+			FULL OUTER JOIN domain_p_values p ON s.domain = p.domain
+			ORDER BY COALESCE(s.average_score, p.average_p_value * 100) NULLS LAST, 1
+		`, courseID, mode)
+		if err != nil {
+			logRequestError(c, "Error computing domain difficulty for %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute domain difficulty"})
+			return
+		}
+		defer rows.Close()
+		resp := models.DomainDifficultyResponse{CourseCode: courseCode, Mode: mode, Domains: []models.DomainDifficulty{}}
+		for rows.Next() {
+			var dd models.DomainDifficulty
+			if err := rows.Scan(&dd.Domain, &dd.AverageScore, &dd.Attempts, &dd.AveragePValue, &dd.QuestionsAnswered); err != nil {
+				logRequestError(c, "Error scanning domain difficulty for %s: %v", courseCode, err)
+				continue
+			}
+			resp.Domains = append(resp.Domains, dd)
+		}
+		if err := rows.Err(); err != nil {
+			logRequestError(c, "Error reading domain difficulty for %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute domain difficulty"})
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+// AdminUpdateExam updates the passing score, allowed session modes and instructions of an already-generated
+// exam; an empty instructions string clears them. Scoring reads passing_score from the exams row at submission
+// time, so the new threshold applies to every attempt scored afterwards. Re-ingesting the course
+// resets the values to the ones in the exam bank metadata.
+// PUT /admin/exams/:exam_id
+func AdminUpdateExam(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		examID, err := strconv.Atoi(c.Param("exam_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid exam ID"})
+			return
+		}
+		var req models.AdminExamUpdateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.PassingScore == nil && req.AllowPractice == nil && req.AllowSimulation == nil && req.Instructions == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At least one of passing_score, allow_practice, allow_simulation or instructions is required"})
+			return
+		}
+		if req.Instructions != nil {
+			trimmed := strings.TrimSpace(*req.Instructions)
+			if len(trimmed) > ingestion.MaxInstructionsLength {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("instructions must be at most %d characters", ingestion.MaxInstructionsLength)})
+				return
+			}
+			req.Instructions = &trimmed
+		}
+		if req.PassingScore != nil && (*req.PassingScore < 0 || *req.PassingScore > 100) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "passing_score must be between 0 and 100"})
+			return
+		}
+		var oldPassingScore, newPassingScore float64
+		var allowPractice, allowSimulation bool
+		var instructions *string
+		err = pool.QueryRow(ctx, `
+			UPDATE exams e SET
+				passing_score = COALESCE($1, e.passing_score),
+				allow_practice = COALESCE($2, e.allow_practice),
+				allow_simulation = COALESCE($3, e.allow_simulation),
+				instructions = NULLIF(COALESCE($5, e.instructions), '')
+			FROM (SELECT id, passing_score FROM exams WHERE id = $4) old
+			WHERE e.id = old.id
+			RETURNING old.passing_score, e.passing_score, e.allow_practice, e.allow_simulation, e.instructions
+		`, req.PassingScore, req.AllowPractice, req.AllowSimulation, examID, req.Instructions).Scan(&oldPassingScore, &newPassingScore, &allowPractice, &allowSimulation, &instructions)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Exam with ID %d not found", examID)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error updating exam %d: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update exam"})
+			return
+		}
+		if req.PassingScore != nil {
+			db.LogAdminEvent(pool, c.GetString("user_email"), "update_exam_passing_score", strconv.Itoa(examID), fmt.Sprintf("Passing score changed from %.2f to %.2f", oldPassingScore, newPassingScore))
+		}
+		if req.AllowPractice != nil || req.AllowSimulation != nil {
+			db.LogAdminEvent(pool, c.GetString("user_email"), "update_exam_modes", strconv.Itoa(examID), fmt.Sprintf("allow_practice=%t, allow_simulation=%t", allowPractice, allowSimulation))
+		}
+		if req.Instructions != nil {
+			notes := "Instructions cleared"
+			if instructions != nil {
+				notes = fmt.Sprintf("Instructions set (%d characters)", len(*instructions))
+			}
+			db.LogAdminEvent(pool, c.GetString("user_email"), "update_exam_instructions", strconv.Itoa(examID), notes)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":          "Exam updated successfully",
+			"exam_id":          examID,
+			"passing_score":    newPassingScore,
+			"allow_practice":   allowPractice,
+			"allow_simulation": allowSimulation,
+			"instructions":     instructions,
+		})
+	}
+}
+// AdminRescoreExam re-runs scoring for every completed attempt of an exam, e.g. after a miskeyed answer
+// is fixed, and updates the stored scores and domain breakdowns. Every attempt is graded before the updates
+// run in one transaction, so a failure leaves all stored scores as they were. Attempts are graded with the
+// current answer keys and scoring_mode; the response summarizes what changed.
+// POST /admin/exams/:exam_id/rescore_all
+func AdminRescoreExam(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		examID, err := strconv.Atoi(c.Param("exam_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid exam ID"})
+			return
+		}
+		var req models.AdminRescoreRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var passingScore, penaltyPerWrong float64
+		var totalQuestions int
+		err = pool.QueryRow(ctx, `
+			SELECT e.passing_score, e.penalty_per_wrong, (SELECT COUNT(id) FROM exam_questions WHERE exam_id = e.id) FROM exams e WHERE e.id = $1
+		`, examID).Scan(&passingScore, &penaltyPerWrong, &totalQuestions)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Exam with ID %d not found", examID)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching exam %d for rescoring: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescore exam"})
+			return
+		}
+		if totalQuestions == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Exam %d has no questions to score", examID)})
+			return
+		}
+		type storedAttempt struct {
+			ID           int
+			ScorePercent int
+		}
+		var attempts []storedAttempt
+		rows, err := pool.Query(ctx, `
+			SELECT id, COALESCE(score_percent, 0) FROM exam_attempts
+			WHERE exam_id = $1 AND completed_at IS NOT NULL
+			ORDER BY id
+		`, examID)
+		if err != nil {
+			logRequestError(c, "Error fetching attempts of exam %d for rescoring: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescore exam"})
+			return
+		}
+		for rows.Next() {
+			var a storedAttempt
+			if err := rows.Scan(&a.ID, &a.ScorePercent); err != nil {
+				rows.Close()
+				logRequestError(c, "Error scanning attempt of exam %d for rescoring: %v", examID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescore exam"})
+				return
+			}
+			attempts = append(attempts, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			logRequestError(c, "Error reading attempts of exam %d for rescoring: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescore exam"})
+			return
+		}
+		// Graded up front so the transaction only holds its locks for the updates
+		scores := make([]exam.AttemptScore, len(attempts))
+		for i, a := range attempts {
+			if scores[i], err = exam.ScoreAttempt(ctx, pool, a.ID, examID, "eq.question_order"); err != nil {
+				logRequestError(c, "Error rescoring attempt %d of exam %d: %v", a.ID, examID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescore exam"})
+				return
+			}
+		}
+		summary := models.RescoreSummary{ExamID: examID, Changes: []models.RescoreChange{}}
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			logRequestError(c, "Error beginning rescore transaction for exam %d: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescore exam"})
+			return
+		}
+		defer tx.Rollback(ctx) // Rollback on error
+		deltaSum := 0
+		for i, a := range attempts {
+			score := scores[i]
+			newScore := exam.ScorePercent(score, totalQuestions, penaltyPerWrong)
+			breakdownJSON, err := json.Marshal(score.DomainBreakdown)
+			if err == nil {
+				_, err = tx.Exec(ctx, `
+					UPDATE exam_attempts SET score_percent = $1, domain_breakdown = $2 WHERE id = $3
+				`, newScore, breakdownJSON, a.ID)
+			}
+			if err == nil {
+				err = exam.StoreAnswerCorrectness(ctx, tx, a.ID, score)
+			}
+			if err != nil {
+				logRequestError(c, "Error storing rescored attempt %d of exam %d: %v", a.ID, examID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescore exam"})
+				return
+			}
+			if newScore == a.ScorePercent {
+				continue
+			}
+			change := models.RescoreChange{AttemptID: a.ID, OldScore: a.ScorePercent, NewScore: newScore, Delta: newScore - a.ScorePercent}
+			summary.Changes = append(summary.Changes, change)
+			if exam.Passed(a.ScorePercent, passingScore) != exam.Passed(newScore, passingScore) {
+				summary.PassChanged++
+			}
+			deltaSum += change.Delta
+			absDelta := change.Delta
+			if absDelta < 0 {
+				absDelta = -absDelta
+			}
+			if absDelta > summary.MaxAbsDelta {
+				summary.MaxAbsDelta = absDelta
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
+			logRequestError(c, "Error committing rescore of exam %d: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rescore exam"})
+			return
+		}
+		summary.AttemptsRescored = len(attempts)
+		summary.AttemptsChanged = len(summary.Changes)
+		if summary.AttemptsChanged > 0 {
+			summary.MeanDelta = float64(deltaSum) / float64(summary.AttemptsChanged)
+		}
+		// Answer key changes also affect reliability; a failure does not undo the rescore
+		if _, err := exam.ComputeReliability(pool, examID); err != nil {
+			logRequestError(c, "Error computing reliability for exam %d after rescoring: %v", examID, err)
+		}
+		db.LogAdminEvent(pool, c.GetString("user_email"), "rescore_exam", strconv.Itoa(examID), fmt.Sprintf("Rescored %d attempts, %d changed (mean change %.1f): %s", summary.AttemptsRescored, summary.AttemptsChanged, summary.MeanDelta, req.Reason))
+		c.JSON(http.StatusOK, summary)
+	}
+}
+// AdminRetitleExam renames a generated exam. The title is stored as an override for the exam's
+// bank and position in its generation plan, so regenerating the course's exams keeps it.
+// PATCH /admin/exams/:exam_id
+func AdminRetitleExam(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		examID, err := strconv.Atoi(c.Param("exam_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid exam ID"})
+			return
+		}
+		var req models.AdminExamRetitleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		title := strings.TrimSpace(req.Title)
+		if title == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "title must not be empty"})
+			return
+		}
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			logRequestError(c, "Error beginning transaction to retitle exam %d: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update exam"})
+			return
+		}
+		defer tx.Rollback(ctx) // Rollback on error
+		var courseID int
+		var examNumber *int
+		var oldTitle, examBankVersion string
+		err = tx.QueryRow(ctx, `
+			SELECT course_id, exam_number, COALESCE(title, ''), exam_bank_version FROM exams WHERE id = $1 FOR UPDATE
+		`, examID).Scan(&courseID, &examNumber, &oldTitle, &examBankVersion)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Exam with ID %d not found", examID)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching exam %d to retitle: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update exam"})
+			return
+		}
+		if examNumber == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Exam was generated before titles could be overridden; re-ingest the course and retry"})
+			return
+		}
+		bankName := exam.BankName(examBankVersion)
+		_, err = tx.Exec(ctx, `
+			INSERT INTO exam_title_overrides (course_id, bank_name, exam_number, title, updated_by)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (course_id, bank_name, exam_number) DO UPDATE SET
+				title = EXCLUDED.title,
+				updated_by = EXCLUDED.updated_by,
+				updated_at = CURRENT_TIMESTAMP
+		`, courseID, bankName, *examNumber, title, c.GetString("user_email"))
+		if err == nil {
+			// Every version of the exam's bank shares the plan position, so retitle them all; the bank name
+			// follows the only '+' of exam_bank_version (schema_version may not contain one)
+			_, err = tx.Exec(ctx, `
+				UPDATE exams SET title = $1, title_override = TRUE
+				WHERE course_id = $2 AND exam_number = $3 AND split_part(exam_bank_version, '+', 2) = $4
+			`, title, courseID, *examNumber, bankName)
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			logRequestError(c, "Error retitling exam %d: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update exam"})
+			return
+		}
+		db.LogAdminEvent(pool, c.GetString("user_email"), "retitle_exam", strconv.Itoa(examID), fmt.Sprintf("Title changed from '%s' to '%s'", oldTitle, title))
+		c.JSON(http.StatusOK, gin.H{"message": "Exam retitled successfully", "exam_id": examID, "title": title})
+	}
+}
+// AdminLiveExamSessions reports the progress of every in-progress attempt for an exam,
+// using one batched query; time remaining is computed as in GetExamSessionStatus.
+// GET /admin/exams/:exam_id/live
+func AdminLiveExamSessions(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		examID, err := strconv.Atoi(c.Param("exam_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid exam ID"})
+			return
+		}
+		var examTitle string
+		var examTimeMinutes, totalQuestions int
+		err = pool.QueryRow(ctx, `
+			SELECT e.title, e.exam_time, (SELECT COUNT(eq.id) FROM exam_questions eq WHERE eq.exam_id = e.id)
+			FROM exams e WHERE e.id = $1
+		`, examID).Scan(&examTitle, &examTimeMinutes, &totalQuestions)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Exam with ID %d not found", examID)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching exam %d for live view: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exam"})
+			return
+		}
+		rows, err := pool.Query(ctx, `
+			SELECT ea.id, ea.email, ea.mode, ea.started_at, COUNT(ua.id)
+			FROM exam_attempts ea
+			LEFT JOIN user_answers ua ON ua.attempt_id = ea.id
+			WHERE ea.exam_id = $1 AND ea.completed_at IS NULL AND ea.abandoned_at IS NULL
+			GROUP BY ea.id, ea.email, ea.mode, ea.started_at
+			ORDER BY ea.started_at
+		`, examID)
+		if err != nil {
+			logRequestError(c, "Error querying live attempts for exam %d: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve live sessions"})
+			return
+		}
+		defer rows.Close()
+		sessions := []models.LiveAttemptStatus{}
+		for rows.Next() {
+			var s models.LiveAttemptStatus
+			if err := rows.Scan(&s.AttemptID, &s.Email, &s.Mode, &s.StartedAt, &s.AnsweredCount); err != nil {
+				logRequestError(c, "Error scanning live attempt row: %v", err)
+				continue
+			}
+			s.TotalQuestions = totalQuestions
+			s.TimeRemaining = formatTimeRemaining(s.StartedAt, examTimeMinutes)
+			sessions = append(sessions, s)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"exam_id":    examID,
+			"exam_title": examTitle,
+			"sessions":   sessions,
+		})
+	}
+}
+// AdminExamStats reports score statistics and the stored reliability (Cronbach's alpha) of an exam
+// over its completed simulation attempts.
+// GET /admin/exams/:exam_id/stats
+func AdminExamStats(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		examID, err := strconv.Atoi(c.Param("exam_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid exam ID"})
+			return
+		}
+		var stats models.ExamStats
+		err = pool.QueryRow(ctx, `
+			SELECT
+				e.id, e.title,
+				(SELECT COUNT(eq.id) FROM exam_questions eq WHERE eq.exam_id = e.id),
+				COUNT(ea.id),
+				AVG(ea.score_percent)::float8,
+				(100.0 * COUNT(ea.id) FILTER (WHERE ea.score_percent >= e.passing_score) / NULLIF(COUNT(ea.id), 0))::float8,
+				e.reliability, e.reliability_attempts, e.reliability_updated_at
+			FROM exams e
+			LEFT JOIN exam_attempts ea ON ea.exam_id = e.id AND ea.mode = 'simulation' AND ea.completed_at IS NOT NULL
+			WHERE e.id = $1
+			GROUP BY e.id
+		`, examID).Scan(
+			&stats.ExamID, &stats.Title, &stats.QuestionCount, &stats.SimulationAttempts, &stats.AverageScore, &stats.PassRate,
+			&stats.Reliability, &stats.ReliabilityAttempts, &stats.ReliabilityUpdatedAt,
+		)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Exam with ID %d not found", examID)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching stats for exam %d: %v", examID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exam stats"})
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	}
+}
+// AdminNormalizePreview shows how a student answer and a fill-in-the-blank question's stored acceptable
+// answers normalize, and whether they would match, using the same normalization as grading. For questions
+// with ignore_flag_order, the normalized forms are the canonical commands that grading compares.
+// GET /admin/questions/:id/normalize_preview?answer=...
+func AdminNormalizePreview(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		locale := db.AnswerLocale(pool)
+		questionID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid question ID"})
+			return
+		}
+		answer, ok := c.GetQuery("answer")
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "answer query parameter is required"})
+			return
+		}
+		var questionType string
+		var ignoreFlagOrder bool
+		err = pool.QueryRow(ctx, `SELECT question_type, ignore_flag_order FROM questions WHERE id = $1`, questionID).Scan(&questionType, &ignoreFlagOrder)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Question not found"})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching question %d for normalize preview: %v", questionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch question"})
+			return
+		}
+		if questionType != "fillblank" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Normalize preview is only available for fill-in-the-blank questions"})
+			return
+		}
+		rows, err := pool.Query(ctx, `
+			SELECT acceptable_answer, is_regex FROM fill_blank_answers WHERE question_id = $1 ORDER BY id
+		`, questionID)
+		if err != nil {
+			logRequestError(c, "Error fetching acceptable answers for question %d: %v", questionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch acceptable answers"})
+			return
+		}
+		defer rows.Close()
+		normalize := func(s string) string {
+			if ignoreFlagOrder {
+				return utils.CanonicalCommand(utils.NormalizeAnswer(s, locale))
+			}
+			return utils.NormalizeAnswer(s, locale)
+		}
+		resp := models.NormalizePreviewResponse{
+			QuestionID:        questionID,
+			Answer:            answer,
+			NormalizedAnswer:  normalize(answer),
+			AcceptableAnswers: []models.NormalizedAnswer{},
+		}
+		for rows.Next() {
+			var stored string
+			var isRegex bool
+			if err := rows.Scan(&stored, &isRegex); err != nil {
+				logRequestError(c, "Error scanning acceptable answer for question %d: %v", questionID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch acceptable answers"})
+				return
+			}
+			normalized := normalize(stored)
+			matches := normalized == resp.NormalizedAnswer
+			if isRegex {
+				// Patterns are shown as declared and matched against the answer as graded (see utils.AnswerMatches)
+				stored = utils.RegexAnswerPrefix + stored
+				normalized = stored
+				matches = utils.AnswerMatches([]string{stored}, utils.NormalizeAnswer(answer, locale), false, 0)
+			}
+			resp.Matches = resp.Matches || matches
+			resp.AcceptableAnswers = append(resp.AcceptableAnswers, models.NormalizedAnswer{Stored: stored, Normalized: normalized, Matches: matches})
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+// AdminErrorLogs displays validation error logs, newest first, paginated with page and page_size.
 // GET /admin/error_logs
 func AdminErrorLogs(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		searchQuery := c.Query("search")
 		searchSource := c.Query("source") // e.g., "ingestion", "exam_generation"
-		query := `
-			SELECT id, timestamp, source, course_code, file_path, line_number, field_name, error_message, suggested_fix
+		page, pageSize, offset := adminPagination(c, pool)
+		filter := `
 			FROM error_logs
 			WHERE (course_code ILIKE $1 OR error_message ILIKE $1)
 			AND ($2 = '' OR source = $2)
-			ORDER BY timestamp DESC
 		`
-		rows, err := pool.Query(context.Background(), query, "%"+searchQuery+"%", searchSource)
+		query := `
+			SELECT id, timestamp, source, course_code, file_path, line_number, field_name, error_message, suggested_fix
+		` + filter + `
+			ORDER BY timestamp DESC, id DESC
+			LIMIT $3 OFFSET $4
+		`
+		rows, err := pool.Query(ctx, query, "%"+searchQuery+"%", searchSource, pageSize, offset)
 		if err != nil {
-			log.Printf("Error querying error logs: %v", err)
-			c.HTML(http.StatusInternalServerError, "admin_error_logs", gin.H{"error": "Failed to retrieve error logs"})
+			renderAdminError(c, "admin_error_logs", "Error Logs", "error logs", err)
 			return
 		}
 		defer rows.Close()
@@ -250,37 +1144,93 @@ func AdminErrorLogs(pool *pgxpool.Pool) gin.HandlerFunc {
 				&logEntry.ID, &logEntry.Timestamp, &logEntry.Source, &logEntry.CourseCode,
 				&logEntry.FilePath, &logEntry.LineNumber, &logEntry.FieldName, &logEntry.ErrorMessage, &logEntry.SuggestedFix,
 			); err != nil {
-				log.Printf("Error scanning error log row: %v", err)
+				logRequestError(c, "Error scanning error log row: %v", err)
 				continue
 			}
 			logs = append(logs, logEntry)
 		}
+		rows.Close()
+		var totalLogs int
+		if err := pool.QueryRow(ctx, `SELECT COUNT(*) `+filter, "%"+searchQuery+"%", searchSource).Scan(&totalLogs); err != nil {
+			renderAdminError(c, "admin_error_logs", "Error Logs", "error log count", err)
+			return
+		}
 		c.HTML(http.StatusOK, "admin_error_logs", gin.H{
 			"Title":        "Error Logs",
 			"ErrorLogs":    logs,
 			"SearchQuery":  searchQuery,
 			"SearchSource": searchSource,
+			"CurrentPage":  page,
+			"TotalPages":   int(math.Ceil(float64(totalLogs) / float64(pageSize))),
+			"PageSize":     pageSize,
 			"UserEmail":    c.GetString("user_email"),
 		})
 	}
 }
-// AdminUserActivity displays student exam attempts.
+// AdminUserActivity displays student exam attempts, newest first.
+// Optional filters: search (email), min_score and max_score (inclusive percentages), pass (true/false,
+// completed attempts only) and mode (practice/simulation). Results are paginated with page and page_size.
 // GET /admin/user_activity
 func AdminUserActivity(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		searchEmail := c.Query("search") // Filter by email
-		query := `
-			SELECT
-				ea.id, ea.email, e.title, ea.score_percent, ea.started_at, ea.completed_at
+		page, pageSize, offset := adminPagination(c, pool)
+		var minScore, maxScore *int
+		for _, bound := range []struct {
+			param  string
+			target **int
+		}{{"min_score", &minScore}, {"max_score", &maxScore}} {
+			param, target := bound.param, bound.target
+			if raw := c.Query(param); raw != "" {
+				value, err := strconv.Atoi(raw)
+				if err != nil || value < 0 || value > 100 {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be an integer between 0 and 100", param)})
+					return
+				}
+				*target = &value
+			}
+		}
+		if minScore != nil && maxScore != nil && *minScore > *maxScore {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "min_score must not exceed max_score"})
+			return
+		}
+		var pass *bool
+		if raw := c.Query("pass"); raw != "" {
+			value, err := strconv.ParseBool(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "pass must be true or false"})
+				return
+			}
+			pass = &value
+		}
+		mode := c.Query("mode")
+		if mode != "" && mode != "practice" && mode != "simulation" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be 'practice' or 'simulation'"})
+			return
+		}
+		filter := `
 			FROM exam_attempts ea
 			JOIN exams e ON ea.exam_id = e.id
 			WHERE ea.email ILIKE $1
+			AND ($2::int IS NULL OR ea.score_percent >= $2)
+			AND ($3::int IS NULL OR ea.score_percent <= $3)
+			AND ($4::boolean IS NULL OR (ea.completed_at IS NOT NULL AND (ea.score_percent >= e.passing_score) = $4))
+			AND ($5 = '' OR ea.mode = $5)
+		`
+		args := []interface{}{"%" + searchEmail + "%", minScore, maxScore, pass, mode}
+		query := `
+			SELECT
+				ea.id, ea.email, e.title, ea.mode, ea.score_percent,
+				CASE WHEN ea.completed_at IS NULL THEN NULL ELSE ea.score_percent >= e.passing_score END AS passed,
+				ea.started_at, ea.completed_at
+		` + filter + `
 			ORDER BY ea.started_at DESC
+			LIMIT $6 OFFSET $7
 		`
-		rows, err := pool.Query(context.Background(), query, "%"+searchEmail+"%")
+		rows, err := pool.Query(ctx, query, append(args, pageSize, offset)...)
 		if err != nil {
-			log.Printf("Error querying user activity: %v", err)
-			c.HTML(http.StatusInternalServerError, "admin_user_activity", gin.H{"error": "Failed to retrieve user activity"})
+			renderAdminError(c, "admin_user_activity", "User Activity", "user activity", err)
 			return
 		}
 		defer rows.Close()
@@ -288,7 +1238,9 @@ func AdminUserActivity(pool *pgxpool.Pool) gin.HandlerFunc {
 			ID          int
 			Email       string
 			ExamTitle   string
+			Mode        string
 			ScorePercent *int // Can be null
+			Passed      *bool // Null until completed
 			StartedAt   time.Time
 			CompletedAt *time.Time // Can be null
 		}
@@ -297,93 +1249,429 @@ func AdminUserActivity(pool *pgxpool.Pool) gin.HandlerFunc {
 				ID          int
 				Email       string
 				ExamTitle   string
+				Mode        string
 				ScorePercent *int
+				Passed      *bool
 				StartedAt   time.Time
 				CompletedAt *time.Time
 			}
 			if err := rows.Scan(
-				&attempt.ID, &attempt.Email, &attempt.ExamTitle, &attempt.ScorePercent, &attempt.StartedAt, &attempt.CompletedAt,
+				&attempt.ID, &attempt.Email, &attempt.ExamTitle, &attempt.Mode, &attempt.ScorePercent, &attempt.Passed, &attempt.StartedAt, &attempt.CompletedAt,
 			); err != nil {
-				log.Printf("Error scanning user activity row: %v", err)
+				logRequestError(c, "Error scanning user activity row: %v", err)
 				continue
 			}
 			attempts = append(attempts, attempt)
 		}
+		rows.Close()
+		var totalAttempts int
+		if err := pool.QueryRow(ctx, `SELECT COUNT(*) `+filter, args...).Scan(&totalAttempts); err != nil {
+			renderAdminError(c, "admin_user_activity", "User Activity", "user activity count", err)
+			return
+		}
+		totalPages := int(math.Ceil(float64(totalAttempts) / float64(pageSize)))
 		c.HTML(http.StatusOK, "admin_user_activity", gin.H{
-			"Title":       "User Activity",
-			"Attempts":    attempts,
-			"SearchEmail": searchEmail,
-			"UserEmail":   c.GetString("user_email"),
+			"Title":         "User Activity",
+			"Attempts":      attempts,
+			"SearchEmail":   searchEmail,
+			"MinScore":      minScore,
+			"MaxScore":      maxScore,
+			"Pass":          pass,
+			"Mode":          mode,
+			"CurrentPage":   page,
+			"TotalPages":    totalPages,
+			"PageSize":      pageSize,
+			"TotalAttempts": totalAttempts,
+			"UserEmail":     c.GetString("user_email"),
 		})
 	}
 }
-// AdminQuestionStats displays question performance and allows flagging.
+// maxRecentFlagReasons bounds the student flag reasons shown per question in the question statistics.
+const maxRecentFlagReasons = 3
+// AdminQuestionStats displays question performance and allows flagging. Student flag reports are counted
+// per question with their most recent reasons; ?min_flags=N keeps questions flagged at least N times and
+// ?order_by=flag_count lists the most reported first. Results are paginated with page and page_size.
 // GET /admin/question_stats
 func AdminQuestionStats(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		searchQuery := c.Query("search")
 		searchDomain := c.Query("domain")
-		query := `
+		draftsOnly := c.Query("draft") == "true"
+		minFlags, _ := strconv.Atoi(c.DefaultQuery("min_flags", "0"))
+		if minFlags < 0 {
+			minFlags = 0
+		}
+		orderBy := c.DefaultQuery("order_by", "id")
+		// Validate order_by to prevent SQL injection
+		validOrderBy := map[string]string{"id": "q.id", "flag_count": "flag_count DESC, q.id"}
+		orderClause, ok := validOrderBy[orderBy]
+		if !ok {
+			orderBy = "id"
+			orderClause = validOrderBy[orderBy]
+		}
+		page, pageSize, offset := adminPagination(c, pool)
+		grouped := fmt.Sprintf(`
 			SELECT
-				q.id, q.question_text, q.question_type, d.name AS domain_name, q.validity_score, q.flagged,
-				COUNT(ua.id) AS times_attempted,
-				SUM(CASE WHEN
-					(q.question_type IN ('single', 'multi', 'truefalse') AND
-						(SELECT COUNT(c.id) FROM choices c WHERE c.question_id = q.id AND c.is_correct = TRUE) = CARDINALITY(ua.choice_ids) AND
-						(SELECT COUNT(c.id) FROM choices c WHERE c.question_id = q.id AND c.is_correct = FALSE AND c.id = ANY(ua.choice_ids)) = 0)
-					OR
-					(q.question_type = 'fillblank' AND
-						EXISTS (SELECT 1 FROM fill_blank_answers fba WHERE fba.question_id = q.id AND LOWER(fba.acceptable_answer) = LOWER(ua.text_answer)))
-				THEN 1 ELSE 0 END) AS correct_count
+				q.id, q.question_text, q.question_type, d.name AS domain_name, co.course_code, q.validity_score, q.flagged, q.draft,
+				COUNT(ua.is_correct) AS times_attempted, -- Answers of scored attempts, graded by exam.ScoreAttempt
+				SUM(CASE WHEN ua.is_correct THEN 1 ELSE 0 END) AS correct_count,
+				(SELECT COUNT(qn.id) FROM question_notes qn WHERE qn.question_id = q.id) AS note_count,
+				COALESCE(qf.flag_count, 0) AS flag_count,
+				qf.recent_reasons
 			FROM questions q
 			JOIN domains d ON q.domain_id = d.id
+			JOIN courses co ON d.course_id = co.id
+			LEFT JOIN (
+				SELECT question_id, COUNT(id) AS flag_count,
+					(array_agg(reason ORDER BY created_at DESC, id DESC) FILTER (WHERE reason IS NOT NULL AND reason <> ''))[1:%d] AS recent_reasons
+				FROM question_flags
+				GROUP BY question_id
+			) qf ON qf.question_id = q.id
 			LEFT JOIN exam_questions eq ON q.id = eq.question_id
 			LEFT JOIN user_answers ua ON eq.id = ua.exam_question_id
 			WHERE (q.question_text ILIKE $1 OR d.name ILIKE $1)
 			AND ($2 = '' OR d.name ILIKE $2)
-			GROUP BY q.id, d.name
-			ORDER BY q.id
-		`
-		rows, err := pool.Query(context.Background(), query, "%"+searchQuery+"%", "%"+searchDomain+"%")
+			AND (NOT $3 OR q.draft)
+			AND COALESCE(qf.flag_count, 0) >= $4
+			GROUP BY q.id, d.name, co.course_code, qf.flag_count, qf.recent_reasons
+		`, maxRecentFlagReasons)
+		args := []interface{}{"%" + searchQuery + "%", "%" + searchDomain + "%", draftsOnly, minFlags}
+		query := grouped + fmt.Sprintf(`
+			ORDER BY %s
+			LIMIT $5 OFFSET $6
+		`, orderClause)
+		rows, err := pool.Query(ctx, query, append(args, pageSize, offset)...)
 		if err != nil {
-			log.Printf("Error querying question stats: %v", err)
-			c.HTML(http.StatusInternalServerError, "admin_question_stats", gin.H{"error": "Failed to retrieve question stats"})
+			renderAdminError(c, "admin_question_stats", "Question Statistics", "question stats", err)
 			return
 		}
 		defer rows.Close()
+		qualityBands := exam.LoadQualityBands(pool)
 		var stats []models.QuestionStats
 		for rows.Next() {
 			var qs models.QuestionStats
 			if err := rows.Scan(
-				&qs.QuestionID, &qs.QuestionText, &qs.QuestionType, &qs.Domain, &qs.ValidityScore, &qs.Flagged,
-				&qs.TimesAttempted, &qs.CorrectCount,
+				&qs.QuestionID, &qs.QuestionText, &qs.QuestionType, &qs.Domain, &qs.CourseCode, &qs.ValidityScore, &qs.Flagged, &qs.Draft,
+				&qs.TimesAttempted, &qs.CorrectCount, &qs.NoteCount, &qs.FlagCount, &qs.RecentFlagReasons,
 			); err != nil {
-				log.Printf("Error scanning question stats row: %v", err)
+				logRequestError(c, "Error scanning question stats row: %v", err)
 				continue
 			}
+			qs.QualityBand = qualityBands.Band(qs.ValidityScore)
 			stats = append(stats, qs)
 		}
+		rows.Close()
+		var totalQuestions int
+		if err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM (`+grouped+`) counted`, args...).Scan(&totalQuestions); err != nil {
+			renderAdminError(c, "admin_question_stats", "Question Statistics", "question count", err)
+			return
+		}
 		c.HTML(http.StatusOK, "admin_question_stats", gin.H{
 			"Title":        "Question Statistics",
 			"Stats":        stats,
 			"SearchQuery":  searchQuery,
 			"SearchDomain": searchDomain,
+			"DraftsOnly":   draftsOnly,
+			"MinFlags":     minFlags,
+			"OrderBy":      orderBy,
+			"CurrentPage":  page,
+			"TotalPages":   int(math.Ceil(float64(totalQuestions) / float64(pageSize))),
+			"PageSize":     pageSize,
 			"UserEmail":    c.GetString("user_email"),
 		})
 	}
 }
+// AdminSearchQuestions searches the question texts of every course with PostgreSQL full-text search
+// (English stemming; q accepts web search syntax such as "quoted phrases", OR and -excluded). Results are
+// ranked by relevance with the course, domain, type and a highlighted snippet, paginated with page and
+// page_size, so content can be found for reuse or de-duplication regardless of course.
+// GET /admin/questions/search?q=...
+func AdminSearchQuestions(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		searchQuery := strings.TrimSpace(c.Query("q"))
+		if searchQuery == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+			return
+		}
+		page, pageSize, offset := adminPagination(c, pool)
+		resp := models.QuestionSearchResponse{Query: searchQuery, Page: page, PageSize: pageSize, Results: []models.QuestionSearchResult{}}
+		err := pool.QueryRow(ctx, `
+			SELECT COUNT(*) FROM questions q
+			WHERE to_tsvector('english', q.question_text) @@ websearch_to_tsquery('english', $1)
+		`, searchQuery).Scan(&resp.Total)
+		if err != nil {
+			logRequestError(c, "Error counting question search results for %q: %v", searchQuery, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search questions"})
+			return
+		}
+		rows, err := pool.Query(ctx, `
+			SELECT q.id, co.course_code, co.name, d.name, q.question_type, q.exam_bank_version,
+				ts_headline('english', q.question_text, query, 'StartSel=**, StopSel=**, MaxWords=30, MinWords=10, MaxFragments=2'),
+				ts_rank(to_tsvector('english', q.question_text), query) AS rank
+			FROM questions q
+			JOIN domains d ON q.domain_id = d.id
+			JOIN courses co ON d.course_id = co.id,
+				websearch_to_tsquery('english', $1) query
+			WHERE to_tsvector('english', q.question_text) @@ query
+			ORDER BY rank DESC, q.id
+			LIMIT $2 OFFSET $3
+		`, searchQuery, pageSize, offset)
+		if err != nil {
+			logRequestError(c, "Error searching questions for %q: %v", searchQuery, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search questions"})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r models.QuestionSearchResult
+			if err := rows.Scan(&r.QuestionID, &r.CourseCode, &r.CourseName, &r.Domain, &r.QuestionType, &r.ExamBankVersion, &r.Snippet, &r.Rank); err != nil {
+				logRequestError(c, "Error scanning question search result: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search questions"})
+				return
+			}
+			resp.Results = append(resp.Results, r)
+		}
+		resp.TotalPages = int(math.Ceil(float64(resp.Total) / float64(pageSize)))
+		c.JSON(http.StatusOK, resp)
+	}
+}
+// maxQuestionNoteLength bounds a single instructor note.
+const maxQuestionNoteLength = 2000
+// AdminListQuestionNotes lists the instructor notes on a question, oldest first.
+// GET /admin/questions/:id/notes
+func AdminListQuestionNotes(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		questionID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid question ID"})
+			return
+		}
+		var exists bool
+		if err := pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM questions WHERE id = $1)`, questionID).Scan(&exists); err != nil {
+			logRequestError(c, "Error checking question %d for notes: %v", questionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve question notes"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Question with ID %d not found", questionID)})
+			return
+		}
+		rows, err := pool.Query(ctx, `
+			SELECT id, question_id, author, note, created_at
+			FROM question_notes
+			WHERE question_id = $1
+			ORDER BY created_at, id
+		`, questionID)
+		if err != nil {
+			logRequestError(c, "Error querying notes for question %d: %v", questionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve question notes"})
+			return
+		}
+		defer rows.Close()
+		notes := []models.QuestionNote{}
+		for rows.Next() {
+			var n models.QuestionNote
+			if err := rows.Scan(&n.ID, &n.QuestionID, &n.Author, &n.Note, &n.CreatedAt); err != nil {
+				logRequestError(c, "Error scanning note for question %d: %v", questionID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve question notes"})
+				return
+			}
+			notes = append(notes, n)
+		}
+		c.JSON(http.StatusOK, notes)
+	}
+}
+// AdminAddQuestionNote adds an instructor note to a question, authored by the signed-in admin. The note is
+// kept across re-ingestion for the question with the same course, text and exam bank (see relinkQuestionNotes).
+// POST /admin/questions/:id/notes
+func AdminAddQuestionNote(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		questionID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid question ID"})
+			return
+		}
+		var req models.QuestionNoteRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		note := strings.TrimSpace(req.Note)
+		if note == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "note must not be empty"})
+			return
+		}
+		if len(note) > maxQuestionNoteLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("note must be at most %d characters", maxQuestionNoteLength)})
+			return
+		}
+		author := c.GetString("user_email")
+		n := models.QuestionNote{QuestionID: questionID, Author: author, Note: note}
+		err = pool.QueryRow(ctx, `
+			INSERT INTO question_notes (question_id, course_id, question_text, bank_name, author, note)
+			SELECT q.id, d.course_id, q.question_text, split_part(q.exam_bank_version, '+', 2), $2, $3 FROM questions q JOIN domains d ON q.domain_id = d.id WHERE q.id = $1
+			RETURNING id, created_at
+		`, questionID, author, note).Scan(&n.ID, &n.CreatedAt)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Question with ID %d not found", questionID)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error adding note to question %d: %v", questionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add question note"})
+			return
+		}
+		db.LogAdminEvent(pool, author, "add_question_note", strconv.Itoa(questionID), fmt.Sprintf("Note %d added", n.ID))
+		c.JSON(http.StatusCreated, n)
+	}
+}
+// AdminSetQuestionFlag sets a question's admin flagged status to flagged, serving both the flag and unflag
+// routes, and records an admin event. Flagging with ?regenerate=true also regenerates the exams of the
+// question's course and exam_bank_version so they drop it, when exclude_flagged_questions is on; that
+// answers 409, with the flag still saved, when those exams have in-progress attempts. Flagging queues a
+// question_flagged notification in the same transaction.
+// POST /admin/questions/:id/flag
+// POST /admin/questions/:id/unflag
+func AdminSetQuestionFlag(pool *pgxpool.Pool, flagged bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		questionID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid question ID"})
+			return
+		}
+		actor := c.GetString("user_email")
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			logRequestError(c, "Error beginning transaction to flag question %d: %v", questionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update question flag"})
+			return
+		}
+		defer tx.Rollback(ctx) // Rollback on error
+		var courseID int
+		var courseCode, examBankVersion string
+		err = tx.QueryRow(ctx, `
+			UPDATE questions q SET flagged = $1
+			FROM domains d
+			JOIN courses co ON d.course_id = co.id
+			WHERE q.id = $2 AND q.domain_id = d.id
+			RETURNING co.id, co.course_code, q.exam_bank_version
+		`, flagged, questionID).Scan(&courseID, &courseCode, &examBankVersion)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Question with ID %d not found", questionID)})
+			return
+		}
+		if err == nil && flagged {
+			err = notifications.EnqueueEventTx(tx, pool, notifications.EventQuestionFlagged, fmt.Sprintf("%s flagged question %d of %s", actor, questionID, courseCode), map[string]interface{}{
+				"question_id":       questionID,
+				"course_code":       courseCode,
+				"exam_bank_version": examBankVersion,
+				"flagged_by":        actor,
+				"source":            "admin",
+			})
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			logRequestError(c, "Error setting flagged status of question %d: %v", questionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update question flag"})
+			return
+		}
+		action := "unflag_question"
+		if flagged {
+			action = "flag_question"
+		}
+		db.LogAdminEvent(pool, actor, action, strconv.Itoa(questionID), fmt.Sprintf("Course %s, exam bank version %s", courseCode, examBankVersion))
+		regenerated := false
+		if flagged && c.Query("regenerate") == "true" && db.GetSettingBool(pool, "exclude_flagged_questions", true) {
+			err := ingestion.RegenerateExamBank(ctx, pool, courseID, courseCode, examBankVersion)
+			if errors.Is(err, ingestion.ErrActiveAttempts) {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Question flagged, but exams were not regenerated: %v", err)})
+				return
+			}
+			if err != nil {
+				logRequestError(c, "Error regenerating exams of %s after flagging question %d: %v", courseCode, questionID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Question flagged, but regenerating the course's exams failed"})
+				return
+			}
+			regenerated = true
+			db.LogAdminEvent(pool, actor, "regenerate_exams", courseCode, fmt.Sprintf("Exam bank version %s regenerated after flagging question %d", examBankVersion, questionID))
+		}
+		c.JSON(http.StatusOK, gin.H{"question_id": questionID, "flagged": flagged, "regenerated": regenerated})
+	}
+}
+// AdminConfig returns the server's effective configuration, as loaded from config.yaml, RECAP_ environment
+// variables and defaults, with secrets redacted (see config.Config.Effective). Restricted to admins.
+// GET /admin/config
+func AdminConfig(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, cfg.Effective())
+	}
+}
+// maxImpersonationTTL caps the impersonation_token_ttl setting.
+const maxImpersonationTTL = time.Hour
+// AdminImpersonate issues a short-lived token acting as a student, so support can see the student's
+// sessions, reviews and history exactly as the student does. The token carries no roles and only allows
+// GET requests; its issue and every request made with it are logged to admin_events with the admin as
+// actor and the student as target (see middleware.ImpersonationMiddleware). Its lifetime is the
+// impersonation_token_ttl setting, at most an hour. Restricted to admins.
+// POST /admin/impersonate
+func AdminImpersonate(pool *pgxpool.Pool, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var req models.ImpersonationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		email := utils.NormalizeEmail(req.Email)
+		reason := strings.TrimSpace(req.Reason)
+		if reason == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required to impersonate a student"})
+			return
+		}
+		var exists bool
+		if err := pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM students WHERE email = $1)`, email).Scan(&exists); err != nil {
+			logRequestError(c, "Error checking student %s for impersonation: %v", email, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve student"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Student %s not found", email)})
+			return
+		}
+		ttl := db.GetSettingDuration(pool, "impersonation_token_ttl", 15*time.Minute)
+		if ttl <= 0 || ttl > maxImpersonationTTL {
+			ttl = maxImpersonationTTL
+		}
+		actor := c.GetString("user_email")
+		token, tokenID, expiresAt, err := middleware.IssueImpersonationToken(cfg.FIRM.JWTSigningKey, cfg.FIRM.Issuer, email, actor, ttl)
+		if err != nil {
+			logRequestError(c, "Error issuing impersonation token for %s: %v", email, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue impersonation token"})
+			return
+		}
+		db.LogAdminEvent(pool, actor, "impersonate_student", email, fmt.Sprintf("Token %s until %s: %s", tokenID, expiresAt.UTC().Format(time.RFC3339), reason))
+		c.JSON(http.StatusCreated, models.ImpersonationToken{Token: token, TokenID: tokenID, Email: email, ExpiresAt: expiresAt})
+	}
+}
 // AdminSettings displays and handles updates for server settings.
 // GET/POST /admin/settings
 func AdminSettings(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		if c.Request.Method == "POST" {
 			AdminUpdateSettings(pool)(c) // Delegate to update handler
 			return
 		}
-		rows, err := pool.Query(context.Background(), `SELECT key, value, description FROM settings ORDER BY key`)
+		rows, err := pool.Query(ctx, `SELECT key, value, description FROM settings ORDER BY key`)
 		if err != nil {
-			log.Printf("Error querying settings: %v", err)
-			c.HTML(http.StatusInternalServerError, "admin_settings", gin.H{"error": "Failed to retrieve settings"})
+			renderAdminError(c, "admin_settings", "Manage Server Settings", "settings", err)
 			return
 		}
 		defer rows.Close()
@@ -391,7 +1679,7 @@ func AdminSettings(pool *pgxpool.Pool) gin.HandlerFunc {
 		for rows.Next() {
 			var s models.Setting
 			if err := rows.Scan(&s.Key, &s.Value, &s.Description); err != nil {
-				log.Printf("Error scanning setting row: %v", err)
+				logRequestError(c, "Error scanning setting row: %v", err)
 				continue
 			}
 			settings = append(settings, s)
@@ -407,6 +1695,7 @@ func AdminSettings(pool *pgxpool.Pool) gin.HandlerFunc {
 // POST /admin/settings
 func AdminUpdateSettings(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		// This handler assumes form submission with key-value pairs
 		// For a more robust solution, validate each setting based on its type (int, bool, duration)
 		updates := make(map[string]string)
@@ -415,52 +1704,243 @@ func AdminUpdateSettings(pool *pgxpool.Pool) gin.HandlerFunc {
 				updates[key] = values[0]
 			}
 		}
-		tx, err := pool.Begin(context.Background())
+		tx, err := pool.Begin(ctx)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction for settings update"})
 			return
 		}
-		defer tx.Rollback(context.Background())
+		defer tx.Rollback(ctx)
 		actor := c.GetString("user_email")
 		var failedUpdates []string
 		for key, value := range updates {
-			_, err := tx.Exec(context.Background(), `
+			_, err := tx.Exec(ctx, `
 				UPDATE settings SET value = $1, updated_at = NOW(), updated_by = $2 WHERE key = $3
 			`, value, actor, key)
 			if err != nil {
-				log.Printf("Error updating setting %s: %v", key, err)
+				logRequestError(c, "Error updating setting %s: %v", key, err)
 				failedUpdates = append(failedUpdates, key)
 			}
 			db.LogAdminEvent(pool, actor, "update_setting", key, fmt.Sprintf("Set to: %s", value))
 		}
 		if len(failedUpdates) > 0 {
-			tx.Rollback(context.Background()) // Rollback if any update failed
+			tx.Rollback(ctx) // Rollback if any update failed
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to update some settings: %s", strings.Join(failedUpdates, ", "))})
 			return
 		}
-		if err := tx.Commit(context.Background()); err != nil {
+		if err := tx.Commit(ctx); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit settings updates"})
 			return
 		}
+		updatedKeys := make([]string, 0, len(updates))
+		for key := range updates {
+			updatedKeys = append(updatedKeys, key)
+		}
+		if len(updatedKeys) > 0 {
+			db.InvalidateSettingsCache(updatedKeys...)
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully"})
 	}
 }
-// TriggerIngestion allows admin to manually trigger ingestion for a course.
+// TriggerIngestion allows admin to manually trigger ingestion for a course. The ingestion runs on queue,
+// after any already waiting, and the response waits for it: a course whose files are unchanged since its
+// last ingestion is skipped, and it answers 409 when exams that would be deleted have in-progress
+// attempts. ?force=true re-ingests unchanged content and deletes those attempts anyway. When the request
+// ends first it answers 202 and the ingestion completes in the background.
 // POST /admin/ingest/:course_code
-func TriggerIngestion(pool *pgxpool.Pool, labsRepoPath string) gin.HandlerFunc {
+func TriggerIngestion(pool *pgxpool.Pool, queue *ingestion.Queue) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		courseCode := c.Param("course_code")
 		actor := c.GetString("user_email") // Get actor from JWT
 		// In a real system, you might pull the latest from git here or ensure it's already updated.
 		// For now, it assumes the labsRepoPath is kept up-to-date by an external process.
-		err := ingestion.ProcessCourseData(pool, courseCode, labsRepoPath)
+		force := c.Query("force") == "true"
+		err := queue.Ingest(c.Request.Context(), courseCode, force)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			db.LogAdminEvent(pool, actor, "manual_ingestion_queued", courseCode, fmt.Sprintf("Still running when the request ended (force %t).", force))
+			c.JSON(http.StatusAccepted, gin.H{"message": fmt.Sprintf("Ingestion of course '%s' is queued and continues in the background. Check logs/admin dashboard for status.", courseCode), "queued": true})
+			return
+		}
+		if errors.Is(err, ingestion.ErrCourseUnchanged) {
+			db.LogAdminEvent(pool, actor, "manual_ingestion_skipped", courseCode, "Content unchanged since last ingestion.")
+			c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Course '%s' is unchanged since its last ingestion; nothing was ingested. Retry with ?force=true to re-ingest anyway.", courseCode), "skipped": true})
+			return
+		}
+		if errors.Is(err, ingestion.ErrActiveAttempts) {
+			db.LogAdminEvent(pool, actor, "manual_ingestion_failed", courseCode, fmt.Sprintf("Error: %v", err))
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Ingestion refused: %v. Retry with ?force=true to delete these attempts.", err)})
+			return
+		}
 		if err != nil {
-			log.Printf("Manual ingestion failed for %s: %v", courseCode, err)
+			logRequestError(c, "Manual ingestion failed for %s: %v", courseCode, err)
 			db.LogAdminEvent(pool, actor, "manual_ingestion_failed", courseCode, fmt.Sprintf("Error: %v", err))
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Ingestion failed: %v", err)})
 			return
 		}
 		db.LogAdminEvent(pool, actor, "manual_ingestion_success", courseCode, "Ingestion and exam regeneration completed.")
-		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Ingestion and exam regeneration for course '%s' triggered successfully. Check logs/admin dashboard for status.", courseCode)})
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Ingestion and exam regeneration for course '%s' completed successfully.", courseCode)})
+	}
+}
+// AdminImportStudents pre-registers a cohort of students from a CSV or JSON roster, upserting
+// them into students. Auto-creation on a student's first attempt is unaffected. The format is
+// taken from ?format=csv|json, or from the Content-Type when omitted. CSV needs a header row
+// with an email column and optional name and cohort columns; JSON is an array of
+// {"email", "name", "cohort"} objects. Any invalid entry rejects the whole roster.
+// POST /admin/students/import
+func AdminImportStudents(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		actor := c.GetString("user_email")
+		format := c.Query("format")
+		if format == "" {
+			format = "csv"
+			if strings.HasPrefix(c.ContentType(), "application/json") {
+				format = "json"
+			}
+		}
+		data, err := c.GetRawData()
+		if err != nil || len(data) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Request body must contain the student roster"})
+			return
+		}
+		students, err := parseRoster(format, data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid roster: %v", err)})
+			return
+		}
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction for roster import"})
+			return
+		}
+		defer tx.Rollback(ctx)
+		created := 0
+		for _, s := range students {
+			var inserted bool
+			err := tx.QueryRow(ctx, `
+				INSERT INTO students (email, full_name, cohort) VALUES ($1, $2, $3)
+				ON CONFLICT (email) DO UPDATE SET
+					full_name = COALESCE(EXCLUDED.full_name, students.full_name),
+					cohort = COALESCE(EXCLUDED.cohort, students.cohort)
+				RETURNING (xmax = 0) AS inserted
+			`, s.Email, utils.StringPtr(s.Name), utils.StringPtr(s.Cohort)).Scan(&inserted)
+			if err != nil {
+				logRequestError(c, "Error upserting student %s from roster: %v", s.Email, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to import student %s", s.Email)})
+				return
+			}
+			if inserted {
+				created++
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit roster import"})
+			return
+		}
+		db.LogAdminEvent(pool, actor, "import_students", "students", fmt.Sprintf("Imported %d students from %s roster (%d new, %d updated)", len(students), format, created, len(students)-created))
+		c.JSON(http.StatusOK, gin.H{
+			"message":  fmt.Sprintf("Imported %d students", len(students)),
+			"imported": len(students),
+			"created":  created,
+			"updated":  len(students) - created,
+		})
+	}
+}
+// parseRoster parses and validates a CSV or JSON student roster, normalizing emails and
+// dropping duplicate entries (the last occurrence wins).
+func parseRoster(format string, data []byte) ([]models.RosterStudent, error) {
+	var entries []models.RosterStudent
+	switch format {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON roster: %w", err)
+		}
+	case "csv":
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CSV roster: %w", err)
+		}
+		if len(rows) == 0 {
+			return nil, fmt.Errorf("CSV roster is empty")
+		}
+		columns := make(map[string]int)
+		for i, header := range rows[0] {
+			columns[strings.ToLower(strings.TrimSpace(header))] = i
+		}
+		if _, ok := columns["email"]; !ok {
+			return nil, fmt.Errorf("CSV roster header must include an 'email' column")
+		}
+		field := func(row []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		for _, row := range rows[1:] {
+			entries = append(entries, models.RosterStudent{
+				Email:  field(row, "email"),
+				Name:   field(row, "name"),
+				Cohort: field(row, "cohort"),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported roster format '%s' (supported: csv, json)", format)
+	}
+	indexByEmail := make(map[string]int)
+	var students []models.RosterStudent
+	for i, entry := range entries {
+		email := utils.NormalizeEmail(entry.Email)
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			return nil, fmt.Errorf("entry %d: invalid email '%s'", i+1, entry.Email)
+		}
+		entry.Email = email
+		entry.Name = strings.TrimSpace(entry.Name)
+		entry.Cohort = strings.TrimSpace(entry.Cohort)
+		if j, dup := indexByEmail[email]; dup {
+			students[j] = entry
+			continue
+		}
+		indexByEmail[email] = len(students)
+		students = append(students, entry)
+	}
+	if len(students) == 0 {
+		return nil, fmt.Errorf("roster contains no students")
+	}
+	return students, nil
+}
+// AdminImportQuestions imports a question bank exported from another platform into a course.
+// The request body is the raw export file.
+// POST /admin/import/:course_code?format=moodlexml
+func AdminImportQuestions(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		courseCode := c.Param("course_code")
+		format := c.Query("format")
+		actor := c.GetString("user_email")
+		if format != ingestion.ImportFormatMoodleXML {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unsupported import format '%s'. Supported formats: %s", format, ingestion.ImportFormatMoodleXML)})
+			return
+		}
+		data, err := c.GetRawData()
+		if err != nil || len(data) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Request body must contain the question bank export"})
+			return
+		}
+		imported, err := ingestion.ImportQuestionBank(c.Request.Context(), pool, courseCode, format, data)
+		if err != nil {
+			logRequestError(c, "Question import failed for %s: %v", courseCode, err)
+			db.LogAdminEvent(pool, actor, "question_import_failed", courseCode, fmt.Sprintf("Format: %s, Error: %v", format, err))
+			switch {
+			case errors.Is(err, ingestion.ErrInvalidImport):
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Import failed: %v", err), "imported": imported})
+			case errors.Is(err, pgx.ErrNoRows):
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course '%s' not found", courseCode), "imported": imported})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed", "imported": imported})
+			}
+			return
+		}
+		db.LogAdminEvent(pool, actor, "question_import_success", courseCode, fmt.Sprintf("Imported %d questions from %s", imported, format))
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Imported %d questions into course '%s'", imported, courseCode), "imported": imported})
 	}
 }
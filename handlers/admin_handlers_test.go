@@ -0,0 +1,93 @@
+
+package handlers
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+// offlinePool returns a pool whose every query fails fast, connecting to a closed port, so settings readers
+// fall back to their defaults without a database.
+func offlinePool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	pool, err := pgxpool.New(context.Background(), "postgres://recap@127.0.0.1:1/recap?connect_timeout=1")
+	if err != nil {
+		t.Fatalf("pgxpool.New: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+// testContext returns a gin context for a GET of target.
+func testContext(target string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", target, nil)
+	return c
+}
+func TestCourseListOrder(t *testing.T) {
+	tests := []struct {
+		orderBy, orderDir string
+		wantBy, wantDir   string
+	}{
+		{"course_code", "asc", "course_code", "asc"},
+		{"marketing_name", "desc", "marketing_name", "desc"},
+		{"exams_taken", "desc", "exams_taken", "desc"},
+		{"exams_taken", "sideways", "exams_taken", "asc"},
+		{"id; DROP TABLE courses", "asc", "course_code", "asc"},
+		{"", "", "course_code", "asc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.orderBy+" "+tt.orderDir, func(t *testing.T) {
+			by, dir := courseListOrder(tt.orderBy, tt.orderDir)
+			if by != tt.wantBy || dir != tt.wantDir {
+				t.Fatalf("courseListOrder(%q, %q) = %q, %q, want %q, %q", tt.orderBy, tt.orderDir, by, dir, tt.wantBy, tt.wantDir)
+			}
+		})
+	}
+}
+func TestAdminPagination(t *testing.T) {
+	tests := []struct {
+		query                              string
+		wantPage, wantPageSize, wantOffset int
+	}{
+		{"", 1, 25, 0}, // admin_page_size default
+		{"page=3", 3, 25, 50},
+		{"page=2&page_size=10", 2, 10, 10},
+		{"page=0&page_size=10", 1, 10, 0},
+		{"page=-4", 1, 25, 0},
+		{"page=x&page_size=y", 1, 25, 0},
+		{"page_size=0", 1, 1, 0},
+		{"page=2&page_size=100000", 2, maxAdminPageSize, maxAdminPageSize},
+	}
+	pool := offlinePool(t)
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			page, pageSize, offset := adminPagination(testContext("/admin/courses?"+tt.query), pool)
+			if page != tt.wantPage || pageSize != tt.wantPageSize || offset != tt.wantOffset {
+				t.Fatalf("adminPagination(%q) = %d, %d, %d, want %d, %d, %d", tt.query, page, pageSize, offset, tt.wantPage, tt.wantPageSize, tt.wantOffset)
+			}
+		})
+	}
+}
+func TestAdminPaginationPagesTiedCourses(t *testing.T) {
+	// Courses with equal sort values are ordered by id, so paging through them must list each exactly once
+	courseIDs := make([]int, 23) // All tied on exams_taken, listed by c.id
+	for i := range courseIDs {
+		courseIDs[i] = i + 1
+	}
+	pool := offlinePool(t)
+	seen := make(map[int]int)
+	for page := 1; page <= 3; page++ {
+		_, pageSize, offset := adminPagination(testContext(fmt.Sprintf("/admin/courses?page=%d&page_size=10", page)), pool)
+		end := min(offset+pageSize, len(courseIDs))
+		for _, id := range courseIDs[offset:end] {
+			seen[id]++
+		}
+	}
+	for _, id := range courseIDs {
+		if seen[id] != 1 {
+			t.Errorf("course %d listed %d times across the pages, want once", id, seen[id])
+		}
+	}
+}
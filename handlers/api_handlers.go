@@ -1,38 +1,289 @@
 
 package handlers
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
-	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 	"database/sql" // ADDED: Import database/sql for sql.NullInt32
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	_ "recap-server/db" // USED: for db.LogError, db.GetSetting etc.
+	"recap-server/db" // USED: for db.LogError, db.GetSetting etc.
+	"recap-server/exam"
+	"recap-server/metrics"
 	"recap-server/models"
+	"recap-server/notifications"
+	"recap-server/report"
 	"recap-server/utils"
 )
+// logRequestError logs a handler error, including errors returned by exam and ingestion calls, with the
+// request-scoped logger, so the line carries the request ID and the authenticated user and a report from
+// a user can be matched to the server logs.
+func logRequestError(c *gin.Context, format string, args ...interface{}) {
+	utils.LoggerFromContext(c.Request.Context()).Error(fmt.Sprintf(format, args...))
+}
+// maxChoiceIDsPerAnswer bounds choice_ids in a submitted answer; questions have at most 6 choices.
+const maxChoiceIDsPerAnswer = 6
+// validateChoiceIDs ensures every submitted choice ID is one of the question's choices and appears only once.
+func validateChoiceIDs(submitted []int, validChoiceIDs map[int]bool) error {
+	seen := make(map[int]bool, len(submitted))
+	for _, id := range submitted {
+		if !validChoiceIDs[id] {
+			return fmt.Errorf("choice_id %d does not belong to this question", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicate choice_id %d", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+// validateMatchingAnswer ensures a submitted pairing only uses the question's prompts and responses, with
+// each response given to one prompt at most. pairs maps each prompt's choice ID to its response's match ID.
+func validateMatchingAnswer(submitted models.MatchingAnswer, pairs map[int]int) error {
+	validMatchIDs := make(map[int]bool, len(pairs))
+	for _, matchID := range pairs {
+		validMatchIDs[matchID] = true
+	}
+	used := make(map[int]int, len(submitted))
+	for choiceID, matchID := range submitted {
+		if _, ok := pairs[choiceID]; !ok {
+			return fmt.Errorf("choice_id %d does not belong to this question", choiceID)
+		}
+		if !validMatchIDs[matchID] {
+			return fmt.Errorf("match_id %d does not belong to this question", matchID)
+		}
+		if other, dup := used[matchID]; dup {
+			return fmt.Errorf("match_id %d is paired with both choice_id %d and %d", matchID, other, choiceID)
+		}
+		used[matchID] = choiceID
+	}
+	return nil
+}
+// loadMatchingPairs returns the pairing of a matching question: each prompt's choice ID mapped to the match
+// ID of its response.
+func loadMatchingPairs(ctx context.Context, pool *pgxpool.Pool, questionID int) (map[int]int, error) {
+	rows, err := pool.Query(ctx, `SELECT choice_id, id FROM match_options WHERE question_id = $1`, questionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pairs := make(map[int]int)
+	for rows.Next() {
+		var choiceID, matchID int
+		if err := rows.Scan(&choiceID, &matchID); err != nil {
+			return nil, err
+		}
+		pairs[choiceID] = matchID
+	}
+	return pairs, rows.Err()
+}
+// Question orderings an attempt can request at StartExamSession.
+const (
+	QuestionOrderShuffled = "shuffled" // Generated (shuffled) exam order
+	QuestionOrderDomain   = "domain"   // Stable order grouped by domain
+)
+// sessionModeAllowed reports whether an exam may be started in mode ("practice" or "simulation"), as set by
+// its allow_practice and allow_simulation flags.
+func sessionModeAllowed(exam models.Exam, mode string) bool {
+	switch mode {
+	case "practice":
+		return exam.AllowPractice
+	case "simulation":
+		return exam.AllowSimulation
+	}
+	return false
+}
+// questionOrderBy returns the ORDER BY expression for an attempt's question ordering, for queries
+// joining exam_questions eq, questions q and domains d. Every view of an attempt (start, submission
+// report, review) uses it so they present questions in the same order.
+func questionOrderBy(questionOrder string) string {
+	if questionOrder == QuestionOrderDomain {
+		return "d.name, q.id"
+	}
+	return "eq.question_order"
+}
+// Values of the practice_choice_feedback setting: explanations for every choice, or only for the
+// choices the student selected plus the correct ones.
+const (
+	ChoiceFeedbackAll      = "all"
+	ChoiceFeedbackSelected = "selected"
+)
+// choiceDisplayOrder returns the ORDER BY expression listing a question's choices as an attempt is served
+// them, for queries joining exam_questions eq and questions q; choiceID is the choice ID column. The items
+// of an ordering question are always shuffled, so the list does not give away the answer: per attempt when
+// the attempt shuffles choices (see the shuffle_choices setting), otherwise fixed per exam question. Other
+// choices are shuffled per attempt when it shuffles choices, except True/False, and otherwise kept in id
+// order. The shuffles hash the IDs, so re-fetching a session serves the same order.
+func choiceDisplayOrder(attemptID int, shuffleChoices bool, choiceID string) string {
+	if shuffleChoices {
+		return fmt.Sprintf(`CASE WHEN q.question_type <> 'truefalse' THEN md5('%d:' || eq.id || ':' || %s) END, %s`, attemptID, choiceID, choiceID)
+	}
+	return fmt.Sprintf(`CASE WHEN q.question_type = 'ordering' THEN md5(eq.id || ':' || %s) END, %s`, choiceID, choiceID)
+}
+// sessionQuestionColumns selects the fields of a models.SessionQuestion from exam_questions eq joined to
+// questions q for an attempt, with the choices as a JSON array in display order (see choiceDisplayOrder)
+// lettered A, B, C... The responses of a matching question follow as a second array, shuffled per attempt.
+// Choice and match IDs are the same in every session, so answers and scoring do not depend on the order.
+// Only the columns a student may see are selected: no correctness, positions, pairings, explanations or
+// acceptable answers, in either mode.
+func sessionQuestionColumns(attemptID int, shuffleChoices bool) string {
+	return fmt.Sprintf(`
+	eq.id AS exam_question_id, q.question_text, q.question_type, q.image_url, q.code_block, q.code_language, q.input_method, q.exact_select,
+	(
+		SELECT COALESCE(jsonb_agg(jsonb_build_object('choice_id', ch.id, 'text', ch.choice_text, 'order', CHR(64 + ch.position::int)) ORDER BY ch.position), '[]'::jsonb)
+		FROM (
+			SELECT id, choice_text, ROW_NUMBER() OVER (ORDER BY %s) AS position
+			FROM choices WHERE question_id = q.id
+		) ch
+	) AS choices_json,
+	(
+		SELECT jsonb_agg(jsonb_build_object('match_id', mo.id, 'text', mo.option_text) ORDER BY md5('%d:' || eq.id || ':' || mo.id))
+		FROM match_options mo WHERE mo.question_id = q.id
+	) AS matches_json
+`, choiceDisplayOrder(attemptID, shuffleChoices, "id"), attemptID)
+}
+// resolveSessionID maps a session token from the URL to the internal exam_attempts.id.
+// Malformed tokens fail the UUID cast and are reported like unknown ones.
+func resolveSessionID(ctx context.Context, pool *pgxpool.Pool, sessionToken string) (int, error) {
+	var sessionID int
+	err := pool.QueryRow(ctx, `
+		SELECT id FROM exam_attempts WHERE session_token = $1::uuid
+	`, sessionToken).Scan(&sessionID)
+	if err != nil {
+		return 0, fmt.Errorf("exam session %q not found: %w", sessionToken, err)
+	}
+	return sessionID, nil
+}
+// isCloseTerminalAnswer reports whether a wrong terminal answer is near an acceptable one:
+// it runs the same command (first word) or is within a small edit distance. Regex answers are skipped.
+func isCloseTerminalAnswer(answer string, acceptableAnswers []string) bool {
+	answerFields := strings.Fields(answer)
+	if len(answerFields) == 0 {
+		return false
+	}
+	for _, accAns := range acceptableAnswers {
+		if strings.HasPrefix(accAns, utils.RegexAnswerPrefix) {
+			continue
+		}
+		accFields := strings.Fields(accAns)
+		if len(accFields) > 0 && accFields[0] == answerFields[0] {
+			return true
+		}
+		if utils.LevenshteinDistance(answer, accAns) <= 2 {
+			return true
+		}
+	}
+	return false
+}
+// fillBlankHint returns the authored hint for a wrong fill-in-the-blank answer, or else applies the fuzzy hint logic. userAnswerLower is the
+// trimmed, lowercased answer and acceptableAnswers the lowercased accepted answers. Returns nil when no hint applies.
+func fillBlankHint(pool *pgxpool.Pool, question models.Question, acceptableAnswers []string, userAnswerLower string) *string {
+	if question.Hint != nil {
+		return question.Hint // An authored hint takes precedence over generated ones
+	}
+	if question.InputMethod != nil && *question.InputMethod == "terminal" {
+		// Simple example: suggest common flags if a command is close
+		if strings.HasPrefix(userAnswerLower, "ls") && !strings.Contains(userAnswerLower, "-l") {
+			hint := "Did you mean `ls -l`? Check the flag."
+			return &hint
+		} else if strings.HasPrefix(userAnswerLower, "cat") && !strings.Contains(userAnswerLower, ".txt") {
+			hint := "Are you looking for a file? Try specifying the file extension, e.g., `filename.txt`."
+			return &hint
+		}
+		// Point at the relevant part of the code_block when the student is close
+		if question.ContextHints && question.CodeBlock != nil && isCloseTerminalAnswer(userAnswerLower, acceptableAnswers) {
+			if db.GetSettingBool(pool, "practice_context_hints", false) {
+				if line := utils.RelevantCodeLine(*question.CodeBlock, userAnswerLower); line != "" {
+					hint := fmt.Sprintf("You're close. Take another look at this part of the code: `%s`", line)
+					return &hint
+				}
+			}
+		}
+		return nil
+	}
+	// 'text' input: suggest based on Levenshtein distance
+	for _, accAns := range acceptableAnswers {
+		if utils.LevenshteinDistance(userAnswerLower, accAns) <= 2 && len(userAnswerLower) > 0 { // Small edit distance
+			hint := fmt.Sprintf("Did you mean `%s`?", accAns)
+			return &hint
+		}
+	}
+	return nil
+}
+// formatTimeRemaining returns the time left on an in-progress attempt as "HH:MM:SS", floored at zero.
+func formatTimeRemaining(startedAt time.Time, examTimeMinutes int) string {
+	elapsed := time.Since(startedAt)
+	timeLimit := time.Duration(examTimeMinutes) * time.Minute
+	remaining := timeLimit - elapsed
+	if remaining < 0 {
+		remaining = 0 // Time's up; simulation attempts are auto-submitted by exam.FinalizeExpiredAttempts
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", int(remaining.Hours()), int(remaining.Minutes())%60, int(remaining.Seconds())%60)
+}
+// answerDeadlinePassed reports whether now is past the attempt's time limit plus grace, the point after
+// which simulation answers are no longer accepted.
+func answerDeadlinePassed(startedAt time.Time, examTimeMinutes int, grace time.Duration, now time.Time) bool {
+	deadline := startedAt.Add(time.Duration(examTimeMinutes)*time.Minute + grace)
+	return now.After(deadline)
+}
 // GetCourses lists available courses with exam counts.
 // GET /api/v1/courses
 func GetCourses(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		query := `
+		ctx := c.Request.Context()
+		orderBy := c.DefaultQuery("order_by", "marketing_name")
+		orderDir := c.DefaultQuery("order_dir", "asc")
+		// Validate order_by and order_dir to prevent SQL injection
+		validOrderBy := map[string]bool{"course_code": true, "marketing_name": true, "exam_count": true, "total_exams": true}
+		if !validOrderBy[orderBy] {
+			orderBy = "marketing_name"
+		}
+		if orderDir != "asc" && orderDir != "desc" {
+			orderDir = "asc"
+		}
+		// exam_count counts the exams students can take now: those accepting a session mode, of the latest
+		// version by semver precedence of each exam bank (primary or named, see exam.LatestBankVersions)
+		latest, err := exam.LatestBankVersions(ctx, pool, 0)
+		if err != nil {
+			logRequestError(c, "Error fetching latest exam bank versions: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve courses"})
+			return
+		}
+		var latestCourseIDs []int
+		var latestVersions []string
+		for courseID, versions := range latest {
+			for _, version := range versions {
+				latestCourseIDs = append(latestCourseIDs, courseID)
+				latestVersions = append(latestVersions, version)
+			}
+		}
+		query := fmt.Sprintf(`
+			WITH latest_versions AS (
+				SELECT * FROM unnest($1::int[], $2::text[]) AS lv(course_id, exam_bank_version)
+			), course_exams AS (
+				SELECT e.course_id, e.id, e.allow_practice OR e.allow_simulation AS active,
+					EXISTS (SELECT 1 FROM latest_versions lv WHERE lv.course_id = e.course_id AND lv.exam_bank_version = e.exam_bank_version) AS latest
+				FROM exams e
+				WHERE `+listedExamCondition+`
+			)
 			SELECT
 				c.id, c.course_code, c.marketing_name, c.duration_days, c.responsibility,
-				COUNT(e.id) AS exam_count
+				COUNT(ce.id) FILTER (WHERE ce.active AND ce.latest) AS exam_count,
+				COUNT(ce.id) AS total_exams
 			FROM courses c
-			LEFT JOIN exams e ON c.id = e.course_id
+			LEFT JOIN course_exams ce ON c.id = ce.course_id
 			GROUP BY c.id
-			ORDER BY c.marketing_name
-		`
-		rows, err := pool.Query(context.Background(), query)
+			ORDER BY %s %s, c.course_code
+		`, orderBy, orderDir)
+		rows, err := pool.Query(ctx, query, latestCourseIDs, latestVersions)
 		if err != nil {
-			log.Printf("Error querying courses: %v", err)
+			logRequestError(c, "Error querying courses: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve courses"})
 			return
 		}
@@ -47,8 +298,9 @@ func GetCourses(pool *pgxpool.Pool) gin.HandlerFunc {
 				&course.DurationDays,
 				&course.Responsibility,
 				&course.ExamCount,
+				&course.TotalExams,
 			); err != nil {
-				log.Printf("Error scanning course row: %v", err)
+				logRequestError(c, "Error scanning course row: %v", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process course data"})
 				return
 			}
@@ -57,27 +309,89 @@ func GetCourses(pool *pgxpool.Pool) gin.HandlerFunc {
 		c.JSON(http.StatusOK, courses)
 	}
 }
-// GetExamsForCourse lists exams available for a specific course.
-// GET /api/v1/courses/:course_code/exams
+// Page sizes accepted by GetExamsForCourse.
+const (
+	defaultExamPageSize = 25
+	maxExamPageSize     = 100
+)
+// listedExamCondition selects, over exams e, the exams shown to students: every exam except sample exams.
+const listedExamCondition = "NOT e.sample"
+// Values of the GetExamsForCourse status filter: exams accepting at least one session mode, or neither.
+var examStatusFilters = map[string]string{
+	"all":      "TRUE",
+	"active":   "(e.allow_practice OR e.allow_simulation)",
+	"inactive": "NOT (e.allow_practice OR e.allow_simulation)",
+}
+// examListPagination reads page and page_size for the exam list, clamping rather than rejecting them:
+// page is at least 1, and page_size defaults to defaultExamPageSize and is kept between 1 and
+// maxExamPageSize. Values that are not integers fall back to the defaults.
+func examListPagination(c *gin.Context) (page, pageSize int) {
+	page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultExamPageSize)))
+	if err != nil {
+		pageSize = defaultExamPageSize
+	}
+	if pageSize < 1 {
+		pageSize = 1
+	}
+	if pageSize > maxExamPageSize {
+		pageSize = maxExamPageSize
+	}
+	return page, pageSize
+}
+// GetExamsForCourse lists one page of the exams of a course, optionally filtered by status. A course with
+// no matching exams, or a page past the last, gets an empty exams list; only an unknown course is 404.
+// GET /api/v1/courses/:course_code/exams[?page=1&page_size=25&status=all|active|inactive]
 func GetExamsForCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		courseCode := c.Param("course_code")
-		query := `
+		page, pageSize := examListPagination(c)
+		status := c.DefaultQuery("status", "all")
+		statusCondition, ok := examStatusFilters[status]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be all, active or inactive"})
+			return
+		}
+		var courseExists bool
+		var total int
+		err := pool.QueryRow(ctx, fmt.Sprintf(`
+			SELECT EXISTS (SELECT 1 FROM courses WHERE course_code = $1),
+				(SELECT COUNT(e.id)
+				FROM exams e
+				JOIN courses c ON e.course_id = c.id
+				WHERE c.course_code = $1 AND %s AND %s)
+		`, listedExamCondition, statusCondition), courseCode).Scan(&courseExists, &total)
+		if err != nil {
+			logRequestError(c, "Error counting exams for course %s: %v", courseCode, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exams"})
+			return
+		}
+		if !courseExists {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Course not found: %s", courseCode)})
+			return
+		}
+		query := fmt.Sprintf(`
 			SELECT
-				e.id, e.title, e.domain_weights, e.min_questions, e.max_questions, e.exam_time, e.passing_score
+				e.id, e.title, e.domain_weights, e.min_questions, e.max_questions, e.exam_time, e.passing_score,
+				e.allow_practice, e.allow_simulation, e.instructions
 			FROM exams e
 			JOIN courses c ON e.course_id = c.id
-			WHERE c.course_code = $1
-			ORDER BY e.title
-		`
-		rows, err := pool.Query(context.Background(), query, courseCode)
+			WHERE c.course_code = $1 AND %s AND %s
+			ORDER BY e.title, e.id -- id breaks ties so pages neither repeat nor skip exams
+			LIMIT $2 OFFSET $3
+		`, listedExamCondition, statusCondition)
+		rows, err := pool.Query(ctx, query, courseCode, pageSize, (page-1)*pageSize)
 		if err != nil {
-			log.Printf("Error querying exams for course %s: %v", courseCode, err)
+			logRequestError(c, "Error querying exams for course %s: %v", courseCode, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exams"})
 			return
 		}
 		defer rows.Close()
-		var exams []models.Exam
+		exams := []models.Exam{}
 		for rows.Next() {
 			var exam models.Exam
 			var domainWeightsJSON []byte
@@ -89,127 +403,231 @@ func GetExamsForCourse(pool *pgxpool.Pool) gin.HandlerFunc {
 				&exam.MaxQuestions,
 				&exam.ExamTime,
 				&exam.PassingScore,
+				&exam.AllowPractice,
+				&exam.AllowSimulation,
+				&exam.Instructions,
 			); err != nil {
-				log.Printf("Error scanning exam row for course %s: %v", courseCode, err)
+				logRequestError(c, "Error scanning exam row for course %s: %v", courseCode, err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process exam data"})
 				return
 				}
 			if err := json.Unmarshal(domainWeightsJSON, &exam.DomainWeights); err != nil {
-				log.Printf("Error unmarshaling domain weights for exam %d: %v", exam.ID, err)
+				logRequestError(c, "Error unmarshaling domain weights for exam %d: %v", exam.ID, err)
 				// Continue without domain weights or handle as appropriate
 			}
 			exams = append(exams, exam)
 		}
-		if len(exams) == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No exams found for course code: %s", courseCode)})
-			return
-		}
-		c.JSON(http.StatusOK, exams)
+		c.JSON(http.StatusOK, models.ExamListResponse{
+			Exams:      exams,
+			Page:       page,
+			PageSize:   pageSize,
+			Total:      total,
+			TotalPages: (total + pageSize - 1) / pageSize,
+		})
 	}
 }
-// StartExamSession initiates a new exam attempt.
+// activeSessionsRetryAfter is the Retry-After (seconds) sent when the active session cap is reached.
+const activeSessionsRetryAfter = 60
+// StartExamSession initiates a new exam attempt. When maxActiveSessions is positive and that many
+// sessions are active, it returns 503 with Retry-After instead. The cap is checked before the insert,
+// so concurrent starts may briefly exceed it.
 // POST /api/v1/exam_sessions
-func StartExamSession(pool *pgxpool.Pool) gin.HandlerFunc {
+func StartExamSession(pool *pgxpool.Pool, maxActiveSessions int) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx := c.Request.Context()
 		var req models.ExamSessionRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if maxActiveSessions > 0 {
+			activeSessions, err := db.CountActiveSessions(pool)
+			if err != nil {
+				logRequestError(c, "Error checking active sessions: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start exam session"})
+				return
+			}
+			if activeSessions >= maxActiveSessions {
+				c.Header("Retry-After", strconv.Itoa(activeSessionsRetryAfter))
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many exam sessions are in progress; try again shortly"})
+				return
+			}
+		}
 		userEmail := c.GetString("user_email") // Set by JWT middleware
 		// Check if student exists, if not, create a basic record
-		_, err := pool.Exec(context.Background(), `
+		_, err := pool.Exec(ctx, `
 			INSERT INTO students (email) VALUES ($1) ON CONFLICT (email) DO NOTHING
 		`, userEmail)
 		if err != nil {
-			log.Printf("Error upserting student %s: %v", userEmail, err)
+			logRequestError(c, "Error upserting student %s: %v", userEmail, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare student record"})
 			return
 		}
 		// Fetch exam details
 		var exam models.Exam
 		var domainWeightsJSON []byte
-		err = pool.QueryRow(context.Background(), `
-			SELECT id, title, exam_time, exam_bank_version, domain_weights
-			FROM exams WHERE id = $1
-		`, req.ExamID).Scan(&exam.ID, &exam.Title, &exam.ExamTime, &exam.ExamBankVersion, &domainWeightsJSON)
+		err = pool.QueryRow(ctx, `
+			SELECT id, title, exam_time, exam_bank_version, domain_weights, allow_practice, allow_simulation, instructions
+			FROM exams WHERE id = $1 AND NOT sample
+		`, req.ExamID).Scan(&exam.ID, &exam.Title, &exam.ExamTime, &exam.ExamBankVersion, &domainWeightsJSON, &exam.AllowPractice, &exam.AllowSimulation, &exam.Instructions)
 		if err != nil {
-			log.Printf("Error fetching exam %d: %v", req.ExamID, err)
+			logRequestError(c, "Error fetching exam %d: %v", req.ExamID, err)
 			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Exam with ID %d not found", req.ExamID)})
 			return
 		}
+		if !sessionModeAllowed(exam, req.Mode) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Exam %d cannot be started in %s mode", exam.ID, req.Mode)})
+			return
+		}
 		if err := json.Unmarshal(domainWeightsJSON, &exam.DomainWeights); err != nil {
-			log.Printf("Error unmarshaling domain weights for exam %d: %v", exam.ID, err)
+			logRequestError(c, "Error unmarshaling domain weights for exam %d: %v", exam.ID, err)
 			// Decide how to handle this, maybe return error or proceed without domain breakdown
 		}
-		// Create a new exam attempt
+		questionOrder := req.QuestionOrder
+		if questionOrder == "" {
+			questionOrder = QuestionOrderShuffled
+		}
+		// Create a new exam attempt; whether it shuffles choices is fixed at start so re-fetches match
 		var attemptID int
-		err = pool.QueryRow(context.Background(), `
-			INSERT INTO exam_attempts (exam_id, email, mode)
-			VALUES ($1, $2, $3) RETURNING id
-		`, req.ExamID, userEmail, req.Mode).Scan(&attemptID)
+		var sessionToken string
+		shuffleChoices := db.GetSettingBool(pool, "shuffle_choices", true)
+		err = pool.QueryRow(ctx, `
+			INSERT INTO exam_attempts (exam_id, email, mode, question_order, shuffle_choices)
+			VALUES ($1, $2, $3, $4, $5) RETURNING id, session_token::text
+		`, req.ExamID, userEmail, req.Mode, questionOrder, shuffleChoices).Scan(&attemptID, &sessionToken)
 		if err != nil {
-			log.Printf("Error creating exam attempt for exam %d, user %s: %v", req.ExamID, userEmail, err)
+			logRequestError(c, "Error creating exam attempt for exam %d, user %s: %v", req.ExamID, userEmail, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start exam session"})
 			return
 		}
+		metrics.ExamsStarted.WithLabelValues(req.Mode).Inc()
+		db.RefreshActiveSessionsGauge(pool)
 		// Fetch questions for this exam
-		questionsQuery := `
-			SELECT
-				eq.id AS exam_question_id, q.question_text, q.question_type, q.image_url, q.code_block, q.input_method,
-				ARRAY_AGG(jsonb_build_object('choice_id', ch.id, 'text', ch.choice_text, 'order', CASE WHEN ch.id IS NOT NULL THEN (64 + (ROW_NUMBER() OVER (PARTITION BY ch.question_id ORDER BY ch.id)))::text ELSE NULL END)) AS choices_json
+		questionsQuery := fmt.Sprintf(`
+			SELECT `+sessionQuestionColumns(attemptID, shuffleChoices)+`
 			FROM exam_questions eq
 			JOIN questions q ON eq.question_id = q.id
-			LEFT JOIN choices ch ON q.id = ch.question_id
+			JOIN domains d ON q.domain_id = d.id
 			WHERE eq.exam_id = $1
-			GROUP BY eq.id, q.question_text, q.question_type, q.image_url, q.code_block, q.input_method -- Fixed GROUP BY to include eq.id
-			ORDER BY eq.question_order
-		`
-		rows, err := pool.Query(context.Background(), questionsQuery, req.ExamID)
+			ORDER BY %s
+		`, questionOrderBy(questionOrder))
+		rows, err := pool.Query(ctx, questionsQuery, req.ExamID)
 		if err != nil {
-			log.Printf("Error fetching questions for exam %d: %v", req.ExamID, err)
+			logRequestError(c, "Error fetching questions for exam %d: %v", req.ExamID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load exam questions"})
 			return
 		}
 		defer rows.Close()
-		var sessionQuestions []models.Question
+		sessionQuestions := []models.SessionQuestion{}
 		for rows.Next() {
-			var q models.Question
-			var choicesJSON []byte
+			var q models.SessionQuestion
+			var choicesJSON, matchesJSON []byte
 			// Scan into q.ExamQuestionID directly
 			if err := rows.Scan(
-				&q.ExamQuestionID, &q.QuestionText, &q.QuestionType, &q.ImageURL, &q.CodeBlock, &q.InputMethod, &choicesJSON,
+				&q.ExamQuestionID, &q.QuestionText, &q.QuestionType, &q.ImageURL, &q.CodeBlock, &q.CodeLanguage, &q.InputMethod, &q.ExactSelect, &choicesJSON, &matchesJSON,
 			); err != nil {
-				log.Printf("Error scanning question for exam %d: %v", req.ExamID, err)
+				logRequestError(c, "Error scanning question for exam %d: %v", req.ExamID, err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process question data"})
 				return
 			}
 			if choicesJSON != nil {
 				if err := json.Unmarshal(choicesJSON, &q.Choices); err != nil {
-					log.Printf("Error unmarshaling choices for question %d: %v", q.ID, err)
+					logRequestError(c, "Error unmarshaling choices for exam question %d: %v", q.ExamQuestionID, err)
 					// Proceed without choices or handle error
 				}
 			}
+			if matchesJSON != nil {
+				if err := json.Unmarshal(matchesJSON, &q.Matches); err != nil {
+					logRequestError(c, "Error unmarshaling matches for exam question %d: %v", q.ExamQuestionID, err)
+				}
+			}
 			sessionQuestions = append(sessionQuestions, q)
 		}
 		resp := models.ExamSessionResponse{
-			SessionID:        strconv.Itoa(attemptID), // Convert attempt ID to string for session_id
+			SessionID:        sessionToken, // Opaque token; the attempt ID stays internal
 			ExamTitle:        exam.Title,
 			Mode:             req.Mode,
+			QuestionOrder:    questionOrder,
 			TimeLimitMinutes: exam.ExamTime, // Corrected: Using exam.ExamTime which is now aliased to TimeLimitMinutes in models.Exam
+			Instructions:     exam.Instructions,
 			Questions:        sessionQuestions,
 		}
 		c.JSON(http.StatusOK, resp)
 	}
 }
+// GetSessionQuestion returns a single question of a session as served at session start (text, media and
+// lettered choices, without correctness), so a client can resume or lazy-load a session question by question.
+// The question must be on the session's exam and the session must belong to the caller.
+// GET /api/v1/exam_sessions/:session_id/questions/:exam_question_id
+func GetSessionQuestion(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		examQuestionID, err := strconv.Atoi(c.Param("exam_question_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid exam question ID"})
+			return
+		}
+		userEmail := c.GetString("user_email") // From JWT middleware
+		var attempt models.ExamAttempt
+		err = pool.QueryRow(ctx, `
+			SELECT id, exam_id, email, shuffle_choices FROM exam_attempts WHERE id = $1
+		`, sessionID).Scan(&attempt.ID, &attempt.ExamID, &attempt.Email, &attempt.ShuffleChoices)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		if attempt.Email != userEmail {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this session"})
+			return
+		}
+		var q models.SessionQuestion
+		var choicesJSON, matchesJSON []byte
+		err = pool.QueryRow(ctx, `
+			SELECT `+sessionQuestionColumns(attempt.ID, attempt.ShuffleChoices)+`
+			FROM exam_questions eq
+			JOIN questions q ON eq.question_id = q.id
+			WHERE eq.id = $1 AND eq.exam_id = $2
+		`, examQuestionID, attempt.ExamID).Scan(
+			&q.ExamQuestionID, &q.QuestionText, &q.QuestionType, &q.ImageURL, &q.CodeBlock, &q.CodeLanguage, &q.InputMethod, &q.ExactSelect, &choicesJSON, &matchesJSON,
+		)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Question %d is not part of this session", examQuestionID)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error fetching exam question %d for attempt %d: %v", examQuestionID, sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load exam question"})
+			return
+		}
+		if err := json.Unmarshal(choicesJSON, &q.Choices); err != nil {
+			logRequestError(c, "Error unmarshaling choices for exam question %d: %v", examQuestionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load exam question"})
+			return
+		}
+		if matchesJSON != nil {
+			if err := json.Unmarshal(matchesJSON, &q.Matches); err != nil {
+				logRequestError(c, "Error unmarshaling matches for exam question %d: %v", examQuestionID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load exam question"})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, q)
+	}
+}
 // RecordAnswer records a student's answer for a question in a session.
 // POST /api/v1/exam_sessions/:session_id/answer
 func RecordAnswer(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		sessionIDStr := c.Param("session_id")
-		sessionID, err := strconv.Atoi(sessionIDStr)
+		ctx := c.Request.Context()
+		locale := db.AnswerLocale(pool)
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
 			return
 		}
 		var req models.AnswerRequest
@@ -220,9 +638,13 @@ func RecordAnswer(pool *pgxpool.Pool) gin.HandlerFunc {
 		userEmail := c.GetString("user_email") // From JWT middleware
 		// Verify session belongs to user and is not completed
 		var attempt models.ExamAttempt
-		err = pool.QueryRow(context.Background(), `
-			SELECT id, email, mode, completed_at FROM exam_attempts WHERE id = $1
-		`, sessionID).Scan(&attempt.ID, &attempt.Email, &attempt.Mode, &attempt.CompletedAt)
+		var examTimeMinutes, fuzzyAcceptDistance int
+		err = pool.QueryRow(ctx, `
+			SELECT ea.id, ea.exam_id, ea.email, ea.mode, ea.started_at, ea.completed_at, ea.abandoned_at, e.exam_time, e.fuzzy_accept_distance
+			FROM exam_attempts ea
+			JOIN exams e ON ea.exam_id = e.id
+			WHERE ea.id = $1
+		`, sessionID).Scan(&attempt.ID, &attempt.ExamID, &attempt.Email, &attempt.Mode, &attempt.StartedAt, &attempt.CompletedAt, &attempt.AbandonedAt, &examTimeMinutes, &fuzzyAcceptDistance)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
 			return
@@ -235,38 +657,121 @@ func RecordAnswer(pool *pgxpool.Pool) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Session already completed"})
 			return
 		}
-		// Get question details via exam_question_id
+		if attempt.AbandonedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Session was abandoned; start a new session"})
+			return
+		}
+		if attempt.Mode == "simulation" {
+			grace := db.GetSettingDuration(pool, "simulation_answer_grace", 30*time.Second)
+			if answerDeadlinePassed(attempt.StartedAt, examTimeMinutes, grace, time.Now()) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "The time limit for this exam has passed; submit the session to finish"})
+				return
+			}
+		}
+		// Get question details via exam_question_id, which must belong to this session's exam
 		var question models.Question
 		var examQID int
-		err = pool.QueryRow(context.Background(), `
-			SELECT eq.id, q.id, q.question_type, q.explanation, q.input_method
+		err = pool.QueryRow(ctx, `
+			SELECT eq.id, q.id, q.question_type, q.explanation, q.input_method, q.exact_select, q.code_block, COALESCE(q.context_hints, FALSE), q.allow_feedback_in_simulation, q.hint, q.ignore_flag_order
 			FROM exam_questions eq
 			JOIN questions q ON eq.question_id = q.id
-			WHERE eq.id = $1
-		`, req.ExamQuestionID).Scan(&examQID, &question.ID, &question.QuestionType, &question.Explanation, &question.InputMethod)
+			WHERE eq.id = $1 AND eq.exam_id = $2
+		`, req.ExamQuestionID, attempt.ExamID).Scan(&examQID, &question.ID, &question.QuestionType, &question.Explanation, &question.InputMethod, &question.ExactSelect, &question.CodeBlock, &question.ContextHints, &question.AllowFeedbackInSimulation, &question.Hint, &question.IgnoreFlagOrder)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Question not found in this exam session"})
 			return
 		}
+		// Ordering questions are answered with the items' choice IDs in order, which are stored as choice_ids
+		submittedIDs := req.ChoiceIDs
+		if question.QuestionType == "ordering" {
+			if len(req.ChoiceIDs) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Ordering questions are answered with order, not choice_ids"})
+				return
+			}
+			submittedIDs = req.Order
+		} else if len(req.Order) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order is only valid for ordering questions"})
+			return
+		}
+		// Matching questions are answered with a pairing, stored as JSON in match_answer
+		var matchPairs map[int]int
+		var matchAnswerJSON []byte
+		if question.QuestionType == "matching" {
+			if len(req.ChoiceIDs) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Matching questions are answered with matches, not choice_ids"})
+				return
+			}
+			matchPairs, err = loadMatchingPairs(ctx, pool, question.ID)
+			if err != nil {
+				logRequestError(c, "Error fetching matching pairs for question %d: %v", question.ID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate answer"})
+				return
+			}
+			if err := validateMatchingAnswer(req.Matches, matchPairs); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if len(req.Matches) > 0 {
+				matchAnswerJSON, _ = json.Marshal(req.Matches)
+			}
+		} else if len(req.Matches) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "matches is only valid for matching questions"})
+			return
+		}
+		// Validate submitted choice IDs against the question's actual choices
+		if len(submittedIDs) > maxChoiceIDsPerAnswer {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Too many choice_ids: at most %d may be submitted", maxChoiceIDsPerAnswer)})
+			return
+		}
+		if len(submittedIDs) > 0 {
+			validChoiceIDs := make(map[int]bool)
+			choiceRows, err := pool.Query(ctx, `SELECT id FROM choices WHERE question_id = $1`, question.ID)
+			if err != nil {
+				logRequestError(c, "Error fetching choice IDs for question %d: %v", question.ID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate answer"})
+				return
+			}
+			for choiceRows.Next() {
+				var choiceID int
+				if err := choiceRows.Scan(&choiceID); err != nil {
+					choiceRows.Close()
+					logRequestError(c, "Error scanning choice ID for question %d: %v", question.ID, err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate answer"})
+					return
+				}
+				validChoiceIDs[choiceID] = true
+			}
+			choiceRows.Close()
+			if err := validateChoiceIDs(submittedIDs, validChoiceIDs); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if question.QuestionType == "ordering" && len(submittedIDs) != len(validChoiceIDs) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("order must list each of the %d items exactly once", len(validChoiceIDs))})
+				return
+			}
+		}
 		// Store the answer
 		var pgChoiceIDs []int32 // pgx requires int32 for arrays
-		for _, id := range req.ChoiceIDs {
+		for _, id := range submittedIDs {
 			pgChoiceIDs = append(pgChoiceIDs, int32(id))
 		}
-		_, err = pool.Exec(context.Background(), `
-			INSERT INTO user_answers (attempt_id, exam_question_id, choice_ids, text_answer)
-			VALUES ($1, $2, $3, $4)
+		_, err = pool.Exec(ctx, `
+			INSERT INTO user_answers (attempt_id, exam_question_id, choice_ids, text_answer, match_answer)
+			VALUES ($1, $2, $3, $4, $5)
 			ON CONFLICT (attempt_id, exam_question_id) DO UPDATE SET
 				choice_ids = EXCLUDED.choice_ids,
-				text_answer = EXCLUDED.text_answer
-		`, sessionID, req.ExamQuestionID, pgChoiceIDs, utils.StringPtr(req.CommandText))
+				text_answer = EXCLUDED.text_answer,
+				match_answer = EXCLUDED.match_answer
+		`, sessionID, req.ExamQuestionID, pgChoiceIDs, utils.StringPtr(req.CommandText), matchAnswerJSON)
 		if err != nil {
-			log.Printf("Error recording answer for session %d, question %d: %v", sessionID, req.ExamQuestionID, err)
+			logRequestError(c, "Error recording answer for session %d, question %d: %v", sessionID, req.ExamQuestionID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record answer"})
 			return
 		}
-		// Provide immediate feedback in Practice Mode
-		if attempt.Mode == "practice" {
+		metrics.AnswersRecorded.WithLabelValues(question.QuestionType).Inc()
+		// Provide immediate feedback in Practice Mode, or in simulation for questions that opt in
+		if attempt.Mode == "practice" || question.AllowFeedbackInSimulation {
 			resp := models.AnswerResponse{
 				Explanation: question.Explanation,
 			}
@@ -274,36 +779,30 @@ func RecordAnswer(pool *pgxpool.Pool) gin.HandlerFunc {
 			if question.QuestionType == "single" || question.QuestionType == "multi" || question.QuestionType == "truefalse" {
 				// Fetch correct choices and user's choices for comparison
 				correctChoices := make(map[int]bool)
-				rows, err := pool.Query(context.Background(), `
+				rows, err := pool.Query(ctx, `
 					SELECT id, is_correct, explanation FROM choices WHERE question_id = $1
 				`, question.ID)
 				if err != nil {
-					log.Printf("Error fetching choices for question %d: %v", question.ID, err)
+					logRequestError(c, "Error fetching choices for question %d: %v", question.ID, err)
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get choice feedback"})
 					return
 				}
 				defer rows.Close()
+				feedbackMode, _ := db.GetSettingCached(pool, "practice_choice_feedback")
 				var choiceFeedback []models.ChoiceFeedback
-				allUserCorrect := true
-				userSelectedAnyIncorrect := false
 				for rows.Next() {
 					var choiceID int
 					var isCorrectChoice bool
 					var explanation string
 					if err := rows.Scan(&choiceID, &isCorrectChoice, &explanation); err != nil {
-						log.Printf("Error scanning choice for question %d: %v", question.ID, err)
+						logRequestError(c, "Error scanning choice for question %d: %v", question.ID, err)
 						continue
 					}
 					if isCorrectChoice {
 						correctChoices[choiceID] = true
 					}
-					// Check if this choice was selected by the user
-					userSelected := utils.ContainsInt(req.ChoiceIDs, choiceID)
-					if isCorrectChoice && !userSelected {
-						allUserCorrect = false // Missed a correct answer
-					}
-					if !isCorrectChoice && userSelected {
-						userSelectedAnyIncorrect = true // Selected an incorrect answer
+					if feedbackMode == ChoiceFeedbackSelected && !isCorrectChoice && !utils.ContainsInt(req.ChoiceIDs, choiceID) {
+						continue // Unselected wrong choices are left out
 					}
 					choiceFeedback = append(choiceFeedback, models.ChoiceFeedback{
 						ChoiceID:    choiceID,
@@ -312,84 +811,321 @@ func RecordAnswer(pool *pgxpool.Pool) gin.HandlerFunc {
 					})
 				}
 				resp.ChoiceFeedback = choiceFeedback
-				// Determine overall correctness for MCQ
-				if question.QuestionType == "single" || question.QuestionType == "truefalse" {
-					isCorrect = allUserCorrect && !userSelectedAnyIncorrect && len(req.ChoiceIDs) == 1 && len(correctChoices) == 1
-				} else { // Multi-choice (select all)
-					isCorrect = allUserCorrect && !userSelectedAnyIncorrect && len(req.ChoiceIDs) == len(correctChoices)
+				// Determine overall correctness for MCQ, and the credit earned when partial scoring applies
+				isCorrect = exam.IsChoiceAnswerCorrect(question.QuestionType, question.ExactSelect, correctChoices, req.ChoiceIDs)
+				if question.QuestionType == "multi" && exam.LoadScoringMode(ctx, pool) == exam.ScoringPartial {
+					credit := exam.ChoiceAnswerCredit(question.QuestionType, question.ExactSelect, correctChoices, req.ChoiceIDs, exam.ScoringPartial)
+					resp.Score = &credit
+				}
+				if !isCorrect {
+					resp.Hint = question.Hint
+				}
+			} else if question.QuestionType == "ordering" {
+				// Each item's feedback tells whether it was placed at its expected position
+				rows, err := pool.Query(ctx, `
+					SELECT id, position, explanation FROM choices WHERE question_id = $1 ORDER BY position, id
+				`, question.ID)
+				if err != nil {
+					logRequestError(c, "Error fetching ordering items for question %d: %v", question.ID, err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get ordering feedback"})
+					return
+				}
+				defer rows.Close()
+				var expected []int
+				var choiceFeedback []models.ChoiceFeedback
+				for rows.Next() {
+					var feedback models.ChoiceFeedback
+					if err := rows.Scan(&feedback.ChoiceID, &feedback.Position, &feedback.Explanation); err != nil {
+						logRequestError(c, "Error scanning ordering item for question %d: %v", question.ID, err)
+						continue
+					}
+					feedback.IsCorrect = len(req.Order) > len(expected) && req.Order[len(expected)] == feedback.ChoiceID
+					expected = append(expected, feedback.ChoiceID)
+					choiceFeedback = append(choiceFeedback, feedback)
+				}
+				resp.ChoiceFeedback = choiceFeedback
+				isCorrect = exam.OrderingAnswerCredit(expected, req.Order, exam.ScoringStrict) == 1
+				if exam.LoadScoringMode(ctx, pool) == exam.ScoringPartial {
+					credit := exam.OrderingAnswerCredit(expected, req.Order, exam.ScoringPartial)
+					resp.Score = &credit
+				}
+				if !isCorrect {
+					resp.Hint = question.Hint
+				}
+			} else if question.QuestionType == "matching" {
+				// Each prompt's feedback tells whether it was paired correctly, and with which response
+				rows, err := pool.Query(ctx, `
+					SELECT id, explanation FROM choices WHERE question_id = $1 ORDER BY id
+				`, question.ID)
+				if err != nil {
+					logRequestError(c, "Error fetching matching prompts for question %d: %v", question.ID, err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get matching feedback"})
+					return
+				}
+				defer rows.Close()
+				var choiceFeedback []models.ChoiceFeedback
+				for rows.Next() {
+					var feedback models.ChoiceFeedback
+					if err := rows.Scan(&feedback.ChoiceID, &feedback.Explanation); err != nil {
+						logRequestError(c, "Error scanning matching prompt for question %d: %v", question.ID, err)
+						continue
+					}
+					matchID, ok := matchPairs[feedback.ChoiceID]
+					if ok {
+						feedback.MatchID = &matchID
+					}
+					submitted, answered := req.Matches[feedback.ChoiceID]
+					feedback.IsCorrect = ok && answered && submitted == matchID
+					choiceFeedback = append(choiceFeedback, feedback)
+				}
+				resp.ChoiceFeedback = choiceFeedback
+				isCorrect = exam.MatchingAnswerCredit(matchPairs, req.Matches, exam.ScoringStrict) == 1
+				if exam.LoadScoringMode(ctx, pool) == exam.ScoringPartial {
+					credit := exam.MatchingAnswerCredit(matchPairs, req.Matches, exam.ScoringPartial)
+					resp.Score = &credit
+				}
+				if !isCorrect {
+					resp.Hint = question.Hint
 				}
 			} else if question.QuestionType == "fillblank" {
 				// Fetch acceptable answers
 				var acceptableAnswers []string
-				rows, err := pool.Query(context.Background(), `
-					SELECT acceptable_answer FROM fill_blank_answers WHERE question_id = $1
+				rows, err := pool.Query(ctx, `
+					SELECT acceptable_answer, is_regex FROM fill_blank_answers WHERE question_id = $1
 				`, question.ID)
 				if err != nil {
-					log.Printf("Error fetching acceptable answers for question %d: %v", question.ID, err)
+					logRequestError(c, "Error fetching acceptable answers for question %d: %v", question.ID, err)
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get fill-in-the-blank feedback"})
 					return
 				}
 				defer rows.Close()
 				for rows.Next() {
 					var ans string
-					if err := rows.Scan(&ans); err != nil {
-						log.Printf("Error scanning acceptable answer: %v", err)
+					var isRegex bool
+					if err := rows.Scan(&ans, &isRegex); err != nil {
+						logRequestError(c, "Error scanning acceptable answer: %v", err)
 						continue
 					}
-					acceptableAnswers = append(acceptableAnswers, strings.ToLower(ans))
+					acceptableAnswers = append(acceptableAnswers, utils.AcceptableAnswerForm(ans, isRegex, locale))
 				}
 				// Compare user's answer
-				userAnswerLower := strings.ToLower(strings.TrimSpace(req.CommandText))
-				isCorrect = utils.ContainsString(acceptableAnswers, userAnswerLower)
+				userAnswerLower := utils.NormalizeAnswer(req.CommandText, locale)
+				isCorrect = utils.AnswerMatches(acceptableAnswers, userAnswerLower, question.IgnoreFlagOrder, fuzzyAcceptDistance)
 				if !isCorrect {
-					// Apply fuzzy logic for hints
-					if question.InputMethod != nil && *question.InputMethod == "terminal" {
-						// Simple example: suggest common flags if a command is close
-						if strings.HasPrefix(userAnswerLower, "ls") && !strings.Contains(userAnswerLower, "-l") {
-							hint := "Did you mean `ls -l`? Check the flag."
-							resp.Hint = &hint
-						} else if strings.HasPrefix(userAnswerLower, "cat") && !strings.Contains(userAnswerLower, ".txt") {
-							hint := "Are you looking for a file? Try specifying the file extension, e.g., `filename.txt`."
-							resp.Hint = &hint
-						}
-					} else { // 'text' input
-						// Simple example: suggest based on Levenshtein distance
-						for _, accAns := range acceptableAnswers {
-							if utils.LevenshteinDistance(userAnswerLower, accAns) <= 2 && len(userAnswerLower) > 0 { // Small edit distance
-								hint := fmt.Sprintf("Did you mean `%s`?", accAns)
-								resp.Hint = &hint
-								break
-							}
-						}
-					}
+					resp.Hint = fillBlankHint(pool, question, acceptableAnswers, userAnswerLower)
 				}
 			}
 			resp.Correct = isCorrect
 			c.JSON(http.StatusOK, resp)
-		} else { // Simulation Mode
+		} else { // Simulation Mode without the per-question override
 			c.JSON(http.StatusOK, gin.H{"saved": true})
 		}
 	}
 }
+// maxQuestionFlagReasonLength bounds the reason a student gives when flagging a question.
+const maxQuestionFlagReasonLength = 1000
+// FlagSessionQuestion records a student's report that a question of their session is broken, with an
+// optional reason, for instructors to review on the question stats page. It does not set the admin
+// flagged column. A question is flagged once per attempt; flagging it again replaces the reason. Each
+// flag queues a question_flagged notification in the same transaction.
+// POST /api/v1/exam_sessions/:session_id/flag_question
+func FlagSessionQuestion(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		var req models.QuestionFlagRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		reason := strings.TrimSpace(req.Reason)
+		if len(reason) > maxQuestionFlagReasonLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("reason must be at most %d characters", maxQuestionFlagReasonLength)})
+			return
+		}
+		userEmail := c.GetString("user_email") // From JWT middleware
+		var attempt models.ExamAttempt
+		err = pool.QueryRow(ctx, `
+			SELECT id, exam_id, email FROM exam_attempts WHERE id = $1
+		`, sessionID).Scan(&attempt.ID, &attempt.ExamID, &attempt.Email)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		if attempt.Email != userEmail {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this session"})
+			return
+		}
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			logRequestError(c, "Error beginning transaction to flag exam question %d for session %d: %v", req.ExamQuestionID, sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to flag question"})
+			return
+		}
+		defer tx.Rollback(ctx) // Rollback on error
+		// The question must be on the session's exam
+		flag := models.QuestionFlag{ExamQuestionID: req.ExamQuestionID, Reason: utils.StringPtr(reason)}
+		var questionID int
+		err = tx.QueryRow(ctx, `
+			INSERT INTO question_flags (question_id, attempt_id, email, reason)
+			SELECT eq.question_id, $3, $4, $5 FROM exam_questions eq WHERE eq.id = $1 AND eq.exam_id = $2
+			ON CONFLICT (attempt_id, question_id) DO UPDATE SET reason = EXCLUDED.reason, created_at = CURRENT_TIMESTAMP
+			RETURNING id, question_id, created_at
+		`, req.ExamQuestionID, attempt.ExamID, sessionID, userEmail, flag.Reason).Scan(&flag.ID, &questionID, &flag.CreatedAt)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Question not found in this exam session"})
+			return
+		}
+		if err == nil {
+			err = notifications.EnqueueEventTx(tx, pool, notifications.EventQuestionFlagged, fmt.Sprintf("%s flagged question %d of exam %d", userEmail, questionID, attempt.ExamID), map[string]interface{}{
+				"question_id": questionID,
+				"exam_id":     attempt.ExamID,
+				"attempt_id":  sessionID,
+				"flagged_by":  userEmail,
+				"reason":      reason,
+				"source":      "student",
+			})
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			logRequestError(c, "Error flagging exam question %d for session %d: %v", req.ExamQuestionID, sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to flag question"})
+			return
+		}
+		c.JSON(http.StatusCreated, flag)
+	}
+}
+// GetAnswerHint returns the fill-in-the-blank hint for a tentative answer without recording it.
+// Practice mode only; each request counts toward the practice_hints_per_session cap.
+// POST /api/v1/exam_sessions/:session_id/hint
+func GetAnswerHint(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		locale := db.AnswerLocale(pool)
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		var req models.HintRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userEmail := c.GetString("user_email") // From JWT middleware
+		var attempt models.ExamAttempt
+		var fuzzyAcceptDistance int
+		err = pool.QueryRow(ctx, `
+			SELECT ea.id, ea.exam_id, ea.email, ea.mode, ea.completed_at, ea.abandoned_at, e.fuzzy_accept_distance
+			FROM exam_attempts ea
+			JOIN exams e ON ea.exam_id = e.id
+			WHERE ea.id = $1
+		`, sessionID).Scan(&attempt.ID, &attempt.ExamID, &attempt.Email, &attempt.Mode, &attempt.CompletedAt, &attempt.AbandonedAt, &fuzzyAcceptDistance)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		if attempt.Email != userEmail {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this session"})
+			return
+		}
+		if attempt.CompletedAt != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Session already completed"})
+			return
+		}
+		if attempt.AbandonedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Session was abandoned; start a new session"})
+			return
+		}
+		if attempt.Mode != "practice" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Hints are only available in practice mode"})
+			return
+		}
+		var question models.Question
+		err = pool.QueryRow(ctx, `
+			SELECT q.id, q.question_type, q.input_method, q.code_block, COALESCE(q.context_hints, FALSE), q.hint, q.ignore_flag_order
+			FROM exam_questions eq
+			JOIN questions q ON eq.question_id = q.id
+			WHERE eq.id = $1 AND eq.exam_id = $2
+		`, req.ExamQuestionID, attempt.ExamID).Scan(&question.ID, &question.QuestionType, &question.InputMethod, &question.CodeBlock, &question.ContextHints, &question.Hint, &question.IgnoreFlagOrder)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Question not found in this exam session"})
+			return
+		}
+		if question.QuestionType != "fillblank" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Hints are only available for fill-in-the-blank questions"})
+			return
+		}
+		// Claim one hint from the session's allowance; the cap check and increment are a single statement
+		hintCap := db.GetSettingInt(pool, "practice_hints_per_session", 10)
+		var hintsUsed int
+		err = pool.QueryRow(ctx, `
+			UPDATE exam_attempts SET hints_used = hints_used + 1
+			WHERE id = $1 AND hints_used < $2
+			RETURNING hints_used
+		`, sessionID, hintCap).Scan(&hintsUsed)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Hint limit of %d reached for this session", hintCap)})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error updating hint count for session %d: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get hint"})
+			return
+		}
+		var acceptableAnswers []string
+		rows, err := pool.Query(ctx, `
+			SELECT acceptable_answer, is_regex FROM fill_blank_answers WHERE question_id = $1
+		`, question.ID)
+		if err != nil {
+			logRequestError(c, "Error fetching acceptable answers for question %d: %v", question.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get hint"})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var ans string
+			var isRegex bool
+			if err := rows.Scan(&ans, &isRegex); err != nil {
+				logRequestError(c, "Error scanning acceptable answer: %v", err)
+				continue
+			}
+			acceptableAnswers = append(acceptableAnswers, utils.AcceptableAnswerForm(ans, isRegex, locale))
+		}
+		resp := models.HintResponse{HintsRemaining: hintCap - hintsUsed}
+		// A correct tentative answer gets no hint, matching RecordAnswer
+		userAnswerLower := utils.NormalizeAnswer(req.CommandText, locale)
+		if !utils.AnswerMatches(acceptableAnswers, userAnswerLower, question.IgnoreFlagOrder, fuzzyAcceptDistance) {
+			resp.Hint = fillBlankHint(pool, question, acceptableAnswers, userAnswerLower)
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
 // GetExamSessionStatus checks the progress of an exam session.
 // GET /api/v1/exam_sessions/:session_id/status
 func GetExamSessionStatus(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		sessionIDStr := c.Param("session_id")
-		sessionID, err := strconv.Atoi(sessionIDStr)
+		ctx := c.Request.Context()
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
 			return
 		}
 		userEmail := c.GetString("user_email") // From JWT middleware
 		var attempt models.ExamAttempt
 		var examTimeMinutes int // Corrected to fetch examTimeMinutes directly
-		err = pool.QueryRow(context.Background(), `
-			SELECT ea.id, ea.email, ea.completed_at, e.exam_time, ea.started_at
+		err = pool.QueryRow(ctx, `
+			SELECT ea.id, ea.exam_id, ea.email, ea.completed_at, ea.abandoned_at, e.exam_time, ea.started_at
 			FROM exam_attempts ea
 			JOIN exams e ON ea.exam_id = e.id
 			WHERE ea.id = $1
-		`, sessionID).Scan(&attempt.ID, &attempt.Email, &attempt.CompletedAt, &examTimeMinutes, &attempt.StartedAt) // Corrected scan order and variable
+		`, sessionID).Scan(&attempt.ID, &attempt.ExamID, &attempt.Email, &attempt.CompletedAt, &attempt.AbandonedAt, &examTimeMinutes, &attempt.StartedAt) // Corrected scan order and variable
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
 			return
@@ -400,66 +1136,60 @@ func GetExamSessionStatus(pool *pgxpool.Pool) gin.HandlerFunc {
 		}
 		statusResp := models.ExamStatusResponse{
 			Completed: attempt.CompletedAt != nil,
+			Abandoned: attempt.AbandonedAt != nil,
 		}
 		// Count answered and total questions
 		var totalQuestions int
-		err = pool.QueryRow(context.Background(), `
+		err = pool.QueryRow(ctx, `
 			SELECT COUNT(eq.id) FROM exam_questions eq JOIN exams e ON eq.exam_id = e.id WHERE e.id = $1
 		`, attempt.ExamID).Scan(&totalQuestions) // Use attempt.ExamID
 		if err != nil {
-			log.Printf("Error counting total questions for exam %d: %v", attempt.ExamID, err)
+			logRequestError(c, "Error counting total questions for exam %d: %v", attempt.ExamID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get exam progress"})
 			return
 		}
 		var answeredCount int
-		err = pool.QueryRow(context.Background(), `
-			SELECT COUNT(ua.id) FROM user_answers ua WHERE ua.attempt_id = $1
-		`, sessionID).Scan(&answeredCount)
+		err = pool.QueryRow(ctx, `
+			SELECT COUNT(ua.id) FROM user_answers ua WHERE ua.attempt_id = $1 AND `+exam.AnsweredCondition, sessionID).Scan(&answeredCount)
 		if err != nil {
-			log.Printf("Error counting answered questions for attempt %d: %v", sessionID, err)
+			logRequestError(c, "Error counting answered questions for attempt %d: %v", sessionID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get exam progress"})
 			return
 		}
 		statusResp.AnsweredCount = answeredCount
 		statusResp.RemainingCount = totalQuestions - answeredCount
 		// Calculate time remaining (only if not completed and in simulation mode)
-		if !statusResp.Completed { // Only calculate if not completed
-			elapsed := time.Since(attempt.StartedAt)
-			timeLimit := time.Duration(examTimeMinutes) * time.Minute
-			remaining := timeLimit - elapsed
-			if remaining < 0 {
-				remaining = 0 // Time's up
-				// In a real app, you might auto-submit here
-			}
-			statusResp.TimeRemaining = fmt.Sprintf("%02d:%02d:%02d", int(remaining.Hours()), int(remaining.Minutes())%60, int(remaining.Seconds())%60)
+		if !statusResp.Completed && !statusResp.Abandoned { // Only calculate if still open
+			statusResp.TimeRemaining = formatTimeRemaining(attempt.StartedAt, examTimeMinutes)
 		} else {
-			statusResp.TimeRemaining = "00:00:00" // Exam completed
+			statusResp.TimeRemaining = "00:00:00" // Exam completed or abandoned
 		}
 		c.JSON(http.StatusOK, statusResp)
 	}
 }
-// SubmitExamSession finalizes an exam session and calculates the score.
-// POST /api/v1/exam_sessions/:session_id/submit
+// SubmitExamSession finalizes an exam session and calculates the score. When fewer than the
+// min_answered_fraction setting of the questions are answered, it returns 409 with a confirmation-required
+// response instead, unless confirm=true is passed.
+// POST /api/v1/exam_sessions/:session_id/submit[?confirm=true]
 func SubmitExamSession(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		sessionIDStr := c.Param("session_id")
-		sessionID, err := strconv.Atoi(sessionIDStr)
+		ctx := c.Request.Context()
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
 			return
 		}
 		userEmail := c.GetString("user_email") // From JWT middleware
 		// Verify session belongs to user and is not completed
 		var attempt models.ExamAttempt
 		var examID int
-		var passingScore float64
 		var domainWeightsJSON []byte
-		err = pool.QueryRow(context.Background(), `
-			SELECT ea.id, ea.email, ea.completed_at, e.id, e.passing_score, e.domain_weights
+		err = pool.QueryRow(ctx, `
+			SELECT ea.id, ea.email, ea.completed_at, ea.abandoned_at, ea.question_order, e.id, e.domain_weights
 			FROM exam_attempts ea
 			JOIN exams e ON ea.exam_id = e.id
 			WHERE ea.id = $1
-		`, sessionID).Scan(&attempt.ID, &attempt.Email, &attempt.CompletedAt, &examID, &passingScore, &domainWeightsJSON)
+		`, sessionID).Scan(&attempt.ID, &attempt.Email, &attempt.CompletedAt, &attempt.AbandonedAt, &attempt.QuestionOrder, &examID, &domainWeightsJSON)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
 			return
@@ -472,18 +1202,22 @@ func SubmitExamSession(pool *pgxpool.Pool) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Session already completed"})
 			return
 		}
+		if attempt.AbandonedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Session was abandoned; start a new session"})
+			return
+		}
 		var domainWeights map[string]float64
 		if err := json.Unmarshal(domainWeightsJSON, &domainWeights); err != nil {
-			log.Printf("Error unmarshaling domain weights for exam %d: %v", examID, err)
+			logRequestError(c, "Error unmarshaling domain weights for exam %d: %v", examID, err)
 			domainWeights = make(map[string]float64) // Fallback to empty map
 		}
 		// Calculate score and domain breakdown
 		var totalQuestions int
-		err = pool.QueryRow(context.Background(), `
+		err = pool.QueryRow(ctx, `
 			SELECT COUNT(id) FROM exam_questions WHERE exam_id = $1
 		`, examID).Scan(&totalQuestions)
 		if err != nil {
-			log.Printf("Error counting total questions for exam %d: %v", examID, err)
+			logRequestError(c, "Error counting total questions for exam %d: %v", examID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate score"})
 			return
 		}
@@ -496,185 +1230,439 @@ func SubmitExamSession(pool *pgxpool.Pool) gin.HandlerFunc {
 			})
 			return
 		}
-		correctCount := 0
-		detailedReport := []models.DetailedQuestionReport{}
-		domainCorrectCounts := make(map[string]int)
-		domainTotalCounts := make(map[string]int)
-		// Fetch all exam questions for this exam
-		examQuestionsRows, err := pool.Query(context.Background(), `
+		minAnsweredFraction := db.GetSettingFloat(pool, "min_answered_fraction", 0)
+		if minAnsweredFraction > 0 && c.Query("confirm") != "true" {
+			var answeredCount int
+			err = pool.QueryRow(ctx, `
+				SELECT COUNT(ua.id) FROM user_answers ua
+				WHERE ua.attempt_id = $1 AND `+exam.AnsweredCondition, sessionID).Scan(&answeredCount)
+			if err != nil {
+				logRequestError(c, "Error counting answered questions for attempt %d: %v", sessionID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to finalize exam session"})
+				return
+			}
+			if float64(answeredCount) < minAnsweredFraction*float64(totalQuestions) {
+				c.JSON(http.StatusConflict, models.SubmitConfirmationResponse{
+					Error:               fmt.Sprintf("Only %d of %d questions answered; submit again with confirm=true to finish anyway", answeredCount, totalQuestions),
+					ConfirmationRequired: true,
+					AnsweredCount:       answeredCount,
+					TotalQuestions:      totalQuestions,
+					MinAnsweredFraction: minAnsweredFraction,
+				})
+				return
+			}
+		}
+		result, err := exam.FinalizeAttempt(ctx, pool, sessionID, questionOrderBy(attempt.QuestionOrder))
+		if err == exam.ErrAttemptCompleted {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Session already completed"})
+			return
+		}
+		if err != nil {
+			logRequestError(c, "Error finalizing exam attempt %d: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to finalize exam session"})
+			return
+		}
+		resp := models.ExamSubmissionResponse{
+			ScorePercent:   result.ScorePercent,
+			Pass:           result.Pass,
+			DomainBreakdown: result.DomainBreakdown,
+			DetailedReport: result.DetailedReport,
+		}
+		if result.Mode == "simulation" {
+			withholdForRelease(&resp, exam.LoadReleasePolicy(ctx, pool))
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+// withholdForRelease removes from a simulation attempt's results what releasePolicy (a simulation_results_release
+// value) keeps from students: the explanations, or the whole detailed report, which is then flagged as withheld.
+func withholdForRelease(resp *models.ExamSubmissionResponse, releasePolicy string) {
+	switch releasePolicy {
+	case exam.ReleaseWithoutExplanations:
+		exam.WithholdExplanations(resp.DetailedReport)
+	case exam.ReleaseScoreOnly:
+		resp.DetailedReport = []models.DetailedQuestionReport{}
+		resp.ReportWithheld = true
+	}
+}
+// GetExamSessionReport returns the results of a completed attempt in the same form as its submission: the
+// stored score and pass/fail, with the domain breakdown and detailed report regraded from the recorded answers
+// as by ScoreAttempt. Students may only read their own attempts; admins may read any.
+// GET /api/v1/exam_sessions/:session_id/report
+func GetExamSessionReport(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		userEmail := c.GetString("user_email") // From JWT middleware
+		userRoles := c.GetStringSlice("user_roles") // From JWT middleware
+		var attempt models.ExamAttempt
+		var passingScore float64
+		err = pool.QueryRow(ctx, `
+			SELECT ea.id, ea.exam_id, ea.email, ea.mode, ea.question_order, ea.completed_at, ea.score_percent, e.passing_score
+			FROM exam_attempts ea
+			JOIN exams e ON ea.exam_id = e.id
+			WHERE ea.id = $1
+		`, sessionID).Scan(&attempt.ID, &attempt.ExamID, &attempt.Email, &attempt.Mode, &attempt.QuestionOrder, &attempt.CompletedAt, &attempt.ScorePercent, &passingScore)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		if attempt.Email != userEmail && !utils.ContainsString(userRoles, "admin") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this session"})
+			return
+		}
+		if attempt.CompletedAt == nil || attempt.ScorePercent == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Session is not completed; submit it before fetching the report"})
+			return
+		}
+		score, err := exam.ScoreAttempt(ctx, pool, sessionID, attempt.ExamID, questionOrderBy(attempt.QuestionOrder))
+		if err != nil {
+			logRequestError(c, "Error fetching exam questions for report of attempt %d: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build exam report"})
+			return
+		}
+		resp := models.ExamSubmissionResponse{
+			ScorePercent:    *attempt.ScorePercent,
+			Pass:            exam.Passed(*attempt.ScorePercent, passingScore),
+			DomainBreakdown: score.DomainBreakdown,
+			DetailedReport:  score.DetailedReport,
+		}
+		// Admins always get the full report; students get what simulation_results_release allows
+		if attempt.Mode == "simulation" && !utils.ContainsString(userRoles, "admin") {
+			withholdForRelease(&resp, exam.LoadReleasePolicy(ctx, pool))
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+// GetExamSessionReportPDF renders the detailed report of a completed attempt owned by the caller as a PDF:
+// score, pass/fail, domain breakdown and per-question results, graded as at submission.
+// GET /api/v1/exam_sessions/:session_id/report.pdf
+func GetExamSessionReportPDF(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		userEmail := c.GetString("user_email") // From JWT middleware
+		var attempt models.ExamAttempt
+		var examTitle string
+		var passingScore float64
+		err = pool.QueryRow(ctx, `
+			SELECT ea.id, ea.exam_id, ea.email, ea.mode, ea.question_order, ea.completed_at, ea.score_percent, e.title, e.passing_score
+			FROM exam_attempts ea
+			JOIN exams e ON ea.exam_id = e.id
+			WHERE ea.id = $1
+		`, sessionID).Scan(&attempt.ID, &attempt.ExamID, &attempt.Email, &attempt.Mode, &attempt.QuestionOrder, &attempt.CompletedAt, &attempt.ScorePercent, &examTitle, &passingScore)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		if attempt.Email != userEmail {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this session"})
+			return
+		}
+		if attempt.CompletedAt == nil || attempt.ScorePercent == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Session is not completed; submit it before downloading the report"})
+			return
+		}
+		score, err := exam.ScoreAttempt(ctx, pool, sessionID, attempt.ExamID, questionOrderBy(attempt.QuestionOrder))
+		if err != nil {
+			logRequestError(c, "Error fetching exam questions for report of attempt %d: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build exam report"})
+			return
+		}
+		if attempt.Mode == "simulation" {
+			switch exam.LoadReleasePolicy(ctx, pool) {
+			case exam.ReleaseWithoutExplanations:
+				exam.WithholdExplanations(score.DetailedReport)
+			case exam.ReleaseScoreOnly:
+				score.DetailedReport = nil // The PDF then has the summary and domain breakdown only
+			}
+		}
+		var buf bytes.Buffer
+		err = report.WritePDF(&buf, report.ExamReport{
+			ExamTitle:       examTitle,
+			Email:           attempt.Email,
+			CompletedAt:     *attempt.CompletedAt,
+			ScorePercent:    *attempt.ScorePercent,
+			PassingScore:    passingScore,
+			Pass:            exam.Passed(*attempt.ScorePercent, passingScore),
+			DomainBreakdown: score.DomainBreakdown,
+			DetailedReport:  score.DetailedReport,
+		})
+		if err != nil {
+			logRequestError(c, "Error rendering PDF report for attempt %d: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render exam report"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="exam-report-%s.pdf"`, c.Param("session_id")))
+		c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+	}
+}
+// GetExamSessionReview replays a completed attempt question-by-question in exam order, with the
+// student's answers, correctness, correct answers, explanations, and full question/choice content.
+// GET /api/v1/exam_sessions/:session_id/review
+func GetExamSessionReview(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		userEmail := c.GetString("user_email") // From JWT middleware
+		userRoles := c.GetStringSlice("user_roles") // From JWT middleware
+		var attempt models.ExamAttempt
+		var examTitle string
+		err = pool.QueryRow(ctx, `
+			SELECT ea.id, ea.exam_id, ea.email, ea.mode, ea.question_order, ea.shuffle_choices, ea.completed_at, ea.score_percent, e.title
+			FROM exam_attempts ea
+			JOIN exams e ON ea.exam_id = e.id
+			WHERE ea.id = $1
+		`, sessionID).Scan(&attempt.ID, &attempt.ExamID, &attempt.Email, &attempt.Mode, &attempt.QuestionOrder, &attempt.ShuffleChoices, &attempt.CompletedAt, &attempt.ScorePercent, &examTitle)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		// Students may only review their own attempts (admins may review any)
+		if attempt.Email != userEmail && !utils.ContainsString(userRoles, "admin") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this session"})
+			return
+		}
+		if attempt.CompletedAt == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Session is not completed; submit it before reviewing"})
+			return
+		}
+		// Admins always see the full review; students see what simulation_results_release allows
+		releasePolicy := exam.ReleaseImmediate
+		if attempt.Mode == "simulation" && !utils.ContainsString(userRoles, "admin") {
+			releasePolicy = exam.LoadReleasePolicy(ctx, pool)
+		}
+		if releasePolicy == exam.ReleaseScoreOnly {
+			c.JSON(http.StatusForbidden, gin.H{"error": "The review of this simulation has not been released; only the score is available"})
+			return
+		}
+		withholdExplanations := releasePolicy == exam.ReleaseWithoutExplanations
+		// Results, credit and the answer texts come from the scorer, so the review agrees with the submission
+		score, err := exam.ScoreAttempt(ctx, pool, sessionID, attempt.ExamID, questionOrderBy(attempt.QuestionOrder))
+		if err != nil {
+			logRequestError(c, "Error scoring attempt %d for review: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exam review"})
+			return
+		}
+		reportByExamQuestion := make(map[int]models.DetailedQuestionReport, len(score.DetailedReport))
+		for i, entry := range score.DetailedReport {
+			reportByExamQuestion[score.ExamQuestionIDs[i]] = entry
+		}
+		// Fetch all choices for the exam's questions up front
+		choicesByQuestion := make(map[int][]models.ReviewChoice)
+		matchIDByChoice := make(map[int]int)  // Matching prompts' choice IDs to their responses' match IDs
+		matchTextByID := make(map[int]string) // Matching responses by match ID
+		// Ordering items are listed in their expected order, other choices as the attempt was served them
+		choiceRows, err := pool.Query(ctx, fmt.Sprintf(`
+			SELECT c.question_id, c.id, c.choice_text, c.is_correct, COALESCE(c.explanation, ''), c.position, mo.id, COALESCE(mo.option_text, '')
+			FROM choices c
+			JOIN exam_questions eq ON eq.question_id = c.question_id
+			JOIN questions q ON q.id = c.question_id
+			LEFT JOIN match_options mo ON mo.choice_id = c.id
+			WHERE eq.exam_id = $1
+			ORDER BY c.question_id, c.position, %s
+		`, choiceDisplayOrder(attempt.ID, attempt.ShuffleChoices, "c.id")), attempt.ExamID)
+		if err != nil {
+			logRequestError(c, "Error fetching choices for review of attempt %d: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exam review"})
+			return
+		}
+		for choiceRows.Next() {
+			var questionID int
+			var rc models.ReviewChoice
+			var matchID *int
+			if err := choiceRows.Scan(&questionID, &rc.ChoiceID, &rc.Text, &rc.IsCorrect, &rc.Explanation, &rc.Position, &matchID, &rc.MatchText); err != nil {
+				logRequestError(c, "Error scanning choice for review of attempt %d: %v", sessionID, err)
+				continue
+			}
+			if matchID != nil {
+				matchIDByChoice[rc.ChoiceID] = *matchID
+				matchTextByID[*matchID] = rc.MatchText
+			}
+			choicesByQuestion[questionID] = append(choicesByQuestion[questionID], rc)
+		}
+		choiceRows.Close()
+		rows, err := pool.Query(ctx, fmt.Sprintf(`
 			SELECT
-				eq.id AS exam_question_id,
-				q.id AS question_id,
-				q.question_text,
-				q.question_type,
-				q.explanation,
-				q.input_method,
-				d.name AS domain_name,
-				ua.choice_ids,
-				ua.text_answer
+				eq.id, eq.question_order, q.id, q.question_text, q.question_type, q.explanation,
+				q.image_url, q.code_block, q.code_language, q.input_method, q.exact_select, d.name,
+				ua.choice_ids, ua.text_answer, ua.match_answer
 			FROM exam_questions eq
 			JOIN questions q ON eq.question_id = q.id
 			JOIN domains d ON q.domain_id = d.id
 			LEFT JOIN user_answers ua ON ua.exam_question_id = eq.id AND ua.attempt_id = $1
 			WHERE eq.exam_id = $2
-			ORDER BY eq.question_order
-		`, sessionID, examID)
+			ORDER BY %s
+		`, questionOrderBy(attempt.QuestionOrder)), sessionID, attempt.ExamID)
 		if err != nil {
-			log.Printf("Error fetching exam questions for scoring: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exam questions for scoring"})
+			logRequestError(c, "Error fetching exam questions for review of attempt %d: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exam review"})
 			return
 		}
-		defer examQuestionsRows.Close()
-		for examQuestionsRows.Next() {
-			var eq models.ExamQuestion
-			var q models.Question
-			var domainName string
+		defer rows.Close()
+		review := models.ExamReviewResponse{
+			SessionID:    c.Param("session_id"),
+			ExamTitle:    examTitle,
+			Mode:         attempt.Mode,
+			QuestionOrder: attempt.QuestionOrder,
+			ScorePercent: attempt.ScorePercent,
+			CompletedAt:  *attempt.CompletedAt,
+			Questions:    []models.ExamReviewQuestion{},
+		}
+		for rows.Next() {
+			var rq models.ExamReviewQuestion
+			var questionID int
 			var userChoiceIDs []int32 // From DB array type
-			var userTextAnswer *string
-			if err := examQuestionsRows.Scan(
-				&eq.ID, &q.ID, &q.QuestionText, &q.QuestionType, &q.Explanation, &q.InputMethod, &domainName,
-				&userChoiceIDs, &userTextAnswer,
+			if err := rows.Scan(
+				&rq.ExamQuestionID, &rq.QuestionOrder, &questionID, &rq.Question, &rq.QuestionType, &rq.Explanation,
+				&rq.ImageURL, &rq.CodeBlock, &rq.CodeLanguage, &rq.InputMethod, &rq.ExactSelect, &rq.Domain,
+				&userChoiceIDs, &rq.TextAnswer, &rq.MatchAnswer,
 			); err != nil {
-				log.Printf("Error scanning exam question for scoring: %v", err)
+				logRequestError(c, "Error scanning exam question for review of attempt %d: %v", sessionID, err)
 				continue
 			}
-			domainTotalCounts[domainName]++
-			reportEntry := models.DetailedQuestionReport{
-				Question:    q.QuestionText,
-				Explanation: q.Explanation,
+			rq.QuestionOrder = len(review.Questions) + 1 // Position as served for the attempt's ordering
+			report, scored := reportByExamQuestion[rq.ExamQuestionID]
+			if !scored {
+				logRequestError(c, "Exam question %d of attempt %d missing from its score", rq.ExamQuestionID, sessionID)
+				continue
 			}
-			// Get correct answers for comparison
-			isCorrect := false
-			correctAnswerTexts := []string{}
-			yourAnswerTexts := []string{}
-			if q.QuestionType == "single" || q.QuestionType == "multi" || q.QuestionType == "truefalse" {
-				correctChoicesMap := make(map[int]bool)
-				var choicesFromDB []struct {
-					ID int
-					Text string
-					IsCorrect bool
-				}
-				choicesRows, err := pool.Query(context.Background(), `
-					SELECT id, choice_text, is_correct FROM choices WHERE question_id = $1
-				`, q.ID)
-				if err != nil {
-					log.Printf("Error fetching choices for question %d during scoring: %v", q.ID, err)
-					continue
-				}
-				for choicesRows.Next() {
-					var cID int
-					var cText string
-					var cIsCorrect bool
-					if err := choicesRows.Scan(&cID, &cText, &cIsCorrect); err != nil {
-						log.Printf("Error scanning choice for question %d during scoring: %v", q.ID, err)
-						continue
-					}
-					choicesFromDB = append(choicesFromDB, struct{ID int; Text string; IsCorrect bool}{cID, cText, cIsCorrect})
-					if cIsCorrect {
-						correctChoicesMap[cID] = true
-						correctAnswerTexts = append(correctAnswerTexts, cText)
-					}
-				}
-				choicesRows.Close()
-				// Convert userChoiceIDs from int32 to int for comparison with int-based map
-				userSelectedChoicesInt := make([]int, len(userChoiceIDs))
-				for i, v := range userChoiceIDs {
-					userSelectedChoicesInt[i] = int(v)
-				}
-				// Check correctness
-				allUserChoicesCorrect := true
-				userSelectedAnyIncorrect := false
-				userSelectedCorrectCount := 0
-				for _, choice := range choicesFromDB {
-					userSelectedThisChoice := utils.ContainsInt(userSelectedChoicesInt, choice.ID)
-					if choice.IsCorrect {
-						if userSelectedThisChoice {
-							userSelectedCorrectCount++
-						} else {
-							allUserChoicesCorrect = false // Missed a correct choice
-						}
-					} else { // Is incorrect choice
-						if userSelectedThisChoice {
-							userSelectedAnyIncorrect = true // Selected an incorrect error
-						}
-					}
-					if userSelectedThisChoice {
-						yourAnswerTexts = append(yourAnswerTexts, choice.Text)
-					}
-				}
-				if q.QuestionType == "single" || q.QuestionType == "truefalse" {
-					isCorrect = allUserChoicesCorrect && !userSelectedAnyIncorrect && userSelectedCorrectCount == 1 && len(userSelectedChoicesInt) == 1
-				} else if q.QuestionType == "multi" { // "select all"
-					isCorrect = allUserChoicesCorrect && !userSelectedAnyIncorrect && userSelectedCorrectCount == len(correctChoicesMap) && len(userSelectedChoicesInt) == len(correctChoicesMap)
-				}
-			} else if q.QuestionType == "fillblank" {
-				var acceptableAnswers []string
-				ansRows, err := pool.Query(context.Background(), `
-					SELECT acceptable_answer FROM fill_blank_answers WHERE question_id = $1
-				`, q.ID)
-				if err != nil {
-					log.Printf("Error fetching acceptable answers for question %d: %v", q.ID, err)
-					continue
-				}
-				for ansRows.Next() {
-					var ans string
-					if err := ansRows.Scan(&ans); err != nil {
-						log.Printf("Error scanning acceptable answer: %v", err)
-						continue
+			rq.YourAnswer, rq.CorrectAnswer, rq.Result, rq.Score = report.YourAnswer, report.CorrectAnswer, report.Result, report.Score
+			if withholdExplanations {
+				rq.Explanation = ""
+			}
+			rq.SelectedChoiceIDs = make([]int, len(userChoiceIDs))
+			for i, v := range userChoiceIDs {
+				rq.SelectedChoiceIDs[i] = int(v)
+			}
+			for i, rc := range choicesByQuestion[questionID] {
+				switch rq.QuestionType {
+				case "ordering":
+					// Items are listed in their expected order; is_correct marks those the student placed there
+					rc.Selected = utils.ContainsInt(rq.SelectedChoiceIDs, rc.ChoiceID)
+					rc.IsCorrect = i < len(rq.SelectedChoiceIDs) && rq.SelectedChoiceIDs[i] == rc.ChoiceID
+				case "matching":
+					// Each prompt shows its response and the one the student paired it with; is_correct marks a match
+					submitted, answered := rq.MatchAnswer[rc.ChoiceID]
+					rc.Selected = answered
+					rc.IsCorrect = answered && submitted == matchIDByChoice[rc.ChoiceID]
+					if answered {
+						rc.YourMatch = matchTextByID[submitted]
 					}
-					acceptableAnswers = append(acceptableAnswers, strings.ToLower(ans))
+				default:
+					rc.Selected = utils.ContainsInt(rq.SelectedChoiceIDs, rc.ChoiceID)
 				}
-				ansRows.Close()
-				if userTextAnswer != nil {
-					yourAnswerTexts = []string{*userTextAnswer}
-					isCorrect = utils.ContainsString(acceptableAnswers, strings.ToLower(strings.TrimSpace(*userTextAnswer)))
-				} else {
-					isCorrect = false
+				if withholdExplanations {
+					rc.Explanation = ""
 				}
-				correctAnswerTexts = acceptableAnswers // Show all acceptable answers
-			}
-			if isCorrect {
-				correctCount++
-				domainCorrectCounts[domainName]++
-				reportEntry.Result = "correct"
-			} else {
-				reportEntry.Result = "incorrect"
-			}
-			// If no answer provided, it's skipped/incorrect depending on interpretation
-			if len(yourAnswerTexts) == 0 && userTextAnswer == nil {
-				reportEntry.Result = "skipped"
-			}
-			reportEntry.YourAnswer = yourAnswerTexts
-			reportEntry.CorrectAnswer = correctAnswerTexts
-			detailedReport = append(detailedReport, reportEntry)
-		}
-		finalScorePercent := int(math.Round(float64(correctCount) / float64(totalQuestions) * 100))
-		passed := finalScorePercent >= int(passingScore)
-		// Calculate domain breakdown percentage
+				rq.Choices = append(rq.Choices, rc)
+			}
+			review.Questions = append(review.Questions, rq)
+		}
+		c.JSON(http.StatusOK, review)
+	}
+}
+// GetNextExamRecommendation suggests the next exam of the course after a completed practice attempt,
+// based on its score and stored domain breakdown (see exam.RecommendNextExam).
+// GET /api/v1/exam_sessions/:session_id/next
+func GetNextExamRecommendation(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sessionID, err := resolveSessionID(ctx, pool, c.Param("session_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		userEmail := c.GetString("user_email") // From JWT middleware
+		var attempt models.ExamAttempt
+		var scorePercent sql.NullInt32
+		var passingScore float64
+		var domainBreakdownJSON []byte
+		err = pool.QueryRow(ctx, `
+			SELECT ea.exam_id, ea.email, ea.mode, ea.completed_at, ea.score_percent, ea.domain_breakdown, e.passing_score
+			FROM exam_attempts ea
+			JOIN exams e ON ea.exam_id = e.id
+			WHERE ea.id = $1
+		`, sessionID).Scan(&attempt.ExamID, &attempt.Email, &attempt.Mode, &attempt.CompletedAt, &scorePercent, &domainBreakdownJSON, &passingScore)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Exam session not found or accessible"})
+			return
+		}
+		if attempt.Email != userEmail {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to this session"})
+			return
+		}
+		if attempt.Mode != "practice" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Recommendations are only available for practice attempts"})
+			return
+		}
+		if attempt.CompletedAt == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Session must be submitted before requesting a recommendation"})
+			return
+		}
+		// Attempts submitted before breakdowns were stored have none; no domain is then treated as weak
 		domainBreakdown := make(map[string]int)
-		for domain, correct := range domainCorrectCounts {
-			total := domainTotalCounts[domain]
-			if total > 0 {
-				domainBreakdown[domain] = int(math.Round(float64(correct) / float64(total) * 100))
-			} else {
-				domainBreakdown[domain] = 0
+		if domainBreakdownJSON != nil {
+			if err := json.Unmarshal(domainBreakdownJSON, &domainBreakdown); err != nil {
+				logRequestError(c, "Error unmarshaling domain breakdown for attempt %d: %v", sessionID, err)
 			}
 		}
-		// Update exam_attempts record
-		completedAt := time.Now()
-		_, err = pool.Exec(context.Background(), `
-			UPDATE exam_attempts SET completed_at = $1, score_percent = $2 WHERE id = $3
-		`, completedAt, finalScorePercent, sessionID)
+		// Candidates: the other listed exams of the same course and bank version that can be started in practice
+		// mode; sample, retired and practice-disabled exams are never recommended
+		rows, err := pool.Query(ctx, `
+			SELECT e.id, e.domain_weights,
+				AVG(ea.score_percent) FILTER (WHERE ea.completed_at IS NOT NULL)::float8,
+				COALESCE(BOOL_OR(ea.email = $2 AND ea.completed_at IS NOT NULL), FALSE)
+			FROM exams e
+			JOIN exams cur ON cur.id = $1 AND e.course_id = cur.course_id AND e.exam_bank_version = cur.exam_bank_version
+			LEFT JOIN exam_attempts ea ON ea.exam_id = e.id
+			WHERE e.id <> $1 AND `+listedExamCondition+` AND e.allow_practice AND e.retired_at IS NULL
+			GROUP BY e.id
+			ORDER BY e.id
+		`, attempt.ExamID, userEmail)
 		if err != nil {
-			log.Printf("Error updating exam attempt %d completion: %v", sessionID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to finalize exam session"})
+			logRequestError(c, "Error fetching recommendation candidates for exam %d: %v", attempt.ExamID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute recommendation"})
+			return
+		}
+		defer rows.Close()
+		var candidates []exam.ExamCandidate
+		for rows.Next() {
+			var candidate exam.ExamCandidate
+			var domainWeightsJSON []byte
+			if err := rows.Scan(&candidate.ExamID, &domainWeightsJSON, &candidate.AverageScore, &candidate.Completed); err != nil {
+				logRequestError(c, "Error scanning recommendation candidate: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute recommendation"})
+				return
+			}
+			if err := json.Unmarshal(domainWeightsJSON, &candidate.DomainWeights); err != nil {
+				logRequestError(c, "Error unmarshaling domain weights for exam %d: %v", candidate.ExamID, err)
+			}
+			candidates = append(candidates, candidate)
+		}
+		margin := db.GetSettingFloat(pool, "practice_recommend_margin", 15)
+		rec, ok := exam.RecommendNextExam(int(scorePercent.Int32), passingScore, margin, domainBreakdown, candidates)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No other exams are available for this course"})
 			return
 		}
-		c.JSON(http.StatusOK, models.ExamSubmissionResponse{
-			ScorePercent:   finalScorePercent,
-			Pass:           passed,
-			DomainBreakdown: domainBreakdown,
-			DetailedReport: detailedReport,
+		c.JSON(http.StatusOK, models.NextExamRecommendation{
+			ExamID:       rec.ExamID,
+			Strategy:     rec.Strategy,
+			ScorePercent: int(scorePercent.Int32),
+			WeakDomains:  rec.WeakDomains,
 		})
 	}
 }
@@ -682,7 +1670,8 @@ func SubmitExamSession(pool *pgxpool.Pool) gin.HandlerFunc {
 // GET /api/v1/students/:email/history
 func GetStudentHistory(pool *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		studentEmail := c.Param("email")
+		ctx := c.Request.Context()
+		studentEmail := utils.NormalizeEmail(c.Param("email"))
 		userEmail := c.GetString("user_email") // From JWT middleware
 		// Ensure user can only view their own history (or admin can view all)
 		userRoles := c.GetStringSlice("user_roles") // From JWT middleware
@@ -696,15 +1685,15 @@ func GetStudentHistory(pool *pgxpool.Pool) gin.HandlerFunc {
 				e.title,
 				ea.score_percent,
 				ea.completed_at,
-				e.domain_weights -- To recalculate domain breakdown
+				ea.domain_breakdown
 			FROM exam_attempts ea
 			JOIN exams e ON ea.exam_id = e.id
 			WHERE ea.email = $1 AND ea.completed_at IS NOT NULL
 			ORDER BY ea.completed_at DESC
 		`
-		rows, err := pool.Query(context.Background(), query, studentEmail)
+		rows, err := pool.Query(ctx, query, studentEmail)
 		if err != nil {
-			log.Printf("Error querying student history for %s: %v", studentEmail, err)
+			logRequestError(c, "Error querying student history for %s: %v", studentEmail, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve student history"})
 			return
 		}
@@ -714,14 +1703,14 @@ func GetStudentHistory(pool *pgxpool.Pool) gin.HandlerFunc {
 			var entry models.StudentHistoryEntry
 			var scorePercent sql.NullInt32 // Use NullInt32 for potentially NULL score_percent
 			var completedAt time.Time
-			var domainWeightsJSON []byte
+			var domainBreakdownJSON []byte
 			if err := rows.Scan(
 				&entry.ExamTitle,
 				&scorePercent,
 				&completedAt,
-				&domainWeightsJSON,
+				&domainBreakdownJSON,
 			); err != nil {
-				log.Printf("Error scanning student history row for %s: %v", studentEmail, err)
+				logRequestError(c, "Error scanning student history row for %s: %v", studentEmail, err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process history data"})
 				return
 			}
@@ -729,21 +1718,13 @@ func GetStudentHistory(pool *pgxpool.Pool) gin.HandlerFunc {
 				entry.ScorePercent = int(scorePercent.Int32)
 			}
 			entry.Timestamp = completedAt
-			var domainWeights map[string]float64
-			if err := json.Unmarshal(domainWeightsJSON, &domainWeights); err != nil {
-				log.Printf("Error unmarshaling domain weights for history entry: %v", err)
-				domainWeights = make(map[string]float64) // Fallback
-			}
-			// For domain breakdown in history, we need to re-calculate based on saved answers.
-			// This is an expensive operation and typically done at submission or pre-calculated.
-			// For simplicity here, we'll return an empty breakdown or just the overall score.
-			// If full domain breakdown is strictly needed for history API, it should be stored
-			// in exam_attempts directly, or this endpoint needs to be more complex.
-			// For now, let's just make a dummy breakdown.
-			entry.DomainBreakdown = make(map[string]int) // Placeholder
-			// If domain breakdown is needed here, fetch user answers for this attempt,
-			// compare against correct answers, and aggregate per domain, similar to SubmitExamSession.
-			// This is left as an exercise to avoid excessive query complexity for a demo.
+			// Domain breakdown is stored at submission; attempts submitted before that have none
+			entry.DomainBreakdown = make(map[string]int)
+			if domainBreakdownJSON != nil {
+				if err := json.Unmarshal(domainBreakdownJSON, &entry.DomainBreakdown); err != nil {
+					logRequestError(c, "Error unmarshaling domain breakdown for history entry: %v", err)
+				}
+			}
 			history = append(history, entry)
 		}
 		c.JSON(http.StatusOK, history) // FIXED: `history` is now correctly scoped and populated
@@ -0,0 +1,469 @@
+
+package handlers
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db/dbtest"
+	"recap-server/exam"
+	"recap-server/ingestion"
+	"recap-server/models"
+)
+func TestValidateChoiceIDs(t *testing.T) {
+	validChoiceIDs := map[int]bool{11: true, 12: true, 13: true, 14: true}
+	tests := []struct {
+		name      string
+		submitted []int
+		wantErr   string
+	}{
+		{"no choices", nil, ""},
+		{"single valid choice", []int{12}, ""},
+		{"several valid choices", []int{14, 11, 13}, ""},
+		{"unknown choice", []int{11, 99}, "choice_id 99 does not belong to this question"},
+		{"negative garbage", []int{-1}, "choice_id -1 does not belong to this question"},
+		{"duplicate choice", []int{11, 12, 11}, "duplicate choice_id 11"},
+		{"every choice repeated", []int{11, 12, 13, 14, 11, 12, 13, 14}, "duplicate choice_id 11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateChoiceIDs(tt.submitted, validChoiceIDs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateChoiceIDs(%v) = %v, want nil", tt.submitted, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateChoiceIDs(%v) = %v, want error containing %q", tt.submitted, err, tt.wantErr)
+			}
+		})
+	}
+}
+func TestMaxChoiceIDsPerAnswerCoversEveryChoice(t *testing.T) {
+	// A multi question may have all of its choices correct, so the cap must admit one ID per CSV choice column
+	const csvChoiceColumns = 6
+	if maxChoiceIDsPerAnswer < csvChoiceColumns {
+		t.Fatalf("maxChoiceIDsPerAnswer = %d, want at least %d", maxChoiceIDsPerAnswer, csvChoiceColumns)
+	}
+}
+func TestValidateChoiceIDsRejectsOtherQuestionsChoices(t *testing.T) {
+	// Choice IDs are global, so a correct choice copied from another question must not pass for this one
+	questionChoices := map[int]bool{21: true, 22: true, 23: true}
+	otherQuestionChoices := []int{31, 32, 33}
+	tests := []struct {
+		name      string
+		submitted []int
+	}{
+		{"only the other question's choice", []int{otherQuestionChoices[0]}},
+		{"own choice plus the other question's", []int{21, otherQuestionChoices[1]}},
+		{"the other question's choices in order", otherQuestionChoices},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateChoiceIDs(tt.submitted, questionChoices); err == nil {
+				t.Fatalf("validateChoiceIDs(%v) = nil, want an error for choices of another question", tt.submitted)
+			}
+		})
+	}
+}
+func TestQuestionOrderBy(t *testing.T) {
+	tests := []struct {
+		name          string
+		questionOrder string
+		want          string
+	}{
+		{"shuffled", QuestionOrderShuffled, "eq.question_order"},
+		{"domain grouped", QuestionOrderDomain, "d.name, q.id"},
+		{"attempt from before the option", "", "eq.question_order"},
+		{"unknown value", "alphabetical", "eq.question_order"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := questionOrderBy(tt.questionOrder); got != tt.want {
+				t.Fatalf("questionOrderBy(%q) = %q, want %q", tt.questionOrder, got, tt.want)
+			}
+		})
+	}
+}
+func TestQuestionOrderByIsStable(t *testing.T) {
+	// Start, status, submission and review all order by the stored ordering, so each must end on a unique
+	// key to list the questions the same way every time
+	for _, questionOrder := range []string{QuestionOrderShuffled, QuestionOrderDomain} {
+		orderBy := questionOrderBy(questionOrder)
+		if !strings.HasSuffix(orderBy, "q.id") && orderBy != "eq.question_order" {
+			t.Errorf("questionOrderBy(%q) = %q, want it to end on a unique key", questionOrder, orderBy)
+		}
+	}
+}
+func TestSessionModeAllowed(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowPractice   bool
+		allowSimulation bool
+		mode            string
+		want            bool
+	}{
+		{"both allowed, practice", true, true, "practice", true},
+		{"both allowed, simulation", true, true, "simulation", true},
+		{"practice only, practice", true, false, "practice", true},
+		{"practice only, simulation", true, false, "simulation", false},
+		{"simulation only, practice", false, true, "practice", false},
+		{"simulation only, simulation", false, true, "simulation", true},
+		{"retired, practice", false, false, "practice", false},
+		{"retired, simulation", false, false, "simulation", false},
+		{"unknown mode", true, true, "review", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exam := models.Exam{AllowPractice: tt.allowPractice, AllowSimulation: tt.allowSimulation}
+			if got := sessionModeAllowed(exam, tt.mode); got != tt.want {
+				t.Fatalf("sessionModeAllowed(practice=%t, simulation=%t, %q) = %t, want %t", tt.allowPractice, tt.allowSimulation, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+func TestAnswerDeadlinePassed(t *testing.T) {
+	startedAt := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		minutes int
+		grace   time.Duration
+		elapsed time.Duration
+		want    bool
+	}{
+		{"well inside the limit", 30, 30 * time.Second, 10 * time.Minute, false},
+		{"at the limit", 30, 30 * time.Second, 30 * time.Minute, false},
+		{"inside the grace", 30, 30 * time.Second, 30*time.Minute + 29*time.Second, false},
+		{"exactly at the deadline", 30, 30 * time.Second, 30*time.Minute + 30*time.Second, false},
+		{"past the grace", 30, 30 * time.Second, 30*time.Minute + 31*time.Second, true},
+		{"no grace", 30, 0, 30*time.Minute + time.Second, true},
+		{"long exam", 240, time.Minute, 3 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := startedAt.Add(tt.elapsed)
+			if got := answerDeadlinePassed(startedAt, tt.minutes, tt.grace, now); got != tt.want {
+				t.Fatalf("answerDeadlinePassed(%d min, grace %s, after %s) = %t, want %t", tt.minutes, tt.grace, tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+func TestSessionResponseCarriesNoAnswerKey(t *testing.T) {
+	// Even if choices_json ever gained answer key fields, decoding into the session models must drop them
+	tests := []struct {
+		name        string
+		mode        string
+		choicesJSON string
+	}{
+		{"simulation, plain choices", "simulation", `[{"choice_id": 1, "text": "TCP", "order": "A"}, {"choice_id": 2, "text": "UDP", "order": "B"}]`},
+		{"simulation, leaky choices", "simulation", `[{"choice_id": 1, "text": "TCP", "order": "A", "is_correct": true, "explanation": "Reliable."}]`},
+		{"practice, leaky choices", "practice", `[{"choice_id": 1, "text": "TCP", "order": "A", "is_correct": false, "explanation": "No."}]`},
+		{"no choices", "simulation", `[]`},
+	}
+	forbidden := []string{`"is_correct"`, `"explanation"`, `"acceptable_answers"`, `"correct_order"`, `"correct_match"`}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			question := models.SessionQuestion{ExamQuestionID: 7, QuestionText: "Which protocol?", QuestionType: "single"}
+			if err := json.Unmarshal([]byte(tt.choicesJSON), &question.Choices); err != nil {
+				t.Fatalf("decoding choices_json: %v", err)
+			}
+			body, err := json.Marshal(models.ExamSessionResponse{Mode: tt.mode, Questions: []models.SessionQuestion{question}})
+			if err != nil {
+				t.Fatalf("encoding the session response: %v", err)
+			}
+			for _, key := range forbidden {
+				if strings.Contains(string(body), key) {
+					t.Errorf("session response %s contains %s", body, key)
+				}
+			}
+		})
+	}
+}
+func TestWithholdForRelease(t *testing.T) {
+	tests := []struct {
+		name             string
+		releasePolicy    string
+		wantReport       bool
+		wantExplanations bool
+	}{
+		{"immediate", exam.ReleaseImmediate, true, true},
+		{"without explanations", exam.ReleaseWithoutExplanations, true, false},
+		{"score only", exam.ReleaseScoreOnly, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := models.ExamSubmissionResponse{
+				ScorePercent:    50,
+				DomainBreakdown: map[string]int{"Networking": 50},
+				DetailedReport: []models.DetailedQuestionReport{
+					{Question: "Which protocol?", Result: "correct", Explanation: "TCP is reliable."},
+					{Question: "Which port?", Result: "incorrect", Explanation: "SSH uses 22."},
+				},
+			}
+			withholdForRelease(&resp, tt.releasePolicy)
+			if resp.ScorePercent != 50 || resp.DomainBreakdown["Networking"] != 50 {
+				t.Errorf("score or domain breakdown changed: %d, %v", resp.ScorePercent, resp.DomainBreakdown)
+			}
+			if gotReport := len(resp.DetailedReport) > 0; gotReport != tt.wantReport || resp.ReportWithheld == tt.wantReport {
+				t.Fatalf("detailed report kept = %t (withheld flag %t), want %t", gotReport, resp.ReportWithheld, tt.wantReport)
+			}
+			if resp.DetailedReport == nil {
+				t.Errorf("detailed report is nil, want an empty list so it encodes as []")
+			}
+			for _, q := range resp.DetailedReport {
+				if gotExplanation := q.Explanation != ""; gotExplanation != tt.wantExplanations {
+					t.Errorf("explanation of %q kept = %t, want %t", q.Question, gotExplanation, tt.wantExplanations)
+				}
+			}
+		})
+	}
+}
+func TestChoiceDisplayOrder(t *testing.T) {
+	tests := []struct {
+		name           string
+		attemptID      int
+		shuffleChoices bool
+		want           string
+	}{
+		{"shuffled per attempt", 41, true, `CASE WHEN q.question_type <> 'truefalse' THEN md5('41:' || eq.id || ':' || id) END, id`},
+		{"another attempt", 42, true, `CASE WHEN q.question_type <> 'truefalse' THEN md5('42:' || eq.id || ':' || id) END, id`},
+		{"authored order", 41, false, `CASE WHEN q.question_type = 'ordering' THEN md5(eq.id || ':' || id) END, id`},
+		{"authored order ignores the attempt", 42, false, `CASE WHEN q.question_type = 'ordering' THEN md5(eq.id || ':' || id) END, id`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := choiceDisplayOrder(tt.attemptID, tt.shuffleChoices, "id"); got != tt.want {
+				t.Fatalf("choiceDisplayOrder(%d, %t) = %s, want %s", tt.attemptID, tt.shuffleChoices, got, tt.want)
+			}
+		})
+	}
+}
+func TestSessionQuestionColumnsOrderChoicesPerAttempt(t *testing.T) {
+	columns := sessionQuestionColumns(41, true)
+	if !strings.Contains(columns, choiceDisplayOrder(41, true, "id")) {
+		t.Errorf("sessionQuestionColumns does not order choices by the attempt's shuffle key:\n%s", columns)
+	}
+	if !strings.Contains(columns, "'choice_id', ch.id") {
+		t.Errorf("sessionQuestionColumns does not return the stable choice_id:\n%s", columns)
+	}
+}
+// sessionRouter routes the exam session endpoints as main.go does, for a student signed in as email.
+func sessionRouter(pool *pgxpool.Pool, email string) *gin.Engine {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("user_email", email)
+		c.Set("user_roles", []string{"student"})
+		c.Next()
+	})
+	router.POST("/exam_sessions", StartExamSession(pool, 0))
+	router.GET("/exam_sessions/:session_id/questions/:exam_question_id", GetSessionQuestion(pool))
+	router.POST("/exam_sessions/:session_id/answer", RecordAnswer(pool))
+	router.GET("/exam_sessions/:session_id/status", GetExamSessionStatus(pool))
+	router.POST("/exam_sessions/:session_id/submit", SubmitExamSession(pool))
+	router.GET("/exam_sessions/:session_id/review", GetExamSessionReview(pool))
+	return router
+}
+// serveJSON sends a request with body, if any, encoded as JSON, fails the test unless it is answered with 200,
+// and decodes the response into out. It returns the raw response body.
+func serveJSON(t *testing.T, router *gin.Engine, method, target string, body, out any) []byte {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("encoding the %s %s body: %v", method, target, err)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, &payload))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s = %d %s, want 200", method, target, w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+		t.Fatalf("decoding the %s %s response %s: %v", method, target, w.Body.String(), err)
+	}
+	return w.Body.Bytes()
+}
+// ingestExam ingests course TST101 with the given questions and returns the ID of its first exam.
+func ingestExam(t *testing.T, pool *pgxpool.Pool, questionsByDomain map[string][]string) int {
+	t.Helper()
+	ctx := context.Background()
+	labs := t.TempDir()
+	dbtest.WriteCourse(t, labs, "TST101", dbtest.ExamBankCSV("1.0.0", questionsByDomain))
+	if err := ingestion.ProcessCourseData(ctx, pool, "TST101", labs, false); err != nil {
+		t.Fatalf("ingesting TST101: %v", err)
+	}
+	var examID int
+	err := pool.QueryRow(ctx, `SELECT e.id FROM exams e JOIN courses c ON e.course_id = c.id WHERE c.course_code = 'TST101' ORDER BY e.exam_number LIMIT 1`).Scan(&examID)
+	if err != nil {
+		t.Fatalf("reading the exam of TST101: %v", err)
+	}
+	return examID
+}
+func TestStartExamSessionBodyCarriesNoAnswerKey(t *testing.T) {
+	pool := dbtest.Pool(t)
+	examID := ingestExam(t, pool, map[string][]string{
+		"Networking": {"What is a subnet?", "What is a VLAN?", "What is ARP?", "What is NAT?"},
+	})
+	router := sessionRouter(pool, "student@example.com")
+	forbidden := []string{`"is_correct"`, `"explanation"`, `"acceptable_answers"`, `"correct_order"`, `"correct_match"`}
+	for _, mode := range []string{"simulation", "practice"} {
+		t.Run(mode, func(t *testing.T) {
+			var session models.ExamSessionResponse
+			body := serveJSON(t, router, "POST", "/exam_sessions", models.ExamSessionRequest{ExamID: examID, Mode: mode}, &session)
+			if len(session.Questions) == 0 || len(session.Questions[0].Choices) == 0 {
+				t.Fatalf("session response %s serves no choices", body)
+			}
+			for _, key := range forbidden {
+				if bytes.Contains(body, []byte(key)) {
+					t.Errorf("session response %s contains %s", body, key)
+				}
+			}
+		})
+	}
+}
+// sessionChoiceIDs lists the choice IDs of each question of a session, as served.
+func sessionChoiceIDs(questions []models.SessionQuestion) map[int][]int {
+	choiceIDs := make(map[int][]int, len(questions))
+	for _, q := range questions {
+		for _, choice := range q.Choices {
+			choiceIDs[q.ExamQuestionID] = append(choiceIDs[q.ExamQuestionID], choice.ChoiceID)
+		}
+	}
+	return choiceIDs
+}
+func TestChoiceOrderStableWithinSession(t *testing.T) {
+	pool := dbtest.Pool(t)
+	examID := ingestExam(t, pool, map[string][]string{
+		"Networking": {"What is a subnet?", "What is a VLAN?", "What is ARP?", "What is NAT?"},
+	})
+	router := sessionRouter(pool, "student@example.com")
+	start := func() models.ExamSessionResponse {
+		var session models.ExamSessionResponse
+		serveJSON(t, router, "POST", "/exam_sessions", models.ExamSessionRequest{ExamID: examID, Mode: "practice"}, &session)
+		return session
+	}
+	session := start()
+	served := sessionChoiceIDs(session.Questions)
+	// Sessions of one exam share its choice IDs; only their order differs, so several are started to see one
+	differs := false
+	for i := 0; i < 3 && !differs; i++ {
+		differs = fmt.Sprint(sessionChoiceIDs(start().Questions)) != fmt.Sprint(served)
+	}
+	if !differs {
+		t.Errorf("four sessions of exam %d were all served the choices in the order %v", examID, served)
+	}
+	base := "/exam_sessions/" + session.SessionID
+	for _, q := range session.Questions {
+		var refetched models.SessionQuestion
+		serveJSON(t, router, "GET", fmt.Sprintf("%s/questions/%d", base, q.ExamQuestionID), nil, &refetched)
+		if got := sessionChoiceIDs([]models.SessionQuestion{refetched})[q.ExamQuestionID]; fmt.Sprint(got) != fmt.Sprint(served[q.ExamQuestionID]) {
+			t.Errorf("re-fetching question %d served the choices %v, at start %v", q.ExamQuestionID, got, served[q.ExamQuestionID])
+		}
+		// Answer with the correct choice wherever the shuffle put it
+		var correctID int
+		for _, choice := range q.Choices {
+			if choice.Text == "Alpha" {
+				correctID = choice.ChoiceID
+			}
+		}
+		var feedback map[string]any
+		serveJSON(t, router, "POST", base+"/answer", models.AnswerRequest{ExamQuestionID: q.ExamQuestionID, ChoiceIDs: []int{correctID}}, &feedback)
+	}
+	var status models.ExamStatusResponse
+	serveJSON(t, router, "GET", base+"/status", nil, &status)
+	if status.AnsweredCount != len(session.Questions) || status.RemainingCount != 0 {
+		t.Errorf("status after answering all %d questions = %+v", len(session.Questions), status)
+	}
+	var result models.ExamSubmissionResponse
+	serveJSON(t, router, "POST", base+"/submit", nil, &result)
+	if result.ScorePercent != 100 {
+		t.Errorf("score of the shuffled session answered correctly = %d, want 100", result.ScorePercent)
+	}
+	var review models.ExamReviewResponse
+	serveJSON(t, router, "GET", base+"/review", nil, &review)
+	for _, q := range review.Questions {
+		var reviewed []int
+		for _, choice := range q.Choices {
+			reviewed = append(reviewed, choice.ChoiceID)
+		}
+		if fmt.Sprint(reviewed) != fmt.Sprint(served[q.ExamQuestionID]) {
+			t.Errorf("review of question %d lists the choices %v, the session served %v", q.ExamQuestionID, reviewed, served[q.ExamQuestionID])
+		}
+		if q.Result != "correct" {
+			t.Errorf("review of question %d = %s, want correct", q.ExamQuestionID, q.Result)
+		}
+	}
+}
+func TestDomainQuestionOrderHonoredAcrossSession(t *testing.T) {
+	pool := dbtest.Pool(t)
+	examID := ingestExam(t, pool, map[string][]string{
+		"Storage":    {"Storage: What is RAID?", "Storage: What is a LUN?"},
+		"Networking": {"Networking: What is a subnet?", "Networking: What is a VLAN?"},
+	})
+	router := sessionRouter(pool, "student@example.com")
+	var session models.ExamSessionResponse
+	serveJSON(t, router, "POST", "/exam_sessions", models.ExamSessionRequest{ExamID: examID, Mode: "practice", QuestionOrder: QuestionOrderDomain}, &session)
+	if session.QuestionOrder != QuestionOrderDomain {
+		t.Fatalf("session question_order = %q, want %q", session.QuestionOrder, QuestionOrderDomain)
+	}
+	var served []string
+	for _, q := range session.Questions {
+		served = append(served, q.QuestionText)
+	}
+	domainOf := func(text string) string { return strings.SplitN(text, ":", 2)[0] }
+	if first, last := domainOf(served[0]), domainOf(served[len(served)-1]); first == last {
+		t.Fatalf("exam %d asks only %s questions %v; the fixture needs both domains", examID, first, served)
+	}
+	if !sort.SliceIsSorted(served, func(i, j int) bool { return domainOf(served[i]) < domainOf(served[j]) }) {
+		t.Errorf("domain-ordered session served %v, not grouped by domain name", served)
+	}
+	base := "/exam_sessions/" + session.SessionID
+	for i, q := range session.Questions {
+		if i == len(session.Questions)-1 {
+			break // One is left unanswered so the status shows progress
+		}
+		var feedback map[string]any
+		serveJSON(t, router, "POST", base+"/answer", models.AnswerRequest{ExamQuestionID: q.ExamQuestionID, ChoiceIDs: []int{q.Choices[0].ChoiceID}}, &feedback)
+	}
+	var status models.ExamStatusResponse
+	serveJSON(t, router, "GET", base+"/status", nil, &status)
+	if status.AnsweredCount != len(served)-1 || status.RemainingCount != 1 {
+		t.Errorf("status with all but one of %d questions answered = %+v", len(served), status)
+	}
+	var result models.ExamSubmissionResponse
+	serveJSON(t, router, "POST", base+"/submit?confirm=true", nil, &result)
+	var reported []string
+	for _, entry := range result.DetailedReport {
+		reported = append(reported, entry.Question)
+	}
+	if fmt.Sprint(reported) != fmt.Sprint(served) {
+		t.Errorf("submission reported the questions %v, the session served %v", reported, served)
+	}
+	var review models.ExamReviewResponse
+	serveJSON(t, router, "GET", base+"/review", nil, &review)
+	if review.QuestionOrder != QuestionOrderDomain {
+		t.Errorf("review question_order = %q, want %q", review.QuestionOrder, QuestionOrderDomain)
+	}
+	if len(review.Questions) != len(served) {
+		t.Fatalf("review lists %d questions, the session served %d", len(review.Questions), len(served))
+	}
+	var reviewed []string
+	for i, q := range review.Questions {
+		reviewed = append(reviewed, q.Question)
+		if q.QuestionOrder != i+1 || q.ExamQuestionID != session.Questions[i].ExamQuestionID {
+			t.Errorf("review entry %d is exam question %d at position %d, the session served exam question %d there", i, q.ExamQuestionID, q.QuestionOrder, session.Questions[i].ExamQuestionID)
+		}
+	}
+	if fmt.Sprint(reviewed) != fmt.Sprint(served) {
+		t.Errorf("review listed the questions %v, the session served %v", reviewed, served)
+	}
+}
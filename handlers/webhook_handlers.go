@@ -0,0 +1,125 @@
+
+package handlers
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/ingestion"
+	"recap-server/models"
+)
+// maxWebhookPayload is the largest webhook payload read; GitHub caps payloads at 25 MB.
+const maxWebhookPayload = 25 << 20
+// validGitHubSignature reports whether signature, an X-Hub-Signature-256 header ("sha256=<hex>"), is the
+// HMAC-SHA256 of payload under secret.
+func validGitHubSignature(secret string, payload []byte, signature string) bool {
+	digest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	expected, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+// changedCourseCodes returns, sorted, the course codes of the courses/<code>/ directories with files
+// added, removed or modified by the push's commits.
+func changedCourseCodes(event models.GitHubPushEvent) []string {
+	commits := event.Commits
+	if len(commits) == 0 && event.HeadCommit != nil {
+		commits = []models.GitHubPushCommit{*event.HeadCommit}
+	}
+	changed := make(map[string]bool)
+	for _, commit := range commits {
+		for _, files := range [][]string{commit.Added, commit.Removed, commit.Modified} {
+			for _, file := range files {
+				parts := strings.Split(file, "/")
+				if len(parts) < 3 || parts[0] != "courses" || parts[1] == "" || parts[1] == "." || parts[1] == ".." {
+					continue // Not inside a course directory
+				}
+				changed[parts[1]] = true
+			}
+		}
+	}
+	courseCodes := make([]string, 0, len(changed))
+	for courseCode := range changed {
+		courseCodes = append(courseCodes, courseCode)
+	}
+	sort.Strings(courseCodes)
+	return courseCodes
+}
+// GitHubWebhook receives GitHub push webhooks for the labs repository and queues an ingestion of each
+// course whose courses/<code>/ directory the push changed. Deliveries must carry a valid
+// X-Hub-Signature-256 for the configured GITHUB.WEBHOOK_SECRET, otherwise it answers 401; with no secret
+// configured it answers 503. Ping events answer 200; other events, and pushes to branches other than the
+// repository's default branch, are acknowledged and ignored. The labs checkout at GITHUB.LABS_REPO_PATH
+// must already be updated when the queued ingestion runs. Answers 202 with the queued courses.
+// POST /webhooks/github
+func GitHubWebhook(pool *pgxpool.Pool, secret string, queue *ingestion.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if secret == "" {
+			logRequestError(c, "GitHub webhook received but GITHUB.WEBHOOK_SECRET is not configured")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "GitHub webhook is not configured"})
+			return
+		}
+		payload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookPayload))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Webhook payload too large"})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read webhook payload"})
+			return
+		}
+		signature := c.GetHeader("X-Hub-Signature-256")
+		if signature == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing X-Hub-Signature-256 header"})
+			return
+		}
+		if !validGitHubSignature(secret, payload, signature) {
+			logRequestError(c, "GitHub webhook delivery %s has an invalid signature", c.GetHeader("X-GitHub-Delivery"))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid webhook signature"})
+			return
+		}
+		switch event := c.GetHeader("X-GitHub-Event"); event {
+		case "ping":
+			c.JSON(http.StatusOK, gin.H{"message": "pong"})
+			return
+		case "push":
+		default:
+			c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Event '%s' ignored", event)})
+			return
+		}
+		var push models.GitHubPushEvent
+		if err := json.Unmarshal(payload, &push); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid push payload: %v", err)})
+			return
+		}
+		if push.Deleted || (push.Repository.DefaultBranch != "" && push.Ref != "refs/heads/"+push.Repository.DefaultBranch) {
+			c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Push to %s ignored; only the default branch is ingested", push.Ref)})
+			return
+		}
+		courseCodes := changedCourseCodes(push)
+		queued := make([]string, 0, len(courseCodes))
+		for _, courseCode := range courseCodes {
+			if queue.Enqueue(courseCode) {
+				queued = append(queued, courseCode)
+			}
+			db.LogAdminEvent(pool, db.SystemActor, "webhook_ingestion_queued", courseCode, fmt.Sprintf("Push %s to %s of %s", push.After, push.Ref, push.Repository.FullName))
+		}
+		c.JSON(http.StatusAccepted, gin.H{"courses": courseCodes, "queued": queued})
+	}
+}
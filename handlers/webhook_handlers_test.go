@@ -0,0 +1,119 @@
+package handlers
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"github.com/gin-gonic/gin"
+	"recap-server/models"
+)
+// signPayload returns the X-Hub-Signature-256 header GitHub sends for payload under secret.
+func signPayload(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+func TestValidGitHubSignature(t *testing.T) {
+	const secret = "hook-secret"
+	const payload = `{"zen":"Keep it logically awesome."}`
+	valid := signPayload(secret, payload)
+	tests := []struct {
+		name      string
+		secret    string
+		payload   string
+		signature string
+		want      bool
+	}{
+		{"valid", secret, payload, valid, true},
+		{"upper case hex", secret, payload, "sha256=" + strings.ToUpper(strings.TrimPrefix(valid, "sha256=")), true},
+		{"wrong secret", "other-secret", payload, valid, false},
+		{"tampered payload", secret, payload + " ", valid, false},
+		{"missing prefix", secret, payload, strings.TrimPrefix(valid, "sha256="), false},
+		{"sha1 prefix", secret, payload, "sha1=" + strings.TrimPrefix(valid, "sha256="), false},
+		{"not hex", secret, payload, "sha256=zz", false},
+		{"truncated digest", secret, payload, valid[:len(valid)-2], false},
+		{"empty", secret, payload, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validGitHubSignature(tt.secret, []byte(tt.payload), tt.signature); got != tt.want {
+				t.Fatalf("validGitHubSignature(%q, %q, %q) = %t, want %t", tt.secret, tt.payload, tt.signature, got, tt.want)
+			}
+		})
+	}
+}
+func TestChangedCourseCodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		event models.GitHubPushEvent
+		want  []string
+	}{
+		{"no commits", models.GitHubPushEvent{}, []string{}},
+		{"added, removed and modified", models.GitHubPushEvent{Commits: []models.GitHubPushCommit{
+			{Added: []string{"courses/LNX101/course.yaml"}, Removed: []string{"courses/K8S200/exam_bank.csv"}},
+			{Modified: []string{"courses/AWS300/labs/lab1.md"}},
+		}}, []string{"AWS300", "K8S200", "LNX101"}},
+		{"duplicates collapse", models.GitHubPushEvent{Commits: []models.GitHubPushCommit{
+			{Modified: []string{"courses/LNX101/course.yaml", "courses/LNX101/exam_bank.csv"}},
+			{Modified: []string{"courses/LNX101/course.yaml"}},
+		}}, []string{"LNX101"}},
+		{"files outside courses ignored", models.GitHubPushEvent{Commits: []models.GitHubPushCommit{
+			{Modified: []string{"README.md", "courses/README.md", "docs/courses/LNX101/x.md", "courses//x", "courses/../x", "courses/./x"}},
+		}}, []string{}},
+		{"head commit when commits are empty", models.GitHubPushEvent{HeadCommit: &models.GitHubPushCommit{
+			Modified: []string{"courses/LNX101/course.yaml"},
+		}}, []string{"LNX101"}},
+		{"commits preferred over head commit", models.GitHubPushEvent{
+			Commits:    []models.GitHubPushCommit{{Modified: []string{"courses/K8S200/course.yaml"}}},
+			HeadCommit: &models.GitHubPushCommit{Modified: []string{"courses/LNX101/course.yaml"}},
+		}, []string{"K8S200"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedCourseCodes(tt.event); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("changedCourseCodes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+func TestGitHubWebhookRequests(t *testing.T) {
+	// None of these deliveries reach the queue, so no pool or queue is needed
+	const secret = "hook-secret"
+	const ping = `{"zen":"Keep it logically awesome."}`
+	const otherBranch = `{"ref":"refs/heads/feature","repository":{"default_branch":"main"},"commits":[{"modified":["courses/LNX101/course.yaml"]}]}`
+	tests := []struct {
+		name      string
+		secret    string
+		event     string
+		payload   string
+		signature string
+		want      int
+	}{
+		{"not configured", "", "ping", ping, signPayload(secret, ping), http.StatusServiceUnavailable},
+		{"missing signature", secret, "ping", ping, "", http.StatusUnauthorized},
+		{"invalid signature", secret, "ping", ping, signPayload("other-secret", ping), http.StatusUnauthorized},
+		{"ping", secret, "ping", ping, signPayload(secret, ping), http.StatusOK},
+		{"other event ignored", secret, "issues", ping, signPayload(secret, ping), http.StatusOK},
+		{"malformed push", secret, "push", "{", signPayload(secret, "{"), http.StatusBadRequest},
+		{"push to other branch ignored", secret, "push", otherBranch, signPayload(secret, otherBranch), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/webhooks/github", strings.NewReader(tt.payload))
+			c.Request.Header.Set("X-GitHub-Event", tt.event)
+			if tt.signature != "" {
+				c.Request.Header.Set("X-Hub-Signature-256", tt.signature)
+			}
+			GitHubWebhook(nil, tt.secret, nil)(c)
+			if w.Code != tt.want {
+				t.Fatalf("GitHubWebhook(%s) = %d %s, want %d", tt.name, w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+
+package ingestion
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/models"
+)
+// ErrNoExamBank is returned when exporting a course that has never been ingested.
+var ErrNoExamBank = errors.New("course has no ingested exam bank")
+// ExamBankQuestionsQuery selects a course's own questions of an exam_bank_version ($1 course ID,
+// $2 version) in ingestion order, in the columns read by ScanExamBankQuestion.
+const ExamBankQuestionsQuery = `
+	SELECT
+		q.question_type, d.name, q.question_text, q.explanation, COALESCE(q.image_url, ''), COALESCE(q.code_block, ''),
+		COALESCE(q.input_method, ''), q.exact_select, COALESCE(q.context_hints, FALSE), q.draft, q.allow_feedback_in_simulation,
+		COALESCE(q.hint, ''), q.ignore_flag_order, COALESCE(q.code_language, ''),
+		(SELECT jsonb_agg(jsonb_build_object('text', ch.choice_text, 'correct', ch.is_correct, 'explanation', COALESCE(ch.explanation, ''), 'position', ch.position, 'match', mo.option_text) ORDER BY ch.id)
+			FROM choices ch LEFT JOIN match_options mo ON mo.choice_id = ch.id WHERE ch.question_id = q.id),
+		(SELECT array_agg(CASE WHEN fba.is_regex THEN 're:' || fba.acceptable_answer ELSE fba.acceptable_answer END ORDER BY fba.id) FROM fill_blank_answers fba WHERE fba.question_id = q.id)
+	FROM questions q
+	JOIN domains d ON q.domain_id = d.id
+	WHERE d.course_id = $1 AND q.exam_bank_version = $2
+	ORDER BY q.id
+`
+// ScanExamBankQuestion scans a row of ExamBankQuestionsQuery into its exam_bank.json form.
+func ScanExamBankQuestion(rows pgx.Rows) (models.ExamBankJSONQuestion, error) {
+	var q models.ExamBankJSONQuestion
+	var choicesJSON []byte
+	if err := rows.Scan(
+		&q.QuestionType, &q.Domain, &q.QuestionText, &q.Explanation, &q.ImageURL, &q.CodeBlock,
+		&q.InputMethod, &q.ExactSelect, &q.ContextHints, &q.Draft, &q.AllowFeedbackInSimulation,
+		&q.Hint, &q.IgnoreFlagOrder, &q.CodeLanguage, &choicesJSON, &q.AcceptableAnswers,
+	); err != nil {
+		return q, err
+	}
+	if choicesJSON != nil {
+		if err := json.Unmarshal(choicesJSON, &q.Choices); err != nil {
+			return q, fmt.Errorf("failed to unmarshal choices: %w", err)
+		}
+	}
+	return q, nil
+}
+// ExportExamBankCSV regenerates exam_bank.csv for the course from the database: the metadata rows of its
+// last ingestion, a declared header row and one row per question of its current exam_bank_version, every
+// row padded to the full column layout. Ingesting the output reproduces the same questions and metadata.
+// Questions drawn from shared banks belong to their owning course and are not included. A course that
+// does not exist yields an error wrapping pgx.ErrNoRows, one never ingested ErrNoExamBank.
+func ExportExamBankCSV(pool *pgxpool.Pool, courseCode string) ([]byte, error) {
+	var courseID int
+	var examBankVersion *string
+	var metadataJSON []byte
+	err := pool.QueryRow(context.Background(), `
+		SELECT id, exam_bank_version, exam_bank_metadata FROM courses WHERE course_code = $1
+	`, courseCode).Scan(&courseID, &examBankVersion, &metadataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch course %s: %w", courseCode, err)
+	}
+	if examBankVersion == nil || metadataJSON == nil {
+		return nil, ErrNoExamBank
+	}
+	var metadata models.ExamBankMetadata
+	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal exam bank metadata for %s: %w", courseCode, err)
+	}
+	columns := csvColumnsFor(*examBankVersion)
+	columnIndex := make(map[string]int, len(columns))
+	for i, column := range columns {
+		columnIndex[column] = i
+	}
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	// The reader expects the same number of fields on every row, so metadata rows are padded too
+	writeMetadata := func(key, value string) {
+		row := make([]string, len(columns))
+		row[0], row[1] = key, value
+		writer.Write(row)
+	}
+	domainNames := make([]string, 0, len(metadata.Domains))
+	for name := range metadata.Domains {
+		domainNames = append(domainNames, name)
+	}
+	sort.Strings(domainNames)
+	domainPairs := make([]string, len(domainNames))
+	for i, name := range domainNames {
+		domainPairs[i] = name + ":" + strconv.FormatFloat(metadata.Domains[name], 'f', -1, 64)
+	}
+	writeMetadata("schema_version", *examBankVersion)
+	writeMetadata("min_questions", strconv.Itoa(metadata.MinQuestions))
+	writeMetadata("max_questions", strconv.Itoa(metadata.MaxQuestions))
+	writeMetadata("exam_time", strconv.Itoa(metadata.ExamTime))
+	writeMetadata("passing_score", strconv.FormatFloat(metadata.PassingScore, 'f', -1, 64))
+	writeMetadata("domains", strings.Join(domainPairs, "|"))
+	writeMetadata("allow_practice", csvBool(metadata.AllowPractice))
+	writeMetadata("allow_simulation", csvBool(metadata.AllowSimulation))
+	if metadata.TargetExamCount > 0 {
+		writeMetadata("target_exam_count", strconv.Itoa(metadata.TargetExamCount))
+	}
+	if metadata.PenaltyPerWrong > 0 {
+		writeMetadata("penalty_per_wrong", strconv.FormatFloat(metadata.PenaltyPerWrong, 'f', -1, 64))
+	}
+	if metadata.FuzzyAcceptDistance > 0 {
+		writeMetadata("fuzzy_accept_distance", strconv.Itoa(metadata.FuzzyAcceptDistance))
+	}
+	if metadata.Instructions != "" {
+		writeMetadata("instructions", metadata.Instructions)
+	}
+	writer.Write(columns)
+	rows, err := pool.Query(context.Background(), ExamBankQuestionsQuery, courseID, *examBankVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query questions for %s: %w", courseCode, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		q, err := ScanExamBankQuestion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan question for %s: %w", courseCode, err)
+		}
+		row := make([]string, len(columns))
+		set := func(column, value string) {
+			if i, ok := columnIndex[column]; ok {
+				row[i] = value
+			}
+		}
+		set("question_type", q.QuestionType)
+		set("domain", q.Domain)
+		set("question_text", q.QuestionText)
+		set("explanation", q.Explanation)
+		set("image_url", q.ImageURL)
+		set("code_block", q.CodeBlock)
+		set("input_method", q.InputMethod) // Stored as "text" when it was defaulted, which re-ingests the same
+		for i, choice := range q.Choices {
+			n := i + 1
+			set(fmt.Sprintf("choice_%d", n), choice.Text)
+			if q.QuestionType == "ordering" {
+				set(fmt.Sprintf("correct_%d", n), strconv.Itoa(choice.Position)) // The item's expected position
+			} else if q.QuestionType == "matching" {
+				set(fmt.Sprintf("choice_%d", n), choice.Text+matchSeparator+choice.Match) // correct_N is unused
+			} else {
+				set(fmt.Sprintf("correct_%d", n), csvBool(choice.Correct))
+			}
+			set(fmt.Sprintf("explain_%d", n), choice.Explanation)
+		}
+		set("acceptable_answers", strings.Join(q.AcceptableAnswers, "|"))
+		if q.ExactSelect != nil {
+			set("exact_select", strconv.Itoa(*q.ExactSelect))
+		}
+		// Optional flags are left empty when false, as in hand-written banks
+		if q.ContextHints {
+			set("context_hints", "TRUE")
+		}
+		if q.Draft {
+			set("draft", "TRUE")
+		}
+		if q.AllowFeedbackInSimulation {
+			set("allow_feedback_in_simulation", "TRUE")
+		}
+		set("hint", q.Hint)
+		if q.IgnoreFlagOrder {
+			set("ignore_flag_order", "TRUE")
+		}
+		set("code_language", q.CodeLanguage)
+		writer.Write(row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read questions for %s: %w", courseCode, err)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, fmt.Errorf("failed to write exam_bank.csv for %s: %w", courseCode, err)
+	}
+	return buf.Bytes(), nil
+}
+// csvBool formats a boolean the way exam_bank.csv spells it.
+func csvBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
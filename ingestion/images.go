@@ -0,0 +1,95 @@
+
+package ingestion
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+)
+// imageCheckWorkers bounds the number of image_url HEAD requests in flight during an ingestion.
+const imageCheckWorkers = 8
+// checkImageURLs issues an HTTP HEAD for every distinct http(s) image_url of the bank when the
+// validate_image_urls setting is true, following redirects, with the image_url_check_timeout setting per
+// request. URLs that cannot be fetched, answer with status 400 or above or are not served as an image are
+// logged to error_logs against each question using them. They are warnings unless the
+// validate_image_urls_strict setting is true, in which case ingestion fails.
+func checkImageURLs(pool *pgxpool.Pool, courseCode string, bank *examBank) error {
+	if !db.GetSettingBool(pool, "validate_image_urls", false) {
+		return nil
+	}
+	strict := db.GetSettingBool(pool, "validate_image_urls_strict", false)
+	timeout := db.GetSettingDuration(pool, "image_url_check_timeout", 5*time.Second)
+	// Questions sharing an image are checked once; malformed URLs are left to buildQuestion
+	linesByURL := make(map[string][]int)
+	var urls []string
+	for _, bq := range bank.Questions {
+		url := strings.TrimSpace(bq.ImageURL)
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			continue
+		}
+		if _, seen := linesByURL[url]; !seen {
+			urls = append(urls, url)
+		}
+		linesByURL[url] = append(linesByURL[url], bq.LineNumber)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	client := &http.Client{Timeout: timeout} // Redirects are followed by default
+	problems := make([]string, len(urls))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < imageCheckWorkers && w < len(urls); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				problems[i] = checkImageURL(client, urls[i])
+			}
+		}()
+	}
+	for i := range urls {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	failed := 0
+	for i, url := range urls {
+		if problems[i] == "" {
+			continue
+		}
+		failed++
+		for _, line := range linesByURL[url] {
+			db.LogError(pool, sourceName, courseCode, bank.FilePath, line, "image_url", fmt.Sprintf("Image URL check failed: %s", problems[i]), fmt.Sprintf("Make sure %s is reachable and serves an image.", url))
+		}
+	}
+	if failed > 0 && strict {
+		return fmt.Errorf("%d image_url(s) failed validation for %s", failed, courseCode)
+	}
+	return nil
+}
+// checkImageURL sends a HEAD request for url and describes why it is not a usable image, or returns "".
+func checkImageURL(client *http.Client, url string) string {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodHead, url, nil)
+	if err != nil {
+		return fmt.Sprintf("invalid URL: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return fmt.Sprintf("content type '%s' is not an image", resp.Header.Get("Content-Type"))
+	}
+	return ""
+}
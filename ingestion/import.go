@@ -0,0 +1,107 @@
+
+package ingestion
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/exam"
+	"recap-server/ingestion/importers"
+	"recap-server/models"
+	"recap-server/utils"
+)
+// Supported question bank import formats for ImportQuestionBank.
+const (
+	ImportFormatMoodleXML = "moodlexml"
+)
+// ErrInvalidImport is returned by ImportQuestionBank when the import itself is at fault: an unsupported
+// format, a file that does not parse, or a question whose domain the course does not define.
+var ErrInvalidImport = errors.New("invalid question bank import")
+// ImportQuestionBank converts a question bank exported from another platform and persists it
+// into an existing course using the same persistence path as CSV ingestion. Each imported
+// question's domain must already be defined for the course. When the course already has
+// generated exams, their metadata is reused to regenerate exams with the imported questions.
+// Note that the next CSV ingestion of the course replaces its questions, imported ones included.
+// An unknown course wraps pgx.ErrNoRows; other database errors are returned as is.
+func ImportQuestionBank(ctx context.Context, pool *pgxpool.Pool, courseCode, format string, data []byte) (int, error) {
+	var imported []importers.ImportedQuestion
+	var err error
+	switch format {
+	case ImportFormatMoodleXML:
+		imported, err = importers.ParseMoodleXML(data)
+	default:
+		return 0, fmt.Errorf("%w: unsupported import format '%s' (supported: %s)", ErrInvalidImport, format, ImportFormatMoodleXML)
+	}
+	if err != nil {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to parse imported question bank", fmt.Sprintf("Format: %s, Error: %v", format, err))
+		return 0, fmt.Errorf("%w: failed to parse %s import for %s: %v", ErrInvalidImport, format, courseCode, err)
+	}
+	var courseID int
+	var marketingName string
+	err = pool.QueryRow(ctx, `SELECT id, marketing_name FROM courses WHERE course_code = $1`, courseCode).Scan(&courseID, &marketingName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("course %s not found: %w", courseCode, err)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up course %s: %w", courseCode, err)
+	}
+	// Map domain names to IDs for this course
+	domainMap := make(map[string]int)
+	rows, err := pool.Query(ctx, `SELECT id, name FROM domains WHERE course_id = $1`, courseID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query domains for %s: %w", courseCode, err)
+	}
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan domain for %s: %w", courseCode, err)
+		}
+		domainMap[name] = id
+	}
+	rows.Close()
+	// Reuse the version and metadata of the most recently generated exam, if any
+	examBankVersion, metadata, hasMetadata := latestExamMetadata(ctx, pool, courseID, courseCode, "")
+	if !hasMetadata {
+		examBankVersion = "1.0.0"
+	}
+	questions := make([]models.Question, 0, len(imported))
+	for _, iq := range imported {
+		domainID, ok := domainMap[iq.Domain]
+		if !ok {
+			db.LogError(pool, sourceName, courseCode, "", 0, "domain", "Imported question domain not defined for course", fmt.Sprintf("Domain '%s' (question: %s) must exist in the course's 'domains' metadata row.", iq.Domain, iq.QuestionText))
+			return 0, fmt.Errorf("%w: domain '%s' is not defined for course %s", ErrInvalidImport, iq.Domain, courseCode)
+		}
+		q := iq.Question
+		q.DomainID = domainID
+		q.ExamBankVersion = examBankVersion
+		questions = append(questions, q)
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // Rollback on error
+	if err := persistQuestions(ctx, tx, pool, courseCode, questions); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to commit import transaction", fmt.Sprintf("Database error: %v", err))
+		return 0, fmt.Errorf("failed to commit import transaction for %s: %w", courseCode, err)
+	}
+	if hasMetadata {
+		if err := exam.GenerateExamsForCourse(ctx, pool, courseID, marketingName, examBankVersion, metadata, exam.LoadSelectionStrategy(ctx, pool)); err != nil {
+			db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to regenerate exams after import", fmt.Sprintf("Error: %v", err))
+			return len(questions), fmt.Errorf("failed to regenerate exams for %s: %w", courseCode, err)
+		}
+		if err := exam.UpdateQuestionValidityScoresForCourse(ctx, pool, courseID); err != nil {
+			utils.LoggerFromContext(ctx).Error("Error updating validity scores after import", "course_code", courseCode, "error", err)
+		}
+	} else {
+		utils.LoggerFromContext(ctx).Info("No existing exam metadata; imported questions stored without regenerating exams", "course_code", courseCode)
+	}
+	return len(questions), nil
+}
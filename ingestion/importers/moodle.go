@@ -0,0 +1,169 @@
+
+package importers
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"recap-server/models"
+)
+const maxChoices = 6 // Same per-question choice limit as the exam_bank.csv layout
+// moodleQuiz is the root <quiz> element of a Moodle XML export.
+type moodleQuiz struct {
+	XMLName   xml.Name         `xml:"quiz"`
+	Questions []moodleQuestion `xml:"question"`
+}
+// moodleQuestion is a single <question> element. Category pseudo-questions share this shape.
+type moodleQuestion struct {
+	Type            string         `xml:"type,attr"`
+	Name            moodleText     `xml:"name"`
+	QuestionText    moodleText     `xml:"questiontext"`
+	GeneralFeedback moodleText     `xml:"generalfeedback"`
+	Category        moodleText     `xml:"category"`
+	Single          string         `xml:"single"`
+	Answers         []moodleAnswer `xml:"answer"`
+}
+// moodleText wraps the <text> child Moodle uses for every text field.
+type moodleText struct {
+	Text string `xml:"text"`
+}
+// moodleAnswer is an <answer> element; fraction is the percentage of credit it awards.
+type moodleAnswer struct {
+	Fraction string     `xml:"fraction,attr"`
+	Text     string     `xml:"text"`
+	Feedback moodleText `xml:"feedback"`
+}
+// ImportedQuestion is a question converted from another platform, with the name of the domain it
+// belongs to; the importer caller resolves the name to a domain of the course.
+type ImportedQuestion struct {
+	models.Question
+	Domain string
+}
+// ParseMoodleXML converts a Moodle XML question bank into RECAP questions.
+// Supported types are multichoice, truefalse and shortanswer; any other type is an error. RECAP has no
+// partial credit, so a single-answer multichoice question must give a positive fraction to one answer only.
+// The domain of each question is taken from the last segment of the most recent
+// category pseudo-question.
+func ParseMoodleXML(data []byte) ([]ImportedQuestion, error) {
+	var quiz moodleQuiz
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&quiz); err != nil {
+		return nil, fmt.Errorf("failed to parse Moodle XML: %w", err)
+	}
+	var (
+		questions     []ImportedQuestion
+		currentDomain string
+	)
+	for i, mq := range quiz.Questions {
+		position := i + 1 // 1-based position of the <question> element, for error messages
+		if mq.Type == "category" {
+			currentDomain = categoryDomain(mq.Category.Text)
+			continue
+		}
+		q, err := convertMoodleQuestion(mq)
+		if err != nil {
+			return nil, fmt.Errorf("question %d (%q): %w", position, strings.TrimSpace(mq.Name.Text), err)
+		}
+		questions = append(questions, ImportedQuestion{Question: q, Domain: currentDomain})
+	}
+	if len(questions) == 0 {
+		return nil, fmt.Errorf("no importable questions found in Moodle XML")
+	}
+	return questions, nil
+}
+// convertMoodleQuestion maps a single Moodle question onto models.Question.
+func convertMoodleQuestion(mq moodleQuestion) (models.Question, error) {
+	q := models.Question{
+		QuestionText: strings.TrimSpace(mq.QuestionText.Text),
+		Explanation:  strings.TrimSpace(mq.GeneralFeedback.Text),
+	}
+	if q.QuestionText == "" {
+		return q, fmt.Errorf("missing questiontext")
+	}
+	if q.Explanation == "" {
+		return q, fmt.Errorf("missing generalfeedback (used as the RECAP explanation)")
+	}
+	switch mq.Type {
+	case "multichoice", "truefalse":
+		q.QuestionType = "truefalse"
+		if mq.Type == "multichoice" {
+			q.QuestionType = "multi"
+			if strings.TrimSpace(strings.ToLower(mq.Single)) == "true" || strings.TrimSpace(mq.Single) == "1" {
+				q.QuestionType = "single"
+			}
+		}
+		if len(mq.Answers) > maxChoices {
+			return q, fmt.Errorf("%d answers exceeds the maximum of %d choices", len(mq.Answers), maxChoices)
+		}
+		correctAnswers := 0
+		for j, a := range mq.Answers {
+			fraction, err := parseFraction(a.Fraction)
+			if err != nil {
+				return q, err
+			}
+			text := strings.TrimSpace(a.Text)
+			if text == "" {
+				return q, fmt.Errorf("answer %d has no text", j+1)
+			}
+			isCorrect := fraction > 0
+			if isCorrect {
+				correctAnswers++
+			}
+			q.Choices = append(q.Choices, models.Choice{
+				ChoiceText:  text,
+				IsCorrect:   isCorrect,
+				Explanation: strings.TrimSpace(a.Feedback.Text),
+				Order:       string(rune('A' + j)),
+			})
+		}
+		if len(q.Choices) == 0 {
+			return q, fmt.Errorf("no answers provided")
+		}
+		if correctAnswers == 0 {
+			return q, fmt.Errorf("no answer has a positive fraction")
+		}
+		if q.QuestionType != "multi" && correctAnswers > 1 {
+			return q, fmt.Errorf("%d answers have a positive fraction but the question takes a single answer; partial credit is not supported", correctAnswers)
+		}
+	case "shortanswer":
+		q.QuestionType = "fillblank"
+		inputMethod := "text"
+		q.InputMethod = &inputMethod
+		for _, a := range mq.Answers {
+			fraction, err := parseFraction(a.Fraction)
+			if err != nil {
+				return q, err
+			}
+			text := strings.TrimSpace(a.Text)
+			if fraction > 0 && text != "" {
+				q.AcceptableAnswers = append(q.AcceptableAnswers, text)
+			}
+		}
+		if len(q.AcceptableAnswers) == 0 {
+			return q, fmt.Errorf("no acceptable answers with a positive fraction")
+		}
+	default:
+		return q, fmt.Errorf("unsupported Moodle question type %q (supported: multichoice, truefalse, shortanswer)", mq.Type)
+	}
+	return q, nil
+}
+// categoryDomain extracts the domain name from a Moodle category path such as "$course$/Linux/Networking".
+func categoryDomain(path string) string {
+	path = strings.TrimSpace(path)
+	if idx := strings.LastIndex(path, "/"); idx >= 0 {
+		path = path[idx+1:]
+	}
+	return strings.TrimSpace(path)
+}
+// parseFraction parses a Moodle answer fraction, treating an absent fraction as zero credit.
+func parseFraction(s string) (float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid answer fraction %q", s)
+	}
+	return f, nil
+}
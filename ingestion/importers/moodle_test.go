@@ -0,0 +1,100 @@
+package importers
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+// moodleXML wraps question elements in a Moodle <quiz>, after a category putting them in the Networking domain.
+func moodleXML(questions ...string) []byte {
+	category := `<question type="category"><category><text>$course$/Linux/Networking</text></category></question>`
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?><quiz>` + category + strings.Join(questions, "") + `</quiz>`)
+}
+// multichoice is a multichoice question element with single set as given and an answer per fraction.
+func multichoice(single string, fractions ...string) string {
+	var answers strings.Builder
+	for i, fraction := range fractions {
+		fmt.Fprintf(&answers, `<answer fraction="%s"><text>Option %d</text><feedback><text>Why %d</text></feedback></answer>`, fraction, i+1, i+1)
+	}
+	return `<question type="multichoice"><name><text>Pick</text></name><questiontext><text>Which protocol?</text></questiontext>` +
+		`<generalfeedback><text>Because.</text></generalfeedback><single>` + single + `</single>` + answers.String() + `</question>`
+}
+func TestParseMoodleXML(t *testing.T) {
+	tests := []struct {
+		name        string
+		question    string
+		wantType    string
+		wantCorrect []bool
+		wantAnswers []string
+	}{
+		{"single answer", multichoice("true", "100", "0", "0"), "single", []bool{true, false, false}, nil},
+		{"single given as 1", multichoice("1", "0", "100"), "single", []bool{false, true}, nil},
+		{"multi answer", multichoice("false", "50", "50", "-50"), "multi", []bool{true, true, false}, nil},
+		{"missing fraction is wrong", multichoice("true", "", "100"), "single", []bool{false, true}, nil},
+		{"truefalse", `<question type="truefalse"><questiontext><text>TCP is reliable.</text></questiontext><generalfeedback><text>It is.</text></generalfeedback>` +
+			`<answer fraction="100"><text>true</text></answer><answer fraction="0"><text>false</text></answer></question>`, "truefalse", []bool{true, false}, nil},
+		{"shortanswer keeps credited answers", `<question type="shortanswer"><questiontext><text>List files</text></questiontext><generalfeedback><text>ls.</text></generalfeedback>` +
+			`<answer fraction="100"><text>ls</text></answer><answer fraction="0"><text>dir</text></answer><answer fraction="100"><text>ls -1</text></answer></question>`, "fillblank", nil, []string{"ls", "ls -1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			questions, err := ParseMoodleXML(moodleXML(tt.question))
+			if err != nil {
+				t.Fatalf("ParseMoodleXML error = %v", err)
+			}
+			if len(questions) != 1 {
+				t.Fatalf("ParseMoodleXML returned %d questions, want 1", len(questions))
+			}
+			q := questions[0]
+			if q.QuestionType != tt.wantType || q.Domain != "Networking" {
+				t.Fatalf("question type %q in domain %q, want %q in Networking", q.QuestionType, q.Domain, tt.wantType)
+			}
+			var correct []bool
+			for i, choice := range q.Choices {
+				correct = append(correct, choice.IsCorrect)
+				if choice.Order != string(rune('A'+i)) {
+					t.Errorf("choice %d order = %q, want %q", i, choice.Order, string(rune('A'+i)))
+				}
+			}
+			if fmt.Sprint(correct) != fmt.Sprint(tt.wantCorrect) || fmt.Sprint(q.AcceptableAnswers) != fmt.Sprint(tt.wantAnswers) {
+				t.Fatalf("correct = %v, acceptable answers = %q, want %v, %q", correct, q.AcceptableAnswers, tt.wantCorrect, tt.wantAnswers)
+			}
+		})
+	}
+}
+func TestParseMoodleXMLRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"malformed XML", []byte("<quiz><question>"), "failed to parse Moodle XML"},
+		{"only categories", moodleXML(), "no importable questions"},
+		{"single with several correct answers", moodleXML(multichoice("true", "100", "50", "0")), "2 answers have a positive fraction but the question takes a single answer"},
+		{"no correct answer", moodleXML(multichoice("false", "0", "0")), "no answer has a positive fraction"},
+		{"too many answers", moodleXML(multichoice("false", "100", "0", "0", "0", "0", "0", "0")), "7 answers exceeds the maximum of 6 choices"},
+		{"bad fraction", moodleXML(multichoice("true", "full", "0")), `invalid answer fraction "full"`},
+		{"unsupported type", moodleXML(`<question type="essay"><questiontext><text>Discuss</text></questiontext><generalfeedback><text>Any.</text></generalfeedback></question>`), `unsupported Moodle question type "essay"`},
+		{"missing explanation", moodleXML(`<question type="truefalse"><questiontext><text>TCP?</text></questiontext><answer fraction="100"><text>true</text></answer></question>`), "missing generalfeedback"},
+		{"shortanswer without credited answer", moodleXML(`<question type="shortanswer"><questiontext><text>List</text></questiontext><generalfeedback><text>ls.</text></generalfeedback><answer fraction="0"><text>dir</text></answer></question>`), "no acceptable answers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseMoodleXML(tt.data); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParseMoodleXML error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+func TestCategoryDomain(t *testing.T) {
+	tests := map[string]string{
+		"$course$/Linux/Networking": "Networking",
+		" $course$/Storage ":        "Storage",
+		"Security":                  "Security",
+		"$course$/Linux/":           "",
+	}
+	for path, want := range tests {
+		if got := categoryDomain(path); got != want {
+			t.Errorf("categoryDomain(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -2,31 +2,178 @@
 package ingestion
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	// "io" // REMOVED: Not directly used in this file
-	// "log" // REMOVED: Not directly used; db.LogError is used instead
 	_ "math" // USED: for math.Round
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"gopkg.in/yaml.v3"
 	"recap-server/db"
 	"recap-server/exam"
+	"recap-server/metrics"
 	"recap-server/models"
 	"recap-server/utils"
 )
 const (
 	csvColumnCount = 17 // Fixed number of columns as per spec
 	sourceName     = "ingestion"
+	maxHintLength  = 500 // Authored hints are short nudges, not second explanations
+	matchSeparator = "::" // Splits a matching pair in a choice column into its prompt and response
 )
-// ProcessCourseData reads course.yaml and exam_bank.csv, validates, and ingests data
-func ProcessCourseData(pool *pgxpool.Pool, courseCode, labsRepoPath string) error {
+// Severities of ingestion checks that can be configured to only warn. An error check fails the ingestion;
+// a warning check logs to error_logs and keeps the question.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+// loadSeverity reads a check severity setting, falling back to severityError for missing or unknown values.
+func loadSeverity(ctx context.Context, pool *pgxpool.Pool, key string) string {
+	severity, err := db.GetSettingCached(pool, key)
+	if err != nil || severity == "" {
+		return severityError
+	}
+	severity = strings.ToLower(strings.TrimSpace(severity))
+	if severity != severityError && severity != severityWarning {
+		utils.LoggerFromContext(ctx).Warn("Unknown check severity, using the default", "setting", key, "value", severity, "default", severityError)
+		return severityError
+	}
+	return severity
+}
+// Values of the unweighted_domain_policy setting, for question domains left out of the domains metadata.
+// Under either policy a domain listed with weight 0 is a holding area: its questions are stored but never
+// selected into exams.
+const (
+	UnweightedDomainsExplicit = "explicit" // Every question domain must be listed in the domains metadata
+	UnweightedDomainsHolding  = "holding"  // Unlisted domains are added with weight 0 and a warning
+)
+// loadUnweightedDomainPolicy reads the unweighted_domain_policy setting, falling back to
+// UnweightedDomainsExplicit for missing or unknown values.
+func loadUnweightedDomainPolicy(ctx context.Context, pool *pgxpool.Pool) string {
+	policy, err := db.GetSettingCached(pool, "unweighted_domain_policy")
+	if err != nil || policy == "" {
+		return UnweightedDomainsExplicit
+	}
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	if policy != UnweightedDomainsExplicit && policy != UnweightedDomainsHolding {
+		utils.LoggerFromContext(ctx).Warn("Unknown unweighted_domain_policy, using the default", "value", policy, "default", UnweightedDomainsExplicit)
+		return UnweightedDomainsExplicit
+	}
+	return policy
+}
+// Values of the duplicate_question_scope setting, the scope within which a question_text must be unique at
+// ingestion. The database only requires uniqueness per course and exam_bank_version, which DuplicateScopeFile
+// already implies since every bank has its own version.
+const (
+	DuplicateScopeFile   = "file"   // Unique within one exam bank file
+	DuplicateScopeCourse = "course" // Unique across all exam banks of the course
+	DuplicateScopeGlobal = "global" // Also unused by the questions of every other course
+)
+// loadDuplicateQuestionScope reads the duplicate_question_scope setting, falling back to DuplicateScopeFile
+// for missing or unknown values.
+func loadDuplicateQuestionScope(ctx context.Context, pool *pgxpool.Pool) string {
+	scope, err := db.GetSettingCached(pool, "duplicate_question_scope")
+	if err != nil || scope == "" {
+		return DuplicateScopeFile
+	}
+	scope = strings.ToLower(strings.TrimSpace(scope))
+	if scope != DuplicateScopeFile && scope != DuplicateScopeCourse && scope != DuplicateScopeGlobal {
+		utils.LoggerFromContext(ctx).Warn("Unknown duplicate_question_scope, using the default", "value", scope, "default", DuplicateScopeFile)
+		return DuplicateScopeFile
+	}
+	return scope
+}
+// scopedQuestionTexts returns the set of question texts a bank's questions must not repeat under
+// duplicateScope: a fresh one per bank for DuplicateScopeFile, otherwise courseQuestionTexts, shared by every
+// bank of the course.
+func scopedQuestionTexts(duplicateScope string, courseQuestionTexts map[string]bool) map[string]bool {
+	if duplicateScope == DuplicateScopeFile {
+		return make(map[string]bool)
+	}
+	return courseQuestionTexts
+}
+// addHoldingDomains applies policy (an unweighted_domain_policy value) to a bank. Under the holding policy
+// every question domain missing from its domains metadata is added with weight 0, so it is stored with the
+// bank's metadata and exams like a listed zero-weight domain, and a warning is logged at the first question
+// using it. Under the explicit policy the bank is left as is and buildQuestion rejects those questions.
+func addHoldingDomains(pool *pgxpool.Pool, courseCode string, bank *examBank, policy string) {
+	if policy != UnweightedDomainsHolding {
+		return
+	}
+	for _, bq := range bank.Questions {
+		if bq.Domain == "" {
+			continue
+		}
+		if _, ok := bank.Metadata.Domains[bq.Domain]; ok {
+			continue
+		}
+		bank.Metadata.Domains[bq.Domain] = 0
+		db.LogError(pool, sourceName, courseCode, bank.FilePath, bq.LineNumber, "domain", fmt.Sprintf("Domain '%s' is not weighted; stored as a holding domain", bq.Domain), "Its questions are never selected into exams. Add the domain with a weight to the 'domains' metadata to use them.")
+	}
+}
+// codeLanguagePattern is the form of a code_language hint, e.g. "bash", "yaml" or "c++".
+var codeLanguagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+#._-]{0,29}$`)
+// MaxFuzzyAcceptDistance bounds the fuzzy_accept_distance metadata, beyond which short answers stop meaning anything.
+const MaxFuzzyAcceptDistance = 5
+// MaxInstructionsLength bounds an exam's pre-exam briefing, from the instructions metadata row or an admin update.
+const MaxInstructionsLength = 5000
+// csvHeaders is the column layout of exam_bank.csv question rows.
+// Columns after the first csvColumnCount are optional and may be omitted from every row.
+var csvHeaders = []string{
+	"question_type", "domain", "question_text", "explanation", "image_url", "code_block", "input_method",
+	"choice_1", "correct_1", "explain_1",
+	"choice_2", "correct_2", "explain_2",
+	"choice_3", "correct_3", "explain_3",
+	"choice_4", "correct_4", "explain_4",
+	"choice_5", "correct_5", "explain_5",
+	"choice_6", "correct_6", "explain_6",
+	"acceptable_answers",
+	"exact_select", // Optional: for multi, the exact number of choices the student must select
+	"context_hints", // Optional: TRUE lets practice hints for terminal fillblank quote the code_block
+	"draft",         // Optional: TRUE ingests a question without a correct answer and keeps it out of exams
+	"allow_feedback_in_simulation", // Optional: TRUE gives practice-style answer feedback for this question in simulation mode
+	"hint",          // Optional: authored hint shown in practice mode after a wrong answer
+	"ignore_flag_order", // Optional: TRUE grades terminal fillblank answers regardless of flag order
+	"code_language", // Optional: syntax highlighting hint for the code_block, e.g. bash or yaml
+}
+// csvHeadersBySchema maps a schema_version major version to the column layout a declared header must match.
+// Versions not listed use the current csvHeaders layout.
+var csvHeadersBySchema = map[string][]string{
+	"1": csvHeaders,
+}
+// ErrActiveAttempts is returned by ProcessCourseData when re-ingesting would delete exams that have
+// in-progress attempts and the ingestion is not forced.
+var ErrActiveAttempts = errors.New("exams have in-progress attempts")
+// ErrCourseUnchanged is returned by ProcessCourseData when the course's files are unchanged since its last
+// successful ingestion and the ingestion is not forced; nothing is written.
+var ErrCourseUnchanged = errors.New("course content unchanged since last ingestion")
+// ProcessCourseData reads course.yaml and the course's exam banks (exam_bank.csv or exam_bank.json, plus any
+// exam_bank_<name>.csv), validates, and ingests data. Each bank is stored under its own exam_bank_version
+// and gets its own exams; errors are logged with the file_path of the bank they come from.
+// Exams with in-progress attempts are retired rather than deleted when possible (see retainActiveExams);
+// otherwise the ingestion fails with ErrActiveAttempts unless force is set.
+// Unless force is set, a course whose files hash to the content_hash of its last successful ingestion
+// (see courseContentHash) and that has no retired exams left to remove is skipped with ErrCourseUnchanged.
+func ProcessCourseData(ctx context.Context, pool *pgxpool.Pool, courseCode, labsRepoPath string, force bool) (err error) {
+	defer func() {
+		result := metrics.IngestionResult(err)
+		if errors.Is(err, ErrCourseUnchanged) {
+			result = "skipped"
+		}
+		metrics.Ingestions.WithLabelValues(result).Inc()
+	}()
 	coursePath := filepath.Join(labsRepoPath, "courses", courseCode)
 	courseYAMLPath := filepath.Join(coursePath, "course.yaml")
-	examBankCSVPath := filepath.Join(coursePath, "exam_bank.csv")
 	// 1. Read course.yaml
 	courseYAMLData, err := os.ReadFile(courseYAMLPath)
 	if err != nil {
@@ -43,9 +190,33 @@ func ProcessCourseData(pool *pgxpool.Pool, courseCode, labsRepoPath string) erro
 		db.LogError(pool, sourceName, courseCode, courseYAMLPath, 0, "course_code", "Mismatch between course.yaml and directory name", fmt.Sprintf("course_code in YAML (%s) must match directory name (%s)", courseMeta.CourseCode, courseCode))
 		return fmt.Errorf("course code mismatch in course.yaml for %s", courseCode)
 	}
+	bankFiles, err := discoverExamBanks(pool, courseCode, coursePath)
+	if err != nil {
+		return err
+	}
+	contentHash, err := courseContentHash(courseYAMLData, bankFiles)
+	if err != nil {
+		db.LogError(pool, sourceName, courseCode, coursePath, 0, "", "Failed to read course files", fmt.Sprintf("Ensure the exam bank files are readable: %v", err))
+		return fmt.Errorf("failed to hash course files for %s: %w", courseCode, err)
+	}
+	if !force {
+		var lastHash *string
+		var hasRetiredExams bool
+		err := pool.QueryRow(ctx, `
+			SELECT c.content_hash, EXISTS (SELECT 1 FROM exams e WHERE e.course_id = c.id AND e.retired_at IS NOT NULL)
+			FROM courses c WHERE c.course_code = $1
+		`, courseCode).Scan(&lastHash, &hasRetiredExams)
+		if err != nil && err != pgx.ErrNoRows {
+			return fmt.Errorf("failed to read last content hash for %s: %w", courseCode, err)
+		}
+		if contentUnchanged(lastHash, contentHash, hasRetiredExams) {
+			db.LogAdminEvent(pool, db.SystemActor, "ingestion_skipped", courseCode, fmt.Sprintf("Content unchanged (sha256 %s)", contentHash))
+			return fmt.Errorf("%w: %s", ErrCourseUnchanged, courseCode)
+		}
+	}
 	// Upsert Course into DB
 	var courseID int
-	err = pool.QueryRow(context.Background(), `
+	err = pool.QueryRow(ctx, `
 		INSERT INTO courses (name, course_code, duration_days, marketing_name, responsibility)
 		VALUES ($1, $2, $3, $4, $5)
 		ON CONFLICT (course_code) DO UPDATE SET
@@ -59,55 +230,603 @@ func ProcessCourseData(pool *pgxpool.Pool, courseCode, labsRepoPath string) erro
 		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to upsert course data", fmt.Sprintf("Database error: %v", err))
 		return fmt.Errorf("failed to upsert course %s: %w", courseCode, err)
 	}
-	// 2. Read exam_bank.csv
+	// 2. Read the exam banks: the primary exam_bank.json or exam_bank.csv, and any exam_bank_<name>.csv
+	banks := make([]*examBank, 0, len(bankFiles))
+	domainWeights := make(map[string]float64) // Every domain weighted by some bank
+	for _, file := range bankFiles {
+		var bank *examBank
+		if strings.HasSuffix(file.Path, ".json") {
+			bank, err = readJSONExamBank(pool, courseCode, file.Path)
+		} else {
+			bank, err = readCSVExamBank(pool, courseCode, file.Path)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(file.Path), err)
+		}
+		bank.Name = file.Name
+		metadata := bank.Metadata
+		if metadata.MinQuestions == 0 || metadata.MaxQuestions == 0 || metadata.ExamTime == 0 || metadata.PassingScore == 0 || metadata.Domains == nil {
+			db.LogError(pool, sourceName, courseCode, bank.FilePath, 0, "", "Missing critical exam metadata", "Ensure min_questions, max_questions, exam_time, passing_score, and domains are defined.")
+			return fmt.Errorf("missing critical exam metadata in %s for %s", filepath.Base(bank.FilePath), courseCode)
+		}
+		if err := validateSchemaVersion(pool, courseCode, bank.FilePath, metadata.SchemaVersion); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(bank.FilePath), err)
+		}
+		if err := validateMetadataBounds(pool, courseCode, bank.FilePath, metadata); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(bank.FilePath), err)
+		}
+		addHoldingDomains(pool, courseCode, bank, loadUnweightedDomainPolicy(ctx, pool))
+		// Checked before the transaction so slow image hosts do not hold it open
+		if err := checkImageURLs(pool, courseCode, bank); err != nil {
+			return err
+		}
+		for domainName, weight := range bank.Metadata.Domains {
+			domainWeights[domainName] = weight
+		}
+		banks = append(banks, bank)
+	}
+	// Process metadata and questions in a transaction
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // Rollback on error
+	versions := make([]string, len(banks))
+	for i, bank := range banks {
+		versions[i] = bank.Version()
+	}
+	retainedExamIDs, err := retainActiveExams(ctx, tx, pool, courseID, courseCode, versions, force)
+	if err != nil {
+		return err
+	}
+	// The answers validity scores were computed from go with the old exams, so the scores are carried over
+	validityScores, err := snapshotValidityScores(ctx, tx, courseID)
+	if err != nil {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to keep question validity scores", fmt.Sprintf("Database error: %v", err))
+		return err
+	}
+	// Clear existing questions and exams for this course to prepare for fresh ingestion
+	// This ensures "no question reuse" enforcement works correctly when the exam bank updates.
+	for _, stmt := range cleanupStatements {
+		if _, err := tx.Exec(ctx, stmt, courseID, retainedExamIDs); err != nil {
+			db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to clear existing exam data", fmt.Sprintf("Database error during pre-ingestion cleanup: %v", err))
+			return fmt.Errorf("failed to clear existing exam data for %s: %w", courseCode, err)
+		}
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM course_shared_domains WHERE course_id = $1`, courseID); err != nil {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to clear existing exam data", fmt.Sprintf("Database error during pre-ingestion cleanup: %v", err))
+		return fmt.Errorf("failed to clear existing exam data for %s: %w", courseCode, err)
+	}
+	// The course's exam_bank_version and metadata are those of its first bank, the primary one when present
+	metadataJSON, err := json.Marshal(banks[0].Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal exam bank metadata for %s: %w", courseCode, err)
+	}
+	if _, err := tx.Exec(ctx, `UPDATE courses SET exam_bank_version = $1, exam_bank_metadata = $2 WHERE id = $3`, banks[0].Version(), metadataJSON, courseID); err != nil {
+		return fmt.Errorf("failed to store exam bank metadata for %s: %w", courseCode, err)
+	}
+	// Insert domains into DB; banks weighting the same domain name share its row
+	domainMap := make(map[string]int) // domain name -> domain ID
+	for _, bank := range banks {
+		for domainName := range bank.Metadata.Domains {
+			if _, ok := domainMap[domainName]; ok {
+				continue
+			}
+			var id int
+			err := tx.QueryRow(ctx, `
+				INSERT INTO domains (course_id, name) VALUES ($1, $2)
+				ON CONFLICT (course_id, name) DO UPDATE SET name = EXCLUDED.name
+				RETURNING id
+			`, courseID, domainName).Scan(&id)
+			if err != nil {
+				db.LogError(pool, sourceName, courseCode, bank.FilePath, bank.DomainsLine, "domain_db_insert", "Failed to insert domain", fmt.Sprintf("Database error: %v", err))
+				return fmt.Errorf("failed to upsert domain %s for %s: %w", domainName, courseCode, err)
+			}
+			domainMap[domainName] = id
+		}
+	}
+	// Record domains drawn from other courses' shared banks
+	if err := saveSharedBanks(ctx, tx, pool, courseID, courseMeta, courseYAMLPath, domainWeights); err != nil {
+		return err
+	}
+	// Validate question entries and convert them to questions, each bank under its own exam_bank_version
+	duplicateScope := loadDuplicateQuestionScope(ctx, pool)
+	courseQuestionTexts := make(map[string]bool) // Shared by the banks unless duplicates are only checked per file
+	for _, bank := range banks {
+		questionsToSave := make([]models.Question, 0, len(bank.Questions)) // To collect questions for bulk insert/validation
+		questionTexts := scopedQuestionTexts(duplicateScope, courseQuestionTexts) // To check for duplicate question_text
+		for _, bq := range bank.Questions {
+			question, err := buildQuestion(ctx, pool, courseCode, bank, bq, domainMap, questionTexts, bank.Version())
+			if err != nil {
+				return fmt.Errorf("%s: %w", filepath.Base(bank.FilePath), err)
+			}
+			questionsToSave = append(questionsToSave, question)
+		}
+		if duplicateScope == DuplicateScopeGlobal {
+			if err := checkOtherCoursesQuestionTexts(ctx, tx, pool, courseID, courseCode, bank); err != nil {
+				return fmt.Errorf("%s: %w", filepath.Base(bank.FilePath), err)
+			}
+		}
+		// Persist questions and choices/answers within the transaction
+		if err := persistQuestions(ctx, tx, pool, courseCode, questionsToSave); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(bank.FilePath), err)
+		}
+	}
+	if err := relinkQuestionNotes(ctx, tx, courseID, versions); err != nil {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to keep question notes", fmt.Sprintf("Database error: %v", err))
+		return err
+	}
+	if err := restoreValidityScores(ctx, tx, courseID, versions, validityScores); err != nil {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to keep question validity scores", fmt.Sprintf("Database error: %v", err))
+		return err
+	}
+	// Commit transaction
+	if err := tx.Commit(ctx); err != nil {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to commit ingestion transaction", fmt.Sprintf("Database error: %v", err))
+		return fmt.Errorf("failed to commit ingestion transaction for %s: %w", courseCode, err)
+	}
+	// The committed ingestion removed the course's exams, so regenerating them is not cut short by ctx
+	ctx = context.WithoutCancel(ctx)
+	if len(retainedExamIDs) > 0 {
+		db.LogAdminEvent(pool, db.SystemActor, "retire_exams", courseCode, fmt.Sprintf("Retired exams %s, which have in-progress attempts", joinInts(retainedExamIDs)))
+	}
+	// Regenerate exams after successful ingestion, bank by bank so one bank's failure does not block the others
+	var generationErrs []error
+	for _, bank := range banks {
+		err = exam.GenerateExamsForCourse(ctx, pool, courseID, courseMeta.MarketingName, bank.Version(), bank.Metadata, exam.LoadSelectionStrategy(ctx, pool))
+		if err != nil {
+			db.LogError(pool, sourceName, courseCode, bank.FilePath, 0, "", "Failed to regenerate exams after ingestion", fmt.Sprintf("Error: %v", err))
+			generationErrs = append(generationErrs, fmt.Errorf("failed to regenerate exams from %s for %s: %w", filepath.Base(bank.FilePath), courseCode, err))
+		}
+	}
+	if len(generationErrs) > 0 {
+		return errors.Join(generationErrs...)
+	}
+	// Only the attempts of retained exams are left to score; the carried scores stand until new answers come in
+	if err := exam.UpdateQuestionValidityScoresForCourse(ctx, pool, courseID); err != nil {
+		utils.LoggerFromContext(ctx).Error("Error updating validity scores after ingestion", "course_code", courseCode, "error", err)
+	}
+	// Exams of courses sharing this course's questions referenced the questions just replaced
+	regenerateSharingCourses(ctx, pool, courseID, courseCode)
+	// Recorded last, so a failed ingestion is retried on the next run
+	if _, err := pool.Exec(ctx, `UPDATE courses SET content_hash = $1 WHERE id = $2`, contentHash, courseID); err != nil {
+		utils.LoggerFromContext(ctx).Error("Error recording content hash", "course_code", courseCode, "error", err)
+	}
+	return nil
+}
+// courseContentHash returns the hex SHA-256 of course.yaml and the course's exam bank files, each with its
+// file name, so editing, adding, removing or renaming a bank changes it. Files listed but missing (see
+// discoverExamBanks) hash as absent and are reported when read.
+func courseContentHash(courseYAMLData []byte, bankFiles []examBankFile) (string, error) {
+	hasher := sha256.New()
+	writePart := func(name string, data []byte) {
+		fmt.Fprintf(hasher, "%s\x00%d\x00", name, len(data))
+		hasher.Write(data)
+	}
+	writePart("course.yaml", courseYAMLData)
+	for _, file := range bankFiles {
+		data, err := os.ReadFile(file.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(hasher, "%s\x00missing\x00", filepath.Base(file.Path))
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		writePart(filepath.Base(file.Path), data)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+// contentUnchanged reports whether a course hashing to contentHash can skip ingestion: its last successful
+// ingestion recorded the same hash (lastHash is nil when none did) and no retired exams are left to remove.
+func contentUnchanged(lastHash *string, contentHash string, hasRetiredExams bool) bool {
+	return lastHash != nil && *lastHash == contentHash && !hasRetiredExams
+}
+// cleanupStatements clear a course's questions and exams before ingestion, children before parents;
+// retained exams ($2) keep their questions and those questions' domains. Each statement is executed
+// separately: a parameterized Exec runs as a single prepared statement.
+var cleanupStatements = []string{
+	`DELETE FROM exam_questions WHERE exam_id IN (SELECT id FROM exams WHERE course_id = $1 AND id <> ALL($2))`,
+	`DELETE FROM exams WHERE course_id = $1 AND id <> ALL($2)`,
+	`DELETE FROM questions WHERE domain_id IN (SELECT id FROM domains WHERE course_id = $1)
+		AND id NOT IN (SELECT question_id FROM exam_questions WHERE exam_id = ANY($2))`,
+	`DELETE FROM domains WHERE course_id = $1
+		AND id NOT IN (SELECT q.domain_id FROM exam_questions eq JOIN questions q ON eq.question_id = q.id WHERE eq.exam_id = ANY($2))`,
+}
+// examBankFile is an exam bank file found in a course directory.
+type examBankFile struct {
+	Path string
+	Name string // Bank name of an exam_bank_<name>.csv; "" for the primary bank
+}
+// bankNamePattern is the form of the <name> of an additional exam_bank_<name>.csv bank.
+var bankNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+// discoverExamBanks lists the exam banks in a course directory: the primary bank first (exam_bank.json,
+// which takes precedence, or exam_bank.csv), then every exam_bank_<name>.csv in name order. Without any
+// additional bank the primary exam_bank.csv is listed even when missing, so reading it reports the error.
+func discoverExamBanks(pool *pgxpool.Pool, courseCode, coursePath string) ([]examBankFile, error) {
+	examBankCSVPath := filepath.Join(coursePath, "exam_bank.csv")
+	examBankJSONPath := filepath.Join(coursePath, "exam_bank.json")
+	namedPaths, err := filepath.Glob(filepath.Join(coursePath, "exam_bank_*.csv"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list exam banks for %s: %w", courseCode, err)
+	}
+	var files []examBankFile
+	if _, statErr := os.Stat(examBankJSONPath); statErr == nil {
+		files = append(files, examBankFile{Path: examBankJSONPath})
+	} else if _, statErr := os.Stat(examBankCSVPath); statErr == nil || len(namedPaths) == 0 {
+		files = append(files, examBankFile{Path: examBankCSVPath})
+	}
+	for _, path := range namedPaths { // Glob returns them sorted
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "exam_bank_"), ".csv")
+		if !bankNamePattern.MatchString(name) {
+			db.LogError(pool, sourceName, courseCode, path, 0, "", "Invalid exam bank file name", "Name additional banks exam_bank_<name>.csv, with <name> in lowercase letters, digits, '_' and '-'.")
+			return nil, fmt.Errorf("invalid exam bank name '%s' for %s", name, courseCode)
+		}
+		files = append(files, examBankFile{Path: path, Name: name})
+	}
+	return files, nil
+}
+// saveSharedBanks records the shared_banks references from course.yaml in course_shared_domains.
+// Each shared domain must be weighted in the exam bank metadata, and the referenced course must
+// already be ingested.
+func saveSharedBanks(ctx context.Context, tx pgx.Tx, pool *pgxpool.Pool, courseID int, courseMeta models.CourseYAML, courseYAMLPath string, domainWeights map[string]float64) error {
+	courseCode := courseMeta.CourseCode
+	for _, ref := range courseMeta.SharedBanks {
+		if ref.CourseCode == courseCode {
+			db.LogError(pool, sourceName, courseCode, courseYAMLPath, 0, "shared_banks", "Course references itself as a shared bank", "Remove the course's own course_code from shared_banks.")
+			return fmt.Errorf("course %s references itself as a shared bank", courseCode)
+		}
+		var sourceCourseID int
+		err := tx.QueryRow(ctx, `SELECT id FROM courses WHERE course_code = $1`, ref.CourseCode).Scan(&sourceCourseID)
+		if err != nil {
+			db.LogError(pool, sourceName, courseCode, courseYAMLPath, 0, "shared_banks", "Shared bank course not found", fmt.Sprintf("Ingest course '%s' before courses that share its questions.", ref.CourseCode))
+			return fmt.Errorf("shared bank course %s not found for %s: %w", ref.CourseCode, courseCode, err)
+		}
+		for _, domainName := range ref.Domains {
+			if _, ok := domainWeights[domainName]; !ok {
+				db.LogError(pool, sourceName, courseCode, courseYAMLPath, 0, "shared_banks", "Shared domain not defined in exam bank metadata", fmt.Sprintf("Add a weight for domain '%s' to the 'domains' metadata row.", domainName))
+				return fmt.Errorf("shared domain '%s' is not weighted in the exam bank for %s", domainName, courseCode)
+			}
+			_, err := tx.Exec(ctx, `
+				INSERT INTO course_shared_domains (course_id, domain_name, source_course_id) VALUES ($1, $2, $3)
+			`, courseID, domainName, sourceCourseID)
+			if err != nil {
+				db.LogError(pool, sourceName, courseCode, courseYAMLPath, 0, "shared_banks", "Failed to record shared domain", fmt.Sprintf("Domain '%s' may only be listed under one shared bank. Database error: %v", domainName, err))
+				return fmt.Errorf("failed to record shared domain '%s' for %s: %w", domainName, courseCode, err)
+			}
+		}
+	}
+	return nil
+}
+// activeAttempt is an in-progress attempt on an exam that re-ingesting a course would delete.
+type activeAttempt struct {
+	ID        int
+	ExamID    int
+	Email     string
+	Retirable bool
+}
+// retainActiveExams finds the in-progress attempts (neither completed nor abandoned) on the course's exams and
+// on other courses' exams using its questions, all of which ingestion would delete. The course's own exams
+// of an exam_bank_version not among versions can be retired instead: they are closed to new attempts and
+// kept, with their questions, until a later ingestion finds them idle. Their IDs are returned for the
+// cleanup to skip. Any other affected attempt fails the ingestion with ErrActiveAttempts, listing them all,
+// unless force is set, in which case those exams are deleted along with their attempts.
+func retainActiveExams(ctx context.Context, tx pgx.Tx, pool *pgxpool.Pool, courseID int, courseCode string, versions []string, force bool) ([]int, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT ea.id, ea.exam_id, ea.email, e.course_id = $1 AND e.exam_bank_version <> ALL($2)
+		FROM exam_attempts ea
+		JOIN exams e ON ea.exam_id = e.id
+		WHERE ea.completed_at IS NULL AND ea.abandoned_at IS NULL
+			AND (e.course_id = $1 OR EXISTS (
+				SELECT 1 FROM exam_questions eq
+				JOIN questions q ON eq.question_id = q.id
+				JOIN domains d ON q.domain_id = d.id
+				WHERE eq.exam_id = e.id AND d.course_id = $1
+			))
+		ORDER BY ea.id
+	`, courseID, versions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query in-progress attempts for %s: %w", courseCode, err)
+	}
+	var attempts []activeAttempt
+	for rows.Next() {
+		var a activeAttempt
+		if err := rows.Scan(&a.ID, &a.ExamID, &a.Email, &a.Retirable); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan in-progress attempt for %s: %w", courseCode, err)
+		}
+		attempts = append(attempts, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read in-progress attempts for %s: %w", courseCode, err)
+	}
+	retained, blocking := partitionActiveAttempts(attempts)
+	if len(blocking) > 0 && !force {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", fmt.Sprintf("Re-ingestion would delete exams with in-progress attempts: %s", strings.Join(blocking, ", ")), "Wait for the attempts to finish, change schema_version so the old exams can be retired, or trigger the ingestion with force=true to delete them.")
+		return nil, fmt.Errorf("%w: %s", ErrActiveAttempts, strings.Join(blocking, ", "))
+	}
+	if len(retained) > 0 {
+		_, err := tx.Exec(ctx, `
+			UPDATE exams SET allow_practice = FALSE, allow_simulation = FALSE, retired_at = COALESCE(retired_at, NOW())
+			WHERE id = ANY($1)
+		`, retained)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retire exams with in-progress attempts for %s: %w", courseCode, err)
+		}
+	}
+	return retained, nil
+}
+// partitionActiveAttempts splits in-progress attempts into the IDs of the exams to retain, each once and in
+// order of first attempt, and a description of every attempt that cannot be kept by retiring its exam.
+func partitionActiveAttempts(attempts []activeAttempt) (retained []int, blocking []string) {
+	retained = []int{} // Never nil: the cleanup compares against it with <> ALL
+	retainedSet := make(map[int]bool)
+	for _, a := range attempts {
+		if a.Retirable {
+			if !retainedSet[a.ExamID] {
+				retainedSet[a.ExamID] = true
+				retained = append(retained, a.ExamID)
+			}
+			continue
+		}
+		blocking = append(blocking, fmt.Sprintf("attempt %d (exam %d, %s)", a.ID, a.ExamID, a.Email))
+	}
+	return retained, blocking
+}
+// joinInts formats ids as a comma-separated list.
+func joinInts(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ", ")
+}
+// regenerateSharingCourses regenerates the exams of every course that draws questions from
+// sourceCourseID's shared bank, reusing the latest exam metadata of each of the course's exam banks.
+// Failures are logged.
+func regenerateSharingCourses(ctx context.Context, pool *pgxpool.Pool, sourceCourseID int, sourceCourseCode string) {
+	rows, err := pool.Query(ctx, `
+		SELECT DISTINCT c.id, c.course_code, c.marketing_name
+		FROM course_shared_domains csd
+		JOIN courses c ON csd.course_id = c.id
+		WHERE csd.source_course_id = $1
+	`, sourceCourseID)
+	if err != nil {
+		db.LogError(pool, sourceName, sourceCourseCode, "", 0, "", "Failed to find courses sharing this course's questions", fmt.Sprintf("Database error: %v", err))
+		return
+	}
+	type sharingCourse struct {
+		ID            int
+		CourseCode    string
+		MarketingName string
+	}
+	var courses []sharingCourse
+	for rows.Next() {
+		var sc sharingCourse
+		if err := rows.Scan(&sc.ID, &sc.CourseCode, &sc.MarketingName); err != nil {
+			rows.Close()
+			db.LogError(pool, sourceName, sourceCourseCode, "", 0, "", "Failed to scan course sharing this course's questions", fmt.Sprintf("Database error: %v", err))
+			return
+		}
+		courses = append(courses, sc)
+	}
+	rows.Close()
+	for _, sc := range courses {
+		// Each bank's latest version is regenerated; no exams generated yet means no versions, and the
+		// course's own ingestion will generate them
+		latest, err := exam.LatestBankVersions(ctx, pool, sc.ID)
+		if err != nil {
+			db.LogError(pool, sourceName, sc.CourseCode, "", 0, "", "Failed to find exam banks of course sharing this course's questions", fmt.Sprintf("Database error: %v", err))
+			continue
+		}
+		for _, version := range latest[sc.ID] {
+			examBankVersion, metadata, ok := latestExamMetadata(ctx, pool, sc.ID, sc.CourseCode, version)
+			if !ok {
+				continue
+			}
+			if err := exam.GenerateExamsForCourse(ctx, pool, sc.ID, sc.MarketingName, examBankVersion, metadata, exam.LoadSelectionStrategy(ctx, pool)); err != nil {
+				db.LogError(pool, sourceName, sc.CourseCode, "", 0, "", "Failed to regenerate exams after shared bank update", fmt.Sprintf("Shared bank: %s, Version: %s, Error: %v", sourceCourseCode, examBankVersion, err))
+			}
+		}
+	}
+}
+// RegenerateExamBank regenerates the course's exams of an exam_bank_version from its stored questions and
+// the metadata of its latest exam, e.g. so a newly flagged question is dropped. Since the exams are
+// replaced, it fails with ErrActiveAttempts, listing them, when any has an in-progress attempt.
+func RegenerateExamBank(ctx context.Context, pool *pgxpool.Pool, courseID int, courseCode, examBankVersion string) error {
+	examBankVersion, metadata, ok := latestExamMetadata(ctx, pool, courseID, courseCode, examBankVersion)
+	if !ok {
+		return fmt.Errorf("course %s has no exams of version %s to regenerate", courseCode, examBankVersion)
+	}
+	var attempts []string
+	err := pool.QueryRow(ctx, `
+		SELECT COALESCE(array_agg(format('attempt %s (exam %s, %s)', ea.id, ea.exam_id, ea.email) ORDER BY ea.id), '{}')
+		FROM exam_attempts ea
+		JOIN exams e ON ea.exam_id = e.id
+		WHERE e.course_id = $1 AND e.exam_bank_version = $2 AND ea.completed_at IS NULL AND ea.abandoned_at IS NULL
+	`, courseID, examBankVersion).Scan(&attempts)
+	if err != nil {
+		return fmt.Errorf("failed to query in-progress attempts for %s: %w", courseCode, err)
+	}
+	if len(attempts) > 0 {
+		return fmt.Errorf("%w: %s", ErrActiveAttempts, strings.Join(attempts, ", "))
+	}
+	var marketingName string
+	if err := pool.QueryRow(ctx, `SELECT COALESCE(marketing_name, name) FROM courses WHERE id = $1`, courseID).Scan(&marketingName); err != nil {
+		return fmt.Errorf("failed to fetch course %s: %w", courseCode, err)
+	}
+	if err := exam.GenerateExamsForCourse(ctx, pool, courseID, marketingName, examBankVersion, metadata, exam.LoadSelectionStrategy(ctx, pool)); err != nil {
+		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to regenerate exams", fmt.Sprintf("Version: %s, Error: %v", examBankVersion, err))
+		return fmt.Errorf("failed to regenerate exams for %s: %w", courseCode, err)
+	}
+	return nil
+}
+// latestExamMetadata returns the exam bank version and metadata of the course's most recently
+// generated exam that is neither retired nor a sample, of the given exam_bank_version or, when version is
+// "", of the latest of its banks' latest versions (see exam.LatestBankVersions and exam.LatestVersion). ok is
+// false when the course has no usable exam.
+func latestExamMetadata(ctx context.Context, pool *pgxpool.Pool, courseID int, courseCode, version string) (string, models.ExamBankMetadata, bool) {
+	if version == "" {
+		latest, err := exam.LatestBankVersions(ctx, pool, courseID)
+		if err != nil {
+			utils.LoggerFromContext(ctx).Error("Error fetching exam bank versions", "course_code", courseCode, "error", err)
+			return "", models.ExamBankMetadata{}, false
+		}
+		if version = exam.LatestVersion(latest[courseID]); version == "" {
+			return "", models.ExamBankMetadata{}, false
+		}
+	}
+	var examBankVersion string
+	var metadata models.ExamBankMetadata
+	var domainWeightsJSON []byte
+	err := pool.QueryRow(ctx, `
+		SELECT exam_bank_version, min_questions, max_questions, exam_time, passing_score, domain_weights, allow_practice, allow_simulation, COALESCE(target_exam_count, 0), penalty_per_wrong, fuzzy_accept_distance, COALESCE(instructions, '')
+		FROM exams WHERE course_id = $1 AND ($2::text = '' OR exam_bank_version = $2) AND retired_at IS NULL AND NOT sample
+		ORDER BY created_at DESC LIMIT 1
+	`, courseID, version).Scan(&examBankVersion, &metadata.MinQuestions, &metadata.MaxQuestions, &metadata.ExamTime, &metadata.PassingScore, &domainWeightsJSON, &metadata.AllowPractice, &metadata.AllowSimulation, &metadata.TargetExamCount, &metadata.PenaltyPerWrong, &metadata.FuzzyAcceptDistance, &metadata.Instructions)
+	if err != nil {
+		return "", metadata, false
+	}
+	if err := json.Unmarshal(domainWeightsJSON, &metadata.Domains); err != nil {
+		utils.LoggerFromContext(ctx).Error("Error unmarshaling domain weights", "course_code", courseCode, "error", err)
+		return "", metadata, false
+	}
+	metadata.SchemaVersion = examBankVersion
+	return examBankVersion, metadata, true
+}
+// validateSchemaVersion rejects a schema_version that is not a semantic version: the version keys questions
+// and exams and seeds generation, and "latest" is decided by semver precedence. A '+' is rejected first, as
+// it separates the bank name in an exam_bank_version.
+func validateSchemaVersion(pool *pgxpool.Pool, courseCode, filePath, schemaVersion string) error {
+	if strings.Contains(schemaVersion, "+") {
+		db.LogError(pool, sourceName, courseCode, filePath, 0, "schema_version", "Invalid schema_version", "schema_version may not contain '+', which separates the bank name in exam_bank_version.")
+		return fmt.Errorf("invalid schema_version '%s' for %s", schemaVersion, courseCode)
+	}
+	if _, err := utils.ParseSemver(schemaVersion); err != nil {
+		db.LogError(pool, sourceName, courseCode, filePath, 0, "schema_version", "Invalid schema_version", fmt.Sprintf("%v. Use MAJOR.MINOR.PATCH, optionally with a pre-release such as '1.1.0-beta.1'; leave it empty to default to 1.0.0.", err))
+		return fmt.Errorf("invalid schema_version '%s' for %s: %w", schemaVersion, courseCode, err)
+	}
+	return nil
+}
+// validateMetadataBounds rejects exam metadata outside the sanity bounds in the settings table
+// (max_exam_time_minutes, max_questions_limit), and min_questions above max_questions,
+// so data-entry mistakes such as a 1200000-minute exam_time are caught at ingestion.
+func validateMetadataBounds(pool *pgxpool.Pool, courseCode, filePath string, metadata models.ExamBankMetadata) error {
+	maxExamTime := db.GetSettingInt(pool, "max_exam_time_minutes", 1440)
+	maxQuestions := db.GetSettingInt(pool, "max_questions_limit", 500)
+	if metadata.ExamTime > maxExamTime {
+		db.LogError(pool, sourceName, courseCode, filePath, 0, "exam_time", "exam_time exceeds the allowed maximum", fmt.Sprintf("Got %d minutes; the maximum is %d (setting max_exam_time_minutes).", metadata.ExamTime, maxExamTime))
+		return fmt.Errorf("exam_time %d exceeds the maximum of %d minutes for %s", metadata.ExamTime, maxExamTime, courseCode)
+	}
+	if metadata.MaxQuestions > maxQuestions {
+		db.LogError(pool, sourceName, courseCode, filePath, 0, "max_questions", "max_questions exceeds the allowed maximum", fmt.Sprintf("Got %d; the maximum is %d (setting max_questions_limit).", metadata.MaxQuestions, maxQuestions))
+		return fmt.Errorf("max_questions %d exceeds the maximum of %d for %s", metadata.MaxQuestions, maxQuestions, courseCode)
+	}
+	if metadata.TargetExamCount < 0 {
+		db.LogError(pool, sourceName, courseCode, filePath, 0, "target_exam_count", "Invalid target_exam_count", "Must be a positive integer, or omitted to let the planner choose.")
+		return fmt.Errorf("invalid target_exam_count %d for %s", metadata.TargetExamCount, courseCode)
+	}
+	if metadata.MinQuestions > metadata.MaxQuestions {
+		db.LogError(pool, sourceName, courseCode, filePath, 0, "min_questions", "min_questions exceeds max_questions", fmt.Sprintf("Got min_questions %d and max_questions %d; min_questions must not be greater.", metadata.MinQuestions, metadata.MaxQuestions))
+		return fmt.Errorf("min_questions %d exceeds max_questions %d for %s", metadata.MinQuestions, metadata.MaxQuestions, courseCode)
+	}
+	return nil
+}
+// examBank is a format-neutral exam bank read from exam_bank.csv or exam_bank.json, before validation.
+type examBank struct {
+	FilePath    string
+	Name        string // Bank name; "" for the course's primary exam bank
+	IsJSON      bool
+	DomainsLine int // Line of the domains metadata row (CSV only), for error logs
+	Metadata    models.ExamBankMetadata
+	Questions   []bankQuestion
+}
+// bankQuestion is a single question entry of an exam bank.
+type bankQuestion struct {
+	LineNumber        int // CSV line number, or 1-based position in the JSON questions array
+	QuestionType      string
+	Domain            string
+	QuestionText      string
+	Explanation       string
+	ImageURL          string
+	CodeBlock         string
+	InputMethod       string
+	ExactSelect       string // Optional, multi only
+	ContextHints      string // Optional, terminal fillblank only
+	Draft             string // Optional, TRUE allows a missing correct answer
+	AllowFeedbackInSimulation string // Optional, TRUE gives answer feedback in simulation mode
+	Hint              string // Optional, shown after a wrong practice answer
+	IgnoreFlagOrder   string // Optional, terminal fillblank only
+	CodeLanguage      string // Optional, requires a code_block
+	Choices           []bankChoice
+	AcceptableAnswers []string
+}
+// bankChoice is a single answer choice of an exam bank question.
+type bankChoice struct {
+	Column      int // 1-based choice column (choice_N) or JSON choices entry; empty ones are skipped, so gaps remain
+	Text        string
+	IsCorrect   bool
+	Explanation string
+	Position    string // Ordering only: expected 1-based position, or "" for the listed order
+	Match       string // Matching only: the right-hand response paired with Text
+}
+// Letter returns the choice's letter from its column, so choice_3 is C even when choice_2 is empty.
+func (c bankChoice) Letter() string {
+	return string(rune('A' + c.Column - 1))
+}
+// Version returns the exam_bank_version the bank's questions and exams are stored under.
+func (b *examBank) Version() string {
+	return exam.BankVersion(b.Metadata.SchemaVersion, b.Name)
+}
+// location describes where an entry lives in the exam bank file for error messages.
+func (b *examBank) location(lineNum int) string {
+	if b.IsJSON {
+		return fmt.Sprintf("question %d", lineNum)
+	}
+	return fmt.Sprintf("line %d", lineNum)
+}
+// readCSVExamBank reads exam_bank.csv into an examBank, validating the metadata rows.
+func readCSVExamBank(pool *pgxpool.Pool, courseCode, examBankCSVPath string) (*examBank, error) {
 	csvFile, err := os.Open(examBankCSVPath)
 	if err != nil {
 		db.LogError(pool, sourceName, courseCode, examBankCSVPath, 0, "", "Failed to open exam_bank.csv", fmt.Sprintf("Ensure file exists and is readable: %v", err))
-		return fmt.Errorf("failed to open exam_bank.csv for %s: %w", courseCode, err)
+		return nil, fmt.Errorf("failed to open exam_bank.csv for %s: %w", courseCode, err)
 	}
 	defer csvFile.Close()
 	reader := csv.NewReader(csvFile)
 	rows, err := reader.ReadAll()
 	if err != nil {
 		db.LogError(pool, sourceName, courseCode, examBankCSVPath, 0, "", "Failed to read exam_bank.csv", fmt.Sprintf("Ensure CSV format is correct: %v", err))
-		return fmt.Errorf("failed to read all CSV rows for %s: %w", courseCode, err)
+		return nil, fmt.Errorf("failed to read all CSV rows for %s: %w", courseCode, err)
 	}
 	if len(rows) < 6 { // At least 5 metadata rows + 1 question row
 		db.LogError(pool, sourceName, courseCode, examBankCSVPath, 0, "", "Insufficient rows in exam_bank.csv", "Minimum 5 metadata rows and at least one question row required.")
-		return fmt.Errorf("insufficient rows in exam_bank.csv for %s", courseCode)
-	}
-	// Process metadata and questions in a transaction
-	tx, err := pool.Begin(context.Background())
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback(context.Background()) // Rollback on error
-	// Clear existing questions and exams for this course to prepare for fresh ingestion
-	// This ensures "no question reuse" enforcement works correctly when the exam bank updates.
-	_, err = tx.Exec(context.Background(), `
-		DELETE FROM exam_questions WHERE exam_id IN (SELECT id FROM exams WHERE course_id = $1);
-		DELETE FROM exams WHERE course_id = $1;
-		DELETE FROM questions WHERE domain_id IN (SELECT id FROM domains WHERE course_id = $1);
-		DELETE FROM domains WHERE course_id = $1;
-	`, courseID)
-	if err != nil {
-		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to clear existing exam data", fmt.Sprintf("Database error during pre-ingestion cleanup: %v", err))
-		return fmt.Errorf("failed to clear existing exam data for %s: %w", courseCode, err)
+		return nil, fmt.Errorf("insufficient rows in exam_bank.csv for %s", courseCode)
 	}
 	var (
-		metadata        models.ExamBankMetadata
-		questionsToSave []models.Question // To collect questions for bulk insert/validation
-		domainMap       = make(map[string]int) // domain name -> domain ID
+		bank            = &examBank{FilePath: examBankCSVPath}
+		metadata        = models.ExamBankMetadata{AllowPractice: true, AllowSimulation: true}
 		examBankVersion = "1.0.0" // Default version
-		questionTexts   = make(map[string]bool) // To check for duplicate question_text within this version
-		lineOffset      = 0 // For header and metadata rows
+		lineOffset      = len(rows) // For header and metadata rows
 	)
-	// Process metadata rows first
+	requireHeader := db.GetSettingBool(pool, "require_csv_header", false)
+	headerDeclared := false
+	// Process metadata rows first, then the optional declared header row
 	for i := 0; i < len(rows); i++ {
 		row := rows[i]
-		if len(row) != csvColumnCount {
-			db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "", "Incorrect column count", fmt.Sprintf("Expected %d columns, got %d", csvColumnCount, len(row)))
-			return fmt.Errorf("incorrect column count in exam_bank.csv at line %d for %s", i+1, courseCode)
+		if isHeaderRow(row) {
+			if err := validateCSVHeader(row, examBankVersion); err != nil {
+				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "header", "Declared header does not match schema", fmt.Sprintf("schema_version %s: %v", examBankVersion, err))
+				return nil, fmt.Errorf("invalid declared header in exam_bank.csv at line %d for %s: %w", i+1, courseCode, err)
+			}
+			headerDeclared = true
+			lineOffset = i + 1 // Question rows start after the header
+			break
+		}
+		if len(row) < csvColumnCount || len(row) > len(csvHeaders) {
+			db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "", "Incorrect column count", fmt.Sprintf("Expected %d to %d columns, got %d", csvColumnCount, len(csvHeaders), len(row)))
+			return nil, fmt.Errorf("incorrect column count in exam_bank.csv at line %d for %s", i+1, courseCode)
 		}
 		firstCol := strings.TrimSpace(row[0])
 		secondCol := strings.TrimSpace(row[1])
@@ -122,234 +841,639 @@ func ProcessCourseData(pool *pgxpool.Pool, courseCode, labsRepoPath string) erro
 			} else {
 				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "schema_version", "Missing schema_version value", "Defaulting to 1.0.0. Provide a version like '1.0.0'")
 			}
-			metadata.SchemaVersion = examBankVersion
 		case "min_questions":
 			val, err := strconv.Atoi(secondCol)
 			if err != nil || val <= 0 {
 				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "min_questions", "Invalid value", "Must be a positive integer.")
-				return fmt.Errorf("invalid min_questions at line %d for %s", i+1, courseCode)
+				return nil, fmt.Errorf("invalid min_questions at line %d for %s", i+1, courseCode)
 			}
 			metadata.MinQuestions = val
 		case "max_questions":
 			val, err := strconv.Atoi(secondCol)
 			if err != nil || val <= 0 {
 				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "max_questions", "Invalid value", "Must be a positive integer.")
-				return fmt.Errorf("invalid max_questions at line %d for %s", i+1, courseCode)
+				return nil, fmt.Errorf("invalid max_questions at line %d for %s", i+1, courseCode)
 			}
 			metadata.MaxQuestions = val
 		case "exam_time":
 			val, err := strconv.Atoi(secondCol)
 			if err != nil || val <= 0 {
 				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "exam_time", "Invalid value", "Must be a positive integer (minutes).")
-				return fmt.Errorf("invalid exam_time at line %d for %s", i+1, courseCode)
+				return nil, fmt.Errorf("invalid exam_time at line %d for %s", i+1, courseCode)
 			}
 			metadata.ExamTime = val
 		case "passing_score":
 			val, err := strconv.ParseFloat(secondCol, 64)
 			if err != nil || val < 0 || val > 100 {
 				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "passing_score", "Invalid value", "Must be a float between 0 and 100.")
-				return fmt.Errorf("invalid passing_score at line %d for %s", i+1, courseCode)
+				return nil, fmt.Errorf("invalid passing_score at line %d for %s", i+1, courseCode)
 			}
 			metadata.PassingScore = val
 		case "domains":
 			parsedDomains, err := utils.ParseDomainWeights(secondCol)
 			if err != nil {
 				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "domains", "Invalid domain format or weights", fmt.Sprintf("Format: 'Name:Weight|Name:Weight'. Weights must sum to 1.0. Error: %v", err))
-				return fmt.Errorf("invalid domains at line %d for %s: %w", i+1, courseCode, err)
+				return nil, fmt.Errorf("invalid domains at line %d for %s: %w", i+1, courseCode, err)
 			}
 			metadata.Domains = parsedDomains
-			// Insert domains into DB
-			for domainName := range parsedDomains {
-				var id int
-				err := tx.QueryRow(context.Background(), `
-					INSERT INTO domains (course_id, name) VALUES ($1, $2)
-					ON CONFLICT (course_id, name) DO UPDATE SET name = EXCLUDED.name
-					RETURNING id
-				`, courseID, domainName).Scan(&id)
-				if err != nil {
-					db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "domain_db_insert", "Failed to insert domain", fmt.Sprintf("Database error: %v", err))
-					return fmt.Errorf("failed to upsert domain %s for %s: %w", domainName, courseCode, err)
-				}
-				domainMap[domainName] = id
+			bank.DomainsLine = i + 1
+		case "allow_practice", "allow_simulation":
+			val, err := strconv.ParseBool(secondCol)
+			if err != nil {
+				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, firstCol, "Invalid value", "Must be TRUE or FALSE.")
+				return nil, fmt.Errorf("invalid %s at line %d for %s", firstCol, i+1, courseCode)
 			}
-		default:
-			// If not a recognized metadata row, it must be the start of questions.
-			// This break will leave lineOffset at the current row index.
-			lineOffset = i
-			break
+			if firstCol == "allow_practice" {
+				metadata.AllowPractice = val
+			} else {
+				metadata.AllowSimulation = val
+			}
+		case "target_exam_count":
+			val, err := strconv.Atoi(secondCol)
+			if err != nil || val <= 0 {
+				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "target_exam_count", "Invalid value", "Must be a positive integer.")
+				return nil, fmt.Errorf("invalid target_exam_count at line %d for %s", i+1, courseCode)
+			}
+			metadata.TargetExamCount = val
+		case "penalty_per_wrong":
+			val, err := strconv.ParseFloat(secondCol, 64)
+			if err != nil || val < 0 || val > 1 {
+				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "penalty_per_wrong", "Invalid value", "Must be a float between 0 and 1.")
+				return nil, fmt.Errorf("invalid penalty_per_wrong at line %d for %s", i+1, courseCode)
+			}
+			metadata.PenaltyPerWrong = val
+		case "fuzzy_accept_distance":
+			val, err := strconv.Atoi(secondCol)
+			if err != nil || val < 0 || val > MaxFuzzyAcceptDistance {
+				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "fuzzy_accept_distance", "Invalid value", fmt.Sprintf("Must be an integer between 0 and %d.", MaxFuzzyAcceptDistance))
+				return nil, fmt.Errorf("invalid fuzzy_accept_distance at line %d for %s", i+1, courseCode)
+			}
+			metadata.FuzzyAcceptDistance = val
+		case "instructions":
+			if len(secondCol) > MaxInstructionsLength {
+				db.LogError(pool, sourceName, courseCode, examBankCSVPath, i+1, "instructions", "Instructions too long", fmt.Sprintf("Keep the instructions to at most %d characters.", MaxInstructionsLength))
+				return nil, fmt.Errorf("instructions longer than %d characters at line %d for %s", MaxInstructionsLength, i+1, courseCode)
+			}
+			metadata.Instructions = secondCol
 		}
 	}
-	if metadata.MinQuestions == 0 || metadata.MaxQuestions == 0 || metadata.ExamTime == 0 || metadata.PassingScore == 0 || metadata.Domains == nil {
-		db.LogError(pool, sourceName, courseCode, examBankCSVPath, 0, "", "Missing critical exam metadata", "Ensure min_questions, max_questions, exam_time, passing_score, and domains are defined.")
-		return fmt.Errorf("missing critical exam metadata for %s", courseCode)
+	if requireHeader && !headerDeclared {
+		db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineOffset+1, "header", "Missing declared header", fmt.Sprintf("The require_csv_header setting is enabled. Add a header row after the metadata rows: %s", strings.Join(csvColumnsFor(examBankVersion), ",")))
+		return nil, fmt.Errorf("missing declared header in exam_bank.csv for %s", courseCode)
 	}
+	metadata.SchemaVersion = examBankVersion
+	bank.Metadata = metadata
 	// Process question rows
 	for i := lineOffset; i < len(rows); i++ {
 		row := rows[i]
-		lineNum := i + 1 // CSV line number
-		// Parse into ExamBankQuestion struct for easier access
-		csvHeaders := []string{
-			"question_type", "domain", "question_text", "explanation", "image_url", "code_block", "input_method",
-			"choice_1", "correct_1", "explain_1",
-			"choice_2", "correct_2", "explain_2",
-			"choice_3", "correct_3", "explain_3",
-			"choice_4", "correct_4", "explain_4",
-			"choice_5", "correct_5", "explain_5",
-			"choice_6", "correct_6", "explain_6",
-			"acceptable_answers",
-		}
 		// Create a map from header to value
 		rowMap := make(map[string]string)
 		for j, header := range csvHeaders {
 			if j < len(row) {
+				if header == "code_block" {
+					rowMap[header] = row[j] // Untrimmed: buildQuestion tidies code blocks
+					continue
+				}
 				rowMap[header] = strings.TrimSpace(row[j])
 			}
 		}
-		qType := rowMap["question_type"]
-		qText := rowMap["question_text"]
-		explanation := rowMap["explanation"]
-		domainName := rowMap["domain"]
-		imageURL := utils.StringPtr(rowMap["image_url"])
-		codeBlock := utils.StringPtr(rowMap["code_block"])
-		inputMethod := utils.StringPtr(rowMap["input_method"])
-		acceptableAnswers := rowMap["acceptable_answers"]
-		// Basic validation for required fields
-		if qText == "" || explanation == "" || domainName == "" {
-			db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "", "Missing required field", "question_text, explanation, and domain are required for all question types.")
-			return fmt.Errorf("missing required field at line %d for %s", lineNum, courseCode)
-		}
-		if questionTexts[qText] {
-			db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "question_text", "Duplicate question text", "Question text must be unique within an exam bank version.")
-			return fmt.Errorf("duplicate question text at line %d for %s: %s", lineNum, courseCode, qText)
-		}
-		questionTexts[qText] = true
-		domainID, ok := domainMap[domainName]
-		if !ok {
-			db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "domain", "Domain not defined in metadata", fmt.Sprintf("Domain '%s' must be specified in the 'domains' metadata row.", domainName))
-			return fmt.Errorf("invalid domain '%s' at line %d for %s", domainName, lineNum, courseCode)
-		}
-		question := models.Question{
-			DomainID:        domainID,
-			QuestionText:    qText,
-			Explanation:     explanation,
-			QuestionType:    qType,
-			ImageURL:        imageURL,
-			CodeBlock:       codeBlock,
-			ExamBankVersion: examBankVersion,
-		}
-		var hasCorrectAnswer bool
-		switch qType {
-		case "single", "multi", "truefalse":
-			var choices []models.Choice
-			for j := 1; j <= 6; j++ {
-				choiceText := rowMap[fmt.Sprintf("choice_%d", j)]
-				correctFlag := rowMap[fmt.Sprintf("correct_%d", j)]
-				explainChoice := rowMap[fmt.Sprintf("explain_%d", j)]
-				if choiceText != "" {
-					isCorrect := strings.ToLower(correctFlag) == "true"
-					if isCorrect {
-						hasCorrectAnswer = true
-					}
-					choices = append(choices, models.Choice{
-						ChoiceText:  choiceText,
-						IsCorrect:   isCorrect,
-						Explanation: explainChoice,
-						Order:       string('A' + j - 1), // Assign A, B, C...
-					})
-				}
+		bq := bankQuestion{
+			LineNumber:   i + 1, // CSV line number
+			QuestionType: rowMap["question_type"],
+			Domain:       rowMap["domain"],
+			QuestionText: rowMap["question_text"],
+			Explanation:  rowMap["explanation"],
+			ImageURL:     rowMap["image_url"],
+			CodeBlock:    rowMap["code_block"],
+			InputMethod:  rowMap["input_method"],
+			ExactSelect:  rowMap["exact_select"],
+			ContextHints: rowMap["context_hints"],
+			Draft:        rowMap["draft"],
+			AllowFeedbackInSimulation: rowMap["allow_feedback_in_simulation"],
+			Hint:         strings.TrimSpace(rowMap["hint"]),
+			IgnoreFlagOrder: rowMap["ignore_flag_order"],
+			CodeLanguage: rowMap["code_language"],
+		}
+		for j := 1; j <= 6; j++ {
+			choiceText := rowMap[fmt.Sprintf("choice_%d", j)]
+			if choiceText == "" {
+				continue
+			}
+			correct := rowMap[fmt.Sprintf("correct_%d", j)]
+			choice := bankChoice{
+				Column:      j,
+				Text:        choiceText,
+				IsCorrect:   strings.ToLower(correct) == "true",
+				Explanation: rowMap[fmt.Sprintf("explain_%d", j)],
+			}
+			if bq.QuestionType == "ordering" {
+				choice.IsCorrect, choice.Position = false, correct // correct_N is the item's expected position
+			}
+			if bq.QuestionType == "matching" {
+				// choice_N holds a pair as left::right
+				left, right, _ := strings.Cut(choiceText, matchSeparator)
+				choice.Text, choice.Match, choice.IsCorrect = strings.TrimSpace(left), strings.TrimSpace(right), false
+			}
+			bq.Choices = append(bq.Choices, choice)
+		}
+		if acceptableAnswers := rowMap["acceptable_answers"]; acceptableAnswers != "" {
+			bq.AcceptableAnswers = strings.Split(acceptableAnswers, "|")
+		}
+		bank.Questions = append(bank.Questions, bq)
+	}
+	return bank, nil
+}
+// buildQuestion validates a single exam bank entry and converts it into a question ready for persistence.
+func buildQuestion(ctx context.Context, pool *pgxpool.Pool, courseCode string, bank *examBank, bq bankQuestion, domainMap map[string]int, questionTexts map[string]bool, examBankVersion string) (models.Question, error) {
+	filePath := bank.FilePath
+	lineNum := bq.LineNumber
+	loc := bank.location(lineNum)
+	qType := bq.QuestionType
+	qText := bq.QuestionText
+	explanation := bq.Explanation
+	domainName := bq.Domain
+	imageURL := utils.StringPtr(bq.ImageURL)
+	// Code blocks are trimmed, or with the normalize_code_blocks setting dedented and tidied line by line
+	code := strings.TrimSpace(bq.CodeBlock)
+	if db.GetSettingBool(pool, "normalize_code_blocks", false) {
+		code = utils.NormalizeCodeBlock(bq.CodeBlock)
+	}
+	codeBlock := utils.StringPtr(code)
+	inputMethod := utils.StringPtr(bq.InputMethod)
+	// Basic validation for required fields
+	if qText == "" || explanation == "" || domainName == "" {
+		db.LogError(pool, sourceName, courseCode, filePath, lineNum, "", "Missing required field", "question_text, explanation, and domain are required for all question types.")
+		return models.Question{}, fmt.Errorf("missing required field at %s for %s", loc, courseCode)
+	}
+	if questionTexts[qText] {
+		fix := "Question text must be unique within an exam bank file."
+		if scope := loadDuplicateQuestionScope(ctx, pool); scope != DuplicateScopeFile {
+			fix = fmt.Sprintf("Question text must be unique across all exam banks of the course while duplicate_question_scope is '%s'.", scope)
+		}
+		db.LogError(pool, sourceName, courseCode, filePath, lineNum, "question_text", "Duplicate question text", fix)
+		return models.Question{}, fmt.Errorf("duplicate question text at %s for %s: %s", loc, courseCode, qText)
+	}
+	questionTexts[qText] = true
+	domainID, ok := domainMap[domainName]
+	if !ok {
+		db.LogError(pool, sourceName, courseCode, filePath, lineNum, "domain", "Domain not defined in metadata", fmt.Sprintf("Domain '%s' must be specified in the 'domains' metadata row; list it with weight 0 to store its questions without selecting them, or set unweighted_domain_policy to 'holding'.", domainName))
+		return models.Question{}, fmt.Errorf("invalid domain '%s' at %s for %s", domainName, loc, courseCode)
+	}
+	question := models.Question{
+		DomainID:        domainID,
+		QuestionText:    qText,
+		Explanation:     explanation,
+		QuestionType:    qType,
+		ImageURL:        imageURL,
+		CodeBlock:       codeBlock,
+		ExamBankVersion: examBankVersion,
+	}
+	if bq.Draft != "" {
+		draft, err := strconv.ParseBool(bq.Draft)
+		if err != nil {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "draft", "Invalid draft", "Must be TRUE, FALSE, or empty.")
+			return models.Question{}, fmt.Errorf("invalid draft '%s' at %s for %s", bq.Draft, loc, courseCode)
+		}
+		question.Draft = draft
+	}
+	if bq.AllowFeedbackInSimulation != "" {
+		allowFeedback, err := strconv.ParseBool(bq.AllowFeedbackInSimulation)
+		if err != nil {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "allow_feedback_in_simulation", "Invalid allow_feedback_in_simulation", "Must be TRUE, FALSE, or empty.")
+			return models.Question{}, fmt.Errorf("invalid allow_feedback_in_simulation '%s' at %s for %s", bq.AllowFeedbackInSimulation, loc, courseCode)
+		}
+		question.AllowFeedbackInSimulation = allowFeedback
+	}
+	if len(bq.Hint) > maxHintLength {
+		db.LogError(pool, sourceName, courseCode, filePath, lineNum, "hint", "Hint too long", fmt.Sprintf("Keep the hint to at most %d characters.", maxHintLength))
+		return models.Question{}, fmt.Errorf("hint longer than %d characters at %s for %s", maxHintLength, loc, courseCode)
+	}
+	question.Hint = utils.StringPtr(bq.Hint)
+	if bq.IgnoreFlagOrder != "" {
+		ignoreFlagOrder, err := strconv.ParseBool(bq.IgnoreFlagOrder)
+		if err != nil {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "ignore_flag_order", "Invalid ignore_flag_order", "Must be TRUE, FALSE, or empty.")
+			return models.Question{}, fmt.Errorf("invalid ignore_flag_order '%s' at %s for %s", bq.IgnoreFlagOrder, loc, courseCode)
+		}
+		if ignoreFlagOrder && (qType != "fillblank" || inputMethod == nil || *inputMethod != "terminal") {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "ignore_flag_order", "ignore_flag_order requires a terminal fill-in-the-blank question", "Set input_method to terminal, or leave ignore_flag_order empty.")
+			return models.Question{}, fmt.Errorf("ignore_flag_order on a non-terminal question at %s for %s", loc, courseCode)
+		}
+		question.IgnoreFlagOrder = ignoreFlagOrder
+	}
+	codeLanguage := strings.ToLower(bq.CodeLanguage)
+	if codeLanguage != "" {
+		if codeBlock == nil {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "code_language", "code_language requires a code_block", "Provide a code_block, or leave code_language empty.")
+			return models.Question{}, fmt.Errorf("code_language without a code_block at %s for %s", loc, courseCode)
+		}
+		if !codeLanguagePattern.MatchString(codeLanguage) {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "code_language", "Invalid code_language", "Use a short language name such as bash, python, yaml or json.")
+			return models.Question{}, fmt.Errorf("invalid code_language '%s' at %s for %s", bq.CodeLanguage, loc, courseCode)
+		}
+	} else if codeBlock != nil && db.GetSettingBool(pool, "detect_code_language", false) {
+		codeLanguage = utils.DetectCodeLanguage(*codeBlock)
+	}
+	question.CodeLanguage = utils.StringPtr(codeLanguage)
+	var hasCorrectAnswer bool
+	switch qType {
+	case "single", "multi", "truefalse":
+		// input_method only applies to fillblank; it is never stored for other types
+		if inputMethod != nil {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "input_method", "input_method is only valid for fillblank questions", "Remove input_method or change question_type to 'fillblank'.")
+			return models.Question{}, fmt.Errorf("input_method set on non-fillblank question at %s for %s", loc, courseCode)
+		}
+		var choices []models.Choice
+		for _, bc := range bq.Choices {
+			if bc.IsCorrect {
+				hasCorrectAnswer = true
 			}
-			if len(choices) == 0 {
-				db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "choices", "No choices provided for MCQ", "Single/Multi-choice questions require at least one choice.")
-				return fmt.Errorf("no choices for MCQ at line %d for %s", lineNum, courseCode)
-			}
-			if !hasCorrectAnswer {
-				db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "correct_flag", "No correct answer marked for MCQ", "At least one choice must be marked TRUE for correctness.")
-				return fmt.Errorf("no correct answer for MCQ at line %d for %s", lineNum, courseCode)
-			}
-			question.Choices = choices
-		case "fillblank":
-			if acceptableAnswers == "" {
-				db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "acceptable_answers", "Missing acceptable answers for fill-in-the-blank", "Fill-in-the-blank questions require pipe-separated acceptable answers.")
-				return fmt.Errorf("missing acceptable_answers at line %d for %s", lineNum, courseCode)
-			}
-			question.AcceptableAnswers = strings.Split(acceptableAnswers, "|")
-			hasCorrectAnswer = true // Fillblank always has "correct" answers if acceptable_answers is not empty
-			if inputMethod != nil && *inputMethod != "" {
-				lowerInputMethod := strings.ToLower(*inputMethod)
-				if lowerInputMethod != "text" && lowerInputMethod != "terminal" {
-					db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "input_method", "Invalid input_method", "Must be 'text', 'terminal', or empty (defaults to 'text').")
-					return fmt.Errorf("invalid input_method '%s' at line %d for %s", *inputMethod, lineNum, courseCode)
+			choices = append(choices, models.Choice{
+				ChoiceText:  bc.Text,
+				IsCorrect:   bc.IsCorrect,
+				Explanation: bc.Explanation,
+				Order:       bc.Letter(), // A, B, C... by column
+			})
+		}
+		if err := checkDistinctChoices(ctx, pool, courseCode, filePath, lineNum, loc, choices); err != nil {
+			return models.Question{}, err
+		}
+		if len(choices) == 0 {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "choices", "No choices provided for MCQ", "Single/Multi-choice questions require at least one choice.")
+			return models.Question{}, fmt.Errorf("no choices for MCQ at %s for %s", loc, courseCode)
+		}
+		if !hasCorrectAnswer && !question.Draft {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "correct_flag", "No correct answer marked for MCQ", "At least one choice must be marked TRUE for correctness.")
+			return models.Question{}, fmt.Errorf("no correct answer for MCQ at %s for %s", loc, courseCode)
+		}
+		question.Choices = choices
+		if bq.ExactSelect != "" {
+			if qType != "multi" {
+				db.LogError(pool, sourceName, courseCode, filePath, lineNum, "exact_select", "exact_select is only valid for multi questions", "Remove exact_select or change question_type to 'multi'.")
+				return models.Question{}, fmt.Errorf("exact_select set on non-multi question at %s for %s", loc, courseCode)
+			}
+			correctCount := 0
+			for _, choice := range choices {
+				if choice.IsCorrect {
+					correctCount++
 				}
-				question.InputMethod = &lowerInputMethod
-			} else {
-				// Default to 'text' if empty or omitted in CSV
-				defaultMethod := "text"
-				question.InputMethod = &defaultMethod
 			}
-		default:
-			db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "question_type", "Unknown question type", "Must be 'single', 'multi', 'truefalse', or 'fillblank'.")
-			return fmt.Errorf("unknown question type '%s' at line %d for %s", qType, lineNum, courseCode)
+			exactSelect, err := strconv.Atoi(bq.ExactSelect)
+			if err != nil || exactSelect < 1 || exactSelect > correctCount {
+				db.LogError(pool, sourceName, courseCode, filePath, lineNum, "exact_select", "Invalid exact_select", fmt.Sprintf("Must be an integer between 1 and the number of correct choices (%d).", correctCount))
+				return models.Question{}, fmt.Errorf("invalid exact_select '%s' at %s for %s", bq.ExactSelect, loc, courseCode)
+			}
+			question.ExactSelect = &exactSelect
+		}
+	case "fillblank":
+		if len(bq.AcceptableAnswers) == 0 && !question.Draft {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "acceptable_answers", "Missing acceptable answers for fill-in-the-blank", "Fill-in-the-blank questions require pipe-separated acceptable answers.")
+			return models.Question{}, fmt.Errorf("missing acceptable_answers at %s for %s", loc, courseCode)
+		}
+		question.AcceptableAnswers = bq.AcceptableAnswers
+		hasCorrectAnswer = len(bq.AcceptableAnswers) > 0
+		if inputMethod != nil && *inputMethod != "" {
+			lowerInputMethod := strings.ToLower(*inputMethod)
+			if lowerInputMethod != "text" && lowerInputMethod != "terminal" {
+				db.LogError(pool, sourceName, courseCode, filePath, lineNum, "input_method", "Invalid input_method", "Must be 'text', 'terminal', or empty (defaults to 'text').")
+				return models.Question{}, fmt.Errorf("invalid input_method '%s' at %s for %s", *inputMethod, loc, courseCode)
+			}
+			question.InputMethod = &lowerInputMethod
+		} else {
+			// Default to 'text' if empty or omitted in CSV
+			defaultMethod := "text"
+			question.InputMethod = &defaultMethod
+		}
+		for _, answer := range bq.AcceptableAnswers {
+			pattern, ok := strings.CutPrefix(strings.TrimSpace(answer), utils.RegexAnswerPrefix)
+			if !ok {
+				continue
+			}
+			if *question.InputMethod != "terminal" {
+				db.LogError(pool, sourceName, courseCode, filePath, lineNum, "acceptable_answers", "Regex acceptable answers require a terminal question", "Set input_method to terminal, or remove the 're:' prefix.")
+				return models.Question{}, fmt.Errorf("regex acceptable answer on a non-terminal question at %s for %s", loc, courseCode)
+			}
+			if _, err := utils.CompileAnswerPattern(pattern); err != nil {
+				db.LogError(pool, sourceName, courseCode, filePath, lineNum, "acceptable_answers", "Invalid regex acceptable answer", fmt.Sprintf("Fix the pattern '%s': %v", pattern, err))
+				return models.Question{}, fmt.Errorf("invalid regex acceptable answer '%s' at %s for %s: %w", pattern, loc, courseCode, err)
+			}
 		}
-		if !hasCorrectAnswer {
-			db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "", "Question has no valid correct answer definition", "Ensure at least one choice is TRUE for MCQ or acceptable_answers is present for fillblank.")
-			return fmt.Errorf("question at line %d has no correct answer definition for %s", lineNum, courseCode)
+	case "ordering":
+		// Choices are the items to arrange; correct_N holds each item's expected position (1 = first).
+		// Without any positions the items are expected in the order listed.
+		if inputMethod != nil {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "input_method", "input_method is only valid for fillblank questions", "Remove input_method or change question_type to 'fillblank'.")
+			return models.Question{}, fmt.Errorf("input_method set on non-fillblank question at %s for %s", loc, courseCode)
 		}
-		// Add image_url and code_block validation (e.g., HTTP HEAD for image_url)
-		if imageURL != nil && *imageURL != "" {
-			// In a real system: Perform HTTP HEAD request to validate image URL
-			// For now, simple URL format check
-			if !strings.HasPrefix(*imageURL, "http://") && !strings.HasPrefix(*imageURL, "https://") {
-				db.LogError(pool, sourceName, courseCode, examBankCSVPath, lineNum, "image_url", "Invalid image URL format", "Must be a valid HTTP/S URL.")
-				return fmt.Errorf("invalid image_url '%s' at line %d for %s", *imageURL, lineNum, courseCode)
+		if len(bq.Choices) < 2 {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "choices", "Too few items for ordering question", "Ordering questions require at least two items in the choice columns.")
+			return models.Question{}, fmt.Errorf("fewer than two items for ordering question at %s for %s", loc, courseCode)
+		}
+		positions := make([]int, len(bq.Choices))
+		seenPositions := make(map[int]bool, len(bq.Choices))
+		authored := 0
+		for j, bc := range bq.Choices {
+			if bc.Position == "" {
+				positions[j] = j + 1
+				continue
+			}
+			position, err := strconv.Atoi(bc.Position)
+			if err != nil || position < 1 || position > len(bq.Choices) || seenPositions[position] {
+				db.LogError(pool, sourceName, courseCode, filePath, lineNum, fmt.Sprintf("correct_%d", bc.Column), "Invalid ordering position", fmt.Sprintf("Give each item a distinct position from 1 to %d, or leave every position empty to use the listed order.", len(bq.Choices)))
+				return models.Question{}, fmt.Errorf("invalid ordering position '%s' at %s for %s", bc.Position, loc, courseCode)
 			}
+			positions[j] = position
+			seenPositions[position] = true
+			authored++
+		}
+		if authored > 0 && authored < len(bq.Choices) {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "correct_flag", "Incomplete ordering positions", "Give every item a position, or leave every position empty to use the listed order.")
+			return models.Question{}, fmt.Errorf("incomplete ordering positions at %s for %s", loc, courseCode)
+		}
+		var choices []models.Choice
+		for j, bc := range bq.Choices {
+			position := positions[j]
+			choices = append(choices, models.Choice{
+				ChoiceText:  bc.Text,
+				Explanation: bc.Explanation,
+				Order:       bc.Letter(),
+				Position:    &position,
+			})
+		}
+		if err := checkDistinctChoices(ctx, pool, courseCode, filePath, lineNum, loc, choices); err != nil {
+			return models.Question{}, err
+		}
+		question.Choices = choices
+		hasCorrectAnswer = true
+	case "matching":
+		// Choices are the left-hand prompts, each with the right-hand response it pairs with
+		if inputMethod != nil {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "input_method", "input_method is only valid for fillblank questions", "Remove input_method or change question_type to 'fillblank'.")
+			return models.Question{}, fmt.Errorf("input_method set on non-fillblank question at %s for %s", loc, courseCode)
+		}
+		if len(bq.Choices) < 2 {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "choices", "Too few pairs for matching question", "Matching questions require at least two pairs in the choice columns, written as left::right.")
+			return models.Question{}, fmt.Errorf("fewer than two pairs for matching question at %s for %s", loc, courseCode)
+		}
+		var choices []models.Choice
+		matchTexts := make(map[string]int, len(bq.Choices))
+		for _, bc := range bq.Choices {
+			column := fmt.Sprintf("choice_%d", bc.Column)
+			if bc.Text == "" || bc.Match == "" {
+				db.LogError(pool, sourceName, courseCode, filePath, lineNum, column, "Incomplete matching pair", "Write each pair as left::right with text on both sides.")
+				return models.Question{}, fmt.Errorf("incomplete matching pair at %s for %s", loc, courseCode)
+			}
+			// A repeated response would make two pairings indistinguishable to the student
+			key := strings.ToLower(bc.Match)
+			if first, dup := matchTexts[key]; dup {
+				db.LogError(pool, sourceName, courseCode, filePath, lineNum, column, fmt.Sprintf("Duplicate matching response: pair %d repeats the response of pair %d", bc.Column, first), "Give every pair of a question a distinct right-hand response.")
+				return models.Question{}, fmt.Errorf("duplicate matching response '%s' at %s for %s", bc.Match, loc, courseCode)
+			}
+			matchTexts[key] = bc.Column
+			choices = append(choices, models.Choice{
+				ChoiceText:  bc.Text,
+				Explanation: bc.Explanation,
+				Order:       bc.Letter(),
+				MatchText:   bc.Match,
+			})
+		}
+		if err := checkDistinctChoices(ctx, pool, courseCode, filePath, lineNum, loc, choices); err != nil {
+			return models.Question{}, err
+		}
+		question.Choices = choices
+		hasCorrectAnswer = true
+	default:
+		db.LogError(pool, sourceName, courseCode, filePath, lineNum, "question_type", "Unknown question type", "Must be 'single', 'multi', 'truefalse', 'fillblank', 'ordering', or 'matching'.")
+		return models.Question{}, fmt.Errorf("unknown question type '%s' at %s for %s", qType, loc, courseCode)
+	}
+	if !hasCorrectAnswer && !question.Draft {
+		db.LogError(pool, sourceName, courseCode, filePath, lineNum, "", "Question has no valid correct answer definition", "Ensure at least one choice is TRUE for MCQ or acceptable_answers is present for fillblank.")
+		return models.Question{}, fmt.Errorf("question at %s has no correct answer definition for %s", loc, courseCode)
+	}
+	if bq.ContextHints != "" {
+		contextHints, err := strconv.ParseBool(bq.ContextHints)
+		if err != nil {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "context_hints", "Invalid context_hints", "Must be TRUE, FALSE, or empty.")
+			return models.Question{}, fmt.Errorf("invalid context_hints '%s' at %s for %s", bq.ContextHints, loc, courseCode)
+		}
+		if contextHints && (qType != "fillblank" || *question.InputMethod != "terminal" || codeBlock == nil) {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "context_hints", "context_hints requires a terminal fillblank question with a code_block", "Remove context_hints, or set input_method to 'terminal' and provide a code_block.")
+			return models.Question{}, fmt.Errorf("context_hints set on unsupported question at %s for %s", loc, courseCode)
+		}
+		question.ContextHints = contextHints
+	}
+	// image_url must be an HTTP/S URL; reachability is checked by checkImageURLs when enabled
+	if imageURL != nil && *imageURL != "" {
+		if !strings.HasPrefix(*imageURL, "http://") && !strings.HasPrefix(*imageURL, "https://") {
+			db.LogError(pool, sourceName, courseCode, filePath, lineNum, "image_url", "Invalid image URL format", "Must be a valid HTTP/S URL.")
+			return models.Question{}, fmt.Errorf("invalid image_url '%s' at %s for %s", *imageURL, loc, courseCode)
+		}
+	}
+	return question, nil
+}
+// checkDistinctChoices logs every choice whose text repeats an earlier choice of the question, ignoring case
+// and surrounding space, and fails unless the duplicate_choice_severity setting is "warning".
+func checkDistinctChoices(ctx context.Context, pool *pgxpool.Pool, courseCode, filePath string, lineNum int, loc string, choices []models.Choice) error {
+	choiceTexts := make(map[string]int, len(choices))
+	for j, choice := range choices {
+		key := strings.ToLower(strings.TrimSpace(choice.ChoiceText))
+		first, dup := choiceTexts[key]
+		if !dup {
+			choiceTexts[key] = j
+			continue
+		}
+		db.LogError(pool, sourceName, courseCode, filePath, lineNum, fmt.Sprintf("choice_%d", int(choice.Order[0]-'A')+1), fmt.Sprintf("Duplicate choice text: choice %s repeats choice %s", choice.Order, choices[first].Order), "Give every choice of a question distinct text.")
+		if loadSeverity(ctx, pool, "duplicate_choice_severity") == severityError {
+			return fmt.Errorf("duplicate choice text '%s' at %s for %s", choice.ChoiceText, loc, courseCode)
+		}
+	}
+	return nil
+}
+// relinkQuestionNotes attaches the course's instructor notes to its questions of versions (one per bank)
+// with the note's question text and bank, so notes survive the questions being deleted and re-inserted.
+// Notes whose question is no longer in any bank keep a NULL question_id until the text returns.
+func relinkQuestionNotes(ctx context.Context, tx pgx.Tx, courseID int, versions []string) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE question_notes n SET question_id = q.id
+		FROM questions q JOIN domains d ON q.domain_id = d.id
+		WHERE n.course_id = $1 AND d.course_id = n.course_id AND q.question_text = n.question_text
+			AND split_part(q.exam_bank_version, '+', 2) = n.bank_name AND q.exam_bank_version = ANY($2)
+	`, courseID, versions)
+	if err != nil {
+		return fmt.Errorf("failed to relink question notes for course %d: %w", courseID, err)
+	}
+	return nil
+}
+// questionKey identifies a question across re-ingestion, when it is re-inserted with a new ID and possibly a
+// new exam_bank_version: the course's questions are unique by bank and text.
+type questionKey struct {
+	BankName     string
+	QuestionText string
+}
+// snapshotValidityScores returns the validity scores of the course's questions before re-ingestion deletes
+// them. When a bank has several versions of a question, the most recently inserted one's score is kept.
+func snapshotValidityScores(ctx context.Context, tx pgx.Tx, courseID int) (map[questionKey]float64, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT split_part(q.exam_bank_version, '+', 2), q.question_text, q.validity_score
+		FROM questions q JOIN domains d ON q.domain_id = d.id
+		WHERE d.course_id = $1 AND q.validity_score IS NOT NULL
+		ORDER BY q.id
+	`, courseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query validity scores for course %d: %w", courseID, err)
+	}
+	defer rows.Close()
+	scores := make(map[questionKey]float64)
+	for rows.Next() {
+		var key questionKey
+		var score float64
+		if err := rows.Scan(&key.BankName, &key.QuestionText, &score); err != nil {
+			return nil, fmt.Errorf("failed to scan validity score for course %d: %w", courseID, err)
+		}
+		scores[key] = score
+	}
+	return scores, rows.Err()
+}
+// restoreValidityScores sets the scores of snapshotValidityScores on the course's questions of versions
+// (one per bank) with the same bank and text.
+func restoreValidityScores(ctx context.Context, tx pgx.Tx, courseID int, versions []string, scores map[questionKey]float64) error {
+	if len(scores) == 0 {
+		return nil
+	}
+	bankNames := make([]string, 0, len(scores))
+	questionTexts := make([]string, 0, len(scores))
+	values := make([]float64, 0, len(scores))
+	for key, score := range scores {
+		bankNames = append(bankNames, key.BankName)
+		questionTexts = append(questionTexts, key.QuestionText)
+		values = append(values, score)
+	}
+	_, err := tx.Exec(ctx, `
+		UPDATE questions q SET validity_score = s.score
+		FROM domains d, unnest($3::text[], $4::text[], $5::float8[]) AS s(bank_name, question_text, score)
+		WHERE q.domain_id = d.id AND d.course_id = $1 AND q.exam_bank_version = ANY($2)
+			AND split_part(q.exam_bank_version, '+', 2) = s.bank_name AND q.question_text = s.question_text
+	`, courseID, versions, bankNames, questionTexts, values)
+	if err != nil {
+		return fmt.Errorf("failed to restore validity scores for course %d: %w", courseID, err)
+	}
+	return nil
+}
+// checkOtherCoursesQuestionTexts enforces the global duplicate_question_scope for a bank: each question
+// whose text is used by a question of another course, in any exam_bank_version, is logged at its line, and
+// the bank fails if there is any.
+func checkOtherCoursesQuestionTexts(ctx context.Context, tx pgx.Tx, pool *pgxpool.Pool, courseID int, courseCode string, bank *examBank) error {
+	texts := make([]string, 0, len(bank.Questions))
+	for _, bq := range bank.Questions {
+		texts = append(texts, bq.QuestionText)
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT q.question_text, MIN(c.course_code)
+		FROM questions q JOIN courses c ON q.course_id = c.id
+		WHERE q.course_id <> $1 AND q.question_text = ANY($2)
+		GROUP BY q.question_text
+	`, courseID, texts)
+	if err != nil {
+		return fmt.Errorf("failed to check question texts of other courses for %s: %w", courseCode, err)
+	}
+	usedBy := make(map[string]string)
+	for rows.Next() {
+		var text, otherCourse string
+		if err := rows.Scan(&text, &otherCourse); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan question text of another course for %s: %w", courseCode, err)
 		}
-		questionsToSave = append(questionsToSave, question)
+		usedBy[text] = otherCourse
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check question texts of other courses for %s: %w", courseCode, err)
 	}
-	// Persist questions and choices/answers within the transaction
-	for _, q := range questionsToSave {
+	if len(usedBy) == 0 {
+		return nil
+	}
+	for _, bq := range bank.Questions {
+		if otherCourse, ok := usedBy[bq.QuestionText]; ok {
+			db.LogError(pool, sourceName, courseCode, bank.FilePath, bq.LineNumber, "question_text", "Question text used by another course", fmt.Sprintf("Question text must be unique across all courses while duplicate_question_scope is 'global'; course %s already has this question.", otherCourse))
+		}
+	}
+	return fmt.Errorf("%d question texts of %s are already used by other courses", len(usedBy), courseCode)
+}
+// persistQuestions inserts or updates questions with their choices and acceptable answers inside tx.
+// It is the shared persistence path for CSV ingestion and question bank imports.
+func persistQuestions(ctx context.Context, tx pgx.Tx, pool *pgxpool.Pool, courseCode string, questions []models.Question) error {
+	locale := db.AnswerLocale(pool)
+	for _, q := range questions {
 		var questionID int
-		err := tx.QueryRow(context.Background(), `
-			INSERT INTO questions (domain_id, question_text, explanation, question_type, image_url, code_block, input_method, exam_bank_version)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			ON CONFLICT (question_text, exam_bank_version) DO UPDATE SET -- Update if duplicate question_text for same version
+		err := tx.QueryRow(ctx, `
+			INSERT INTO questions (domain_id, course_id, question_text, explanation, question_type, image_url, code_block, input_method, exam_bank_version, exact_select, context_hints, draft, allow_feedback_in_simulation, hint, ignore_flag_order, code_language)
+			VALUES ($1, (SELECT course_id FROM domains WHERE id = $1), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			ON CONFLICT (course_id, question_text, exam_bank_version) DO UPDATE SET -- Update if duplicate question_text for same course and version
 				domain_id = EXCLUDED.domain_id,
 				explanation = EXCLUDED.explanation,
 				question_type = EXCLUDED.question_type,
 				image_url = EXCLUDED.image_url,
 				code_block = EXCLUDED.code_block,
-				input_method = EXCLUDED.input_method
+				input_method = EXCLUDED.input_method,
+				exact_select = EXCLUDED.exact_select,
+				context_hints = EXCLUDED.context_hints,
+				draft = EXCLUDED.draft,
+				allow_feedback_in_simulation = EXCLUDED.allow_feedback_in_simulation,
+				hint = EXCLUDED.hint,
+				ignore_flag_order = EXCLUDED.ignore_flag_order,
+				code_language = EXCLUDED.code_language
 			RETURNING id
-		`, q.DomainID, q.QuestionText, q.Explanation, q.QuestionType, q.ImageURL, q.CodeBlock, q.InputMethod, q.ExamBankVersion).Scan(&questionID)
+		`, q.DomainID, q.QuestionText, q.Explanation, q.QuestionType, q.ImageURL, q.CodeBlock, q.InputMethod, q.ExamBankVersion, q.ExactSelect, q.ContextHints, q.Draft, q.AllowFeedbackInSimulation, q.Hint, q.IgnoreFlagOrder, q.CodeLanguage).Scan(&questionID)
 		if err != nil {
 			db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to insert/update question", fmt.Sprintf("Database error: %v, Question: %s", err, q.QuestionText))
 			return fmt.Errorf("failed to insert/update question '%s': %w", q.QuestionText, err)
 		}
 		// Delete existing choices/answers for this question before re-inserting
-		_, err = tx.Exec(context.Background(), `DELETE FROM choices WHERE question_id = $1`, questionID)
+		_, err = tx.Exec(ctx, `DELETE FROM choices WHERE question_id = $1`, questionID)
 		if err != nil {
 			return fmt.Errorf("failed to clear old choices for question %d: %w", questionID, err)
 		}
-		_, err = tx.Exec(context.Background(), `DELETE FROM fill_blank_answers WHERE question_id = $1`, questionID)
+		_, err = tx.Exec(ctx, `DELETE FROM fill_blank_answers WHERE question_id = $1`, questionID)
 		if err != nil {
 			return fmt.Errorf("failed to clear old fill_blank_answers for question %d: %w", questionID, err)
 		}
-		if q.QuestionType == "single" || q.QuestionType == "multi" || q.QuestionType == "truefalse" {
-			for _, choice := range q.Choices {
-				_, err := tx.Exec(context.Background(), `
-					INSERT INTO choices (question_id, choice_text, is_correct, explanation)
-					VALUES ($1, $2, $3, $4)
-				`, questionID, choice.ChoiceText, choice.IsCorrect, choice.Explanation)
+		if q.QuestionType == "single" || q.QuestionType == "multi" || q.QuestionType == "truefalse" || q.QuestionType == "ordering" || q.QuestionType == "matching" {
+			choiceIDs := make([]int, len(q.Choices))
+			for j, choice := range q.Choices {
+				err := tx.QueryRow(ctx, `
+					INSERT INTO choices (question_id, choice_text, is_correct, explanation, position)
+					VALUES ($1, $2, $3, $4, $5)
+					RETURNING id
+				`, questionID, choice.ChoiceText, choice.IsCorrect, choice.Explanation, choice.Position).Scan(&choiceIDs[j])
 				if err != nil {
 					db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to insert choice", fmt.Sprintf("Database error: %v, Choice: %s", err, choice.ChoiceText))
 					return fmt.Errorf("failed to insert choice '%s' for question %d: %w", choice.ChoiceText, questionID, err)
 				}
 			}
+			if q.QuestionType == "matching" {
+				// Responses are inserted in random order so match IDs cannot be lined up with choice IDs
+				for _, j := range rand.Perm(len(q.Choices)) {
+					_, err := tx.Exec(ctx, `
+						INSERT INTO match_options (question_id, choice_id, option_text)
+						VALUES ($1, $2, $3)
+					`, questionID, choiceIDs[j], q.Choices[j].MatchText)
+					if err != nil {
+						db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to insert matching response", fmt.Sprintf("Database error: %v, Response: %s", err, q.Choices[j].MatchText))
+						return fmt.Errorf("failed to insert matching response '%s' for question %d: %w", q.Choices[j].MatchText, questionID, err)
+					}
+				}
+			}
 		} else if q.QuestionType == "fillblank" {
 			for _, answer := range q.AcceptableAnswers {
-				_, err := tx.Exec(context.Background(), `
-					INSERT INTO fill_blank_answers (question_id, acceptable_answer)
-					VALUES ($1, $2)
-				`, questionID, strings.ToLower(answer)) // Store in lowercase for case-insensitive comparison
+				stored := utils.NormalizeAnswer(answer, locale) // Store normalized (trimmed, lowercased for the answer locale) for comparison
+				pattern, isRegex := strings.CutPrefix(strings.TrimSpace(answer), utils.RegexAnswerPrefix)
+				if isRegex {
+					stored = pattern // Lowercasing would change escapes such as \S; patterns match case-insensitively instead
+				}
+				_, err := tx.Exec(ctx, `
+					INSERT INTO fill_blank_answers (question_id, acceptable_answer, is_regex)
+					VALUES ($1, $2, $3)
+				`, questionID, stored, isRegex)
 				if err != nil {
 					db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to insert acceptable answer", fmt.Sprintf("Database error: %v, Answer: %s", err, answer))
 					return fmt.Errorf("failed to insert acceptable answer '%s' for question %d: %w", answer, questionID, err)
@@ -357,22 +1481,85 @@ func ProcessCourseData(pool *pgxpool.Pool, courseCode, labsRepoPath string) erro
 			}
 		}
 	}
-	// Commit transaction
-	if err := tx.Commit(context.Background()); err != nil {
-		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to commit ingestion transaction", fmt.Sprintf("Database error: %v", err))
-		return fmt.Errorf("failed to commit ingestion transaction for %s: %w", courseCode, err)
+	return nil
+}
+// isHeaderRow reports whether a row is a declared header naming the question columns.
+func isHeaderRow(row []string) bool {
+	return len(row) > 0 && strings.ToLower(strings.TrimSpace(row[0])) == "question_type"
+}
+// csvColumnsFor returns the question column layout for a schema_version.
+func csvColumnsFor(schemaVersion string) []string {
+	major := strings.SplitN(strings.TrimSpace(schemaVersion), ".", 2)[0]
+	if columns, ok := csvHeadersBySchema[major]; ok {
+		return columns
 	}
-	// Regenerate exams after successful ingestion
-	err = exam.GenerateExamsForCourse(pool, courseID, courseMeta.MarketingName, examBankVersion, metadata)
-	if err != nil {
-		db.LogError(pool, sourceName, courseCode, "", 0, "", "Failed to regenerate exams after ingestion", fmt.Sprintf("Error: %v", err))
-		return fmt.Errorf("failed to regenerate exams for %s: %w", courseCode, err)
+	return csvHeaders
+}
+// validateCSVHeader checks a declared header against the expected columns for the schema_version.
+// The required columns must all be present; optional trailing columns may be omitted from the end.
+// The returned error lists every missing, extra and misordered column.
+func validateCSVHeader(row []string, schemaVersion string) error {
+	expected := csvColumnsFor(schemaVersion)
+	expectedIndex := make(map[string]int, len(expected))
+	for i, column := range expected {
+		expectedIndex[column] = i
 	}
-	return nil
+	declared := make([]string, 0, len(row))
+	for _, column := range row {
+		declared = append(declared, strings.ToLower(strings.TrimSpace(column)))
+	}
+	// Drop trailing empty cells left by spreadsheet exports
+	for len(declared) > 0 && declared[len(declared)-1] == "" {
+		declared = declared[:len(declared)-1]
+	}
+	var missing, extra, misordered []string
+	seen := make(map[string]bool, len(declared))
+	known := 0 // Position among recognised columns, used to detect misordering
+	for i, column := range declared {
+		idx, ok := expectedIndex[column]
+		if !ok || seen[column] {
+			if column == "" {
+				column = fmt.Sprintf("(blank column %d)", i+1)
+			}
+			extra = append(extra, column)
+			continue
+		}
+		seen[column] = true
+		if idx != known {
+			misordered = append(misordered, fmt.Sprintf("%s (column %d, expected %d)", column, i+1, idx+1))
+		}
+		known++
+	}
+	// Optional columns may be left off the end, but not skipped when a later one is declared
+	lastDeclared := -1
+	for i, column := range expected {
+		if seen[column] {
+			lastDeclared = i
+		}
+	}
+	for i, column := range expected {
+		if !seen[column] && (i < csvColumnCount || i < lastDeclared) {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) == 0 && len(extra) == 0 && len(misordered) == 0 {
+		return nil
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing columns: "+strings.Join(missing, ", "))
+	}
+	if len(extra) > 0 {
+		problems = append(problems, "extra columns: "+strings.Join(extra, ", "))
+	}
+	if len(misordered) > 0 {
+		problems = append(problems, "misordered columns: "+strings.Join(misordered, ", "))
+	}
+	return fmt.Errorf("%s; expected order: %s", strings.Join(problems, "; "), strings.Join(expected, ","))
 }
 func isMetadataRow(firstCol string) bool {
 	switch firstCol {
-	case "schema_version", "min_questions", "max_questions", "exam_time", "passing_score", "domains":
+	case "schema_version", "min_questions", "max_questions", "exam_time", "passing_score", "domains", "allow_practice", "allow_simulation", "target_exam_count", "penalty_per_wrong", "fuzzy_accept_distance", "instructions":
 		return true
 	default:
 		return false
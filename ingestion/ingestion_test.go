@@ -0,0 +1,781 @@
+
+package ingestion
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db/dbtest"
+	"recap-server/exam"
+	"recap-server/models"
+)
+// csvBank renders exam_bank.csv rows, padding each to the required column count.
+func csvBank(t *testing.T, rows ...[]string) string {
+	t.Helper()
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	for _, row := range rows {
+		padded := make([]string, csvColumnCount)
+		if len(row) > csvColumnCount {
+			padded = make([]string, len(row))
+		}
+		copy(padded, row)
+		if err := w.Write(padded); err != nil {
+			t.Fatalf("writing CSV row: %v", err)
+		}
+	}
+	w.Flush()
+	return b.String()
+}
+// csvMetadata returns the metadata rows of a valid bank with the domains Networking and Storage,
+// followed by extra metadata rows.
+func csvMetadata(extra ...[]string) [][]string {
+	rows := [][]string{
+		{"schema_version", "1.0.0"},
+		{"min_questions", "2"},
+		{"max_questions", "4"},
+		{"exam_time", "30"},
+		{"passing_score", "70"},
+		{"domains", "Networking:0.5|Storage:0.5"},
+	}
+	return append(rows, extra...)
+}
+// singleRow is a single-answer question row of domain with the text, correct on its first choice.
+func singleRow(domain, text string) []string {
+	return []string{"single", domain, text, "Because.", "", "", "", "Alpha", "TRUE", "", "Beta", "FALSE", "", "Gamma", "FALSE", "", ""}
+}
+func TestCleanupStatements(t *testing.T) {
+	// Every table is cleared by its own statement, a table referencing another before the referenced one
+	wantTables := []string{"exam_questions", "exams", "questions", "domains"}
+	if len(cleanupStatements) != len(wantTables) {
+		t.Fatalf("len(cleanupStatements) = %d, want %d", len(cleanupStatements), len(wantTables))
+	}
+	for i, stmt := range cleanupStatements {
+		t.Run(wantTables[i], func(t *testing.T) {
+			if strings.Contains(stmt, ";") {
+				t.Errorf("statement %d holds more than one statement: %s", i, stmt)
+			}
+			if strings.Count(stmt, "DELETE FROM") != 1 {
+				t.Errorf("statement %d is not a single DELETE: %s", i, stmt)
+			}
+			if !strings.HasPrefix(stmt, "DELETE FROM "+wantTables[i]+" ") {
+				t.Errorf("statement %d = %q, want it to clear %s", i, stmt, wantTables[i])
+			}
+			if !strings.Contains(stmt, "$2") {
+				t.Errorf("statement %d ignores the retained exams ($2): %s", i, stmt)
+			}
+		})
+	}
+}
+func TestValidateCSVHeader(t *testing.T) {
+	header := func(columns []string, edit func([]string) []string) []string {
+		row := append([]string(nil), columns...)
+		if edit != nil {
+			row = edit(row)
+		}
+		return row
+	}
+	required := csvHeaders[:csvColumnCount]
+	tests := []struct {
+		name    string
+		row     []string
+		wantErr []string
+	}{
+		{"every column", header(csvHeaders, nil), nil},
+		{"required columns only", header(required, nil), nil},
+		{"case and spacing", header(csvHeaders, func(r []string) []string { r[0], r[1] = " Question_Type ", "DOMAIN"; return r }), nil},
+		{"trailing blank cells", header(csvHeaders, func(r []string) []string { return append(r, "", " ") }), nil},
+		{"missing required column", header(required, func(r []string) []string { return append(r[:2], r[3:]...) }), []string{"missing columns: question_text"}},
+		{"extra column", header(required, func(r []string) []string { return append(r, "notes") }), []string{"extra columns: notes"}},
+		{"repeated column", header(required, func(r []string) []string { return append(r, "domain") }), []string{"extra columns: domain"}},
+		{"blank column inside", header(required, func(r []string) []string { return append(r[:3], append([]string{""}, r[3:]...)...) }), []string{"extra columns: (blank column 4)"}},
+		{"swapped columns", header(required, func(r []string) []string { r[1], r[2] = r[2], r[1]; return r }), []string{"misordered columns: question_text (column 2, expected 3)", "domain (column 3, expected 2)"}},
+		{"skipped optional column", header(csvHeaders, func(r []string) []string { return append(r[:len(r)-2], r[len(r)-1]) }), []string{"missing columns: " + csvHeaders[len(csvHeaders)-2]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCSVHeader(tt.row, "1.0.0")
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("validateCSVHeader = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("validateCSVHeader = nil, want errors %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validateCSVHeader = %v, want it to contain %q", err, want)
+				}
+			}
+			if !strings.Contains(err.Error(), "expected order: "+strings.Join(csvHeaders, ",")) {
+				t.Errorf("validateCSVHeader = %v, want it to give the expected order", err)
+			}
+		})
+	}
+}
+func TestReadCSVExamBankModeFlags(t *testing.T) {
+	tests := []struct {
+		name           string
+		extra          [][]string
+		wantPractice   bool
+		wantSimulation bool
+	}{
+		{"defaults", nil, true, true},
+		{"practice disabled", [][]string{{"allow_practice", "FALSE"}}, false, true},
+		{"simulation disabled", [][]string{{"allow_simulation", "false"}}, true, false},
+		{"both disabled", [][]string{{"allow_practice", "FALSE"}, {"allow_simulation", "FALSE"}}, false, false},
+		{"explicitly enabled", [][]string{{"allow_practice", "TRUE"}, {"allow_simulation", "TRUE"}}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := append(csvMetadata(tt.extra...), singleRow("Networking", "What is a subnet?"))
+			path := writeBankFile(t, "exam_bank.csv", csvBank(t, rows...))
+			bank, err := readCSVExamBank(offlinePool(t), "TEST101", path)
+			if err != nil {
+				t.Fatalf("readCSVExamBank error = %v", err)
+			}
+			if bank.Metadata.AllowPractice != tt.wantPractice || bank.Metadata.AllowSimulation != tt.wantSimulation {
+				t.Fatalf("allow_practice, allow_simulation = %t, %t, want %t, %t", bank.Metadata.AllowPractice, bank.Metadata.AllowSimulation, tt.wantPractice, tt.wantSimulation)
+			}
+		})
+	}
+}
+func TestIsHeaderRow(t *testing.T) {
+	tests := []struct {
+		row  []string
+		want bool
+	}{
+		{[]string{"question_type", "domain"}, true},
+		{[]string{" Question_Type "}, true},
+		{[]string{"single", "Networking"}, false},
+		{[]string{"schema_version", "1.0.0"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isHeaderRow(tt.row); got != tt.want {
+			t.Errorf("isHeaderRow(%q) = %t, want %t", tt.row, got, tt.want)
+		}
+	}
+}
+func TestCSVColumnsFor(t *testing.T) {
+	for _, version := range []string{"1.0.0", "1.4.2", " 1.0.0", "9.0.0", ""} {
+		if got := csvColumnsFor(version); len(got) != len(csvHeaders) || got[0] != "question_type" {
+			t.Errorf("csvColumnsFor(%q) = %q, want the current layout", version, got)
+		}
+	}
+}
+func TestReadCSVExamBankRejectsInvalidModeFlag(t *testing.T) {
+	rows := append(csvMetadata([]string{"allow_simulation", "sometimes"}), singleRow("Networking", "What is a subnet?"))
+	path := writeBankFile(t, "exam_bank.csv", csvBank(t, rows...))
+	if _, err := readCSVExamBank(offlinePool(t), "TEST101", path); err == nil || !strings.Contains(err.Error(), "invalid allow_simulation") {
+		t.Fatalf("readCSVExamBank error = %v, want invalid allow_simulation", err)
+	}
+}
+func TestValidateMetadataBounds(t *testing.T) {
+	// The offline pool has no settings, so the default bounds apply: 1440 minutes and 500 questions
+	valid := models.ExamBankMetadata{MinQuestions: 10, MaxQuestions: 20, ExamTime: 60}
+	tests := []struct {
+		name    string
+		modify  func(m *models.ExamBankMetadata)
+		wantErr string
+	}{
+		{"typical", func(m *models.ExamBankMetadata) {}, ""},
+		{"exam_time at the maximum", func(m *models.ExamBankMetadata) { m.ExamTime = 1440 }, ""},
+		{"exam_time over the maximum", func(m *models.ExamBankMetadata) { m.ExamTime = 1441 }, "exam_time 1441 exceeds the maximum of 1440 minutes"},
+		{"exam_time typo", func(m *models.ExamBankMetadata) { m.ExamTime = 1200000 }, "exam_time 1200000 exceeds"},
+		{"max_questions at the maximum", func(m *models.ExamBankMetadata) { m.MaxQuestions = 500 }, ""},
+		{"max_questions over the maximum", func(m *models.ExamBankMetadata) { m.MaxQuestions = 501 }, "max_questions 501 exceeds the maximum of 500"},
+		{"min_questions equal to max_questions", func(m *models.ExamBankMetadata) { m.MinQuestions = 20 }, ""},
+		{"min_questions over max_questions", func(m *models.ExamBankMetadata) { m.MinQuestions = 21 }, "min_questions 21 exceeds max_questions 20"},
+		{"negative target_exam_count", func(m *models.ExamBankMetadata) { m.TargetExamCount = -1 }, "invalid target_exam_count -1"},
+	}
+	pool := offlinePool(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := valid
+			tt.modify(&metadata)
+			err := validateMetadataBounds(pool, "TEST101", "exam_bank.csv", metadata)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateMetadataBounds error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateMetadataBounds error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+// testBank is a CSV bank with the domains Networking and Storage, as buildQuestion sees it.
+func testBank() *examBank {
+	return &examBank{
+		FilePath: "exam_bank.csv",
+		Metadata: models.ExamBankMetadata{SchemaVersion: "1.0.0", Domains: map[string]float64{"Networking": 0.5, "Storage": 0.5}},
+	}
+}
+// buildTestQuestion runs buildQuestion on bq in testBank, without a database.
+func buildTestQuestion(t *testing.T, bq bankQuestion) (models.Question, error) {
+	t.Helper()
+	domainMap := map[string]int{"Networking": 1, "Storage": 2}
+	return buildQuestion(context.Background(), offlinePool(t), "TEST101", testBank(), bq, domainMap, map[string]bool{}, "1.0.0")
+}
+// choiceQuestion is a valid entry of questionType (single, multi, truefalse, ordering or matching).
+func choiceQuestion(questionType string) bankQuestion {
+	bq := bankQuestion{LineNumber: 8, QuestionType: questionType, Domain: "Networking", QuestionText: "Pick one", Explanation: "Because."}
+	switch questionType {
+	case "ordering":
+		bq.Choices = []bankChoice{{Column: 1, Text: "First", Position: "1"}, {Column: 2, Text: "Second", Position: "2"}}
+	case "matching":
+		bq.Choices = []bankChoice{{Column: 1, Text: "TCP", Match: "Transport"}, {Column: 2, Text: "IP", Match: "Network"}}
+	case "truefalse":
+		bq.Choices = []bankChoice{{Column: 1, Text: "True", IsCorrect: true}, {Column: 2, Text: "False"}}
+	default:
+		bq.Choices = []bankChoice{{Column: 1, Text: "Alpha", IsCorrect: true}, {Column: 2, Text: "Beta"}}
+	}
+	return bq
+}
+func TestBuildQuestionInputMethod(t *testing.T) {
+	tests := []struct {
+		name        string
+		bq          bankQuestion
+		inputMethod string
+		want        string // Stored input_method; "" means none
+		wantErr     string
+	}{
+		{"single with input_method", choiceQuestion("single"), "text", "", "input_method set on non-fillblank question at line 8"},
+		{"multi with input_method", choiceQuestion("multi"), "terminal", "", "input_method set on non-fillblank question"},
+		{"truefalse with input_method", choiceQuestion("truefalse"), "text", "", "input_method set on non-fillblank question"},
+		{"ordering with input_method", choiceQuestion("ordering"), "text", "", "input_method set on non-fillblank question"},
+		{"matching with input_method", choiceQuestion("matching"), "text", "", "input_method set on non-fillblank question"},
+		{"single without input_method", choiceQuestion("single"), "", "", ""},
+		{"fillblank defaults to text", bankQuestion{QuestionType: "fillblank", AcceptableAnswers: []string{"ls"}}, "", "text", ""},
+		{"fillblank terminal", bankQuestion{QuestionType: "fillblank", AcceptableAnswers: []string{"ls"}}, "Terminal", "terminal", ""},
+		{"fillblank unknown method", bankQuestion{QuestionType: "fillblank", AcceptableAnswers: []string{"ls"}}, "voice", "", "invalid input_method 'voice'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq := tt.bq
+			if bq.QuestionType == "fillblank" {
+				bq.LineNumber, bq.Domain, bq.QuestionText, bq.Explanation = 8, "Networking", "List files", "Because."
+			}
+			bq.InputMethod = tt.inputMethod
+			question, err := buildTestQuestion(t, bq)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("buildQuestion error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildQuestion error = %v", err)
+			}
+			got := ""
+			if question.InputMethod != nil {
+				got = *question.InputMethod
+			}
+			if got != tt.want {
+				t.Fatalf("stored input_method = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+func TestCheckDistinctChoices(t *testing.T) {
+	// Without a database duplicate_choice_severity is at its default, error
+	tests := []struct {
+		name    string
+		texts   []string
+		wantErr string
+	}{
+		{"distinct", []string{"TCP", "UDP", "ICMP"}, ""},
+		{"exact repeat", []string{"TCP", "UDP", "TCP"}, "duplicate choice text 'TCP' at line 12"},
+		{"differs only by case", []string{"Ping", "PING"}, "duplicate choice text 'PING'"},
+		{"differs only by surrounding space", []string{"ls -l", " ls -l "}, "duplicate choice text"},
+		{"similar but distinct", []string{"ls -l", "ls -la"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			choices := make([]models.Choice, len(tt.texts))
+			for i, text := range tt.texts {
+				choices[i] = models.Choice{ChoiceText: text, Order: string(rune('A' + i))}
+			}
+			err := checkDistinctChoices(context.Background(), offlinePool(t), "TEST101", "exam_bank.csv", 12, "line 12", choices)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkDistinctChoices(%q) = %v, want nil", tt.texts, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkDistinctChoices(%q) = %v, want error containing %q", tt.texts, err, tt.wantErr)
+			}
+		})
+	}
+}
+func TestBuildQuestionRejectsDuplicateChoiceText(t *testing.T) {
+	bq := choiceQuestion("single")
+	bq.Choices = append(bq.Choices, bankChoice{Column: 3, Text: "alpha"})
+	if _, err := buildTestQuestion(t, bq); err == nil || !strings.Contains(err.Error(), "duplicate choice text 'alpha'") {
+		t.Fatalf("buildQuestion error = %v, want a duplicate choice text error", err)
+	}
+}
+func TestAddHoldingDomains(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        string
+		wantDomains   map[string]float64
+		wantLegacyErr bool // buildQuestion rejects the question of the unlisted domain
+	}{
+		{"explicit", UnweightedDomainsExplicit, map[string]float64{"Networking": 1, "Archive": 0}, true},
+		{"holding", UnweightedDomainsHolding, map[string]float64{"Networking": 1, "Archive": 0, "Legacy": 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := offlinePool(t)
+			bank := &examBank{FilePath: "exam_bank.csv", Metadata: models.ExamBankMetadata{Domains: map[string]float64{"Networking": 1, "Archive": 0}}}
+			for i, domain := range []string{"Networking", "Archive", "Legacy", "Legacy", ""} {
+				bq := choiceQuestion("single")
+				bq.LineNumber, bq.Domain, bq.QuestionText = 8+i, domain, fmt.Sprintf("Question %d", i)
+				bank.Questions = append(bank.Questions, bq)
+			}
+			addHoldingDomains(pool, "TEST101", bank, tt.policy)
+			if len(bank.Metadata.Domains) != len(tt.wantDomains) {
+				t.Fatalf("domains = %v, want %v", bank.Metadata.Domains, tt.wantDomains)
+			}
+			for domain, weight := range tt.wantDomains {
+				if got, ok := bank.Metadata.Domains[domain]; !ok || got != weight {
+					t.Fatalf("domains = %v, want %v", bank.Metadata.Domains, tt.wantDomains)
+				}
+			}
+			// Stored domains are those of the metadata, as ProcessCourseData builds the domain map from it
+			domainMap := make(map[string]int)
+			for domain := range bank.Metadata.Domains {
+				domainMap[domain] = len(domainMap) + 1
+			}
+			for _, bq := range bank.Questions[:3] {
+				_, err := buildQuestion(context.Background(), pool, "TEST101", bank, bq, domainMap, map[string]bool{}, "1.0.0")
+				wantErr := bq.Domain == "Legacy" && tt.wantLegacyErr
+				if (err != nil) != wantErr {
+					t.Errorf("buildQuestion for domain %s error = %v, want error %t", bq.Domain, err, wantErr)
+				}
+				if err != nil && !strings.Contains(err.Error(), "invalid domain 'Legacy'") {
+					t.Errorf("buildQuestion for domain %s error = %v, want an invalid domain error", bq.Domain, err)
+				}
+			}
+		})
+	}
+}
+func TestPartitionActiveAttempts(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     []activeAttempt
+		wantRetained []int
+		wantBlocking []string
+	}{
+		{"no attempts", nil, []int{}, nil},
+		{"old version retired", []activeAttempt{{ID: 1, ExamID: 10, Email: "a@example.com", Retirable: true}}, []int{10}, nil},
+		{"exam retained once", []activeAttempt{
+			{ID: 1, ExamID: 10, Email: "a@example.com", Retirable: true},
+			{ID: 2, ExamID: 11, Email: "b@example.com", Retirable: true},
+			{ID: 3, ExamID: 10, Email: "c@example.com", Retirable: true},
+		}, []int{10, 11}, nil},
+		{"current version blocks", []activeAttempt{{ID: 4, ExamID: 12, Email: "d@example.com"}}, []int{}, []string{"attempt 4 (exam 12, d@example.com)"}},
+		{"mixed", []activeAttempt{
+			{ID: 5, ExamID: 12, Email: "e@example.com"},
+			{ID: 6, ExamID: 10, Email: "f@example.com", Retirable: true},
+			{ID: 7, ExamID: 40, Email: "g@example.com"}, // Another course's exam using these questions
+		}, []int{10}, []string{"attempt 5 (exam 12, e@example.com)", "attempt 7 (exam 40, g@example.com)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retained, blocking := partitionActiveAttempts(tt.attempts)
+			if retained == nil {
+				t.Fatalf("retained exam IDs are nil, want a list the cleanup can compare with <> ALL")
+			}
+			if fmt.Sprint(retained) != fmt.Sprint(tt.wantRetained) || fmt.Sprint(blocking) != fmt.Sprint(tt.wantBlocking) {
+				t.Fatalf("partitionActiveAttempts = %v, %q, want %v, %q", retained, blocking, tt.wantRetained, tt.wantBlocking)
+			}
+		})
+	}
+}
+func TestJoinInts(t *testing.T) {
+	tests := []struct {
+		ids  []int
+		want string
+	}{
+		{nil, ""},
+		{[]int{7}, "7"},
+		{[]int{7, 12, 40}, "7, 12, 40"},
+	}
+	for _, tt := range tests {
+		if got := joinInts(tt.ids); got != tt.want {
+			t.Errorf("joinInts(%v) = %q, want %q", tt.ids, got, tt.want)
+		}
+	}
+}
+func TestValidateSchemaVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		wantErr string
+	}{
+		{"1.0.0", ""},
+		{"1.10.0", ""},
+		{"2.0.0-beta.1", ""},
+		{"v1", "invalid schema_version 'v1'"},
+		{"1.0", "invalid schema_version '1.0'"},
+		{"", "invalid schema_version ''"},
+		{"1.0.0+networking", "invalid schema_version '1.0.0+networking'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			err := validateSchemaVersion(offlinePool(t), "TEST101", "exam_bank.csv", tt.version)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateSchemaVersion(%q) = %v, want nil", tt.version, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateSchemaVersion(%q) = %v, want error containing %q", tt.version, err, tt.wantErr)
+			}
+		})
+	}
+}
+func TestReadCSVExamBankDefaultsSchemaVersion(t *testing.T) {
+	// An empty schema_version defaults deliberately to 1.0.0, which validateSchemaVersion accepts
+	rows := csvMetadata()
+	rows[0] = []string{"schema_version", ""}
+	path := writeBankFile(t, "exam_bank.csv", csvBank(t, append(rows, singleRow("Networking", "What is a subnet?"))...))
+	bank, err := readCSVExamBank(offlinePool(t), "TEST101", path)
+	if err != nil {
+		t.Fatalf("readCSVExamBank error = %v", err)
+	}
+	if bank.Metadata.SchemaVersion != "1.0.0" {
+		t.Fatalf("schema_version = %q, want the 1.0.0 default", bank.Metadata.SchemaVersion)
+	}
+}
+func TestCourseContentHash(t *testing.T) {
+	courseYAML := []byte("course_code: LNX101\n")
+	// course writes the baseline course files into dir, applies change, and hashes the result
+	course := func(t *testing.T, change func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile)) string {
+		t.Helper()
+		dir := t.TempDir()
+		files := []examBankFile{{Path: filepath.Join(dir, "exam_bank.csv")}, {Path: filepath.Join(dir, "exam_bank_labs.csv"), Name: "labs"}}
+		for i, content := range []string{"primary bank", "labs bank"} {
+			if err := os.WriteFile(files[i].Path, []byte(content), 0o644); err != nil {
+				t.Fatalf("writing %s: %v", files[i].Path, err)
+			}
+		}
+		yaml := courseYAML
+		if change != nil {
+			yaml, files = change(dir, yaml, files)
+		}
+		hash, err := courseContentHash(yaml, files)
+		if err != nil {
+			t.Fatalf("courseContentHash: %v", err)
+		}
+		return hash
+	}
+	writeFile := func(t *testing.T, path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+	baseline := course(t, nil)
+	if len(baseline) != 64 {
+		t.Fatalf("courseContentHash = %q, want a hex SHA-256", baseline)
+	}
+	tests := []struct {
+		name        string
+		change      func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile)
+		wantChanged bool
+	}{
+		{"unchanged files in another checkout", func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile) {
+			return yaml, files
+		}, false},
+		{"course.yaml edited", func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile) {
+			return []byte("course_code: LNX101\nduration_days: 3\n"), files
+		}, true},
+		{"bank edited", func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile) {
+			writeFile(t, files[1].Path, "labs bank, edited")
+			return yaml, files
+		}, true},
+		{"bank added", func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile) {
+			extra := filepath.Join(dir, "exam_bank_quiz.csv")
+			writeFile(t, extra, "quiz bank")
+			return yaml, append(files, examBankFile{Path: extra, Name: "quiz"})
+		}, true},
+		{"bank removed", func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile) {
+			return yaml, files[:1]
+		}, true},
+		{"bank renamed", func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile) {
+			renamed := filepath.Join(dir, "exam_bank_lab.csv")
+			if err := os.Rename(files[1].Path, renamed); err != nil {
+				t.Fatalf("renaming: %v", err)
+			}
+			return yaml, []examBankFile{files[0], {Path: renamed, Name: "lab"}}
+		}, true},
+		{"bank missing", func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile) {
+			if err := os.Remove(files[1].Path); err != nil {
+				t.Fatalf("removing: %v", err)
+			}
+			return yaml, files
+		}, true},
+		{"content moved between files", func(dir string, yaml []byte, files []examBankFile) ([]byte, []examBankFile) {
+			writeFile(t, files[0].Path, "primary banklabs")
+			writeFile(t, files[1].Path, " bank")
+			return yaml, files
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := course(t, tt.change); (got != baseline) != tt.wantChanged {
+				t.Fatalf("courseContentHash changed = %t, want %t", got != baseline, tt.wantChanged)
+			}
+		})
+	}
+}
+func TestContentUnchanged(t *testing.T) {
+	hash := "3f2a"
+	other := "9c1b"
+	tests := []struct {
+		name            string
+		lastHash        *string
+		hasRetiredExams bool
+		want            bool
+	}{
+		{"same hash", &hash, false, true},
+		{"never ingested", nil, false, false},
+		{"different hash", &other, false, false},
+		{"same hash with retired exams to remove", &hash, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentUnchanged(tt.lastHash, hash, tt.hasRetiredExams); got != tt.want {
+				t.Fatalf("contentUnchanged(%s) = %t, want %t", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+func TestLoadDuplicateQuestionScopeDefault(t *testing.T) {
+	if got := loadDuplicateQuestionScope(context.Background(), offlinePool(t)); got != DuplicateScopeFile {
+		t.Fatalf("loadDuplicateQuestionScope without a setting = %q, want %q", got, DuplicateScopeFile)
+	}
+}
+func TestDuplicateQuestionScope(t *testing.T) {
+	// Two banks of one course both ask "What is a subnet?"; the primary bank also repeats a question
+	tests := []struct {
+		name           string
+		scope          string
+		withinFileDup  bool
+		wantErrInBank2 bool
+	}{
+		{"file scope allows reuse across banks", DuplicateScopeFile, false, false},
+		{"course scope rejects reuse across banks", DuplicateScopeCourse, false, true},
+		{"global scope rejects reuse across banks", DuplicateScopeGlobal, false, true},
+		{"file scope rejects reuse within a bank", DuplicateScopeFile, true, false},
+		{"course scope rejects reuse within a bank", DuplicateScopeCourse, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := offlinePool(t)
+			domainMap := map[string]int{"Networking": 1}
+			courseTexts := make(map[string]bool)
+			build := func(texts map[string]bool, text string) error {
+				bq := choiceQuestion("single")
+				bq.QuestionText = text
+				_, err := buildQuestion(context.Background(), pool, "TEST101", testBank(), bq, domainMap, texts, "1.0.0")
+				return err
+			}
+			primary := scopedQuestionTexts(tt.scope, courseTexts)
+			if err := build(primary, "What is a subnet?"); err != nil {
+				t.Fatalf("first question of the primary bank: %v", err)
+			}
+			if tt.withinFileDup {
+				if err := build(primary, "What is a subnet?"); err == nil || !strings.Contains(err.Error(), "duplicate question text") {
+					t.Fatalf("repeated question in the primary bank error = %v, want a duplicate question text error", err)
+				}
+				return
+			}
+			err := build(scopedQuestionTexts(tt.scope, courseTexts), "What is a subnet?")
+			if (err != nil) != tt.wantErrInBank2 {
+				t.Fatalf("same question in the second bank error = %v, want error %t", err, tt.wantErrInBank2)
+			}
+			if err != nil && !strings.Contains(err.Error(), "duplicate question text") {
+				t.Fatalf("same question in the second bank error = %v, want a duplicate question text error", err)
+			}
+		})
+	}
+}
+// queryStrings runs a query returning one text column and collects its rows.
+func queryStrings(t *testing.T, pool *pgxpool.Pool, query string, args ...any) []string {
+	t.Helper()
+	rows, err := pool.Query(context.Background(), query, args...)
+	if err != nil {
+		t.Fatalf("querying %s: %v", query, err)
+	}
+	values, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatalf("reading %s: %v", query, err)
+	}
+	return values
+}
+// TestProcessCourseDataReplacesStaleData ingests a course twice and checks that the domains and questions
+// dropped from its exam bank are gone, along with the exams that used them.
+func TestProcessCourseDataReplacesStaleData(t *testing.T) {
+	pool := dbtest.Pool(t)
+	ctx := context.Background()
+	labs := t.TempDir()
+	dbtest.WriteCourse(t, labs, "ING101", dbtest.ExamBankCSV("1.0.0", map[string][]string{
+		"Networking": {"What is a subnet?", "What is a VLAN?", "What is ARP?", "What is NAT?"},
+		"Storage":    {"What is RAID?", "What is a LUN?", "What is NFS?", "What is iSCSI?"},
+	}))
+	if err := ProcessCourseData(ctx, pool, "ING101", labs, false); err != nil {
+		t.Fatalf("first ingestion: %v", err)
+	}
+	dbtest.WriteCourse(t, labs, "ING101", dbtest.ExamBankCSV("1.0.0", map[string][]string{
+		"Networking": {"What is a subnet?", "What is DNS?", "What is DHCP?", "What is a VLAN?"},
+	}))
+	if err := ProcessCourseData(ctx, pool, "ING101", labs, false); err != nil {
+		t.Fatalf("second ingestion: %v", err)
+	}
+	domains := queryStrings(t, pool, `SELECT d.name FROM domains d JOIN courses c ON d.course_id = c.id WHERE c.course_code = $1 ORDER BY d.name`, "ING101")
+	if want := []string{"Networking"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("domains after re-ingestion = %v, want %v", domains, want)
+	}
+	questions := queryStrings(t, pool, `SELECT q.question_text FROM questions q JOIN courses c ON q.course_id = c.id WHERE c.course_code = $1 ORDER BY q.question_text`, "ING101")
+	if want := []string{"What is DHCP?", "What is DNS?", "What is a VLAN?", "What is a subnet?"}; !reflect.DeepEqual(questions, want) {
+		t.Errorf("questions after re-ingestion = %v, want %v", questions, want)
+	}
+	examQuestions := queryStrings(t, pool, `
+		SELECT DISTINCT q.question_text FROM exam_questions eq
+		JOIN exams e ON eq.exam_id = e.id JOIN courses c ON e.course_id = c.id JOIN questions q ON eq.question_id = q.id
+		WHERE c.course_code = $1 AND q.question_text IN ('What is RAID?', 'What is ARP?')
+	`, "ING101")
+	if len(examQuestions) > 0 {
+		t.Errorf("exams still ask removed questions %v", examQuestions)
+	}
+}
+// TestDuplicateQuestionScopeAcrossCourses ingests the same question text into two courses: only the global
+// scope rejects the second course.
+func TestDuplicateQuestionScopeAcrossCourses(t *testing.T) {
+	tests := []struct {
+		scope   string
+		wantErr bool
+	}{
+		{DuplicateScopeFile, false},
+		{DuplicateScopeCourse, false},
+		{DuplicateScopeGlobal, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			pool := dbtest.Pool(t)
+			ctx := context.Background()
+			dbtest.SetSetting(t, pool, "duplicate_question_scope", tt.scope)
+			labs := t.TempDir()
+			for _, code := range []string{"NET101", "NET201"} {
+				dbtest.WriteCourse(t, labs, code, dbtest.ExamBankCSV("1.0.0", map[string][]string{
+					"Networking": {"What is a subnet?", fmt.Sprintf("What does %s cover?", code)},
+				}))
+			}
+			if err := ProcessCourseData(ctx, pool, "NET101", labs, false); err != nil {
+				t.Fatalf("ingesting the first course: %v", err)
+			}
+			err := ProcessCourseData(ctx, pool, "NET201", labs, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ingesting the second course with the same question = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), "already used by other courses") {
+					t.Fatalf("ingesting the second course error = %v, want the question text reported as used by another course", err)
+				}
+				return
+			}
+			courses := queryStrings(t, pool, `
+				SELECT c.course_code FROM questions q JOIN courses c ON q.course_id = c.id
+				WHERE q.question_text = 'What is a subnet?' ORDER BY c.course_code
+			`)
+			if want := []string{"NET101", "NET201"}; !reflect.DeepEqual(courses, want) {
+				t.Fatalf("courses asking the shared question = %v, want %v", courses, want)
+			}
+		})
+	}
+}
+// TestProcessCourseDataKeepsInProgressAttempt re-ingests a course while an attempt is in progress: the same
+// version is refused, and a new one retires the attempt's exam so it can still be answered and is scored
+// against the questions it was started with.
+func TestProcessCourseDataKeepsInProgressAttempt(t *testing.T) {
+	pool := dbtest.Pool(t)
+	ctx := context.Background()
+	labs := t.TempDir()
+	oldQuestions := []string{"What is a subnet?", "What is a VLAN?", "What is ARP?", "What is NAT?"}
+	dbtest.WriteCourse(t, labs, "ING101", dbtest.ExamBankCSV("1.0.0", map[string][]string{"Networking": oldQuestions}))
+	if err := ProcessCourseData(ctx, pool, "ING101", labs, false); err != nil {
+		t.Fatalf("first ingestion: %v", err)
+	}
+	var examID, attemptID int
+	err := pool.QueryRow(ctx, `SELECT e.id FROM exams e JOIN courses c ON e.course_id = c.id WHERE c.course_code = $1 ORDER BY e.exam_number LIMIT 1`, "ING101").Scan(&examID)
+	if err == nil {
+		_, err = pool.Exec(ctx, `INSERT INTO students (email) VALUES ('student@example.com')`)
+	}
+	if err == nil {
+		err = pool.QueryRow(ctx, `INSERT INTO exam_attempts (exam_id, email, mode) VALUES ($1, 'student@example.com', 'practice') RETURNING id`, examID).Scan(&attemptID)
+	}
+	if err != nil {
+		t.Fatalf("starting an attempt: %v", err)
+	}
+	dbtest.WriteCourse(t, labs, "ING101", dbtest.ExamBankCSV("1.0.0", map[string][]string{"Networking": append(oldQuestions[:3:3], "What is BGP?")}))
+	if err := ProcessCourseData(ctx, pool, "ING101", labs, false); !errors.Is(err, ErrActiveAttempts) {
+		t.Fatalf("re-ingesting the same version during an attempt = %v, want %v", err, ErrActiveAttempts)
+	}
+	dbtest.WriteCourse(t, labs, "ING101", dbtest.ExamBankCSV("1.1.0", map[string][]string{
+		"Networking": {"What is DNS?", "What is DHCP?", "What is BGP?", "What is OSPF?"},
+	}))
+	if err := ProcessCourseData(ctx, pool, "ING101", labs, false); err != nil {
+		t.Fatalf("re-ingesting a new version during an attempt: %v", err)
+	}
+	var retired bool
+	if err := pool.QueryRow(ctx, `SELECT retired_at IS NOT NULL AND NOT allow_practice FROM exams WHERE id = $1`, examID).Scan(&retired); err != nil {
+		t.Fatalf("reading the attempt's exam: %v", err)
+	}
+	if !retired {
+		t.Errorf("exam %d of the in-progress attempt was not retired", examID)
+	}
+	_, err = pool.Exec(ctx, `
+		INSERT INTO user_answers (attempt_id, exam_question_id, choice_ids)
+		SELECT $1, eq.id, ARRAY[(SELECT c.id FROM choices c WHERE c.question_id = eq.question_id AND c.is_correct)]
+		FROM exam_questions eq WHERE eq.exam_id = $2
+	`, attemptID, examID)
+	if err != nil {
+		t.Fatalf("answering the attempt after re-ingestion: %v", err)
+	}
+	result, err := exam.FinalizeAttempt(ctx, pool, attemptID, "eq.question_order")
+	if err != nil {
+		t.Fatalf("finalizing the attempt after re-ingestion: %v", err)
+	}
+	if result.ScorePercent != 100 {
+		t.Errorf("score of the attempt answered correctly = %d, want 100", result.ScorePercent)
+	}
+	if len(result.DetailedReport) == 0 {
+		t.Fatal("the attempt's report has no questions")
+	}
+	for _, q := range result.DetailedReport {
+		found := false
+		for _, text := range oldQuestions {
+			found = found || q.Question == text
+		}
+		if !found {
+			t.Errorf("the attempt was scored on %q, not a question of the bank it was started with", q.Question)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+
+package ingestion
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/models"
+	"recap-server/utils"
+)
+// readJSONExamBank reads exam_bank.json into an examBank.
+// The document is validated against the models.ExamBankJSON schema: unknown fields are rejected,
+// metadata follows the same rules as the CSV metadata rows, and every question entry must be an object.
+// Per-question rules are applied afterwards by buildQuestion, exactly as for CSV rows.
+func readJSONExamBank(pool *pgxpool.Pool, courseCode, examBankJSONPath string) (*examBank, error) {
+	data, err := os.ReadFile(examBankJSONPath)
+	if err != nil {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "", "Failed to read exam_bank.json", fmt.Sprintf("Ensure file exists and is readable: %v", err))
+		return nil, fmt.Errorf("failed to read exam_bank.json for %s: %w", courseCode, err)
+	}
+	var doc models.ExamBankJSON
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&doc); err != nil {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "", "Failed to parse exam_bank.json", fmt.Sprintf("Ensure the JSON matches the exam bank schema: %v", err))
+		return nil, fmt.Errorf("failed to parse exam_bank.json for %s: %w", courseCode, err)
+	}
+	meta := doc.Metadata
+	examBankVersion := strings.TrimSpace(meta.SchemaVersion)
+	if examBankVersion == "" {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "schema_version", "Missing schema_version value", "Defaulting to 1.0.0. Provide a version like '1.0.0'")
+		examBankVersion = "1.0.0"
+	}
+	if meta.MinQuestions <= 0 {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "min_questions", "Invalid value", "Must be a positive integer.")
+		return nil, fmt.Errorf("invalid min_questions in exam_bank.json for %s", courseCode)
+	}
+	if meta.MaxQuestions <= 0 {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "max_questions", "Invalid value", "Must be a positive integer.")
+		return nil, fmt.Errorf("invalid max_questions in exam_bank.json for %s", courseCode)
+	}
+	if meta.ExamTime <= 0 {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "exam_time", "Invalid value", "Must be a positive integer (minutes).")
+		return nil, fmt.Errorf("invalid exam_time in exam_bank.json for %s", courseCode)
+	}
+	if meta.PassingScore < 0 || meta.PassingScore > 100 {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "passing_score", "Invalid value", "Must be a float between 0 and 100.")
+		return nil, fmt.Errorf("invalid passing_score in exam_bank.json for %s", courseCode)
+	}
+	if meta.PenaltyPerWrong < 0 || meta.PenaltyPerWrong > 1 {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "penalty_per_wrong", "Invalid value", "Must be a float between 0 and 1.")
+		return nil, fmt.Errorf("invalid penalty_per_wrong in exam_bank.json for %s", courseCode)
+	}
+	if meta.FuzzyAcceptDistance < 0 || meta.FuzzyAcceptDistance > MaxFuzzyAcceptDistance {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "fuzzy_accept_distance", "Invalid value", fmt.Sprintf("Must be an integer between 0 and %d.", MaxFuzzyAcceptDistance))
+		return nil, fmt.Errorf("invalid fuzzy_accept_distance in exam_bank.json for %s", courseCode)
+	}
+	instructions := strings.TrimSpace(meta.Instructions)
+	if len(instructions) > MaxInstructionsLength {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "instructions", "Instructions too long", fmt.Sprintf("Keep the instructions to at most %d characters.", MaxInstructionsLength))
+		return nil, fmt.Errorf("instructions longer than %d characters in exam_bank.json for %s", MaxInstructionsLength, courseCode)
+	}
+	domains := make(map[string]float64, len(meta.Domains))
+	for name, weight := range meta.Domains {
+		domains[strings.TrimSpace(name)] = weight
+	}
+	if err := utils.ValidateDomainWeights(domains); err != nil {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "domains", "Invalid domain weights", fmt.Sprintf("Format: {\"Name\": Weight, ...}. Weights must sum to 1.0. Error: %v", err))
+		return nil, fmt.Errorf("invalid domains in exam_bank.json for %s: %w", courseCode, err)
+	}
+	if len(doc.Questions) == 0 {
+		db.LogError(pool, sourceName, courseCode, examBankJSONPath, 0, "questions", "No questions in exam_bank.json", "At least one question is required.")
+		return nil, fmt.Errorf("no questions in exam_bank.json for %s", courseCode)
+	}
+	bank := &examBank{
+		FilePath: examBankJSONPath,
+		IsJSON:   true,
+		Metadata: models.ExamBankMetadata{
+			SchemaVersion: examBankVersion,
+			MinQuestions:  meta.MinQuestions,
+			MaxQuestions:  meta.MaxQuestions,
+			ExamTime:      meta.ExamTime,
+			PassingScore:  meta.PassingScore,
+			Domains:       domains,
+			AllowPractice:   meta.AllowPractice == nil || *meta.AllowPractice,
+			AllowSimulation: meta.AllowSimulation == nil || *meta.AllowSimulation,
+			TargetExamCount: meta.TargetExamCount,
+			PenaltyPerWrong: meta.PenaltyPerWrong,
+			FuzzyAcceptDistance: meta.FuzzyAcceptDistance,
+			Instructions:    instructions,
+		},
+	}
+	for i, jq := range doc.Questions {
+		bq := bankQuestion{
+			LineNumber:   i + 1, // Position in the questions array
+			QuestionType: strings.TrimSpace(jq.QuestionType),
+			Domain:       strings.TrimSpace(jq.Domain),
+			QuestionText: strings.TrimSpace(jq.QuestionText),
+			Explanation:  strings.TrimSpace(jq.Explanation),
+			ImageURL:     strings.TrimSpace(jq.ImageURL),
+			CodeBlock:    jq.CodeBlock, // Untrimmed: buildQuestion tidies code blocks
+			InputMethod:  strings.TrimSpace(jq.InputMethod),
+		}
+		if jq.ExactSelect != nil {
+			bq.ExactSelect = strconv.Itoa(*jq.ExactSelect)
+		}
+		if jq.ContextHints {
+			bq.ContextHints = "true"
+		}
+		if jq.Draft {
+			bq.Draft = "true"
+		}
+		if jq.AllowFeedbackInSimulation {
+			bq.AllowFeedbackInSimulation = "true"
+		}
+		bq.Hint = strings.TrimSpace(jq.Hint)
+		if jq.IgnoreFlagOrder {
+			bq.IgnoreFlagOrder = "true"
+		}
+		bq.CodeLanguage = strings.TrimSpace(jq.CodeLanguage)
+		if len(jq.Choices) > 6 {
+			db.LogError(pool, sourceName, courseCode, examBankJSONPath, i+1, "choices", "Too many choices", "A question may have at most 6 choices.")
+			return nil, fmt.Errorf("too many choices at question %d for %s", i+1, courseCode)
+		}
+		for k, jc := range jq.Choices {
+			text := strings.TrimSpace(jc.Text)
+			if text == "" {
+				continue
+			}
+			choice := bankChoice{
+				Column:      k + 1,
+				Text:        text,
+				IsCorrect:   jc.Correct,
+				Explanation: strings.TrimSpace(jc.Explanation),
+			}
+			if jc.Position != 0 {
+				choice.Position = strconv.Itoa(jc.Position)
+			}
+			if bq.QuestionType == "matching" {
+				choice.Match, choice.IsCorrect = strings.TrimSpace(jc.Match), false
+			}
+			bq.Choices = append(bq.Choices, choice)
+		}
+		for _, answer := range jq.AcceptableAnswers {
+			if answer = strings.TrimSpace(answer); answer != "" {
+				bq.AcceptableAnswers = append(bq.AcceptableAnswers, answer)
+			}
+		}
+		bank.Questions = append(bank.Questions, bq)
+	}
+	return bank, nil
+}
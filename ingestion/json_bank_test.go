@@ -0,0 +1,128 @@
+
+package ingestion
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+// offlinePool returns a pool whose every query fails fast, connecting to a closed port: error logging and
+// settings reads fail, and setting readers fall back to their defaults, so ingestion can run without a database.
+func offlinePool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	pool, err := pgxpool.New(context.Background(), "postgres://recap@127.0.0.1:1/recap?connect_timeout=1")
+	if err != nil {
+		t.Fatalf("pgxpool.New: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+// writeBankFile writes an exam bank file into a temporary directory and returns its path.
+func writeBankFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+	return path
+}
+// jsonBank returns an exam_bank.json document with one single-answer question and the given extra
+// metadata members, e.g. `"allow_practice": false`.
+func jsonBank(extraMetadata ...string) string {
+	metadata := []string{`"schema_version": "1.0.0"`, `"min_questions": 1`, `"max_questions": 2`, `"exam_time": 30`, `"passing_score": 70`, `"domains": {"Networking": 1}`}
+	metadata = append(metadata, extraMetadata...)
+	return `{"metadata": {` + strings.Join(metadata, ", ") + `}, "questions": [
+		{"question_type": "single", "domain": "Networking", "question_text": "What is a subnet?", "explanation": "Because.",
+		 "choices": [{"text": "Alpha", "correct": true}, {"text": "Beta"}]}
+	]}`
+}
+func TestReadJSONExamBankQuestions(t *testing.T) {
+	doc := `{"metadata": {"schema_version": "", "min_questions": 1, "max_questions": 2, "exam_time": 30, "passing_score": 70, "domains": {" Networking ": 1}},
+		"questions": [
+			{"question_type": "multi", "domain": " Networking ", "question_text": " Which are transport protocols? ", "explanation": "Both.", "exact_select": 2,
+			 "choices": [{"text": "TCP", "correct": true}, {"text": "  "}, {"text": "UDP", "correct": true, "explanation": "Connectionless."}]},
+			{"question_type": "fillblank", "domain": "Networking", "question_text": "List files", "explanation": "ls.", "input_method": "terminal",
+			 "ignore_flag_order": true, "acceptable_answers": ["ls -la", " ", "ls -al"]}
+		]}`
+	bank, err := readJSONExamBank(offlinePool(t), "TEST101", writeBankFile(t, "exam_bank.json", doc))
+	if err != nil {
+		t.Fatalf("readJSONExamBank error = %v", err)
+	}
+	if bank.Metadata.SchemaVersion != "1.0.0" || bank.Metadata.Domains["Networking"] != 1 {
+		t.Fatalf("metadata = %+v, want schema_version 1.0.0 and the trimmed Networking domain", bank.Metadata)
+	}
+	if len(bank.Questions) != 2 {
+		t.Fatalf("read %d questions, want 2", len(bank.Questions))
+	}
+	multi, fillblank := bank.Questions[0], bank.Questions[1]
+	if multi.LineNumber != 1 || multi.Domain != "Networking" || multi.QuestionText != "Which are transport protocols?" || multi.ExactSelect != "2" {
+		t.Errorf("multi question = %+v", multi)
+	}
+	// The blank second choice is dropped, but the third keeps its letter
+	var letters []string
+	for _, choice := range multi.Choices {
+		letters = append(letters, choice.Letter())
+	}
+	if strings.Join(letters, ",") != "A,C" || !multi.Choices[1].IsCorrect || multi.Choices[1].Explanation != "Connectionless." {
+		t.Errorf("multi choices = %+v, want TCP as A and UDP as C", multi.Choices)
+	}
+	if fillblank.InputMethod != "terminal" || fillblank.IgnoreFlagOrder != "true" || strings.Join(fillblank.AcceptableAnswers, "|") != "ls -la|ls -al" {
+		t.Errorf("fillblank question = %+v", fillblank)
+	}
+	if got := bank.location(2); got != "question 2" {
+		t.Errorf("location(2) = %q, want \"question 2\"", got)
+	}
+}
+func TestReadJSONExamBankRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{"malformed JSON", `{"metadata": `, "failed to parse exam_bank.json"},
+		{"unknown field", strings.Replace(jsonBank(), `"explanation"`, `"explanaton"`, 1), "failed to parse exam_bank.json"},
+		{"question not an object", `{"metadata": {}, "questions": ["What is a subnet?"]}`, "failed to parse exam_bank.json"},
+		{"zero exam_time", strings.Replace(jsonBank(), `"exam_time": 30`, `"exam_time": 0`, 1), "invalid exam_time"},
+		{"passing_score above 100", strings.Replace(jsonBank(), `"passing_score": 70`, `"passing_score": 170`, 1), "invalid passing_score"},
+		{"weights not summing to 1", strings.Replace(jsonBank(), `{"Networking": 1}`, `{"Networking": 0.5}`, 1), "invalid domains"},
+		{"no questions", `{"metadata": {"min_questions": 1, "max_questions": 2, "exam_time": 30, "passing_score": 70, "domains": {"Networking": 1}}, "questions": []}`, "no questions"},
+		{"too many choices", strings.Replace(jsonBank(), `{"text": "Beta"}`, `{"text": "B"}, {"text": "C"}, {"text": "D"}, {"text": "E"}, {"text": "F"}, {"text": "G"}`, 1), "too many choices at question 1"},
+		{"penalty above 1", jsonBank(`"penalty_per_wrong": 1.5`), "invalid penalty_per_wrong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readJSONExamBank(offlinePool(t), "TEST101", writeBankFile(t, "exam_bank.json", tt.doc))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("readJSONExamBank error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+func TestReadJSONExamBankModeFlags(t *testing.T) {
+	tests := []struct {
+		name           string
+		extra          []string
+		wantPractice   bool
+		wantSimulation bool
+	}{
+		{"defaults", nil, true, true},
+		{"practice disabled", []string{`"allow_practice": false`}, false, true},
+		{"simulation disabled", []string{`"allow_simulation": false`}, true, false},
+		{"both disabled", []string{`"allow_practice": false`, `"allow_simulation": false`}, false, false},
+		{"explicitly enabled", []string{`"allow_practice": true`, `"allow_simulation": true`}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeBankFile(t, "exam_bank.json", jsonBank(tt.extra...))
+			bank, err := readJSONExamBank(offlinePool(t), "TEST101", path)
+			if err != nil {
+				t.Fatalf("readJSONExamBank error = %v", err)
+			}
+			if bank.Metadata.AllowPractice != tt.wantPractice || bank.Metadata.AllowSimulation != tt.wantSimulation {
+				t.Fatalf("allow_practice, allow_simulation = %t, %t, want %t, %t", bank.Metadata.AllowPractice, bank.Metadata.AllowSimulation, tt.wantPractice, tt.wantSimulation)
+			}
+		})
+	}
+}
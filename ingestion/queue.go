@@ -0,0 +1,142 @@
+
+package ingestion
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/utils"
+)
+// Queue ingests enqueued courses in the background, one at a time and in order, so scheduled,
+// webhook-triggered and manual ingestions of a course never run concurrently. A course already waiting is
+// not queued again; it runs once for every request waiting on it. Only Ingest can force an ingestion.
+type Queue struct {
+	pool         *pgxpool.Pool
+	labsRepoPath string
+	timeout      time.Duration // Deadline of each ingestion; 0 leaves it without one
+	mu           sync.Mutex
+	pending      []string
+	queued       map[string]*queuedIngestion
+	wake         chan struct{}
+}
+// queuedIngestion is a waiting or running ingestion of one course. done is closed once err is set.
+type queuedIngestion struct {
+	force   bool
+	waiters int // Ingest calls still waiting for err
+	done    chan struct{}
+	err     error
+}
+// NewQueue returns a Queue ingesting courses from labsRepoPath, each within timeout, and starts its worker.
+func NewQueue(pool *pgxpool.Pool, labsRepoPath string, timeout time.Duration) *Queue {
+	q := &Queue{pool: pool, labsRepoPath: labsRepoPath, timeout: timeout, queued: make(map[string]*queuedIngestion), wake: make(chan struct{}, 1)}
+	go q.run()
+	return q
+}
+// Enqueue queues an ingestion of courseCode. It returns false when the course is already waiting.
+func (q *Queue) Enqueue(courseCode string) bool {
+	_, added := q.add(courseCode, false, false)
+	return added
+}
+// Ingest queues an ingestion of courseCode, joining the one already waiting (forced when either asks for
+// it), and returns its error once it has run. When ctx ends first Ingest returns ctx's error and the
+// ingestion still runs, logging its outcome to admin_events like other queued ingestions.
+func (q *Queue) Ingest(ctx context.Context, courseCode string, force bool) error {
+	job, _ := q.add(courseCode, force, true)
+	select {
+	case <-job.done:
+		return job.err
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-job.done: // Finished while the lock was awaited; the worker counted this caller as waiting
+		return job.err
+	default:
+	}
+	job.waiters--
+	return ctx.Err()
+}
+// add queues courseCode unless it is already waiting, and returns its queued ingestion and whether it
+// was added.
+func (q *Queue) add(courseCode string, force, wait bool) (*queuedIngestion, bool) {
+	q.mu.Lock()
+	job, waiting := q.queued[courseCode]
+	if !waiting {
+		job = &queuedIngestion{done: make(chan struct{})}
+		q.queued[courseCode] = job
+		q.pending = append(q.pending, courseCode)
+	}
+	job.force = job.force || force
+	if wait {
+		job.waiters++
+	}
+	q.mu.Unlock()
+	if !waiting {
+		select {
+		case q.wake <- struct{}{}:
+		default: // The worker is already due to drain the queue
+		}
+	}
+	return job, !waiting
+}
+// next removes and returns the first waiting course, or false when none is waiting.
+func (q *Queue) next() (string, *queuedIngestion, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return "", nil, false
+	}
+	courseCode := q.pending[0]
+	q.pending = q.pending[1:]
+	job := q.queued[courseCode]
+	delete(q.queued, courseCode)
+	return courseCode, job, true
+}
+// finish hands err to the requests waiting on job and reports whether any still were.
+func (q *Queue) finish(job *queuedIngestion, err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.err = err
+	close(job.done)
+	return job.waiters > 0
+}
+// ingest runs one queued ingestion of courseCode within the queue's timeout.
+func (q *Queue) ingest(ctx context.Context, courseCode string, force bool) error {
+	if q.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		defer cancel()
+	}
+	return ProcessCourseData(ctx, q.pool, courseCode, q.labsRepoPath, force)
+}
+// run ingests the waiting courses each time the queue is woken. Outcomes no request is waiting for are
+// logged to admin_events; waiting requests log their own.
+func (q *Queue) run() {
+	for range q.wake {
+		for courseCode, job, ok := q.next(); ok; courseCode, job, ok = q.next() {
+			logger := slog.Default().With("course_code", courseCode)
+			logger.Info("Ingesting and regenerating exams", "force", job.force)
+			err := q.ingest(utils.ContextWithLogger(context.Background(), logger), courseCode, job.force)
+			if errors.Is(err, ErrCourseUnchanged) {
+				logger.Info("Skipped ingestion: content unchanged")
+			} else if err != nil {
+				logger.Error("Error during queued ingestion", "error", err)
+			} else {
+				logger.Info("Successfully ingested and regenerated exams")
+			}
+			if q.finish(job, err) || errors.Is(err, ErrCourseUnchanged) {
+				continue
+			}
+			if err != nil {
+				db.LogAdminEvent(q.pool, db.SystemActor, "ingestion_failed", courseCode, fmt.Sprintf("Error: %v", err))
+			} else {
+				db.LogAdminEvent(q.pool, db.SystemActor, "ingestion_success", courseCode, "Ingestion and exam regeneration completed.")
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+
+package ingestion
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+// TestQueueIngestWaitsForResult checks that Ingest returns the queued ingestion's own error to every
+// request waiting on the course, rather than returning once the course is queued.
+func TestQueueIngestWaitsForResult(t *testing.T) {
+	q := NewQueue(offlinePool(t), t.TempDir(), time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errs := make([]error, 3)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = q.Ingest(ctx, "NO-SUCH-COURSE", i == 0)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil || ctx.Err() != nil {
+			t.Fatalf("Ingest %d = %v (ctx %v), want the error for the missing course directory", i, err, ctx.Err())
+		}
+	}
+	if !q.Enqueue("NO-SUCH-COURSE") {
+		t.Error("Enqueue after the ingestion ran = false, want the course queued again")
+	}
+}
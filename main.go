@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,16 +12,21 @@ import (
 	"time"
 	"github.com/gin-contrib/multitemplate"
 	"github.com/gin-gonic/gin"
-	_ "github.com/jackc/pgx/v5/pgxpool" // USED: Required for db.InitDB to initialize the pgxpool.Pool type
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	_ "github.com/spf13/viper"         // USED: Required for config.LoadConfig() to unmarshal configuration
 	"recap-server/config"
 	"recap-server/db"
 	"recap-server/handlers"
 	"recap-server/ingestion"
+	"recap-server/metrics"
 	"recap-server/middleware"
+	"recap-server/notifications"
 	"recap-server/exam" // Import the exam package for generator logic
 )
 func main() {
+	// Structured JSON logs; log.Printf output goes through the same handler
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 	// Load configuration
 	cfg, err := config.LoadConfig()
 	if err != nil {
@@ -39,7 +45,8 @@ func main() {
 	// Set Gin mode
 	gin.SetMode(cfg.GinMode)
 	// Initialize Gin router
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery()) // Requests are logged by middleware.Logger rather than gin's plaintext logger
 	// Load HTML templates for admin UI
 	renderer := multitemplate.NewRenderer()
 	renderer.AddFromFiles("admin_layout", "templates/layout.html")
@@ -47,66 +54,83 @@ func main() {
 	// Add other admin templates here as they are created
 	router.HTMLRender = renderer
 	// Middleware
+	router.Use(middleware.RequestID()) // Assigns the request ID used in logs
 	router.Use(middleware.Logger()) // Custom logger middleware
+	router.Use(middleware.QueryTimeout(cfg.QueryTimeout)) // Bounds each request's database work
+	// Prometheus metrics; unauthenticated, so restrict access to the scraper with a network policy
+	metrics.Register()
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	// Scheduled and webhook-triggered ingestions share one queue, so a course is never ingested twice at once
+	ingestionQueue := ingestion.NewQueue(pool, cfg.GitHub.LabsRepoPath, cfg.AdminOperationTimeout)
+	// GitHub push webhook; authenticated by its HMAC signature rather than a FIRM JWT
+	router.POST("/webhooks/github", handlers.GitHubWebhook(pool, cfg.GitHub.WebhookSecret, ingestionQueue))
 	// FIRM JWT authentication middleware for API and Admin routes
 	authMiddleware := middleware.AuthMiddleware(cfg.FIRM.JWTSigningKey, cfg.FIRM.Issuer)
 	// API Routes (version 1)
 	apiV1 := router.Group("/api/v1")
 	apiV1.Use(authMiddleware) // Apply auth to all API routes
+	apiV1.Use(middleware.ImpersonationMiddleware(pool)) // Audits impersonation tokens and keeps them read-only
+	// Per-user limit, keyed on the JWT email. Taking an exam is exempt, so a long exam never runs into it
+	// while its clock keeps running.
+	apiV1.Use(middleware.RateLimitMiddleware(pool, "rate_limit_api_per_hour",
+		"/api/v1/exam_sessions/:session_id/questions/:exam_question_id",
+		"/api/v1/exam_sessions/:session_id/answer",
+		"/api/v1/exam_sessions/:session_id/status",
+		"/api/v1/exam_sessions/:session_id/submit",
+	))
 	{
 		apiV1.GET("/courses", handlers.GetCourses(pool))
 		apiV1.GET("/courses/:course_code/exams", handlers.GetExamsForCourse(pool))
-		apiV1.POST("/exam_sessions", handlers.StartExamSession(pool))
+		apiV1.POST("/exam_sessions", handlers.StartExamSession(pool, cfg.MaxActiveSessions))
+		apiV1.GET("/exam_sessions/:session_id/questions/:exam_question_id", handlers.GetSessionQuestion(pool))
 		apiV1.POST("/exam_sessions/:session_id/answer", handlers.RecordAnswer(pool))
+		apiV1.POST("/exam_sessions/:session_id/hint", handlers.GetAnswerHint(pool))
+		apiV1.POST("/exam_sessions/:session_id/flag_question", handlers.FlagSessionQuestion(pool))
 		apiV1.GET("/exam_sessions/:session_id/status", handlers.GetExamSessionStatus(pool))
 		apiV1.POST("/exam_sessions/:session_id/submit", handlers.SubmitExamSession(pool))
+		apiV1.GET("/exam_sessions/:session_id/review", handlers.GetExamSessionReview(pool))
+		apiV1.GET("/exam_sessions/:session_id/report", handlers.GetExamSessionReport(pool))
+		apiV1.GET("/exam_sessions/:session_id/report.pdf", handlers.GetExamSessionReportPDF(pool))
+		apiV1.GET("/exam_sessions/:session_id/next", handlers.GetNextExamRecommendation(pool))
 		apiV1.GET("/students/:email/history", handlers.GetStudentHistory(pool))
 	}
 	// Admin UI Routes
 	admin := router.Group("/admin")
 	admin.Use(authMiddleware) // Apply auth to all admin routes
+	admin.Use(middleware.ImpersonationMiddleware(pool))
 	admin.Use(middleware.RoleCheckMiddleware([]string{"admin", "instructor"})) // Role-based access control for admin routes
-	{
-		admin.GET("/dashboard", handlers.AdminDashboard(pool))
-		// Admin CRUD routes for courses
-		admin.GET("/courses", handlers.AdminListCourses(pool))
-		admin.POST("/courses", handlers.AdminCreateCourse(pool))
-		admin.PUT("/courses/:course_code", handlers.AdminUpdateCourse(pool))
-		admin.DELETE("/courses/:course_code", handlers.AdminDeleteCourse(pool))
-		admin.GET("/error_logs", handlers.AdminErrorLogs(pool))
-		admin.GET("/user_activity", handlers.AdminUserActivity(pool))
-		admin.GET("/question_stats", handlers.AdminQuestionStats(pool))
-		admin.GET("/settings", handlers.AdminSettings(pool))
-		admin.POST("/settings", handlers.AdminUpdateSettings(pool)) // Placeholder for updating settings
-		// Admin trigger for CSV ingestion
-		admin.POST("/ingest/:course_code", handlers.TriggerIngestion(pool, cfg.GitHub.LabsRepoPath))
-	}
-	// Start background ingestion/exam generation service
-	go func() {
-		// This is a simplified periodic check. In a real system, you'd use webhooks from GitHub
-		// or a more sophisticated change detection mechanism.
-		ticker := time.NewTicker(cfg.IngestionInterval) // e.g., 5 minutes
-		defer ticker.Stop()
-		for range ticker.C {
-			log.Println("Running scheduled ingestion and exam regeneration...")
-			// Ingest all courses defined in the system
-			courseCodes, err := db.GetAllCourseCodes(pool)
-			if err != nil {
-				log.Printf("Error getting course codes for scheduled ingestion: %v", err)
-				continue
-			}
-			for _, courseCode := range courseCodes {
-				log.Printf("Ingesting and regenerating exams for course: %s", courseCode)
-				err := ingestion.ProcessCourseData(pool, courseCode, cfg.GitHub.LabsRepoPath)
+	admin.Use(middleware.RateLimitMiddleware(pool, "rate_limit_admin_per_hour"))
+	registerAdminRoutes(admin, pool, cfg, ingestionQueue)
+	// Start background ingestion/exam generation service. The periodic check is a fallback for the GitHub
+	// push webhook; an INGESTION_INTERVAL of 0 disables it.
+	if cfg.IngestionInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.IngestionInterval) // e.g., 5 minutes
+			defer ticker.Stop()
+			for range ticker.C {
+				log.Println("Running scheduled ingestion and exam regeneration...")
+				// Ingest all courses defined in the system
+				courseCodes, err := db.GetAllCourseCodes(pool)
 				if err != nil {
-					log.Printf("Error during scheduled ingestion for %s: %v", courseCode, err)
-					// Log to admin_events table as well
-					db.LogAdminEvent(pool, "system", "ingestion_failed", courseCode, fmt.Sprintf("Error: %v", err))
-				} else {
-					log.Printf("Successfully ingested and regenerated exams for %s", courseCode)
-					db.LogAdminEvent(pool, "system", "ingestion_success", courseCode, "Ingestion and exam regeneration completed.")
+					log.Printf("Error getting course codes for scheduled ingestion: %v", err)
+					continue
+				}
+				for _, courseCode := range courseCodes {
+					ingestionQueue.Enqueue(courseCode)
 				}
 			}
+		}()
+	} else {
+		log.Println("Scheduled ingestion disabled (INGESTION_INTERVAL is 0); relying on the GitHub webhook")
+	}
+	// Store the scorer's answer correctness for attempts completed before it was recorded, so reliability
+	// and question statistics grade them like the scorer
+	go func() {
+		filled, err := exam.BackfillAnswerCorrectness(context.Background(), pool)
+		if err != nil {
+			log.Printf("Error backfilling answer correctness: %v", err)
+		} else if filled > 0 {
+			log.Printf("Stored answer correctness for %d earlier attempts", filled)
 		}
 	}()
 	// Start background job for validity score calculation
@@ -115,12 +139,48 @@ func main() {
 		defer ticker.Stop()
 		for range ticker.C {
 			log.Println("Running daily validity score calculation...")
-			if err := exam.UpdateQuestionValidityScores(pool); err != nil {
+			if err := exam.UpdateQuestionValidityScores(context.Background(), pool); err != nil {
 				log.Printf("Error updating validity scores: %v", err)
-				db.LogAdminEvent(pool, "system", "validity_score_update_failed", "all_questions", fmt.Sprintf("Error: %v", err))
+				db.LogAdminEvent(pool, db.SystemActor, "validity_score_update_failed", "all_questions", fmt.Sprintf("Error: %v", err))
 			} else {
 				log.Println("Successfully updated validity scores.")
-				db.LogAdminEvent(pool, "system", "validity_score_update_success", "all_questions", "Validity scores updated.")
+				db.LogAdminEvent(pool, db.SystemActor, "validity_score_update_success", "all_questions", "Validity scores updated.")
+			}
+		}
+	}()
+	// Start background job that auto-submits simulation attempts whose time limit has expired
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			finalized, err := exam.FinalizeExpiredAttempts(context.Background(), pool)
+			if err != nil {
+				log.Printf("Error auto-submitting expired attempts: %v", err)
+			} else if finalized > 0 {
+				log.Printf("Auto-submitted %d expired simulation attempts", finalized)
+			}
+		}
+	}()
+	// Start background job that marks stale in-progress practice attempts abandoned
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			abandoned, err := exam.AbandonStaleAttempts(context.Background(), pool)
+			if err != nil {
+				log.Printf("Error abandoning stale attempts: %v", err)
+			} else if abandoned > 0 {
+				log.Printf("Marked %d stale practice attempts abandoned", abandoned)
+			}
+		}
+	}()
+	// Start background worker for queued email/webhook notifications
+	go func() {
+		ticker := time.NewTicker(cfg.Notifications.PollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := notifications.DeliverPending(pool, cfg.Notifications); err != nil {
+				log.Printf("Error delivering pending notifications: %v", err)
 			}
 		}
 	}()
@@ -147,3 +207,44 @@ func main() {
 	}
 	log.Println("Server exited gracefully.")
 }
+// registerAdminRoutes adds the admin UI routes to admin, a group open to admins and instructors. Routes that
+// change server-wide state or whole courses, or expose configuration and logs, are narrowed to admins.
+func registerAdminRoutes(admin *gin.RouterGroup, pool *pgxpool.Pool, cfg *config.Config, ingestionQueue *ingestion.Queue) {
+	adminOnly := middleware.RoleCheckMiddleware([]string{"admin"})
+	longOperation := middleware.LongOperation(cfg.AdminOperationTimeout) // Ingestion, rescoring, imports and exam generation
+	admin.GET("/dashboard", handlers.AdminDashboard(pool))
+	// Admin CRUD routes for courses
+	admin.GET("/courses", handlers.AdminListCourses(pool))
+	admin.POST("/courses", adminOnly, handlers.AdminCreateCourse(pool))
+	admin.PUT("/courses/:course_code", adminOnly, handlers.AdminUpdateCourse(pool))
+	admin.DELETE("/courses/:course_code", adminOnly, handlers.AdminDeleteCourse(pool))
+	admin.GET("/courses/:course_code/exam_plan", handlers.AdminExamPlanPreview(pool))
+	admin.GET("/courses/:course_code/export", handlers.AdminExportExamBank(pool))
+	admin.GET("/courses/:course_code/export.csv", handlers.AdminExportExamBankCSV(pool))
+	admin.GET("/courses/:course_code/domain_difficulty", handlers.AdminDomainDifficulty(pool))
+	admin.POST("/courses/:course_code/sample_exam", adminOnly, longOperation, handlers.AdminGenerateSampleExam(pool))
+	// Admin updates to generated exams
+	admin.PUT("/exams/:exam_id", adminOnly, handlers.AdminUpdateExam(pool))
+	admin.PATCH("/exams/:exam_id", handlers.AdminRetitleExam(pool))
+	admin.GET("/exams/:exam_id/live", handlers.AdminLiveExamSessions(pool))
+	admin.GET("/exams/:exam_id/stats", handlers.AdminExamStats(pool))
+	admin.POST("/exams/:exam_id/rescore_all", adminOnly, longOperation, handlers.AdminRescoreExam(pool))
+	admin.POST("/students/import", handlers.AdminImportStudents(pool))
+	admin.GET("/error_logs", adminOnly, handlers.AdminErrorLogs(pool))
+	admin.GET("/user_activity", handlers.AdminUserActivity(pool))
+	admin.GET("/question_stats", handlers.AdminQuestionStats(pool))
+	admin.GET("/questions/search", handlers.AdminSearchQuestions(pool))
+	admin.GET("/questions/:id/normalize_preview", handlers.AdminNormalizePreview(pool))
+	admin.GET("/questions/:id/notes", handlers.AdminListQuestionNotes(pool))
+	admin.POST("/questions/:id/notes", handlers.AdminAddQuestionNote(pool))
+	admin.POST("/questions/:id/flag", longOperation, handlers.AdminSetQuestionFlag(pool, true))
+	admin.POST("/questions/:id/unflag", handlers.AdminSetQuestionFlag(pool, false))
+	admin.POST("/impersonate", adminOnly, handlers.AdminImpersonate(pool, cfg)) // Read-only support tokens acting as a student
+	admin.GET("/config", adminOnly, handlers.AdminConfig(cfg))
+	admin.GET("/settings", adminOnly, handlers.AdminSettings(pool))
+	admin.POST("/settings", adminOnly, handlers.AdminUpdateSettings(pool)) // Placeholder for updating settings
+	// Admin trigger for CSV ingestion
+	admin.POST("/ingest/:course_code", adminOnly, longOperation, handlers.TriggerIngestion(pool, ingestionQueue))
+	// Admin import of question banks exported from other platforms (e.g. Moodle XML)
+	admin.POST("/import/:course_code", adminOnly, longOperation, handlers.AdminImportQuestions(pool))
+}
@@ -0,0 +1,86 @@
+package main
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/config"
+	"recap-server/middleware"
+)
+// adminOnlyRoutes are the admin routes instructors must not reach: server-wide settings, configuration and
+// logs, impersonation, and changes to whole courses and exams.
+var adminOnlyRoutes = map[string]bool{
+	"POST /admin/courses":                          true,
+	"PUT /admin/courses/:course_code":              true,
+	"DELETE /admin/courses/:course_code":           true,
+	"POST /admin/courses/:course_code/sample_exam": true,
+	"PUT /admin/exams/:exam_id":                    true,
+	"POST /admin/exams/:exam_id/rescore_all":       true,
+	"GET /admin/error_logs":                        true,
+	"POST /admin/impersonate":                      true,
+	"GET /admin/config":                            true,
+	"GET /admin/settings":                          true,
+	"POST /admin/settings":                         true,
+	"POST /admin/ingest/:course_code":              true,
+	"POST /admin/import/:course_code":              true,
+}
+// adminRouter registers the admin routes behind the group's role check, for callers with roles, against a
+// pool whose every query fails fast.
+func adminRouter(t *testing.T, roles ...string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	pool, err := pgxpool.New(context.Background(), "postgres://recap@127.0.0.1:1/recap?connect_timeout=1")
+	if err != nil {
+		t.Fatalf("pgxpool.New: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	router := gin.New()
+	// Handlers that pass the role check fail without templates or a database; only the check matters here
+	router.Use(gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, _ any) { c.AbortWithStatus(http.StatusInternalServerError) }))
+	admin := router.Group("/admin")
+	admin.Use(func(c *gin.Context) { c.Set("user_roles", roles) }) // Stands in for AuthMiddleware
+	admin.Use(middleware.RoleCheckMiddleware([]string{"admin", "instructor"}))
+	registerAdminRoutes(admin, pool, &config.Config{}, nil)
+	return router
+}
+// requestPath fills a route's parameters with sample values.
+func requestPath(path string) string {
+	replacer := strings.NewReplacer(":course_code", "TEST101", ":exam_id", "1", ":id", "1")
+	return replacer.Replace(path)
+}
+func TestAdminRouteRoles(t *testing.T) {
+	routes := adminRouter(t).Routes()
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for key := range adminOnlyRoutes {
+		if !registered[key] {
+			t.Errorf("admin-only route %s is not registered", key)
+		}
+	}
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		t.Run(key, func(t *testing.T) {
+			tests := []struct {
+				role      string
+				wantBlock bool
+			}{
+				{"admin", false},
+				{"instructor", adminOnlyRoutes[key]},
+				{"student", true},
+			}
+			for _, tt := range tests {
+				w := httptest.NewRecorder()
+				adminRouter(t, tt.role).ServeHTTP(w, httptest.NewRequest(route.Method, requestPath(route.Path), strings.NewReader("{}")))
+				if blocked := w.Code == http.StatusForbidden; blocked != tt.wantBlock {
+					t.Errorf("%s as %s: status %d, want blocked = %t", key, tt.role, w.Code, tt.wantBlock)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+
+package metrics
+import (
+	"context"
+	"strings"
+	"time"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+// Exam activity collectors, registered by Register and served on /metrics.
+var (
+	ExamsStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "recap_exams_started_total",
+		Help: "Exam sessions started, by mode.",
+	}, []string{"mode"})
+	AnswersRecorded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "recap_answers_recorded_total",
+		Help: "Answers recorded, by question type.",
+	}, []string{"question_type"})
+	ExamsSubmitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "recap_exams_submitted_total",
+		Help: "Exam attempts finalized on submission or expiry, by mode.",
+	}, []string{"mode"})
+	Ingestions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "recap_ingestions_total",
+		Help: "Course ingestions, by result (success, failure or skipped).",
+	}, []string{"result"})
+	ActiveExamSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "recap_active_exam_sessions",
+		Help: "Active exam sessions (see db.ActiveSessionsQuery), refreshed on start, submission and expiry.",
+	})
+	ScoringDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "recap_submission_scoring_seconds",
+		Help:    "Time to score an attempt when it is finalized.",
+		Buckets: prometheus.DefBuckets,
+	})
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "recap_db_query_duration_seconds",
+		Help:    "Database query durations, by SQL command (select, insert, ...; error for failed queries).",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"command"})
+)
+// Register registers the collectors with the default Prometheus registry. Call it once at startup.
+func Register() {
+	prometheus.MustRegister(ExamsStarted, AnswersRecorded, ExamsSubmitted, Ingestions, ActiveExamSessions, ScoringDuration, QueryDuration)
+}
+// IngestionResult returns the result label of an ingestion that returned err.
+func IngestionResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+// queryStartKey is the context key of a traced query's start time.
+type queryStartKey struct{}
+// QueryTracer is a pgx.QueryTracer observing every query's duration in QueryDuration.
+type QueryTracer struct{}
+// TraceQueryStart records the query's start time in the returned context.
+func (QueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, time.Now())
+}
+// TraceQueryEnd observes the query's duration under its command tag's verb.
+func (QueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	command := "error"
+	if data.Err == nil {
+		command = "other"
+		if fields := strings.Fields(data.CommandTag.String()); len(fields) > 0 {
+			command = strings.ToLower(fields[0])
+		}
+	}
+	QueryDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
@@ -1,19 +1,24 @@
 
 package middleware
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"recap-server/utils"
 )
 // claims struct to hold JWT custom claims
 type claims struct {
 	Email string   `json:"sub"`
 	Roles []string `json:"roles"`
+	ImpersonatedBy string `json:"impersonated_by,omitempty"` // Admin email on tokens from IssueImpersonationToken
 	jwt.RegisteredClaims
 }
 // AuthMiddleware validates the FIRM JWT and sets user context.
@@ -38,7 +43,7 @@ func AuthMiddleware(jwtSigningKey, issuer string) gin.HandlerFunc {
 			return []byte(jwtSigningKey), nil
 		})
 		if err != nil {
-			log.Printf("JWT parsing error: %v", err)
+			utils.LoggerFromContext(c.Request.Context()).Warn("JWT parsing error", "error", err)
 			// FIXED: Use errors.Is for robust JWT error checking (correct and consistent with jwt/v5)
 			if errors.Is(err, jwt.ErrSignatureInvalid) {
 				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token signature"})
@@ -67,8 +72,15 @@ func AuthMiddleware(jwtSigningKey, issuer string) gin.HandlerFunc {
 				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
 				return
 			}
-			c.Set("user_email", claims.Email)
+			email := utils.NormalizeEmail(claims.Email) // Emails are compared and stored lowercase
+			c.Set("user_email", email)
+			ctx := c.Request.Context()
+			c.Request = c.Request.WithContext(utils.ContextWithLogger(ctx, utils.LoggerFromContext(ctx).With("user_email", email)))
 			c.Set("user_roles", claims.Roles) // Pass roles to context for RBAC
+			if claims.ImpersonatedBy != "" {
+				c.Set("impersonated_by", utils.NormalizeEmail(claims.ImpersonatedBy))
+				c.Set("impersonation_id", claims.ID)
+			}
 			c.Next()
 		} else {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
@@ -108,12 +120,75 @@ func RoleCheckMiddleware(requiredRoles []string) gin.HandlerFunc {
 		c.Next()
 	}
 }
-// Logger middleware for request logging
+// RequestIDHeader carries the request ID in both directions.
+const RequestIDHeader = "X-Request-ID"
+// maxRequestIDLength bounds a caller-supplied request ID; longer ones are replaced.
+const maxRequestIDLength = 128
+// RequestID middleware assigns each request an ID, stored in the context as "request_id" and echoed in the
+// X-Request-ID response header. A caller-supplied X-Request-ID is kept so requests can be traced across services.
+// The request context carries a logger tagged with the ID (see utils.LoggerFromContext); AuthMiddleware adds
+// the user's email to it.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			b := make([]byte, 8)
+			if _, err := rand.Read(b); err != nil {
+				slog.Error("Error generating request ID", "error", err)
+			}
+			requestID = hex.EncodeToString(b)
+		}
+		c.Set("request_id", requestID)
+		c.Header(RequestIDHeader, requestID)
+		c.Request = c.Request.WithContext(utils.ContextWithLogger(c.Request.Context(), slog.Default().With("request_id", requestID)))
+		c.Next()
+	}
+}
+// QueryTimeout middleware gives the request context a deadline of timeout, so handler queries run with
+// c.Request.Context() are cancelled when it passes or the client disconnects. A zero timeout leaves only
+// the disconnect cancellation.
+func QueryTimeout(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+// LongOperation middleware exempts a long admin operation from QueryTimeout: its request context is
+// detached from that deadline and from client disconnects, and ends after timeout instead, so the operation
+// is not cut short partway. A zero timeout leaves it without a deadline.
+func LongOperation(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.WithoutCancel(c.Request.Context())
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+// Logger middleware logs one structured line per request with its method, path, status, latency,
+// user_email (empty before authentication) and request_id.
 func Logger() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		t := time.Now()
 		c.Next()
 		latency := time.Since(t)
-		log.Printf("[RECAP] %s %s %s %d %s", c.Request.Method, c.Request.URL.Path, c.Request.Proto, c.Writer.Status(), latency)
+		slog.Info("request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"proto", c.Request.Proto,
+			"status", c.Writer.Status(),
+			"latency_ms", float64(latency.Microseconds())/1000,
+			"user_email", c.GetString("user_email"),
+			"request_id", c.GetString("request_id"),
+		)
 	}
 }
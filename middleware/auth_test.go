@@ -0,0 +1,75 @@
+package middleware
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"github.com/gin-gonic/gin"
+)
+func TestRoleCheckMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		required   []string
+		roles      any // Value of user_roles; nil leaves it unset
+		wantStatus int
+	}{
+		{"admin on admin-only", []string{"admin"}, []string{"admin"}, http.StatusOK},
+		{"instructor on admin-only", []string{"admin"}, []string{"instructor"}, http.StatusForbidden},
+		{"instructor on shared", []string{"admin", "instructor"}, []string{"instructor"}, http.StatusOK},
+		{"one of several roles", []string{"admin"}, []string{"student", "admin"}, http.StatusOK},
+		{"student on shared", []string{"admin", "instructor"}, []string{"student"}, http.StatusForbidden},
+		{"no roles", []string{"admin"}, []string{}, http.StatusForbidden},
+		{"roles not set", []string{"admin"}, nil, http.StatusForbidden},
+		{"malformed roles", []string{"admin"}, "admin", http.StatusInternalServerError},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/admin/settings", func(c *gin.Context) {
+				if tt.roles != nil {
+					c.Set("user_roles", tt.roles)
+				}
+			}, RoleCheckMiddleware(tt.required), func(c *gin.Context) { c.Status(http.StatusOK) })
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/settings", nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+func TestLongOperationOutlivesQueryTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		wantDeadline bool
+	}{
+		{"own timeout", time.Hour, true},
+		{"no timeout", 0, false},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(QueryTimeout(time.Millisecond))
+			router.POST("/admin/ingest/:course_code", LongOperation(tt.timeout), func(c *gin.Context) {
+				time.Sleep(10 * time.Millisecond) // Past the QueryTimeout deadline
+				ctx := c.Request.Context()
+				if err := ctx.Err(); err != nil {
+					t.Errorf("ctx.Err() = %v after the query timeout, want nil", err)
+				}
+				deadline, ok := ctx.Deadline()
+				if ok != tt.wantDeadline || ok && time.Until(deadline) < 30*time.Minute {
+					t.Errorf("ctx.Deadline() = %v, %t; want a deadline %t about %v away", deadline, ok, tt.wantDeadline, tt.timeout)
+				}
+				c.Status(http.StatusOK)
+			})
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/ingest/AA-ANS100", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
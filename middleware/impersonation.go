@@ -0,0 +1,65 @@
+
+package middleware
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+	"recap-server/utils"
+)
+// IssueImpersonationToken signs a token, accepted by AuthMiddleware, that acts as studentEmail with no
+// roles and records actor as the admin behind it. The token expires after ttl and is read-only (see
+// ImpersonationMiddleware). It returns the token, its ID (jti) and its expiry.
+func IssueImpersonationToken(jwtSigningKey, issuer, studentEmail, actor string, ttl time.Duration) (string, string, time.Time, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", time.Time{}, fmt.Errorf("failed to generate impersonation token ID: %w", err)
+	}
+	tokenID := hex.EncodeToString(b)
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims{
+		Email:          utils.NormalizeEmail(studentEmail),
+		Roles:          []string{},
+		ImpersonatedBy: utils.NormalizeEmail(actor),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			ID:        tokenID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	signed, err := token.SignedString([]byte(jwtSigningKey))
+	if err != nil {
+		return "", "", time.Time{}, fmt.Errorf("failed to sign impersonation token: %w", err)
+	}
+	return signed, tokenID, expiresAt, nil
+}
+// ImpersonationMiddleware audits requests made with impersonation tokens (the "impersonated_by" context
+// key set by AuthMiddleware). Each one is logged to admin_events with the admin as actor and the student
+// as target; anything but GET is refused with 403, so impersonation can only read. Other requests pass
+// through untouched.
+func ImpersonationMiddleware(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		actor := c.GetString("impersonated_by")
+		if actor == "" {
+			c.Next()
+			return
+		}
+		student := c.GetString("user_email")
+		notes := fmt.Sprintf("%s %s (token %s)", c.Request.Method, c.Request.URL.Path, c.GetString("impersonation_id"))
+		if c.Request.Method != http.MethodGet {
+			db.LogAdminEvent(pool, actor, "impersonation_denied", student, notes)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Impersonation tokens are read-only"})
+			return
+		}
+		db.LogAdminEvent(pool, actor, "impersonated_request", student, notes)
+		c.Next()
+	}
+}
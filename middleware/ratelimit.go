@@ -0,0 +1,81 @@
+
+package middleware
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/db"
+)
+// rateLimitWindow is the sliding window the per-hour limits apply to.
+const rateLimitWindow = time.Hour
+// rateLimiter keeps, per user, the times of the requests made within the last window.
+type rateLimiter struct {
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	lastSweep time.Time
+}
+// allow records a request by user at now if fewer than limit requests were made in the window before it.
+// Otherwise it returns false and how long until the oldest request leaves the window.
+func (l *rateLimiter) allow(user string, limit int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := now.Add(-rateLimitWindow)
+	if now.Sub(l.lastSweep) >= rateLimitWindow {
+		// Forget users with no requests in the window so the map does not grow without bound
+		for u, times := range l.hits {
+			if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+				delete(l.hits, u)
+			}
+		}
+		l.lastSweep = now
+	}
+	times := l.hits[user]
+	kept := 0
+	for kept < len(times) && !times[kept].After(cutoff) {
+		kept++
+	}
+	times = times[kept:]
+	if len(times) >= limit {
+		l.hits[user] = times
+		return false, times[len(times)-limit].Add(rateLimitWindow).Sub(now)
+	}
+	l.hits[user] = append(times, now)
+	return true, 0
+}
+// RateLimitMiddleware limits each user (user_email from AuthMiddleware) to the number of requests per
+// sliding hour given by the settingKey setting, e.g. rate_limit_api_per_hour. The limit is read through
+// the settings cache, so changes apply within the cache TTL; 0 or less disables limiting. Requests over
+// the limit get 429 with a Retry-After header. Counts are kept in memory per middleware instance.
+// Requests to exemptRoutes, given as full route patterns (e.g. "/api/v1/exam_sessions/:session_id/answer"),
+// are neither limited nor counted.
+func RateLimitMiddleware(pool *pgxpool.Pool, settingKey string, exemptRoutes ...string) gin.HandlerFunc {
+	limiter := &rateLimiter{hits: make(map[string][]time.Time), lastSweep: time.Now()}
+	exempt := make(map[string]bool, len(exemptRoutes))
+	for _, route := range exemptRoutes {
+		exempt[route] = true
+	}
+	return func(c *gin.Context) {
+		if exempt[c.FullPath()] {
+			c.Next()
+			return
+		}
+		limit := db.GetSettingInt(pool, settingKey, 0)
+		user := c.GetString("user_email")
+		if limit <= 0 || user == "" {
+			c.Next()
+			return
+		}
+		allowed, retryAfter := limiter.allow(user, limit, time.Now())
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Rate limit of %d requests per hour exceeded", limit)})
+			return
+		}
+		c.Next()
+	}
+}
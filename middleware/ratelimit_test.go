@@ -0,0 +1,80 @@
+package middleware
+import (
+	"testing"
+	"time"
+)
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	type request struct {
+		user        string
+		at          time.Duration // After start
+		wantAllowed bool
+		wantRetry   time.Duration
+	}
+	tests := []struct {
+		name     string
+		limit    int
+		requests []request
+	}{
+		{"under the limit", 3, []request{
+			{"ana@example.com", 0, true, 0},
+			{"ana@example.com", time.Minute, true, 0},
+			{"ana@example.com", 2 * time.Minute, true, 0},
+		}},
+		{"over the limit waits for the oldest request", 2, []request{
+			{"ana@example.com", 0, true, 0},
+			{"ana@example.com", 10 * time.Minute, true, 0},
+			{"ana@example.com", 20 * time.Minute, false, 40 * time.Minute},
+			{"ana@example.com", 30 * time.Minute, false, 30 * time.Minute},
+		}},
+		{"rejected requests are not counted", 1, []request{
+			{"ana@example.com", 0, true, 0},
+			{"ana@example.com", 30 * time.Minute, false, 30 * time.Minute},
+			{"ana@example.com", time.Hour - time.Second, false, time.Second},
+			{"ana@example.com", time.Hour, true, 0}, // A request exactly one window old has left it
+		}},
+		{"window slides", 2, []request{
+			{"ana@example.com", 0, true, 0},
+			{"ana@example.com", 40 * time.Minute, true, 0},
+			{"ana@example.com", 61 * time.Minute, true, 0},
+			{"ana@example.com", 70 * time.Minute, false, 30 * time.Minute},
+		}},
+		{"users are limited separately", 1, []request{
+			{"ana@example.com", 0, true, 0},
+			{"ben@example.com", time.Minute, true, 0},
+			{"ana@example.com", 2 * time.Minute, false, 58 * time.Minute},
+			{"ben@example.com", 3 * time.Minute, false, 58 * time.Minute},
+		}},
+		{"idle users are swept", 1, []request{
+			{"ana@example.com", 0, true, 0},
+			{"ben@example.com", 2 * time.Hour, true, 0},
+			{"ana@example.com", 2*time.Hour + time.Minute, true, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &rateLimiter{hits: make(map[string][]time.Time), lastSweep: start}
+			for i, r := range tt.requests {
+				allowed, retry := limiter.allow(r.user, tt.limit, start.Add(r.at))
+				if allowed != r.wantAllowed || retry != r.wantRetry {
+					t.Fatalf("request %d by %s at +%s: allow = %t, %s, want %t, %s", i, r.user, r.at, allowed, retry, r.wantAllowed, r.wantRetry)
+				}
+			}
+		})
+	}
+}
+func TestRateLimiterSweepForgetsIdleUsers(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	limiter := &rateLimiter{hits: make(map[string][]time.Time), lastSweep: start}
+	limiter.allow("ana@example.com", 5, start)
+	limiter.allow("ben@example.com", 5, start.Add(30*time.Minute))
+	limiter.allow("cai@example.com", 5, start.Add(time.Hour+time.Minute))
+	if _, ok := limiter.hits["ana@example.com"]; ok {
+		t.Errorf("idle user ana@example.com still tracked after the sweep")
+	}
+	for _, user := range []string{"ben@example.com", "cai@example.com"} {
+		if len(limiter.hits[user]) != 1 {
+			t.Errorf("user %s has %d recorded requests, want 1", user, len(limiter.hits[user]))
+		}
+	}
+}
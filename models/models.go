@@ -11,7 +11,8 @@ type Course struct {
 	DurationDays  int        `json:"duration_days"`
 	MarketingName string     `json:"marketing_name"`
 	Responsibility string    `json:"responsibility"`
-	ExamCount     int        `json:"exam_count,omitempty"` // For API response
+	ExamCount     int        `json:"exam_count,omitempty"` // For API response: active exams of each bank's latest version
+	TotalExams    int        `json:"total_exams,omitempty"` // For API response: every exam, including older versions and inactive ones
 }
 // Domain struct represents a topic domain within a course
 type Domain struct {
@@ -29,6 +30,13 @@ type Question struct {
 	ImageURL        *string `json:"image_url"` // Pointer to allow NULL
 	CodeBlock       *string `json:"code_block"`
 	InputMethod     *string `json:"input_method"` // For fillblank
+	ExactSelect     *int    `json:"exact_select,omitempty"` // For multi: exact number of choices to select ("choose exactly N")
+	ContextHints    bool    `json:"-"` // For terminal fillblank: practice hints may quote the code_block
+	Draft           bool    `json:"-"` // Ingested without a correct answer; excluded from exam generation
+	AllowFeedbackInSimulation bool `json:"-"` // RecordAnswer returns practice-style feedback even in simulation mode
+	Hint            *string `json:"-"` // Authored hint after a wrong practice answer; preferred over generated hints
+	IgnoreFlagOrder bool    `json:"-"` // For terminal fillblank: answers are compared as utils.CanonicalCommand forms
+	CodeLanguage    *string `json:"code_language,omitempty"` // Syntax highlighting hint for the code_block
 	ValidityScore   *float64 `json:"validity_score"`
 	Flagged         bool    `json:"flagged"`
 	ExamBankVersion string  `json:"exam_bank_version"`
@@ -36,7 +44,6 @@ type Question struct {
 	// For API responses, might also contain choices/acceptable answers
 	Choices          []Choice `json:"choices,omitempty"`
 	AcceptableAnswers []string `json:"acceptable_answers,omitempty"`
-    QuestionDomainName string `json:"question_domain_name"` // Used internally for exam generation
 }
 // Choice struct represents an answer choice for MCQ
 type Choice struct {
@@ -46,6 +53,8 @@ type Choice struct {
 	IsCorrect   bool   `json:"is_correct"`
 	Explanation string `json:"explanation"`
 	Order       string `json:"order"` // 'A', 'B', 'C' for frontend
+	Position    *int   `json:"position,omitempty"` // For ordering: the item's expected position, 1 = first
+	MatchText   string `json:"match_text,omitempty"` // For matching: the right-hand response paired with this prompt
 }
 // FillBlankAnswer struct represents an acceptable answer for fill-in-the-blank
 type FillBlankAnswer struct {
@@ -58,6 +67,63 @@ type ExamPlan struct {
 	NumExams         int
 	QuestionsPerExam int
 	PerDomainPerExam map[string]int
+	ReuseAcrossExams bool // A target_exam_count needs more questions than the bank has, so exams share questions
+}
+// DomainShortage is a weighted domain with fewer questions than the smallest exam needs
+type DomainShortage struct {
+	Domain    string `json:"domain"`
+	Available int    `json:"available"`
+	Required  int    `json:"required"` // Questions needed for an exam of min_questions
+}
+// ExamBankExportCourse identifies the course in an exam bank export. The export document is
+// {"course": ExamBankExportCourse, "exam_bank": ExamBankJSON}, so its exam_bank is a valid exam_bank.json.
+type ExamBankExportCourse struct {
+	CourseCode      string `json:"course_code"`
+	Name            string `json:"name"`
+	MarketingName   string `json:"marketing_name"`
+	ExamBankVersion string `json:"exam_bank_version"`
+}
+// ExamPlanPreview is the dry-run result of planning exams from a course's stored questions
+type ExamPlanPreview struct {
+	CourseCode        string             `json:"course_code"`
+	ExamBankVersion   string             `json:"exam_bank_version"`
+	MinQuestions      int                `json:"min_questions"`
+	MaxQuestions      int                `json:"max_questions"`
+	DomainWeights     map[string]float64 `json:"domain_weights"`
+	AvailableByDomain map[string]int     `json:"available_by_domain"` // Questions eligible for generation per domain
+	NumExams          int                `json:"num_exams"`
+	QuestionsPerExam  int                `json:"questions_per_exam"`
+	PerDomainPerExam  map[string]int     `json:"per_domain_per_exam"`
+	TargetExamCount   int                `json:"target_exam_count,omitempty"`
+	ReuseAcrossExams  bool               `json:"reuse_across_exams"` // Questions repeat across exams to meet the target
+	LimitingDomains   []string           `json:"limiting_domains"` // Domains that bound num_exams, or that are short
+	Shortages         []DomainShortage   `json:"shortages,omitempty"`
+	Error             string             `json:"error,omitempty"` // Why no plan could be formed
+}
+// SampleExamRequest asks for a demo exam of Size questions
+type SampleExamRequest struct {
+	Size int `json:"size" binding:"required"`
+}
+// ImpersonationRequest asks for a read-only token acting as a student (see AdminImpersonate)
+type ImpersonationRequest struct {
+	Email  string `json:"email" binding:"required"`
+	Reason string `json:"reason" binding:"required"` // Recorded in admin_events with the token
+}
+// ImpersonationToken is a short-lived, read-only token acting as a student
+type ImpersonationToken struct {
+	Token     string    `json:"token"`
+	TokenID   string    `json:"token_id"` // jti, quoted in the admin_events notes of every request made with the token
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+// SampleExam describes a generated demo exam (see exam.GenerateSampleExam)
+type SampleExam struct {
+	ExamID          int            `json:"exam_id"`
+	Title           string         `json:"title"`
+	ExamBankVersion string         `json:"exam_bank_version"`
+	Sample          bool           `json:"sample"` // Always true; sample exams are never served to students
+	Questions       int            `json:"questions"`
+	PerDomain       map[string]int `json:"per_domain"`
 }
 // Exam struct represents a generated exam
 type Exam struct {
@@ -71,6 +137,17 @@ type Exam struct {
 	ExamTime        int                  `json:"time_limit_minutes"` // Renamed from exam_time to match API
 	PassingScore    float64              `json:"passing_score"`
 	DomainWeights   map[string]float64 `json:"domain_weights"`
+	AllowPractice   bool                 `json:"allow_practice"`   // Practice sessions may be started
+	AllowSimulation bool                 `json:"allow_simulation"` // Simulation sessions may be started
+	Instructions    *string              `json:"instructions"`     // Pre-exam briefing (markdown), if any
+}
+// ExamListResponse is one page of a course's exams
+type ExamListResponse struct {
+	Exams      []Exam `json:"exams"`
+	Page       int    `json:"page"`
+	PageSize   int    `json:"page_size"`
+	Total      int    `json:"total"` // Exams matching the filter across all pages
+	TotalPages int    `json:"total_pages"`
 }
 // ExamQuestion struct links a question to an exam and its order
 type ExamQuestion struct {
@@ -89,6 +166,9 @@ type ExamAttempt struct {
 	CompletedAt *time.Time `json:"completed_at"` // Pointer to allow NULL
 	ScorePercent *int      `json:"score_percent"` // Pointer to allow NULL
 	Mode        string     `json:"mode"`
+	QuestionOrder string   `json:"question_order"` // "shuffled" (generated exam order) or "domain"
+	AbandonedAt *time.Time `json:"abandoned_at"` // Set when a stale in-progress attempt was marked abandoned
+	ShuffleChoices bool    `json:"shuffle_choices"` // Choices are served in a per-attempt order
 }
 // UserAnswer struct represents a student's answer to a specific exam question
 type UserAnswer struct {
@@ -102,47 +182,168 @@ type UserAnswer struct {
 type ExamSessionRequest struct {
 	ExamID int    `json:"exam_id" binding:"required"`
 	Mode   string `json:"mode" binding:"required,oneof=practice simulation"`
+	QuestionOrder string `json:"question_order" binding:"omitempty,oneof=shuffled domain"` // "domain" serves a stable domain-grouped order (e.g. for screen readers)
 }
 // ExamSessionResponse for starting an exam
 type ExamSessionResponse struct {
-	SessionID        string     `json:"session_id"` // This is the exam_attempt.id as a string
+	SessionID        string     `json:"session_id"` // Opaque session token (exam_attempts.session_token), used in session URLs
 	ExamTitle        string     `json:"exam_title"`
 	Mode             string     `json:"mode"`
+	QuestionOrder    string     `json:"question_order"` // "shuffled" or "domain"
 	TimeLimitMinutes int        `json:"time_limit_minutes"`
-	Questions        []Question `json:"questions"` // Questions for the session (abridged)
+	Instructions     *string    `json:"instructions"` // Pre-exam briefing (markdown), if any
+	Questions        []SessionQuestion `json:"questions"` // Questions for the session, without answer keys
+}
+// SessionQuestion is a question as served to a student during a session. It deliberately has no
+// correctness, explanation or answer fields, so nothing of the answer key reaches the client before submission.
+type SessionQuestion struct {
+	ExamQuestionID int             `json:"exam_question_id"`
+	QuestionText   string          `json:"question_text"`
+	QuestionType   string          `json:"question_type"`
+	ImageURL       *string         `json:"image_url"`
+	CodeBlock      *string         `json:"code_block"`
+	CodeLanguage   *string         `json:"code_language,omitempty"` // Syntax highlighting hint for the code_block
+	InputMethod    *string         `json:"input_method"`
+	ExactSelect    *int            `json:"exact_select,omitempty"`
+	Choices        []SessionChoice `json:"choices,omitempty"`
+	Matches        []SessionMatch  `json:"matches,omitempty"` // For matching: the right-hand responses, shuffled
+}
+// SessionChoice is a choice as served during a session: its ID, text and display letter only
+type SessionChoice struct {
+	ChoiceID int    `json:"choice_id"`
+	Text     string `json:"text"`
+	Order    string `json:"order"` // 'A', 'B', 'C' for frontend
+}
+// SessionMatch is a right-hand response of a matching question as served during a session
+type SessionMatch struct {
+	MatchID int    `json:"match_id"`
+	Text    string `json:"text"`
 }
 // AnswerRequest for submitting an answer
 type AnswerRequest struct {
 	ExamQuestionID int   `json:"exam_question_id" binding:"required"`
 	ChoiceIDs      []int `json:"choice_ids"`   // For single/multi-choice
 	CommandText    string `json:"command_text"` // For fill-in-the-blank (maps to text_answer)
+	Order          OrderingAnswer `json:"order,omitempty"` // For ordering
+	Matches        MatchingAnswer `json:"matches,omitempty"` // For matching
 }
+// OrderingAnswer is the submitted arrangement of an ordering question: every item's choice ID, from first
+// to last. It is stored in user_answers.choice_ids, whose element order is kept.
+type OrderingAnswer []int
+// MatchingAnswer is the submitted pairing of a matching question: each prompt's choice ID mapped to the
+// match_id of the response chosen for it. It is stored as JSON in user_answers.match_answer.
+type MatchingAnswer map[int]int
 // AnswerResponse for practice mode feedback
 type AnswerResponse struct {
 	Correct        bool         `json:"correct"`
 	Explanation    string       `json:"explanation"`
 	Hint           *string      `json:"hint,omitempty"` // For fuzzy logic in fillblank
 	ChoiceFeedback []ChoiceFeedback `json:"choice_feedback,omitempty"`
+	Score          *float64     `json:"score,omitempty"` // Partial credit for multi, ordering and matching questions when scoring_mode is "partial"
+}
+// HintRequest asks for the hint on a tentative fill-in-the-blank answer without recording it
+type HintRequest struct {
+	ExamQuestionID int    `json:"exam_question_id" binding:"required"`
+	CommandText    string `json:"command_text" binding:"required"`
+}
+// QuestionFlagRequest reports a question of the session as broken
+type QuestionFlagRequest struct {
+	ExamQuestionID int    `json:"exam_question_id" binding:"required"`
+	Reason         string `json:"reason"` // Optional
+}
+// QuestionFlag is a student's report that a question is broken
+type QuestionFlag struct {
+	ID             int       `json:"id"`
+	ExamQuestionID int       `json:"exam_question_id"`
+	Reason         *string   `json:"reason"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+// HintResponse returns the hint, if any, and how many hint requests the session has left
+type HintResponse struct {
+	Hint           *string `json:"hint,omitempty"`
+	HintsRemaining int     `json:"hints_remaining"`
+}
+// NormalizePreviewResponse shows how a student answer and a question's acceptable answers normalize and match
+type NormalizePreviewResponse struct {
+	QuestionID        int                `json:"question_id"`
+	Answer            string             `json:"answer"`
+	NormalizedAnswer  string             `json:"normalized_answer"`
+	Matches           bool               `json:"matches"`
+	AcceptableAnswers []NormalizedAnswer `json:"acceptable_answers"`
+}
+// NormalizedAnswer is a stored acceptable answer alongside its normalized form
+type NormalizedAnswer struct {
+	Stored     string `json:"stored"`
+	Normalized string `json:"normalized"`
+	Matches    bool   `json:"matches"`
 }
 // ChoiceFeedback provides per-choice explanation in practice mode
 type ChoiceFeedback struct {
 	ChoiceID    int    `json:"choice_id"`
-	IsCorrect   bool   `json:"is_correct"`
+	IsCorrect   bool   `json:"is_correct"` // For ordering: the item was placed at its expected position; for matching: the prompt was paired correctly
 	Explanation string `json:"explanation"`
+	Position    *int   `json:"position,omitempty"` // For ordering: the item's expected position
+	MatchID     *int   `json:"match_id,omitempty"` // For matching: the response the prompt pairs with
 }
 // ExamStatusResponse for checking progress
 type ExamStatusResponse struct {
 	Completed      bool   `json:"completed"`
+	Abandoned      bool   `json:"abandoned"` // Marked abandoned after sitting unsubmitted too long; it cannot be continued
 	AnsweredCount  int    `json:"answered_count"`
 	RemainingCount int    `json:"remaining_count"`
 	TimeRemaining  string `json:"time_remaining"` // Formatted as "HH:MM:SS"
 }
+// ExamStats summarizes completed simulation attempts of an exam for the admin exam stats view
+type ExamStats struct {
+	ExamID               int        `json:"exam_id"`
+	Title                string     `json:"title"`
+	QuestionCount        int        `json:"question_count"`
+	SimulationAttempts   int        `json:"simulation_attempts"` // Completed simulation attempts
+	AverageScore         *float64   `json:"average_score"`       // Null until an attempt is completed
+	PassRate             *float64   `json:"pass_rate"`           // Percentage of completed attempts that passed
+	Reliability          *float64   `json:"reliability"`         // Cronbach's alpha; null until enough attempts
+	ReliabilityAttempts  int        `json:"reliability_attempts"` // Attempts the stored alpha was computed from
+	ReliabilityUpdatedAt *time.Time `json:"reliability_updated_at"`
+}
+// DomainDifficulty is one domain's aggregate performance across a course's completed attempts
+type DomainDifficulty struct {
+	Domain            string   `json:"domain"`
+	AverageScore      *float64 `json:"average_score"`      // Mean domain_breakdown percentage; null without completed attempts
+	Attempts          int      `json:"attempts"`           // Completed attempts whose breakdown includes the domain
+	AveragePValue     *float64 `json:"average_p_value"`    // Mean share of correct answers per answered question (0-1)
+	QuestionsAnswered int      `json:"questions_answered"` // Questions of the domain with at least one recorded answer
+}
+// DomainDifficultyResponse lists a course's domains, hardest first
+type DomainDifficultyResponse struct {
+	CourseCode string             `json:"course_code"`
+	Mode       string             `json:"mode,omitempty"` // practice or simulation when filtered
+	Domains    []DomainDifficulty `json:"domains"`
+}
+// LiveAttemptStatus is the progress of one in-progress attempt in the admin live monitoring view
+type LiveAttemptStatus struct {
+	AttemptID      int       `json:"attempt_id"`
+	Email          string    `json:"email"`
+	Mode           string    `json:"mode"`
+	StartedAt      time.Time `json:"started_at"`
+	AnsweredCount  int       `json:"answered_count"`
+	TotalQuestions int       `json:"total_questions"`
+	TimeRemaining  string    `json:"time_remaining"` // Formatted as "HH:MM:SS"
+}
 // ExamSubmissionResponse for finalizing the session
 type ExamSubmissionResponse struct {
 	ScorePercent   int                  `json:"score_percent"`
 	Pass           bool                 `json:"pass"`
 	DomainBreakdown map[string]int     `json:"domain_breakdown"`
 	DetailedReport []DetailedQuestionReport `json:"detailed_report"`
+	ReportWithheld bool                 `json:"report_withheld,omitempty"` // The detailed report is held back by simulation_results_release
+}
+// SubmitConfirmationResponse is returned instead of finalizing when too few questions are answered
+type SubmitConfirmationResponse struct {
+	Error               string  `json:"error"`
+	ConfirmationRequired bool   `json:"confirmation_required"`
+	AnsweredCount       int     `json:"answered_count"`
+	TotalQuestions      int     `json:"total_questions"`
+	MinAnsweredFraction float64 `json:"min_answered_fraction"`
 }
 // DetailedQuestionReport provides per-question results
 type DetailedQuestionReport struct {
@@ -150,8 +351,54 @@ type DetailedQuestionReport struct {
 	YourAnswer     []string `json:"your_answer"` // Text representation of chosen choices or fill-in-blank
 	CorrectAnswer  []string `json:"correct_answer"` // Text representation
 	Result         string   `json:"result"` // "correct", "incorrect", "skipped"
+	Score          *float64 `json:"score,omitempty"` // Credit earned (0-1), set when scoring_mode is "partial"
 	Explanation    string   `json:"explanation"`
 }
+// ExamReviewResponse replays a completed attempt question-by-question
+type ExamReviewResponse struct {
+	SessionID    string               `json:"session_id"`
+	ExamTitle    string               `json:"exam_title"`
+	Mode         string               `json:"mode"`
+	QuestionOrder string              `json:"question_order"` // Ordering the attempt was served in
+	ScorePercent *int                 `json:"score_percent"`
+	CompletedAt  time.Time            `json:"completed_at"`
+	Questions    []ExamReviewQuestion `json:"questions"`
+}
+// ExamReviewQuestion is a detailed report entry enriched with the full question and choice content
+type ExamReviewQuestion struct {
+	DetailedQuestionReport
+	QuestionOrder     int            `json:"question_order"`
+	ExamQuestionID    int            `json:"exam_question_id"`
+	QuestionType      string         `json:"question_type"`
+	Domain            string         `json:"domain"`
+	ImageURL          *string        `json:"image_url"`
+	CodeBlock         *string        `json:"code_block"`
+	CodeLanguage      *string        `json:"code_language,omitempty"`
+	InputMethod       *string        `json:"input_method"`
+	ExactSelect       *int           `json:"exact_select,omitempty"`
+	Choices           []ReviewChoice `json:"choices,omitempty"`
+	SelectedChoiceIDs []int          `json:"selected_choice_ids"`
+	TextAnswer        *string        `json:"text_answer,omitempty"`
+	MatchAnswer       MatchingAnswer `json:"match_answer,omitempty"` // For matching: the submitted pairing
+}
+// ReviewChoice is a choice as shown in the attempt review, with correctness and the student's selection
+type ReviewChoice struct {
+	ChoiceID    int    `json:"choice_id"`
+	Text        string `json:"text"`
+	IsCorrect   bool   `json:"is_correct"`
+	Selected    bool   `json:"selected"`
+	Explanation string `json:"explanation"`
+	Position    *int   `json:"position,omitempty"` // For ordering: the item's expected position
+	MatchText   string `json:"match_text,omitempty"` // For matching: the response the prompt pairs with
+	YourMatch   string `json:"your_match,omitempty"` // For matching: the response the student paired it with
+}
+// NextExamRecommendation suggests the exam to take after a completed practice attempt
+type NextExamRecommendation struct {
+	ExamID       int      `json:"exam_id"`
+	Strategy     string   `json:"strategy"` // "advance", "practice" or "review"
+	ScorePercent int      `json:"score_percent"`
+	WeakDomains  []string `json:"weak_domains"`
+}
 // StudentHistoryEntry represents a past exam attempt for a student
 type StudentHistoryEntry struct {
 	ExamTitle      string           `json:"exam_title"`
@@ -159,6 +406,12 @@ type StudentHistoryEntry struct {
 	Timestamp      time.Time        `json:"timestamp"`
 	DomainBreakdown map[string]int `json:"domain_breakdown"`
 }
+// RosterStudent is one entry of a student roster import; name and cohort are optional
+type RosterStudent struct {
+	Email  string `json:"email"`
+	Name   string `json:"name,omitempty"`
+	Cohort string `json:"cohort,omitempty"`
+}
 // AdminCourseCreateRequest for admin UI
 type AdminCourseCreateRequest struct {
 	Name           string `form:"name" binding:"required"`
@@ -167,6 +420,39 @@ type AdminCourseCreateRequest struct {
 	MarketingName  string `form:"marketing_name" binding:"required"`
 	Responsibility string `form:"responsibility"`
 }
+// AdminExamRetitleRequest for renaming a generated exam via the admin API
+type AdminExamRetitleRequest struct {
+	Title string `json:"title" binding:"required,max=255"`
+}
+// AdminExamUpdateRequest for updating a generated exam via the admin API
+// Omitted fields are left unchanged; at least one must be given
+type AdminExamUpdateRequest struct {
+	PassingScore    *float64 `json:"passing_score"`
+	AllowPractice   *bool    `json:"allow_practice"`
+	AllowSimulation *bool    `json:"allow_simulation"`
+	Instructions    *string  `json:"instructions"` // Empty string clears them
+}
+// AdminRescoreRequest gives the reason recorded with an exam rescore
+type AdminRescoreRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+// RescoreChange is one attempt whose stored score changed when its exam was rescored
+type RescoreChange struct {
+	AttemptID int `json:"attempt_id"`
+	OldScore  int `json:"old_score"`
+	NewScore  int `json:"new_score"`
+	Delta     int `json:"delta"`
+}
+// RescoreSummary reports the outcome of rescoring every completed attempt of an exam
+type RescoreSummary struct {
+	ExamID           int             `json:"exam_id"`
+	AttemptsRescored int             `json:"attempts_rescored"`
+	AttemptsChanged  int             `json:"attempts_changed"` // Attempts whose score_percent changed
+	PassChanged      int             `json:"pass_changed"`     // Attempts that moved across the passing score
+	MeanDelta        float64         `json:"mean_delta"`       // Mean score change over the changed attempts
+	MaxAbsDelta      int             `json:"max_abs_delta"`
+	Changes          []RescoreChange `json:"changes"`
+}
 // ErrorLog represents an entry in the error_logs table
 type ErrorLog struct {
 	ID          int       `json:"id"`
@@ -187,6 +473,8 @@ type AdminEvent struct {
 	Actor     string    `json:"actor"`
 	Target    string    `json:"target"`
 	Notes     string    `json:"notes"`
+	Occurrences int        `json:"occurrences"`  // Identical consecutive system events coalesced into this row
+	LastSeenAt  *time.Time `json:"last_seen_at"` // Latest coalesced occurrence; nil if it happened once
 }
 // QuestionStats for admin question_stats page
 type QuestionStats struct {
@@ -194,10 +482,48 @@ type QuestionStats struct {
 	QuestionText  string    `json:"question_text"`
 	QuestionType  string    `json:"question_type"`
 	Domain        string    `json:"domain"`
+	CourseCode    string    `json:"course_code"` // Course that owns the question; shared banks are other courses' banks
 	ValidityScore *float64  `json:"validity_score"`
+	QualityBand   string    `json:"quality_band"` // Label for ValidityScore, e.g. "good" or "review"
 	Flagged       bool      `json:"flagged"`
+	Draft         bool      `json:"draft"` // Ingested without a correct answer; needs completion before it can appear on exams
 	TimesAttempted int      `json:"times_attempted"`
 	CorrectCount  int       `json:"correct_count"`
+	NoteCount     int       `json:"note_count"` // Instructor notes left on the question
+	FlagCount     int       `json:"flag_count"` // Attempts in which a student flagged the question as broken
+	RecentFlagReasons []string `json:"recent_flag_reasons,omitempty"` // Latest non-empty reasons of those flags, newest first, at most three
+}
+// QuestionSearchResult is a question matched by the admin question search
+type QuestionSearchResult struct {
+	QuestionID      int     `json:"question_id"`
+	CourseCode      string  `json:"course_code"` // Course that owns the question
+	CourseName      string  `json:"course_name"`
+	Domain          string  `json:"domain"`
+	QuestionType    string  `json:"question_type"`
+	ExamBankVersion string  `json:"exam_bank_version"`
+	Snippet         string  `json:"snippet"` // Excerpt of the question text with the matched words in **bold**
+	Rank            float64 `json:"rank"`
+}
+// QuestionSearchResponse is one page of admin question search results
+type QuestionSearchResponse struct {
+	Query      string                 `json:"query"`
+	Page       int                    `json:"page"`
+	PageSize   int                    `json:"page_size"`
+	Total      int                    `json:"total"`
+	TotalPages int                    `json:"total_pages"`
+	Results    []QuestionSearchResult `json:"results"`
+}
+// QuestionNote is an instructor's note on a question, visible to other instructors
+type QuestionNote struct {
+	ID         int       `json:"id"`
+	QuestionID int       `json:"question_id"`
+	Author     string    `json:"author"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+// QuestionNoteRequest adds a note to a question
+type QuestionNoteRequest struct {
+	Note string `json:"note" binding:"required"`
 }
 // Setting represents an entry in the settings table
 type Setting struct {
@@ -213,15 +539,74 @@ type CourseYAML struct {
 	CourseCode    string `yaml:"course_code"`
 	DurationDays  int    `yaml:"duration_days"`
 	Responsibility string `yaml:"responsibility"`
+	SharedBanks   []SharedBankYAML `yaml:"shared_banks"` // Optional: domains drawn from other courses' question banks
+}
+// SharedBankYAML references another course whose questions in the listed domains are shared with this course
+type SharedBankYAML struct {
+	CourseCode string   `yaml:"course_code"`
+	Domains    []string `yaml:"domains"`
 }
 // ExamBankMetadata for parsing exam_bank.csv metadata rows
 type ExamBankMetadata struct {
-	SchemaVersion string             `csv:"schema_version"`
-	MinQuestions  int                `csv:"min_questions"`
-	MaxQuestions  int                `csv:"max_questions"`
-	ExamTime      int                `csv:"exam_time"`
-	PassingScore  float64            `csv:"passing_score"`
-	Domains       map[string]float64 `csv:"domains"` // Will be parsed from string
+	SchemaVersion string             `csv:"schema_version" json:"schema_version"`
+	MinQuestions  int                `csv:"min_questions" json:"min_questions"`
+	MaxQuestions  int                `csv:"max_questions" json:"max_questions"`
+	ExamTime      int                `csv:"exam_time" json:"exam_time"`
+	PassingScore  float64            `csv:"passing_score" json:"passing_score"`
+	Domains       map[string]float64 `csv:"domains" json:"domains"` // Will be parsed from string
+	AllowPractice   bool             `csv:"allow_practice" json:"allow_practice"`     // Optional row, defaults to TRUE
+	AllowSimulation bool             `csv:"allow_simulation" json:"allow_simulation"` // Optional row, defaults to TRUE
+	TargetExamCount int              `csv:"target_exam_count" json:"target_exam_count"` // Optional row; 0 lets the planner choose
+	PenaltyPerWrong float64          `csv:"penalty_per_wrong" json:"penalty_per_wrong"` // Optional row; questions deducted per wrong answer
+	FuzzyAcceptDistance int          `csv:"fuzzy_accept_distance" json:"fuzzy_accept_distance"` // Optional row; edit distance accepted in fillblank answers, 0 = exact
+	Instructions    string           `csv:"instructions" json:"instructions"` // Optional row; pre-exam briefing (markdown)
+}
+// ExamBankJSON is the document structure of exam_bank.json, the structured alternative to exam_bank.csv
+type ExamBankJSON struct {
+	Metadata  ExamBankJSONMetadata   `json:"metadata"`
+	Questions []ExamBankJSONQuestion `json:"questions"`
+}
+// ExamBankJSONMetadata mirrors the metadata rows of exam_bank.csv
+type ExamBankJSONMetadata struct {
+	SchemaVersion string             `json:"schema_version"`
+	MinQuestions  int                `json:"min_questions"`
+	MaxQuestions  int                `json:"max_questions"`
+	ExamTime      int                `json:"exam_time"`
+	PassingScore  float64            `json:"passing_score"`
+	Domains       map[string]float64 `json:"domains"` // Domain name -> weight
+	AllowPractice   *bool            `json:"allow_practice"`   // Optional, defaults to true
+	AllowSimulation *bool            `json:"allow_simulation"` // Optional, defaults to true
+	TargetExamCount int              `json:"target_exam_count,omitempty"` // Optional, exact number of exams to generate
+	PenaltyPerWrong float64          `json:"penalty_per_wrong,omitempty"` // Optional negative marking, 0 to 1
+	FuzzyAcceptDistance int          `json:"fuzzy_accept_distance,omitempty"` // Optional typo tolerance for fillblank answers
+	Instructions    string           `json:"instructions,omitempty"` // Optional pre-exam briefing (markdown)
+}
+// ExamBankJSONQuestion is a single question in exam_bank.json
+type ExamBankJSONQuestion struct {
+	QuestionType      string               `json:"question_type"`
+	Domain            string               `json:"domain"`
+	QuestionText      string               `json:"question_text"`
+	Explanation       string               `json:"explanation"`
+	ImageURL          string               `json:"image_url,omitempty"`
+	CodeBlock         string               `json:"code_block,omitempty"`
+	InputMethod       string               `json:"input_method,omitempty"` // For fillblank
+	ExactSelect       *int                 `json:"exact_select,omitempty"` // For multi
+	ContextHints      bool                 `json:"context_hints,omitempty"` // For terminal fillblank with a code_block
+	Draft             bool                 `json:"draft,omitempty"` // Allows a missing correct answer; excluded from exams
+	AllowFeedbackInSimulation bool         `json:"allow_feedback_in_simulation,omitempty"` // Answer feedback even in simulation mode
+	Hint              string               `json:"hint,omitempty"` // Shown after a wrong practice answer
+	IgnoreFlagOrder   bool                 `json:"ignore_flag_order,omitempty"` // For terminal fillblank
+	CodeLanguage      string               `json:"code_language,omitempty"` // Highlighting hint for the code_block
+	Choices           []ExamBankJSONChoice `json:"choices,omitempty"`
+	AcceptableAnswers []string             `json:"acceptable_answers,omitempty"` // For fillblank
+}
+// ExamBankJSONChoice is an answer choice of a question in exam_bank.json
+type ExamBankJSONChoice struct {
+	Text        string `json:"text"`
+	Correct     bool   `json:"correct"`
+	Explanation string `json:"explanation,omitempty"`
+	Position    int    `json:"position,omitempty"` // For ordering: expected position, 1 = first
+	Match       string `json:"match,omitempty"`    // For matching: the right-hand response paired with text
 }
 // ExamBankQuestion for parsing exam_bank.csv question rows
 type ExamBankQuestion struct {
@@ -251,4 +636,30 @@ type ExamBankQuestion struct {
 	Correct6        string `csv:"correct_6"`
 	Explain6        string `csv:"explain_6"`
 	AcceptableAnswers string `csv:"acceptable_answers"` // Pipe-separated for fillblank
+	ExactSelect     string `csv:"exact_select"` // Optional, for multi
+	ContextHints    string `csv:"context_hints"` // Optional, for terminal fillblank
+	Draft           string `csv:"draft"` // Optional, TRUE for a work-in-progress question
+	AllowFeedbackInSimulation string `csv:"allow_feedback_in_simulation"` // Optional, TRUE for feedback in simulation mode
+	Hint            string `csv:"hint"` // Optional, authored practice hint
+	IgnoreFlagOrder string `csv:"ignore_flag_order"` // Optional, TRUE for terminal fillblank
+	CodeLanguage    string `csv:"code_language"` // Optional, highlighting hint for the code_block
+}
+// GitHubPushEvent holds the fields of a GitHub push webhook payload used to find changed courses
+type GitHubPushEvent struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		FullName      string `json:"full_name"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+	Commits    []GitHubPushCommit `json:"commits"`
+	HeadCommit *GitHubPushCommit  `json:"head_commit"`
+}
+// GitHubPushCommit lists the files a pushed commit added, removed or modified
+type GitHubPushCommit struct {
+	ID       string   `json:"id"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
 }
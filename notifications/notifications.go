@@ -0,0 +1,216 @@
+
+package notifications
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"recap-server/config"
+	"recap-server/db"
+)
+// Delivery channels and statuses stored in the pending_notifications table.
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+// Events enqueued by notification producers.
+const (
+	EventExamCompleted   = "exam_completed"
+	EventQuestionFlagged = "question_flagged"
+)
+// claimLease is how long DeliverPending holds the notifications it claims. A worker that stops
+// mid-batch leaves them to be retried once the lease runs out.
+const claimLease = 10 * time.Minute
+// claimQuery claims up to $2 due notifications of status $1 for delivery, leasing them until $3. Rows
+// locked by another worker's claim are skipped rather than waited for.
+const claimQuery = `
+	UPDATE pending_notifications SET next_attempt_at = $3
+	WHERE id IN (
+		SELECT id FROM pending_notifications
+		WHERE status = $1 AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY next_attempt_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, channel, recipient, subject, payload, attempts
+`
+// execer is the part of *pgxpool.Pool and pgx.Tx used to queue notifications.
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+// EnqueueEvent queues an event for every notification target configured in the settings table
+// (notification_webhook_url, notification_email). Producers call this instead of sending inline;
+// the background worker delivers the queued rows via DeliverPending.
+func EnqueueEvent(pool *pgxpool.Pool, event, subject string, data interface{}) error {
+	return enqueueEvent(pool, pool, event, subject, data)
+}
+// EnqueueEventTx is EnqueueEvent inside tx, so the notification is only queued if the producer's
+// change commits. Settings are still read through pool.
+func EnqueueEventTx(tx pgx.Tx, pool *pgxpool.Pool, event, subject string, data interface{}) error {
+	return enqueueEvent(tx, pool, event, subject, data)
+}
+// enqueueEvent queues the event's notifications through q.
+func enqueueEvent(q execer, pool *pgxpool.Pool, event, subject string, data interface{}) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":   event,
+		"subject": subject,
+		"data":    data,
+		"sent_at": time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s notification payload: %w", event, err)
+	}
+	targets := map[string]string{
+		ChannelWebhook: "notification_webhook_url",
+		ChannelEmail:   "notification_email",
+	}
+	for channel, settingKey := range targets {
+		recipient, err := db.GetSettingCached(pool, settingKey)
+		if err != nil || strings.TrimSpace(recipient) == "" {
+			continue // Channel not configured
+		}
+		if err := enqueue(q, channel, event, strings.TrimSpace(recipient), subject, string(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+// Enqueue inserts a single notification into the pending_notifications table.
+func Enqueue(pool *pgxpool.Pool, channel, event, recipient, subject, payload string) error {
+	return enqueue(pool, channel, event, recipient, subject, payload)
+}
+// enqueue inserts a single notification through q.
+func enqueue(q execer, channel, event, recipient, subject, payload string) error {
+	_, err := q.Exec(context.Background(), `
+		INSERT INTO pending_notifications (channel, event, recipient, subject, payload)
+		VALUES ($1, $2, $3, $4, $5)
+	`, channel, event, recipient, subject, payload)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue %s notification to %s: %w", channel, recipient, err)
+	}
+	return nil
+}
+// DeliverPending attempts delivery of up to cfg.BatchSize due notifications. A failed delivery is
+// rescheduled with exponential backoff (RetryBaseDelay doubled per attempt, capped at RetryMaxDelay)
+// until MaxAttempts is reached, after which it is marked failed. Due rows are claimed with FOR UPDATE
+// SKIP LOCKED and leased for claimLease, so concurrent workers (e.g. several server instances) never
+// deliver the same notification twice.
+func DeliverPending(pool *pgxpool.Pool, cfg config.NotificationsConfig) error {
+	rows, err := pool.Query(context.Background(), claimQuery, StatusPending, cfg.BatchSize, time.Now().Add(claimLease))
+	if err != nil {
+		return fmt.Errorf("failed to query pending notifications: %w", err)
+	}
+	type pendingNotification struct {
+		ID        int
+		Channel   string
+		Recipient string
+		Subject   string
+		Payload   string
+		Attempts  int
+	}
+	var due []pendingNotification
+	for rows.Next() {
+		var n pendingNotification
+		if err := rows.Scan(&n.ID, &n.Channel, &n.Recipient, &n.Subject, &n.Payload, &n.Attempts); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan pending notification: %w", err)
+		}
+		due = append(due, n)
+	}
+	rows.Close()
+	for _, n := range due {
+		attempts := n.Attempts + 1
+		deliveryErr := deliver(cfg, n.Channel, n.Recipient, n.Subject, n.Payload)
+		if deliveryErr == nil {
+			_, err = pool.Exec(context.Background(), `
+				UPDATE pending_notifications SET status = $1, attempts = $2, delivered_at = CURRENT_TIMESTAMP, last_error = NULL
+				WHERE id = $3
+			`, StatusDelivered, attempts, n.ID)
+		} else if attempts >= cfg.MaxAttempts {
+			log.Printf("Notification %d (%s to %s) failed permanently after %d attempts: %v", n.ID, n.Channel, n.Recipient, attempts, deliveryErr)
+			_, err = pool.Exec(context.Background(), `
+				UPDATE pending_notifications SET status = $1, attempts = $2, last_error = $3
+				WHERE id = $4
+			`, StatusFailed, attempts, deliveryErr.Error(), n.ID)
+		} else {
+			delay := retryDelay(cfg, attempts)
+			log.Printf("Notification %d (%s to %s) failed, retrying in %s: %v", n.ID, n.Channel, n.Recipient, delay, deliveryErr)
+			_, err = pool.Exec(context.Background(), `
+				UPDATE pending_notifications SET attempts = $1, last_error = $2, next_attempt_at = $3
+				WHERE id = $4
+			`, attempts, deliveryErr.Error(), time.Now().Add(delay), n.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update notification %d: %w", n.ID, err)
+		}
+	}
+	return nil
+}
+// retryDelay returns the backoff before the next delivery attempt, given the attempts made so far.
+func retryDelay(cfg config.NotificationsConfig, attempts int) time.Duration {
+	delay := time.Duration(float64(cfg.RetryBaseDelay) * math.Pow(2, float64(attempts-1)))
+	if delay > cfg.RetryMaxDelay || delay <= 0 {
+		return cfg.RetryMaxDelay
+	}
+	return delay
+}
+// deliver sends a single notification over its channel.
+func deliver(cfg config.NotificationsConfig, channel, recipient, subject, payload string) error {
+	switch channel {
+	case ChannelWebhook:
+		return deliverWebhook(recipient, payload)
+	case ChannelEmail:
+		return deliverEmail(cfg, recipient, subject, payload)
+	default:
+		return fmt.Errorf("unknown notification channel '%s'", channel)
+	}
+}
+// deliverWebhook POSTs the JSON payload to the webhook URL; any non-2xx response is a failure.
+func deliverWebhook(url, payload string) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewBufferString(payload))
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+// deliverEmail sends the payload as a plain-text email through the configured SMTP server.
+func deliverEmail(cfg config.NotificationsConfig, recipient, subject, payload string) error {
+	if cfg.SMTPAddr == "" || cfg.SMTPFrom == "" {
+		return fmt.Errorf("SMTP is not configured (NOTIFICATIONS.SMTP_ADDR and NOTIFICATIONS.SMTP_FROM are required)")
+	}
+	var body bytes.Buffer
+	if err := json.Indent(&body, []byte(payload), "", "  "); err != nil {
+		body.Reset()
+		body.WriteString(payload)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n", cfg.SMTPFrom, recipient, subject, body.String())
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host := cfg.SMTPAddr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	if err := smtp.SendMail(cfg.SMTPAddr, auth, cfg.SMTPFrom, []string{recipient}, []byte(msg)); err != nil {
+		return fmt.Errorf("SMTP delivery failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+
+package notifications
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"recap-server/config"
+)
+func TestRetryDelay(t *testing.T) {
+	cfg := config.NotificationsConfig{RetryBaseDelay: time.Minute, RetryMaxDelay: time.Hour}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour}, // 64 minutes, capped
+		{200, time.Hour}, // Overflows the duration; still capped
+	}
+	for _, tt := range tests {
+		if got := retryDelay(cfg, tt.attempts); got != tt.want {
+			t.Errorf("retryDelay(attempts %d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+// TestClaimQuery checks that a claim only takes due pending rows, bounded by the batch size, skips rows
+// another worker holds instead of blocking on them, and leases what it takes.
+func TestClaimQuery(t *testing.T) {
+	query := strings.Join(strings.Fields(claimQuery), " ")
+	for _, want := range []string{
+		"UPDATE pending_notifications SET next_attempt_at = $3",
+		"WHERE status = $1 AND next_attempt_at <= CURRENT_TIMESTAMP",
+		"ORDER BY next_attempt_at LIMIT $2 FOR UPDATE SKIP LOCKED",
+		"RETURNING id, channel, recipient, subject, payload, attempts",
+	} {
+		if !strings.Contains(query, want) {
+			t.Errorf("claimQuery lacks %q:\n%s", want, query)
+		}
+	}
+}
+func TestDeliverWebhook(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNoContent, false},
+		{http.StatusMovedPermanently, true},
+		{http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			w.WriteHeader(tt.status)
+		}))
+		err := deliverWebhook(server.URL, `{"event":"exam_completed"}`)
+		server.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("deliverWebhook with status %d: err = %v, want error %t", tt.status, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+
+package report
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"github.com/go-pdf/fpdf"
+	"recap-server/models"
+)
+// ExamReport is the data rendered into a completed attempt's PDF report.
+type ExamReport struct {
+	ExamTitle       string
+	Email           string
+	CompletedAt     time.Time
+	ScorePercent    int
+	PassingScore    float64
+	Pass            bool
+	DomainBreakdown map[string]int
+	DetailedReport  []models.DetailedQuestionReport
+}
+// WritePDF renders the report as an A4 PDF to w. Every page carries a header with the exam title,
+// student email and completion date, and a page-number footer.
+func WritePDF(w io.Writer, r ExamReport) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("") // Core fonts are cp1252; translate from UTF-8
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("")
+	pdf.SetHeaderFunc(func() {
+		pdf.SetFont("Helvetica", "B", 14)
+		pdf.CellFormat(0, 8, tr(r.ExamTitle), "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.CellFormat(0, 6, tr(fmt.Sprintf("%s - completed %s", r.Email, r.CompletedAt.UTC().Format("2006-01-02 15:04 UTC"))), "B", 1, "L", false, 0, "")
+		pdf.Ln(4)
+	})
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 6, fmt.Sprintf("Page %d of {nb}", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+	// Summary
+	result := "FAIL"
+	if r.Pass {
+		result = "PASS"
+	}
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(0, 8, fmt.Sprintf("Score: %d%% (passing score %.0f%%) - %s", r.ScorePercent, r.PassingScore, result), "", 1, "L", false, 0, "")
+	pdf.Ln(2)
+	// Domain breakdown, in name order
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.CellFormat(0, 7, "Domain breakdown", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	domains := make([]string, 0, len(r.DomainBreakdown))
+	for domain := range r.DomainBreakdown {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		pdf.CellFormat(140, 6, tr(domain), "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 6, fmt.Sprintf("%d%%", r.DomainBreakdown[domain]), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(4)
+	// Per-question results, left out when they are withheld
+	if len(r.DetailedReport) > 0 {
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.CellFormat(0, 7, "Question results", "", 1, "L", false, 0, "")
+	}
+	for i, entry := range r.DetailedReport {
+		pdf.SetFont("Helvetica", "B", 10)
+		result := entry.Result
+		if entry.Score != nil {
+			result = fmt.Sprintf("%s, score %.2f", result, *entry.Score) // Partial scoring
+		}
+		pdf.MultiCell(0, 5, tr(fmt.Sprintf("%d. %s [%s]", i+1, entry.Question, result)), "", "L", false)
+		pdf.SetFont("Helvetica", "", 10)
+		yourAnswer := strings.Join(entry.YourAnswer, "; ")
+		if yourAnswer == "" {
+			yourAnswer = "(no answer)"
+		}
+		pdf.MultiCell(0, 5, tr("Your answer: "+yourAnswer), "", "L", false)
+		pdf.MultiCell(0, 5, tr("Correct answer: "+strings.Join(entry.CorrectAnswer, "; ")), "", "L", false)
+		if entry.Explanation != "" {
+			pdf.SetFont("Helvetica", "I", 9)
+			pdf.MultiCell(0, 5, tr(entry.Explanation), "", "L", false)
+		}
+		pdf.Ln(3)
+	}
+	return pdf.Output(w)
+}
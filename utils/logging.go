@@ -0,0 +1,19 @@
+
+package utils
+import (
+	"context"
+	"log/slog"
+)
+// loggerKey is the context key of the request-scoped logger.
+type loggerKey struct{}
+// ContextWithLogger returns a copy of ctx carrying logger, e.g. one tagged with the request ID.
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+// LoggerFromContext returns the logger stored by ContextWithLogger, or the default logger when there is none.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
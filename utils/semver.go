@@ -0,0 +1,98 @@
+
+package utils
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+// semverPattern matches MAJOR.MINOR.PATCH with an optional -prerelease. Build metadata ("+...") is not
+// accepted, since "+" separates the bank name in an exam_bank_version.
+var semverPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?$`)
+// Semver is a parsed semantic version.
+type Semver struct {
+	Major, Minor, Patch int
+	Prerelease          []string // Dot-separated pre-release identifiers, e.g. ["beta", "1"]; nil for a release
+}
+// ParseSemver parses a semantic version such as "1.0.0" or "2.1.0-beta.1". Prefixes such as "v" and
+// shortened forms such as "1.0" are rejected.
+func ParseSemver(version string) (Semver, error) {
+	m := semverPattern.FindStringSubmatch(version)
+	if m == nil {
+		return Semver{}, fmt.Errorf("%q is not a semantic version (MAJOR.MINOR.PATCH, e.g. 1.0.0)", version)
+	}
+	var v Semver
+	for i, target := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return Semver{}, fmt.Errorf("%q is not a semantic version: %w", version, err)
+		}
+		*target = n
+	}
+	if m[4] != "" {
+		v.Prerelease = strings.Split(m[4], ".")
+	}
+	return v, nil
+}
+// Compare orders v and o by semver precedence, returning -1, 0 or +1. A pre-release sorts before its
+// release; pre-release identifiers compare numerically when both are numeric, numeric before alphanumeric.
+func (v Semver) Compare(o Semver) int {
+	for _, d := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if d[0] != d[1] {
+			return compareInts(d[0], d[1])
+		}
+	}
+	switch {
+	case len(v.Prerelease) == 0 && len(o.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(o.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(o.Prerelease); i++ {
+		a, b := v.Prerelease[i], o.Prerelease[i]
+		an, aErr := strconv.Atoi(a)
+		bn, bErr := strconv.Atoi(b)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return compareInts(an, bn)
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(a, b); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(len(v.Prerelease), len(o.Prerelease))
+}
+// CompareSemver compares two version strings by semver precedence (see Semver.Compare). Versions that do
+// not parse sort before those that do, and among themselves in string order.
+func CompareSemver(a, b string) int {
+	va, aErr := ParseSemver(a)
+	vb, bErr := ParseSemver(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return va.Compare(vb)
+	case aErr == nil:
+		return 1
+	case bErr == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+// compareInts returns -1, 0 or +1 as a is less than, equal to or greater than b.
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
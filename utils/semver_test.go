@@ -0,0 +1,74 @@
+package utils
+import (
+	"fmt"
+	"testing"
+)
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		version string
+		want    Semver
+		wantErr bool
+	}{
+		{"1.0.0", Semver{Major: 1}, false},
+		{"0.0.1", Semver{Patch: 1}, false},
+		{"1.10.3", Semver{Major: 1, Minor: 10, Patch: 3}, false},
+		{"2.1.0-beta.1", Semver{Major: 2, Minor: 1, Prerelease: []string{"beta", "1"}}, false},
+		{"1.0.0-rc-1", Semver{Major: 1, Prerelease: []string{"rc-1"}}, false},
+		{"", Semver{}, true},
+		{"v1", Semver{}, true},
+		{"v1.0.0", Semver{}, true},
+		{"1.0", Semver{}, true},
+		{"1", Semver{}, true},
+		{"1.0.0.0", Semver{}, true},
+		{"01.0.0", Semver{}, true},
+		{"1.0.0-01", Semver{}, true},
+		{"1.0.0-", Semver{}, true},
+		{"1.0.0+build", Semver{}, true},
+		{" 1.0.0", Semver{}, true},
+		{"1.x.0", Semver{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseSemver(tt.version)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSemver(%q) = %+v, want an error", tt.version, got)
+				}
+				return
+			}
+			if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("ParseSemver(%q) = %+v, %v, want %+v", tt.version, got, err, tt.want)
+			}
+		})
+	}
+}
+func TestCompareSemver(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.10.0", "1.9.0", 1},
+		{"1.9.0", "1.10.0", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.10", "1.0.9", 1},
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.0-beta", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.10", -1},
+		{"1.0.0-1", "1.0.0-alpha", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"v1", "1.0.0", -1},
+		{"1.0.0", "garbage", 1},
+		{"a", "b", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			if got := CompareSemver(tt.a, tt.b); got != tt.want {
+				t.Fatalf("CompareSemver(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := CompareSemver(tt.b, tt.a); got != -tt.want {
+				t.Fatalf("CompareSemver(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,15 @@
 
 package utils
 import (
+	"encoding/json"
 	"fmt"
 	"math"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
 )
 // StringPtr returns a pointer to a string, or nil if empty.
 func StringPtr(s string) *string {
@@ -13,6 +18,129 @@ func StringPtr(s string) *string {
 	}
 	return &s
 }
+// NormalizeEmail canonicalizes an email address (trimmed, lowercase) so that addresses
+// differing only by case refer to the same student.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+// NormalizeAnswer canonicalizes a fill-in-the-blank answer (trimmed, lowercased with the case rules of
+// locale, a BCP 47 tag such as "tr"; "und" applies the Unicode defaults). Stored acceptable answers and
+// student answers are both normalized with it before being compared.
+func NormalizeAnswer(answer, locale string) string {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.Und
+	}
+	return cases.Lower(tag).String(strings.TrimSpace(answer))
+}
+// CanonicalCommand rewrites a terminal command so that flag order does not matter: the command word,
+// then its flags sorted and de-duplicated, then the remaining arguments in their original order.
+// Combined short flags are split ("-la" becomes "-a -l"); long flags keep any "=value". Arguments after
+// "--" are never treated as flags. A flag's separate value (as in "-n 5") stays an argument, so it is
+// only matched by position among the arguments.
+func CanonicalCommand(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+	flagSet := make(map[string]bool)
+	var args []string
+	endOfFlags := false
+	for _, field := range fields[1:] {
+		switch {
+		case endOfFlags || field == "-" || !strings.HasPrefix(field, "-"):
+			args = append(args, field)
+		case field == "--":
+			endOfFlags = true
+			args = append(args, field)
+		case strings.HasPrefix(field, "--"):
+			flagSet[field] = true
+		case isLetters(field[1:]):
+			for _, r := range field[1:] {
+				flagSet["-"+string(r)] = true
+			}
+		default:
+			flagSet[field] = true // e.g. "-n5" or "-1"
+		}
+	}
+	flags := make([]string, 0, len(flagSet))
+	for flag := range flagSet {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	parts := append([]string{fields[0]}, flags...)
+	return strings.Join(append(parts, args...), " ")
+}
+// isLetters reports whether s is non-empty and made only of ASCII letters.
+func isLetters(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+// RegexAnswerPrefix marks an acceptable answer of a terminal question as a regular expression (RE2
+// syntax), e.g. "re:ls\s+-(la|al)". fill_blank_answers stores the pattern without it and is_regex set.
+const RegexAnswerPrefix = "re:"
+// CompileAnswerPattern compiles a regex acceptable answer (without RegexAnswerPrefix) so that it must match
+// a whole answer, case-insensitively. The pattern is compiled on its own first, so an unbalanced group
+// cannot escape the anchors.
+func CompileAnswerPattern(pattern string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	return regexp.Compile(`\A(?i:` + pattern + `)\z`)
+}
+// AcceptableAnswerForm returns a stored acceptable answer in the form AnswerMatches compares: regex answers
+// keep their pattern as is behind RegexAnswerPrefix, others are normalized with NormalizeAnswer.
+func AcceptableAnswerForm(stored string, isRegex bool, locale string) string {
+	if isRegex {
+		return RegexAnswerPrefix + stored
+	}
+	return NormalizeAnswer(stored, locale)
+}
+// AnswerMatches reports whether a normalized answer equals one of the normalized acceptable answers.
+// With ignoreFlagOrder, both sides are compared as CanonicalCommand forms instead. A positive maxDistance
+// also accepts an answer within that Levenshtein distance of an acceptable answer, with runs of
+// whitespace collapsed on both sides first, to tolerate typos. Acceptable answers with RegexAnswerPrefix
+// (see AcceptableAnswerForm) are matched against the whole answer instead (see CompileAnswerPattern);
+// patterns that fail to compile never match.
+func AnswerMatches(acceptableAnswers []string, answer string, ignoreFlagOrder bool, maxDistance int) bool {
+	form := func(s string) string {
+		if ignoreFlagOrder {
+			return CanonicalCommand(s)
+		}
+		return s
+	}
+	answerForm := form(answer)
+	var literals []string
+	for _, acceptable := range acceptableAnswers {
+		if pattern, ok := strings.CutPrefix(acceptable, RegexAnswerPrefix); ok {
+			if re, err := CompileAnswerPattern(pattern); err == nil && re.MatchString(answer) {
+				return true
+			}
+			continue
+		}
+		if form(acceptable) == answerForm {
+			return true
+		}
+		literals = append(literals, acceptable)
+	}
+	if maxDistance <= 0 {
+		return false
+	}
+	answerForm = strings.Join(strings.Fields(answerForm), " ")
+	for _, acceptable := range literals {
+		if LevenshteinDistance(strings.Join(strings.Fields(form(acceptable)), " "), answerForm) <= maxDistance {
+			return true
+		}
+	}
+	return false
+}
 // ContainsInt checks if an int slice contains a specific int.
 func ContainsInt(slice []int, item int) bool {
 	for _, a := range slice {
@@ -35,7 +163,6 @@ func ContainsString(slice []string, item string) bool {
 // Also validates that weights sum to 1.0 (within 0.01 tolerance).
 func ParseDomainWeights(domainStr string) (map[string]float64, error) {
 	weights := make(map[string]float64)
-	totalWeight := 0.0
 	pairs := strings.Split(domainStr, "|")
 	for _, pair := range pairs {
 		parts := strings.Split(pair, ":")
@@ -48,16 +175,33 @@ func ParseDomainWeights(domainStr string) (map[string]float64, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid weight for domain '%s': %s", domainName, weightStr)
 		}
+		weights[domainName] = weight
+	}
+	if err := ValidateDomainWeights(weights); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+// ValidateDomainWeights checks that each weight is between 0.0 and 1.0 and that
+// the weights sum to 1.0 (within 0.01 tolerance).
+func ValidateDomainWeights(weights map[string]float64) error {
+	if len(weights) == 0 {
+		return fmt.Errorf("at least one domain is required")
+	}
+	totalWeight := 0.0
+	for domainName, weight := range weights {
+		if strings.TrimSpace(domainName) == "" {
+			return fmt.Errorf("domain name must not be empty")
+		}
 		if weight < 0 || weight > 1 {
-			return nil, fmt.Errorf("domain weight for '%s' must be between 0.0 and 1.0", domainName)
+			return fmt.Errorf("domain weight for '%s' must be between 0.0 and 1.0", domainName)
 		}
-		weights[domainName] = weight
 		totalWeight += weight
 	}
 	if math.Abs(totalWeight-1.0) > 0.01 { // Allow for slight floating point inaccuracies
-		return nil, fmt.Errorf("domain weights do not sum to 1.0 (sum is %.2f)", totalWeight)
+		return fmt.Errorf("domain weights do not sum to 1.0 (sum is %.2f)", totalWeight)
 	}
-	return weights, nil
+	return nil
 }
 // LevenshteinDistance calculates the Levenshtein distance between two strings.
 // Used for fuzzy matching in fill-in-the-blank hints.
@@ -91,6 +235,115 @@ func LevenshteinDistance(s1, s2 string) int {
 	}
 	return dp[len1][len2]
 }
+// RelevantCodeLine returns the line of codeBlock sharing the most whitespace-separated tokens
+// with answer, or "" if no line shares any. Used for context hints on terminal questions.
+func RelevantCodeLine(codeBlock, answer string) string {
+	answerTokens := make(map[string]bool)
+	for _, token := range strings.Fields(strings.ToLower(answer)) {
+		answerTokens[token] = true
+	}
+	bestLine := ""
+	bestShared := 0
+	for _, line := range strings.Split(codeBlock, "\n") {
+		shared := 0
+		for _, token := range strings.Fields(strings.ToLower(line)) {
+			if answerTokens[token] {
+				shared++
+			}
+		}
+		if shared > bestShared {
+			bestShared = shared
+			bestLine = strings.TrimSpace(line)
+		}
+	}
+	return bestLine
+}
+// NormalizeCodeBlock tidies a code block for display without changing its content: line endings become
+// "\n", trailing whitespace is dropped from each line, blank lines before and after the code are removed,
+// and the indentation shared by every non-blank line is stripped.
+func NormalizeCodeBlock(code string) string {
+	lines := strings.Split(strings.ReplaceAll(code, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	prefix := ""
+	first := true
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			prefix, first = indent, false
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, prefix)
+	}
+	return strings.Join(lines, "\n")
+}
+// DetectCodeLanguage guesses a syntax highlighting hint for a code block from a shebang or the shape of
+// its lines: "bash", "python", "javascript", "json", "yaml" or "dockerfile". It returns "" when unsure.
+func DetectCodeLanguage(code string) string {
+	trimmed := strings.TrimSpace(code)
+	if trimmed == "" {
+		return ""
+	}
+	lines := strings.Split(trimmed, "\n")
+	if shebang := lines[0]; strings.HasPrefix(shebang, "#!") {
+		switch {
+		case strings.Contains(shebang, "python"):
+			return "python"
+		case strings.Contains(shebang, "node"):
+			return "javascript"
+		case strings.Contains(shebang, "sh"):
+			return "bash"
+		}
+	}
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+	if strings.HasPrefix(strings.ToUpper(lines[0]), "FROM ") {
+		return "dockerfile"
+	}
+	yamlLines, promptLines, pythonLines, nonBlank := 0, 0, 0, 0
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		nonBlank++
+		switch {
+		case line == "---" || yamlKeyPattern.MatchString(line):
+			yamlLines++
+		case strings.HasPrefix(line, "$ "):
+			promptLines++
+		case strings.HasPrefix(line, "def ") || strings.HasPrefix(line, "import ") || strings.HasPrefix(line, "from ") && strings.Contains(line, " import "):
+			pythonLines++
+		}
+	}
+	switch {
+	case promptLines*2 >= nonBlank:
+		return "bash" // Shell session with $ prompts
+	case pythonLines > 0 && pythonLines >= yamlLines:
+		return "python"
+	case yamlLines*2 > nonBlank:
+		return "yaml"
+	}
+	return ""
+}
+// yamlKeyPattern matches a YAML mapping or list entry line such as "name: web" or "- hosts: all".
+var yamlKeyPattern = regexp.MustCompile(`^(- )?[A-Za-z_][\w.-]*:(\s|$)`)
 func min(a, b, c int) int {
 	if a < b {
 		if a < c {
@@ -0,0 +1,132 @@
+package utils
+import "testing"
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		want  string
+	}{
+		{"already canonical", "user@example.com", "user@example.com"},
+		{"mixed case", "User@Example.COM", "user@example.com"},
+		{"upper case", "USER@EXAMPLE.COM", "user@example.com"},
+		{"surrounding space", "  User@example.com\t", "user@example.com"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeEmail(tt.email); got != tt.want {
+				t.Fatalf("NormalizeEmail(%q) = %q, want %q", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+func TestNormalizeEmailMixedCaseVariantsAgree(t *testing.T) {
+	// The JWT subject and an earlier student row may differ only by case; both must resolve to one student
+	variants := []string{"Jane.Doe@Example.com", "jane.doe@example.com", "JANE.DOE@EXAMPLE.COM", " jane.doe@Example.Com "}
+	want := NormalizeEmail(variants[0])
+	for _, v := range variants[1:] {
+		if got := NormalizeEmail(v); got != want {
+			t.Fatalf("NormalizeEmail(%q) = %q, want %q like NormalizeEmail(%q)", v, got, want, variants[0])
+		}
+	}
+}
+func TestNormalizeAnswer(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer string
+		locale string
+		want   string
+	}{
+		{"plain", "  Kubernetes ", "und", "kubernetes"},
+		{"default dotted capital I", "İstanbul", "und", "i̇stanbul"},
+		{"turkish dotted capital I", "İstanbul", "tr", "istanbul"},
+		{"default dotless capital I", "IRMAK", "und", "irmak"},
+		{"turkish dotless capital I", "IRMAK", "tr", "ırmak"},
+		{"region subtag", "IRMAK", "tr-TR", "ırmak"},
+		{"malformed locale falls back", "IRMAK", "not a locale!", "irmak"},
+		{"empty locale falls back", "IRMAK", "", "irmak"},
+		{"german sharp s is kept", "Straße", "de", "straße"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeAnswer(tt.answer, tt.locale); got != tt.want {
+				t.Fatalf("NormalizeAnswer(%q, %q) = %q, want %q", tt.answer, tt.locale, got, tt.want)
+			}
+		})
+	}
+}
+func TestAnswerMatchesWithLocale(t *testing.T) {
+	// Both sides are normalized with the bank's locale, so a Turkish answer typed in either case matches
+	tests := []struct {
+		name       string
+		acceptable string
+		answer     string
+		locale     string
+		want       bool
+	}{
+		{"turkish upper and lower", "IĞDIR", "ığdır", "tr", true},
+		{"turkish dotted", "izmir", "İZMİR", "tr", true},
+		{"default folding misses dotless i", "IĞDIR", "ığdır", "und", false},
+		{"default folding", "Storage", "STORAGE", "und", true},
+		{"different word", "Storage", "Network", "und", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acceptable := []string{NormalizeAnswer(tt.acceptable, tt.locale)}
+			if got := ContainsString(acceptable, NormalizeAnswer(tt.answer, tt.locale)); got != tt.want {
+				t.Fatalf("%q matching %q with locale %q = %t, want %t", tt.answer, tt.acceptable, tt.locale, got, tt.want)
+			}
+		})
+	}
+}
+func TestCanonicalCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"empty", "   ", ""},
+		{"command only", "ls", "ls"},
+		{"separate flags sorted", "ls -l -a", "ls -a -l"},
+		{"combined short flags split", "ls -la", "ls -a -l"},
+		{"duplicate flags dropped", "ls -l -al", "ls -a -l"},
+		{"long flags keep value", "grep --color=auto -i pattern", "grep --color=auto -i pattern"},
+		{"arguments keep their order", "cp -r b a", "cp -r b a"},
+		{"flags after arguments", "tar xf archive.tar -v", "tar -v xf archive.tar"},
+		{"flag value stays an argument", "head -n 5 file", "head -n 5 file"},
+		{"digits are one flag", "head -n5 file", "head -n5 file"},
+		{"double dash ends flags", "rm -f -- -x", "rm -f -- -x"},
+		{"lone dash is an argument", "cat - -u", "cat -u -"},
+		{"extra whitespace", "  ls   -a\t-l ", "ls -a -l"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanonicalCommand(tt.command); got != tt.want {
+				t.Fatalf("CanonicalCommand(%q) = %q, want %q", tt.command, got, tt.want)
+			}
+		})
+	}
+}
+func TestAnswerMatchesIgnoreFlagOrder(t *testing.T) {
+	acceptable := []string{"ls -l -a"}
+	tests := []struct {
+		name            string
+		answer          string
+		ignoreFlagOrder bool
+		want            bool
+	}{
+		{"same order", "ls -l -a", false, true},
+		{"swapped flags, exact grading", "ls -a -l", false, false},
+		{"swapped flags, terminal grading", "ls -a -l", true, true},
+		{"combined flags, terminal grading", "ls -al", true, true},
+		{"missing flag, terminal grading", "ls -a", true, false},
+		{"other command, terminal grading", "dir -a -l", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AnswerMatches(acceptable, tt.answer, tt.ignoreFlagOrder, 0); got != tt.want {
+				t.Fatalf("AnswerMatches(%q, %q, ignoreFlagOrder=%t) = %t, want %t", acceptable, tt.answer, tt.ignoreFlagOrder, got, tt.want)
+			}
+		})
+	}
+}